@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// adminTokenPath holds the bearer token that admin endpoints handling key
+// material require. Only someone who can read the data directory has it.
+func adminTokenPath() string {
+	return filepath.Join(DataDir, "admin.token")
+}
+
+// loadOrCreateAdminToken reads the admin token, creating one on first start
+func loadOrCreateAdminToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// requireAdmin only lets a request through with the admin token as its
+// bearer token
+func (s *Server) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ripcord-admin"`)
+			http.Error(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+const (
+	// BackupPassphraseEnv supplies the passphrase a backup file is sealed
+	// with; MnemonicEnv the recovery words for restore-mnemonic
+	BackupPassphraseEnv = "RIPCORD_BACKUP_PASSPHRASE"
+	MnemonicEnv         = "RIPCORD_MNEMONIC"
+)
+
+var (
+	ErrIdentityExists = errors.New("an identity already exists; pass -force to replace it")
+	ErrInvalidBackup  = errors.New("backup holds an invalid seed or prekey")
+)
+
+// exportBackup gathers the identity and our prekeys into a backup
+func exportBackup(cryptoManager *security.CryptoManager, db database.Database) (*security.Backup, error) {
+	backup, err := cryptoManager.NewBackup()
+	if err != nil {
+		return nil, err
+	}
+	
+	prekeys, err := db.GetPrekeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, prekey := range prekeys {
+		backup.Prekeys = append(backup.Prekeys, security.BackupPrekey{
+			ID:         prekey.ID,
+			Kind:       prekey.Kind,
+			PrivateKey: prekey.PrivateKey,
+			PublicKey:  prekey.PublicKey,
+			Signature:  prekey.Signature,
+			Issued:     prekey.Issued,
+			CreatedAt:  prekey.CreatedAt.Unix(),
+		})
+	}
+	return backup, nil
+}
+
+
+// checkBackup refuses a backup restoreIdentity would fail on part way
+func checkBackup(backup *security.Backup) error {
+	if len(backup.Seed) != ed25519.SeedSize {
+		return ErrInvalidBackup
+	}
+	for _, prekey := range backup.Prekeys {
+		if prekey.Kind != database.PrekeySigned && prekey.Kind != database.PrekeyOneTime {
+			return ErrInvalidBackup
+		}
+		if len(prekey.PrivateKey) != 32 || len(prekey.PublicKey) != 32 {
+			return ErrInvalidBackup
+		}
+	}
+	return nil
+}
+
+// restoreIdentity writes the identity in a backup to keyPath, protected by
+// keyPassphrase when it is not empty. The prekeys replace ours; a mnemonic
+// carries none, so fresh ones are made. Sessions are dropped since they
+// may belong to the identity being replaced.
+func restoreIdentity(keyPath string, db database.Database, backup *security.Backup, keyPassphrase []byte) (*security.CryptoManager, error) {
+	if err := checkBackup(backup); err != nil {
+		return nil, err
+	}
+	
+	cryptoManager := security.NewCryptoManager(keyPath)
+	cryptoManager.SetPassphrase(keyPassphrase)
+	if err := cryptoManager.RestoreSeed(backup.Seed, backup.Nickname); err != nil {
+		return nil, err
+	}
+	
+	prekeys := make([]*database.Prekey, 0, len(backup.Prekeys))
+	for _, prekey := range backup.Prekeys {
+		prekeys = append(prekeys, &database.Prekey{
+			ID:         prekey.ID,
+			Kind:       prekey.Kind,
+			PrivateKey: prekey.PrivateKey,
+			PublicKey:  prekey.PublicKey,
+			Signature:  prekey.Signature,
+			Issued:     prekey.Issued,
+			CreatedAt:  time.Unix(prekey.CreatedAt, 0),
+		})
+	}
+	if err := db.ReplacePrekeys(prekeys); err != nil {
+		return nil, err
+	}
+	if err := db.DeleteSessions(""); err != nil {
+		return nil, err
+	}
+	return cryptoManager, nil
+}
+
+// showMnemonic prints the recovery words for the identity
+func showMnemonic(keyPath string, passphrases *passphraseSource) error {
+	cryptoManager, err := loadIdentity(keyPath, passphrases)
+	if err != nil {
+		return err
+	}
+	
+	mnemonic, err := cryptoManager.Mnemonic()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Anyone with these words can act as this identity. Write them down and keep them offline.")
+	fmt.Println(mnemonic)
+	return nil
+}
+
+// writeBackup seals the identity and prekeys into a file
+func writeBackup(keyPath, dbPath, path string, passphrases *passphraseSource) error {
+	cryptoManager, err := loadIdentity(keyPath, passphrases)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect()
+	
+	backup, err := exportBackup(cryptoManager, db)
+	if err != nil {
+		return err
+	}
+	passphrase, err := passphrases.read(BackupPassphraseEnv, "Passphrase for the backup: ", true)
+	if err != nil {
+		return err
+	}
+	data, err := security.SealBackup(backup, passphrase)
+	if err != nil {
+		return err
+	}
+	
+	// O_EXCL so an older backup is never overwritten by mistake
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	
+	fmt.Printf("Backup written to %s\n", path)
+	return nil
+}
+
+// restoreCommand restores the identity from recovery words, or from a
+// backup file when fromFile is set
+func restoreCommand(keyPath, dbPath string, args []string, fromFile bool, passphrases *passphraseSource) error {
+	name := "restore-mnemonic"
+	if fromFile {
+		name = "restore-backup"
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	force := flags.Bool("force", false, "replace an existing identity")
+	nickname := flags.String("nickname", "Anonymous", "nickname for an identity restored from recovery words")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if fromFile && flags.NArg() != 1 {
+		return errors.New("usage: restore-backup [-force] FILE")
+	}
+	
+	if _, err := os.Stat(keyPath); err == nil && !*force {
+		return ErrIdentityExists
+	}
+	
+	var backup *security.Backup
+	if fromFile {
+		data, err := os.ReadFile(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		passphrase, err := passphrases.read(BackupPassphraseEnv, "Passphrase for the backup: ", false)
+		if err != nil {
+			return err
+		}
+		if backup, err = security.OpenBackup(data, passphrase); err != nil {
+			return err
+		}
+	} else {
+		words, err := passphrases.read(MnemonicEnv, "Recovery words: ", false)
+		if err != nil {
+			return err
+		}
+		seed, err := security.SeedFromMnemonic(string(words))
+		if err != nil {
+			return err
+		}
+		backup = &security.Backup{Nickname: *nickname, Seed: seed}
+	}
+	
+	keyPassphrase, err := passphrases.read(NewPassphraseEnv, "New passphrase for the private key (empty for none): ", true)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect()
+	
+	cryptoManager, err := restoreIdentity(keyPath, db, backup, keyPassphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s (%s)\n", cryptoManager.GetNickname(), cryptoManager.GetPublicKeyBase58())
+	return nil
+}
+
+func (s *Server) handleAdminMnemonic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	mnemonic, err := s.cryptoManager.Mnemonic()
+	if err != nil {
+		http.Error(w, "Failed to encode identity", http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"mnemonic": mnemonic})
+}
+
+func (s *Server) handleAdminBackupExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Passphrase == "" {
+		http.Error(w, "passphrase required", http.StatusBadRequest)
+		return
+	}
+	
+	backup, err := exportBackup(s.cryptoManager, s.db)
+	if err != nil {
+		http.Error(w, "Failed to export backup", http.StatusInternalServerError)
+		return
+	}
+	data, err := security.SealBackup(backup, []byte(req.Passphrase))
+	if err != nil {
+		http.Error(w, "Failed to seal backup", http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="ripcord-backup.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// handleAdminBackupRestore replaces the identity from recovery words or a
+// backup file. The node stops, since it still runs as the old identity;
+// the server has to be restarted to come back as the restored one. The
+// backup is opened and checked first, so a bad one leaves the node running.
+func (s *Server) handleAdminBackupRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		Mnemonic      string          `json:"mnemonic"`
+		Nickname      string          `json:"nickname"`
+		Backup        json.RawMessage `json:"backup"`
+		Passphrase    string          `json:"passphrase"`     // the backup's
+		KeyPassphrase string          `json:"key_passphrase"` // protects the restored key
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	// A protected key is not silently replaced by an unprotected one
+	if s.cryptoManager.IsKeyProtected() && req.KeyPassphrase == "" {
+		http.Error(w, "key_passphrase required to keep the private key protected", http.StatusBadRequest)
+		return
+	}
+	
+	var backup *security.Backup
+	switch {
+	case len(req.Backup) > 0:
+		opened, err := security.OpenBackup(req.Backup, []byte(req.Passphrase))
+		if err != nil {
+			http.Error(w, "Failed to open backup: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		backup = opened
+	case req.Mnemonic != "":
+		seed, err := security.SeedFromMnemonic(req.Mnemonic)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Nickname == "" {
+			req.Nickname = s.cryptoManager.GetNickname()
+		}
+		backup = &security.Backup{Nickname: req.Nickname, Seed: seed}
+	default:
+		http.Error(w, "mnemonic or backup required", http.StatusBadRequest)
+		return
+	}
+	
+	if err := checkBackup(backup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	s.node.Stop()
+	restored, err := restoreIdentity(identityPath(), s.db, backup, []byte(req.KeyPassphrase))
+	if err != nil {
+		// The node's transports cannot listen again once closed
+		log.Printf("Failed to restore identity: %v", err)
+		http.Error(w, "Failed to restore identity; restart the server", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Identity restored as %s; restart the server to use it", restored.GetPublicKeyBase58())
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":           "restored",
+		"nickname":         restored.GetNickname(),
+		"public_key":       restored.GetPublicKeyBase58(),
+		"restart_required": true,
+	})
+} 
\ No newline at end of file
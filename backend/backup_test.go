@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"ripcord/database"
+	"ripcord/security"
+	"ripcord/transport"
+)
+
+func TestBackupRestoresIdentityAndPrekeys(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	if _, err := alice.signedPrekey(); err != nil {
+		t.Fatalf("Failed to create prekey: %v", err)
+	}
+	
+	backup, err := exportBackup(alice.cryptoManager, alice.db)
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	data, err := security.SealBackup(backup, []byte("backup secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	opened, err := security.OpenBackup(data, []byte("backup secret"))
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	
+	dir := t.TempDir()
+	db := database.NewSQLiteDatabase(filepath.Join(dir, "ripcord.db"))
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Disconnect()
+	
+	restored, err := restoreIdentity(filepath.Join(dir, "identity.json"), db, opened, []byte("key secret"))
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if restored.GetPublicKeyBase58() != alice.cryptoManager.GetPublicKeyBase58() || restored.GetNickname() != "alice" {
+		t.Error("Expected alice's identity back")
+	}
+	if !restored.IsKeyProtected() {
+		t.Error("Expected the restored key to be protected")
+	}
+	
+	// The bundle peers hold still verifies against the restored prekey
+	original, _ := alice.db.GetLatestPrekey(database.PrekeySigned)
+	prekey, err := db.GetLatestPrekey(database.PrekeySigned)
+	if err != nil || prekey.ID != original.ID || string(prekey.PrivateKey) != string(original.PrivateKey) {
+		t.Fatalf("Expected the signed prekey to be restored, got %v, %v", prekey, err)
+	}
+	bundle := restored.NewPrekeyBundle(securityPrekey(prekey), nil)
+	if err := bundle.Verify(); err != nil {
+		t.Errorf("Expected the restored bundle to verify, got %v", err)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	server := &Server{adminToken: "secret"}
+	handler := server.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	
+	for header, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/api/admin/backup/mnemonic", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != want {
+			t.Errorf("Authorization %q: expected %d, got %d", header, want, recorder.Code)
+		}
+	}
+}
+
+func TestBackupRestoreKeepsNodeOnBadBackup(t *testing.T) {
+	server, _ := newTestServer(t)
+	backup, err := server.cryptoManager.NewBackup()
+	if err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	backup.Prekeys = []security.BackupPrekey{{ID: 1, Kind: "stolen"}}
+	data, err := security.SealBackup(backup, []byte("backup secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	
+	for name, passphrase := range map[string]string{"wrong passphrase": "guess", "bad prekey": "backup secret"} {
+		body, _ := json.Marshal(map[string]interface{}{"backup": json.RawMessage(data), "passphrase": passphrase})
+		recorder := httptest.NewRecorder()
+		server.handleAdminBackupRestore(recorder, httptest.NewRequest(http.MethodPost, "/api/admin/backup/restore", bytes.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", name, http.StatusBadRequest, recorder.Code)
+		}
+	}
+	if !server.node.IsRunning() {
+		t.Error("Expected the node to keep running")
+	}
+} 
\ No newline at end of file
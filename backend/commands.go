@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+// DataDir holds the database and the identity keys
+const DataDir = "data"
+
+func identityPath() string {
+	return filepath.Join(DataDir, "identity.json")
+}
+
+// databasePath is the SQLite file named in the config, or ripcord.db
+func databasePath(config *Config) string {
+	if config.Database.Database == "" {
+		return filepath.Join(DataDir, "ripcord.db")
+	}
+	return filepath.Join(DataDir, config.Database.Database)
+}
+
+// loadIdentity unlocks and loads the existing identity for a command
+func loadIdentity(keyPath string, passphrases *passphraseSource) (*security.CryptoManager, error) {
+	if _, err := os.Stat(keyPath); err != nil {
+		return nil, fmt.Errorf("no identity at %s: %v", keyPath, err)
+	}
+	
+	cryptoManager := security.NewCryptoManager(keyPath)
+	if err := unlockIdentity(cryptoManager, passphrases); err != nil {
+		return nil, err
+	}
+	if err := cryptoManager.LoadOrGenerateKeys(""); err != nil {
+		return nil, err
+	}
+	return cryptoManager, nil
+}
+
+func openDatabase(dbPath string) (*database.SQLiteDatabase, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, err
+	}
+	db := database.NewSQLiteDatabase(dbPath)
+	if err := db.Connect(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintln(out, "Without a command the server is started.")
+	fmt.Fprintln(out, "\nCommands:")
+	fmt.Fprintln(out, "  change-passphrase   protect the private key with a passphrase, change it, or remove it")
+	fmt.Fprintln(out, "  rotate-key          replace the identity key; peers follow when the server next runs")
+	fmt.Fprintln(out, "  show-mnemonic       print the 24 recovery words for the identity key")
+	fmt.Fprintln(out, "  export-backup FILE  write an encrypted backup of the identity and prekeys")
+	fmt.Fprintln(out, "  restore-mnemonic    rebuild the identity from recovery words [-force] [-nickname NAME]")
+	fmt.Fprintln(out, "  restore-backup FILE rebuild the identity from a backup file [-force]")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a maintenance command instead of the server
+func runCommand(name string, args []string, configPath string, passphrases *passphraseSource) error {
+	switch name {
+	case "change-passphrase":
+		return changePassphrase(identityPath(), passphrases)
+	case "show-mnemonic":
+		return showMnemonic(identityPath(), passphrases)
+	case "rotate-key", "export-backup", "restore-mnemonic", "restore-backup":
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+	
+	// The rest also work on the database
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	dbPath := databasePath(config)
+	
+	switch name {
+	case "rotate-key":
+		return rotateIdentity(identityPath(), dbPath, passphrases)
+	case "export-backup":
+		if len(args) != 1 {
+			return errors.New("usage: export-backup FILE")
+		}
+		return writeBackup(identityPath(), dbPath, args[0], passphrases)
+	case "restore-mnemonic":
+		return restoreCommand(identityPath(), dbPath, args, false, passphrases)
+	}
+	return restoreCommand(identityPath(), dbPath, args, true, passphrases)
+} 
\ No newline at end of file
@@ -10,13 +10,21 @@ type Config struct {
 	Server   ServerConfig   `json:"server"`
 	Database DatabaseConfig `json:"database"`
 	I2P      I2PConfig     `json:"i2p"`
+	Network  NetworkConfig  `json:"network"`
 	Security SecurityConfig `json:"security"`
+	
+	path string // the file it was loaded from, where changes are saved
 }
 
+// ConfigFile is where the configuration lives unless -config names another
+const ConfigFile = "config.json"
+
 // ServerConfig defines server settings
 type ServerConfig struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	Host           string   `json:"host"`
+	Port           int      `json:"port"`
+	ClientKeys     []string `json:"client_keys,omitempty"`     // hex keys, besides the node's, that may use the WebSocket
+	AllowedOrigins []string `json:"allowed_origins,omitempty"` // pages, besides our own, that may open the WebSocket
 }
 
 // DatabaseConfig defines database settings
@@ -39,11 +47,23 @@ type I2PConfig struct {
 	Destination string `json:"destination"`
 }
 
+// NetworkConfig defines the peer transports besides I2P
+type NetworkConfig struct {
+	TCPListen    string   `json:"tcp_listen"`    // e.g. ":7700", empty disables TCP
+	TCPAdvertise string   `json:"tcp_advertise"` // address peers should dial, e.g. "10.0.0.5:7700"
+	Bootstrap    []string `json:"bootstrap"`     // qualified peer addresses to announce ourselves to
+	GossipFanout int      `json:"gossip_fanout"` // room peers each message is relayed to
+	GossipTTL    int      `json:"gossip_ttl"`    // hops a room message may travel
+}
+
 // SecurityConfig defines security settings
 type SecurityConfig struct {
 	EncryptionEnabled bool   `json:"encryption_enabled"`
 	KeySize          int    `json:"key_size"`
 	Algorithm        string `json:"algorithm"`
+	
+	// Refuse messages whose signature did not verify against the author's key
+	RequireSignatureVerification bool `json:"require_signature_verification"`
 }
 
 // TODO: Implement configuration validation
@@ -54,6 +74,7 @@ type SecurityConfig struct {
 func LoadConfig(filename string) (*Config, error) {
 	// Default configuration
 	config := &Config{
+		path: filename,
 		Server: ServerConfig{
 			Host: "localhost",
 			Port: 8080,
@@ -69,10 +90,15 @@ func LoadConfig(filename string) (*Config, error) {
 			SamAddress: "127.0.0.1",
 			SamPort:    7656,
 		},
+		Network: NetworkConfig{
+			GossipFanout: DefaultGossipFanout,
+			GossipTTL:    DefaultGossipTTL,
+		},
 		Security: SecurityConfig{
 			EncryptionEnabled: true,
 			KeySize:          256,
 			Algorithm:        "Ed25519",
+			RequireSignatureVerification: true,
 		},
 	}
 	
@@ -105,5 +131,6 @@ func (c *Config) Save(filename string) error {
 		return err
 	}
 	
-	return os.WriteFile(filename, data, 0644)
+	// The file holds the private I2P destination, so keep it owner-only
+	return os.WriteFile(filename, data, 0600)
 } 
\ No newline at end of file
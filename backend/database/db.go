@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 	"errors"
 	_ "modernc.org/sqlite"
@@ -20,11 +21,102 @@ type Room struct {
 	Participants []string  `json:"participants,omitempty"`
 }
 
+// QueuedMessage is an unsigned protocol message waiting for an offline peer
+type QueuedMessage struct {
+	ID          int64     `json:"id" db:"id"`
+	PeerKey     string    `json:"peer_key" db:"peer_key"`
+	Type        string    `json:"type" db:"type"`
+	Data        []byte    `json:"data" db:"data"`
+	Attempts    int       `json:"attempts" db:"attempts"`
+	NextAttempt time.Time `json:"next_attempt" db:"next_attempt"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	
+	// Unsealed DM content waits for the peer's prekeys and is encrypted
+	// when it is finally sent
+	Unsealed bool `json:"unsealed" db:"unsealed"`
+}
+
+// Prekey kinds
+const (
+	PrekeySigned  = "signed"
+	PrekeyOneTime = "one_time"
+)
+
+// Prekey is an X25519 key pair published for starting DM sessions. One-time
+// prekeys are marked issued once handed to a peer.
+type Prekey struct {
+	ID         int64     `json:"id" db:"id"`
+	Kind       string    `json:"kind" db:"kind"`
+	PrivateKey []byte    `json:"-" db:"private_key"`
+	PublicKey  []byte    `json:"public_key" db:"public_key"`
+	Signature  []byte    `json:"signature,omitempty" db:"signature"`
+	Issued     bool      `json:"issued" db:"issued"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// Succession records that an identity key was replaced. Keys are hex, the
+// user IDs base58, and Record is the signed security.Succession as JSON.
+type Succession struct {
+	OldKey    string    `json:"old_key" db:"old_key"`
+	NewKey    string    `json:"new_key" db:"new_key"`
+	OldUserID string    `json:"old_user_id" db:"-"`
+	NewUserID string    `json:"new_user_id" db:"-"`
+	Record    []byte    `json:"record" db:"record"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// TrustedKey records that the user compared safety numbers with a contact.
+// ReplacedBy is set when a succession moved the contact to a key that has
+// not been compared yet.
+type TrustedKey struct {
+	UserID     string    `json:"user_id" db:"user_id"`
+	Nickname   string    `json:"nickname" db:"nickname"`
+	VerifiedAt time.Time `json:"verified_at" db:"verified_at"`
+	ReplacedBy string    `json:"replaced_by,omitempty" db:"replaced_by"`
+}
+
+// Invite is a signed invite we issued or saw redeemed. Issuer is a base58
+// user ID, Token the security.Invite as shared, and Uses the number of
+// distinct users that joined with it here.
+type Invite struct {
+	ID        string    `json:"id" db:"id"`
+	RoomID    string    `json:"room_id" db:"room_id"`
+	Issuer    string    `json:"issuer" db:"issuer"`
+	Role      string    `json:"role" db:"role"`
+	MaxUses   int       `json:"max_uses" db:"max_uses"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	Token     string    `json:"token" db:"token"`
+	Revoked   bool      `json:"revoked" db:"revoked"`
+	Uses      int       `json:"uses" db:"-"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+var (
+	ErrMessageNotFound    = errors.New("message not found")
+	ErrMessageConflict    = errors.New("message ID belongs to another author or room")
+	ErrPrekeyNotFound     = errors.New("prekey not found")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrSenderKeyNotFound  = errors.New("sender key not found")
+	ErrSuccessionNotFound = errors.New("succession not found")
+	ErrTrustNotFound      = errors.New("trusted key not found")
+	ErrInviteNotFound     = errors.New("invite not found")
+	ErrInviteRevoked      = errors.New("invite has been revoked")
+	ErrInviteUsedUp       = errors.New("invite has no uses left")
+	ErrNotParticipant     = errors.New("user is not a participant of the room")
+)
+
 type Database interface {
 	Connect() error
 	Disconnect() error
 	SaveMessage(msg *types.Message) error
 	GetMessages(roomID string, limit int) ([]*types.Message, error)
+	GetMessagesSince(roomID string, since time.Time, afterID string, limit int) ([]*types.Message, error)
+	GetMessagesAfterSeq(roomID string, seq int64, limit int) ([]*types.Message, error)
+	GetMessageByClientID(roomID, userID, clientID string) (*types.Message, error)
+	GetRoomSeq(roomID string) (int64, error)
+	MessageExists(messageID string) (bool, error)
+	GetUncheckedMessages(limit int) ([]*types.Message, error)
+	SetMessageVerification(messageID, state string) error
 	SaveRoom(room *Room) error
 	GetRoom(roomID string) (*Room, error)
 	GetRooms() ([]*Room, error)
@@ -33,8 +125,48 @@ type Database interface {
 	AddRoomParticipant(roomID, userID string) error
 	RemoveRoomParticipant(roomID, userID string) error
 	GetRoomParticipants(roomID string) ([]string, error)
+	SetParticipantRole(roomID, userID, role string) error
+	GetParticipantRoles(roomID string) (map[string]string, error)
+	GetParticipantJoinedAt(roomID, userID string) (time.Time, error)
 	SaveSettings(key, value string) error
 	GetSettings(key string) (string, error)
+	EnqueueOutbound(item *QueuedMessage) error
+	GetQueuedForPeer(peerKey string) ([]*QueuedMessage, error)
+	GetDueOutbound(now time.Time, limit int) ([]*QueuedMessage, error)
+	UpdateOutboundAttempt(id int64, attempts int, next time.Time) error
+	UpdateOutboundData(id int64, data []byte) error
+	DeleteOutbound(id int64) error
+	CountQueuedByPeer() (map[string]int, error)
+	SavePrekey(prekey *Prekey) error
+	GetPrekey(id int64) (*Prekey, error)
+	GetLatestPrekey(kind string) (*Prekey, error)
+	IssueOneTimePrekey() (*Prekey, error)
+	CountUnissuedPrekeys() (int, error)
+	DeletePrekey(id int64) error
+	DeleteExpiredPrekeys(signedBefore, issuedBefore time.Time) error
+	GetPrekeys() ([]*Prekey, error)
+	ReplacePrekeys(prekeys []*Prekey) error
+	SaveSession(peerKey, sessionID string, state []byte) error
+	GetSession(peerKey, sessionID string) ([]byte, error)
+	GetLatestSession(peerKey string) ([]byte, error)
+	SaveSenderKey(roomID, senderID string, keyID int64, state []byte) error
+	GetSenderKey(roomID, senderID string, keyID int64) ([]byte, error)
+	GetLatestSenderKey(roomID, senderID string) ([]byte, error)
+	DeleteSenderKeys(roomID, senderID string) error
+	DeleteSessions(peerKey string) error
+	ApplySuccession(succession *Succession) error
+	GetSuccession(oldKey string) (*Succession, error)
+	GetSuccessionTo(newKey string) (*Succession, error)
+	SaveTrustedKey(trusted *TrustedKey) error
+	GetTrustedKey(userID string) (*TrustedKey, error)
+	GetTrustedKeys() ([]*TrustedKey, error)
+	GetReplacedTrust(userID string) (*TrustedKey, error)
+	DeleteTrustedKey(userID string) error
+	SaveInvite(invite *Invite) error
+	GetInvite(inviteID string) (*Invite, error)
+	GetInvites(roomID string) ([]*Invite, error)
+	RedeemInvite(inviteID, userID string) error
+	RevokeInvite(inviteID string) error
 }
 
 type SQLiteDatabase struct {
@@ -50,7 +182,9 @@ func NewSQLiteDatabase(dbPath string) *SQLiteDatabase {
 
 func (sdb *SQLiteDatabase) Connect() error {
 	var err error
-	sdb.db, err = sql.Open("sqlite", sdb.dbPath)
+	// The node and the HTTP handlers write concurrently; wait for locks
+	// instead of failing with SQLITE_BUSY
+	sdb.db, err = sql.Open("sqlite", sdb.dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return err
 	}
@@ -86,6 +220,12 @@ func (sdb *SQLiteDatabase) createTables() error {
 			encrypted BOOLEAN DEFAULT FALSE,
 			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
 			signature TEXT,
+			clock INTEGER DEFAULT 0,
+			parents TEXT DEFAULT '',
+			verification TEXT DEFAULT '',
+			seq INTEGER DEFAULT 0,
+			client_id TEXT DEFAULT '',
+			unix_time INTEGER DEFAULT 0,
 			FOREIGN KEY (room_id) REFERENCES rooms(id),
 			FOREIGN KEY (user_id) REFERENCES users(id)
 		)`,
@@ -93,6 +233,7 @@ func (sdb *SQLiteDatabase) createTables() error {
 			room_id TEXT NOT NULL,
 			user_id TEXT NOT NULL,
 			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			role TEXT DEFAULT 'member',
 			PRIMARY KEY (room_id, user_id),
 			FOREIGN KEY (room_id) REFERENCES rooms(id),
 			FOREIGN KEY (user_id) REFERENCES users(id)
@@ -101,6 +242,69 @@ func (sdb *SQLiteDatabase) createTables() error {
 			key TEXT PRIMARY KEY,
 			value TEXT NOT NULL
 		)`,
+		`CREATE TABLE IF NOT EXISTS outbound_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			peer_key TEXT NOT NULL,
+			type TEXT NOT NULL,
+			data BLOB NOT NULL,
+			attempts INTEGER DEFAULT 0,
+			next_attempt DATETIME NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			unsealed BOOLEAN DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS prekeys (
+			id INTEGER PRIMARY KEY,
+			kind TEXT NOT NULL,
+			private_key BLOB NOT NULL,
+			public_key BLOB NOT NULL,
+			signature BLOB,
+			issued BOOLEAN DEFAULT FALSE,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS dm_sessions (
+			peer_key TEXT NOT NULL,
+			session_id TEXT NOT NULL,
+			state BLOB NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (peer_key, session_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS successions (
+			old_key TEXT PRIMARY KEY,
+			new_key TEXT NOT NULL,
+			record BLOB NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS trusted_keys (
+			user_id TEXT PRIMARY KEY,
+			nickname TEXT DEFAULT '',
+			verified_at DATETIME NOT NULL,
+			replaced_by TEXT DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS invites (
+			id TEXT PRIMARY KEY,
+			room_id TEXT NOT NULL,
+			issuer TEXT NOT NULL,
+			role TEXT NOT NULL,
+			max_uses INTEGER DEFAULT 0,
+			expires_at DATETIME NOT NULL,
+			token TEXT NOT NULL,
+			revoked BOOLEAN DEFAULT FALSE,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS invite_uses (
+			invite_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			used_at DATETIME NOT NULL,
+			PRIMARY KEY (invite_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS sender_keys (
+			room_id TEXT NOT NULL,
+			sender_id TEXT NOT NULL,
+			key_id INTEGER NOT NULL,
+			state BLOB NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (room_id, sender_id, key_id)
+		)`,
 	}
 	
 	for _, query := range queries {
@@ -109,16 +313,44 @@ func (sdb *SQLiteDatabase) createTables() error {
 		}
 	}
 	
+	if err := sdb.addMissingColumns(); err != nil {
+		return err
+	}
+	
+	// Messages stored before sequence numbers are numbered in the order
+	// they were stored
+	backfill := `UPDATE messages SET seq = (SELECT COUNT(*) FROM messages m
+				 WHERE m.room_id = messages.room_id AND m.rowid <= messages.rowid)
+				 WHERE seq = 0`
+	if _, err := sdb.db.Exec(backfill); err != nil {
+		return err
+	}
+	
+	if err := sdb.backfillUnixTimes(); err != nil {
+		return err
+	}
+	
+
 	// Create indexes for better performance
 	indexQueries := []string{
 		`CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages(room_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_clock ON messages(room_id, clock)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_seq ON messages(room_id, seq)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_unix_time ON messages(room_id, unix_time)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_client_id ON messages(room_id, user_id, client_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_rooms_created_at ON rooms(created_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_public_key ON users(public_key)`,
 		`CREATE INDEX IF NOT EXISTS idx_room_participants_room_id ON room_participants(room_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_room_participants_user_id ON room_participants(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_outbound_queue_peer_key ON outbound_queue(peer_key)`,
+		`CREATE INDEX IF NOT EXISTS idx_outbound_queue_next_attempt ON outbound_queue(next_attempt)`,
+		`CREATE INDEX IF NOT EXISTS idx_prekeys_kind ON prekeys(kind, issued)`,
+		`CREATE INDEX IF NOT EXISTS idx_dm_sessions_updated_at ON dm_sessions(peer_key, updated_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_successions_new_key ON successions(new_key)`,
+		`CREATE INDEX IF NOT EXISTS idx_invites_room_id ON invites(room_id)`,
 	}
 	
 	for _, query := range indexQueries {
@@ -130,6 +362,82 @@ func (sdb *SQLiteDatabase) createTables() error {
 	return nil
 }
 
+// addMissingColumns upgrades databases created before a column existed
+func (sdb *SQLiteDatabase) addMissingColumns() error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"messages", "clock", "INTEGER DEFAULT 0"},
+		{"messages", "parents", "TEXT DEFAULT ''"},
+		{"messages", "verification", "TEXT DEFAULT ''"},
+		{"messages", "seq", "INTEGER DEFAULT 0"},
+		{"messages", "client_id", "TEXT DEFAULT ''"},
+		{"messages", "unix_time", "INTEGER DEFAULT 0"},
+		{"room_participants", "role", "TEXT DEFAULT 'member'"},
+		{"outbound_queue", "unsealed", "BOOLEAN DEFAULT 0"},
+	}
+	
+	for _, column := range columns {
+		var count int
+		query := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`
+		if err := sdb.db.QueryRow(query, column.table, column.name).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+	
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, column.definition)
+		if _, err := sdb.db.Exec(alter); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// backfillUnixTimes fills in unix_time for messages stored before it
+// existed. Timestamps are stored as text in the writer's zone, which SQL
+// cannot compare, so each one is parsed here.
+func (sdb *SQLiteDatabase) backfillUnixTimes() error {
+	rows, err := sdb.db.Query(`SELECT id, timestamp FROM messages WHERE unix_time = 0 OR unix_time IS NULL`)
+	if err != nil {
+		return err
+	}
+	
+	unixTimes := make(map[string]int64)
+	for rows.Next() {
+		var id string
+		var timestamp time.Time
+		if err := rows.Scan(&id, &timestamp); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan message timestamp: %v", err)
+		}
+		unixTimes[id] = timestamp.Unix()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	
+	if len(unixTimes) == 0 {
+		return nil
+	}
+	
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	
+	for id, unixTime := range unixTimes {
+		if _, err := tx.Exec(`UPDATE messages SET unix_time = ? WHERE id = ?`, unixTime, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (sdb *SQLiteDatabase) Disconnect() error {
 	if sdb.db != nil {
 		return sdb.db.Close()
@@ -146,17 +454,94 @@ func (sdb *SQLiteDatabase) SaveMessage(msg *types.Message) error {
 		return errors.New("message missing required fields")
 	}
 	
-	query := `INSERT OR REPLACE INTO messages (id, room_id, user_id, username, content, type, encrypted, timestamp, signature)
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	// A message keeps its sequence number when saved again; a new one
+	// takes the next in its room. Peers choose message IDs, so an ID
+	// already stored is only updated for the same author and room.
+	query := `INSERT INTO messages (id, room_id, user_id, username, content, type, encrypted, timestamp, signature, clock, parents, verification, client_id, unix_time, seq)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+				  (SELECT COALESCE(MAX(seq), 0) + 1 FROM messages WHERE room_id = ?))
+			  ON CONFLICT(id) DO UPDATE SET
+				  username = excluded.username, content = excluded.content, type = excluded.type,
+				  encrypted = excluded.encrypted, timestamp = excluded.timestamp, signature = excluded.signature,
+				  clock = excluded.clock, parents = excluded.parents, verification = excluded.verification,
+				  client_id = excluded.client_id, unix_time = excluded.unix_time
+			  WHERE messages.user_id = excluded.user_id AND messages.room_id = excluded.room_id`
 	
-	_, err := sdb.db.Exec(query, msg.ID, msg.RoomID, msg.UserID, msg.Username, 
-		msg.Content, msg.Type, msg.Encrypted, msg.Timestamp, msg.Signature)
+	result, err := sdb.db.Exec(query, msg.ID, msg.RoomID, msg.UserID, msg.Username,
+		msg.Content, msg.Type, msg.Encrypted, msg.Timestamp, msg.Signature,
+		msg.Clock, strings.Join(msg.Parents, ","), msg.Verification, msg.ClientID,
+		msg.Timestamp.Unix(), msg.RoomID)
 	if err != nil {
 		return fmt.Errorf("failed to save message: %v", err)
 	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrMessageConflict
+	}
+	
+	if err := sdb.db.QueryRow(`SELECT seq FROM messages WHERE id = ?`, msg.ID).Scan(&msg.Seq); err != nil {
+		return fmt.Errorf("failed to read message sequence: %v", err)
+	}
 	return nil
 }
 
+// GetRoomSeq returns the sequence number of the last message stored in a
+// room, or zero if there is none
+func (sdb *SQLiteDatabase) GetRoomSeq(roomID string) (int64, error) {
+	var seq int64
+	query := `SELECT COALESCE(MAX(seq), 0) FROM messages WHERE room_id = ?`
+	if err := sdb.db.QueryRow(query, roomID).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("failed to query room sequence: %v", err)
+	}
+	return seq, nil
+}
+
+// GetMessagesAfterSeq returns up to limit messages of a room stored after
+// seq, in the order they were stored
+func (sdb *SQLiteDatabase) GetMessagesAfterSeq(roomID string, seq int64, limit int) ([]*types.Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	
+	query := `SELECT ` + messageColumns + `
+			  FROM messages WHERE room_id = ? AND seq > ? ORDER BY seq ASC LIMIT ?`
+	
+	rows, err := sdb.db.Query(query, roomID, seq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+	
+	return scanMessages(rows)
+}
+
+// GetMessageByClientID finds a message a local client already sent to a
+// room as userID under its own ID
+func (sdb *SQLiteDatabase) GetMessageByClientID(roomID, userID, clientID string) (*types.Message, error) {
+	if clientID == "" {
+		return nil, ErrMessageNotFound
+	}
+
+	query := `SELECT ` + messageColumns + `
+			  FROM messages WHERE room_id = ? AND user_id = ? AND client_id = ? LIMIT 1`
+
+	rows, err := sdb.db.Query(query, roomID, userID, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+	
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	return messages[0], nil
+}
+
+// GetMessages returns the latest limit messages of a room, oldest first in
+// causal order (see types.CausalLess)
 func (sdb *SQLiteDatabase) GetMessages(roomID string, limit int) ([]*types.Message, error) {
 	if roomID == "" {
 		return nil, errors.New("room ID is required")
@@ -166,8 +551,8 @@ func (sdb *SQLiteDatabase) GetMessages(roomID string, limit int) ([]*types.Messa
 		limit = 50 // Default limit
 	}
 	
-	query := `SELECT id, room_id, user_id, username, content, type, encrypted, timestamp, signature
-			  FROM messages WHERE room_id = ? ORDER BY timestamp DESC LIMIT ?`
+	query := `SELECT ` + messageColumns + `
+			  FROM messages WHERE room_id = ? ORDER BY clock DESC, unix_time DESC, id DESC LIMIT ?`
 	
 	rows, err := sdb.db.Query(query, roomID, limit)
 	if err != nil {
@@ -175,24 +560,103 @@ func (sdb *SQLiteDatabase) GetMessages(roomID string, limit int) ([]*types.Messa
 	}
 	defer rows.Close()
 	
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	
+	types.SortCausal(messages)
+	return messages, nil
+}
+
+const messageColumns = `id, room_id, user_id, username, content, type, encrypted, timestamp, signature, clock, parents, verification, seq, client_id`
+
+func scanMessages(rows *sql.Rows) ([]*types.Message, error) {
 	var messages []*types.Message
 	for rows.Next() {
 		msg := &types.Message{}
+		var parents string
 		err := rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.Username,
-			&msg.Content, &msg.Type, &msg.Encrypted, &msg.Timestamp, &msg.Signature)
+			&msg.Content, &msg.Type, &msg.Encrypted, &msg.Timestamp, &msg.Signature,
+			&msg.Clock, &parents, &msg.Verification, &msg.Seq, &msg.ClientID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message: %v", err)
 		}
+		if parents != "" {
+			msg.Parents = strings.Split(parents, ",")
+		}
 		messages = append(messages, msg)
 	}
 	
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating messages: %v", err)
 	}
 	
 	return messages, nil
 }
 
+// GetMessagesSince returns up to limit messages after the cursor (since,
+// afterID), in order of second and then ID: those in later seconds, and
+// those in the second of since whose ID is greater than afterID
+func (sdb *SQLiteDatabase) GetMessagesSince(roomID string, since time.Time, afterID string, limit int) ([]*types.Message, error) {
+	if roomID == "" {
+		return nil, errors.New("room ID is required")
+	}
+	
+	if limit <= 0 {
+		limit = 50
+	}
+	
+	// Timestamps are stored as text in the writer's zone, so the cursor
+	// is compared against the unix time stored alongside
+	second := since.Unix()
+	query := `SELECT ` + messageColumns + `
+			  FROM messages WHERE room_id = ? AND (unix_time > ? OR (unix_time = ? AND id > ?))
+			  ORDER BY unix_time ASC, id ASC LIMIT ?`
+	
+	rows, err := sdb.db.Query(query, roomID, second, second, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+	
+	return scanMessages(rows)
+}
+
+// GetUncheckedMessages returns up to limit messages stored before their
+// signatures were checked on ingest
+func (sdb *SQLiteDatabase) GetUncheckedMessages(limit int) ([]*types.Message, error) {
+	query := `SELECT id, room_id, user_id, username, content, type, encrypted, timestamp, COALESCE(signature, ''), clock, parents, COALESCE(verification, ''), seq, COALESCE(client_id, '')
+			  FROM messages WHERE verification = '' OR verification IS NULL LIMIT ?`
+	
+	rows, err := sdb.db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+	
+	return scanMessages(rows)
+}
+
+func (sdb *SQLiteDatabase) SetMessageVerification(messageID, state string) error {
+	query := `UPDATE messages SET verification = ? WHERE id = ?`
+	
+	if _, err := sdb.db.Exec(query, state, messageID); err != nil {
+		return fmt.Errorf("failed to update message: %v", err)
+	}
+	return nil
+}
+
+func (sdb *SQLiteDatabase) MessageExists(messageID string) (bool, error) {
+	query := `SELECT COUNT(*) FROM messages WHERE id = ?`
+	
+	var count int
+	if err := sdb.db.QueryRow(query, messageID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (sdb *SQLiteDatabase) SaveRoom(room *Room) error {
 	query := `INSERT OR REPLACE INTO rooms (id, name, description, invite_code, is_private, created_at)
 			  VALUES (?, ?, ?, ?, ?, ?)`
@@ -298,6 +762,47 @@ func (sdb *SQLiteDatabase) GetRoomParticipants(roomID string) ([]string, error)
 	return participants, nil
 }
 
+// SetParticipantRole records a participant's role, so it outlives a restart
+func (sdb *SQLiteDatabase) SetParticipantRole(roomID, userID, role string) error {
+	query := `UPDATE room_participants SET role = ? WHERE room_id = ? AND user_id = ?`
+	_, err := sdb.db.Exec(query, role, roomID, userID)
+	return err
+}
+
+// GetParticipantRoles maps each participant of a room to their role
+func (sdb *SQLiteDatabase) GetParticipantRoles(roomID string) (map[string]string, error) {
+	query := `SELECT user_id, COALESCE(role, 'member') FROM room_participants WHERE room_id = ?`
+	
+	rows, err := sdb.db.Query(query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	roles := make(map[string]string)
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return nil, err
+		}
+		roles[userID] = role
+	}
+	
+	return roles, rows.Err()
+}
+
+// GetParticipantJoinedAt returns when a user last joined a room
+func (sdb *SQLiteDatabase) GetParticipantJoinedAt(roomID, userID string) (time.Time, error) {
+	query := `SELECT joined_at FROM room_participants WHERE room_id = ? AND user_id = ?`
+	
+	var joinedAt time.Time
+	err := sdb.db.QueryRow(query, roomID, userID).Scan(&joinedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrNotParticipant
+	}
+	return joinedAt, err
+}
+
 func (sdb *SQLiteDatabase) SaveSettings(key, value string) error {
 	query := `INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)`
 	_, err := sdb.db.Exec(query, key, value)
@@ -314,4 +819,538 @@ func (sdb *SQLiteDatabase) GetSettings(key string) (string, error) {
 	}
 	
 	return value, err
+}
+
+func (sdb *SQLiteDatabase) EnqueueOutbound(item *QueuedMessage) error {
+	query := `INSERT INTO outbound_queue (peer_key, type, data, attempts, next_attempt, created_at, unsealed)
+			  VALUES (?, ?, ?, ?, ?, ?, ?)`
+	
+	result, err := sdb.db.Exec(query, item.PeerKey, item.Type, item.Data, item.Attempts, item.NextAttempt.UTC(), item.CreatedAt.UTC(), item.Unsealed)
+	if err != nil {
+		return err
+	}
+	
+	item.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetQueuedForPeer returns everything queued for a peer in the order it was sent
+func (sdb *SQLiteDatabase) GetQueuedForPeer(peerKey string) ([]*QueuedMessage, error) {
+	query := `SELECT id, peer_key, type, data, attempts, next_attempt, created_at, unsealed
+			  FROM outbound_queue WHERE peer_key = ? ORDER BY id`
+	
+	rows, err := sdb.db.Query(query, peerKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	return scanQueued(rows)
+}
+
+// GetDueOutbound returns queued messages whose next attempt is at or before now
+func (sdb *SQLiteDatabase) GetDueOutbound(now time.Time, limit int) ([]*QueuedMessage, error) {
+	query := `SELECT id, peer_key, type, data, attempts, next_attempt, created_at, unsealed
+			  FROM outbound_queue WHERE next_attempt <= ? ORDER BY id LIMIT ?`
+	
+	// Stored in UTC so the text comparison orders correctly
+	rows, err := sdb.db.Query(query, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	return scanQueued(rows)
+}
+
+func scanQueued(rows *sql.Rows) ([]*QueuedMessage, error) {
+	var items []*QueuedMessage
+	for rows.Next() {
+		item := &QueuedMessage{}
+		if err := rows.Scan(&item.ID, &item.PeerKey, &item.Type, &item.Data, &item.Attempts, &item.NextAttempt, &item.CreatedAt, &item.Unsealed); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	
+	return items, rows.Err()
+}
+
+func (sdb *SQLiteDatabase) UpdateOutboundAttempt(id int64, attempts int, next time.Time) error {
+	query := `UPDATE outbound_queue SET attempts = ?, next_attempt = ? WHERE id = ?`
+	_, err := sdb.db.Exec(query, attempts, next.UTC(), id)
+	return err
+}
+
+func (sdb *SQLiteDatabase) UpdateOutboundData(id int64, data []byte) error {
+	query := `UPDATE outbound_queue SET data = ? WHERE id = ?`
+	_, err := sdb.db.Exec(query, data, id)
+	return err
+}
+
+func (sdb *SQLiteDatabase) DeleteOutbound(id int64) error {
+	query := `DELETE FROM outbound_queue WHERE id = ?`
+	_, err := sdb.db.Exec(query, id)
+	return err
+}
+
+// CountQueuedByPeer returns the number of queued messages per peer key
+func (sdb *SQLiteDatabase) CountQueuedByPeer() (map[string]int, error) {
+	query := `SELECT peer_key, COUNT(*) FROM outbound_queue GROUP BY peer_key`
+	
+	rows, err := sdb.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	counts := make(map[string]int)
+	for rows.Next() {
+		var peerKey string
+		var count int
+		if err := rows.Scan(&peerKey, &count); err != nil {
+			return nil, err
+		}
+		counts[peerKey] = count
+	}
+	
+	return counts, rows.Err()
+}
+
+// SavePrekey stores a new prekey under the ID it was signed with
+func (sdb *SQLiteDatabase) SavePrekey(prekey *Prekey) error {
+	query := `INSERT INTO prekeys (id, kind, private_key, public_key, signature, issued, created_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?)`
+	
+	_, err := sdb.db.Exec(query, prekey.ID, prekey.Kind, prekey.PrivateKey, prekey.PublicKey,
+		prekey.Signature, prekey.Issued, prekey.CreatedAt.UTC())
+	return err
+}
+
+const prekeyColumns = `id, kind, private_key, public_key, signature, issued, created_at`
+
+func scanPrekey(row *sql.Row) (*Prekey, error) {
+	prekey := &Prekey{}
+	err := row.Scan(&prekey.ID, &prekey.Kind, &prekey.PrivateKey, &prekey.PublicKey,
+		&prekey.Signature, &prekey.Issued, &prekey.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrPrekeyNotFound
+	}
+	
+	return prekey, err
+}
+
+func (sdb *SQLiteDatabase) GetPrekey(id int64) (*Prekey, error) {
+	query := `SELECT ` + prekeyColumns + ` FROM prekeys WHERE id = ?`
+	return scanPrekey(sdb.db.QueryRow(query, id))
+}
+
+// GetPrekeys returns every prekey, oldest first
+func (sdb *SQLiteDatabase) GetPrekeys() ([]*Prekey, error) {
+	rows, err := sdb.db.Query(`SELECT ` + prekeyColumns + ` FROM prekeys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var prekeys []*Prekey
+	for rows.Next() {
+		prekey := &Prekey{}
+		if err := rows.Scan(&prekey.ID, &prekey.Kind, &prekey.PrivateKey, &prekey.PublicKey,
+			&prekey.Signature, &prekey.Issued, &prekey.CreatedAt); err != nil {
+			return nil, err
+		}
+		prekeys = append(prekeys, prekey)
+	}
+	
+	return prekeys, rows.Err()
+}
+
+// ReplacePrekeys swaps every stored prekey for the given ones, as when an
+// identity is restored from a backup
+func (sdb *SQLiteDatabase) ReplacePrekeys(prekeys []*Prekey) error {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	
+	if _, err := tx.Exec(`DELETE FROM prekeys`); err != nil {
+		return err
+	}
+	for _, prekey := range prekeys {
+		query := `INSERT INTO prekeys (` + prekeyColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+		if _, err := tx.Exec(query, prekey.ID, prekey.Kind, prekey.PrivateKey, prekey.PublicKey,
+			prekey.Signature, prekey.Issued, prekey.CreatedAt.UTC()); err != nil {
+			return err
+		}
+	}
+	
+	return tx.Commit()
+}
+
+// GetLatestPrekey returns the newest prekey of a kind
+func (sdb *SQLiteDatabase) GetLatestPrekey(kind string) (*Prekey, error) {
+	query := `SELECT ` + prekeyColumns + ` FROM prekeys WHERE kind = ? ORDER BY created_at DESC LIMIT 1`
+	return scanPrekey(sdb.db.QueryRow(query, kind))
+}
+
+// IssueOneTimePrekey marks the oldest unissued one-time prekey as issued
+// and returns it, so no two peers are handed the same one
+func (sdb *SQLiteDatabase) IssueOneTimePrekey() (*Prekey, error) {
+	query := `UPDATE prekeys SET issued = TRUE
+			  WHERE id = (SELECT id FROM prekeys WHERE kind = ? AND NOT issued ORDER BY created_at LIMIT 1)
+			  RETURNING ` + prekeyColumns
+	return scanPrekey(sdb.db.QueryRow(query, PrekeyOneTime))
+}
+
+func (sdb *SQLiteDatabase) CountUnissuedPrekeys() (int, error) {
+	query := `SELECT COUNT(*) FROM prekeys WHERE kind = ? AND NOT issued`
+	
+	var count int
+	err := sdb.db.QueryRow(query, PrekeyOneTime).Scan(&count)
+	return count, err
+}
+
+func (sdb *SQLiteDatabase) DeletePrekey(id int64) error {
+	query := `DELETE FROM prekeys WHERE id = ?`
+	_, err := sdb.db.Exec(query, id)
+	return err
+}
+
+// DeleteExpiredPrekeys drops signed prekeys that have been replaced for long
+// enough and one-time prekeys that were issued but never used
+func (sdb *SQLiteDatabase) DeleteExpiredPrekeys(signedBefore, issuedBefore time.Time) error {
+	query := `DELETE FROM prekeys
+			  WHERE (kind = ? AND created_at < ? AND created_at < (SELECT MAX(created_at) FROM prekeys WHERE kind = ?))
+			     OR (kind = ? AND issued AND created_at < ?)`
+	_, err := sdb.db.Exec(query, PrekeySigned, signedBefore.UTC(), PrekeySigned, PrekeyOneTime, issuedBefore.UTC())
+	return err
+}
+
+// SaveSession stores a DM session's ratchet state
+func (sdb *SQLiteDatabase) SaveSession(peerKey, sessionID string, state []byte) error {
+	query := `INSERT OR REPLACE INTO dm_sessions (peer_key, session_id, state, updated_at)
+			  VALUES (?, ?, ?, ?)`
+	_, err := sdb.db.Exec(query, peerKey, sessionID, state, time.Now().UTC())
+	return err
+}
+
+func (sdb *SQLiteDatabase) GetSession(peerKey, sessionID string) ([]byte, error) {
+	query := `SELECT state FROM dm_sessions WHERE peer_key = ? AND session_id = ?`
+	
+	var state []byte
+	err := sdb.db.QueryRow(query, peerKey, sessionID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	
+	return state, err
+}
+
+// GetLatestSession returns the most recently used session with a peer, the
+// one new messages to it are sent on
+func (sdb *SQLiteDatabase) GetLatestSession(peerKey string) ([]byte, error) {
+	query := `SELECT state FROM dm_sessions WHERE peer_key = ? ORDER BY updated_at DESC LIMIT 1`
+	
+	var state []byte
+	err := sdb.db.QueryRow(query, peerKey).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	
+	return state, err
+}
+
+// SaveSenderKey stores a room sender key chain. Updating a key keeps its
+// creation time, which decides the key a sender currently uses.
+func (sdb *SQLiteDatabase) SaveSenderKey(roomID, senderID string, keyID int64, state []byte) error {
+	query := `INSERT INTO sender_keys (room_id, sender_id, key_id, state, created_at)
+			  VALUES (?, ?, ?, ?, ?)
+			  ON CONFLICT (room_id, sender_id, key_id) DO UPDATE SET state = excluded.state`
+	_, err := sdb.db.Exec(query, roomID, senderID, keyID, state, time.Now().UTC())
+	return err
+}
+
+func (sdb *SQLiteDatabase) GetSenderKey(roomID, senderID string, keyID int64) ([]byte, error) {
+	query := `SELECT state FROM sender_keys WHERE room_id = ? AND sender_id = ? AND key_id = ?`
+	
+	var state []byte
+	err := sdb.db.QueryRow(query, roomID, senderID, keyID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, ErrSenderKeyNotFound
+	}
+	
+	return state, err
+}
+
+// GetLatestSenderKey returns the newest key of a sender in a room
+func (sdb *SQLiteDatabase) GetLatestSenderKey(roomID, senderID string) ([]byte, error) {
+	query := `SELECT state FROM sender_keys WHERE room_id = ? AND sender_id = ?
+			  ORDER BY created_at DESC LIMIT 1`
+	
+	var state []byte
+	err := sdb.db.QueryRow(query, roomID, senderID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, ErrSenderKeyNotFound
+	}
+	
+	return state, err
+}
+
+// DeleteSenderKeys forgets a sender's keys for a room, or every key of the
+// room when senderID is empty
+func (sdb *SQLiteDatabase) DeleteSenderKeys(roomID, senderID string) error {
+	if senderID == "" {
+		_, err := sdb.db.Exec(`DELETE FROM sender_keys WHERE room_id = ?`, roomID)
+		return err
+	}
+	
+	query := `DELETE FROM sender_keys WHERE room_id = ? AND sender_id = ?`
+	_, err := sdb.db.Exec(query, roomID, senderID)
+	return err
+}
+
+// DeleteSessions forgets the DM sessions with a peer, or every session
+// when peerKey is empty
+func (sdb *SQLiteDatabase) DeleteSessions(peerKey string) error {
+	if peerKey == "" {
+		_, err := sdb.db.Exec(`DELETE FROM dm_sessions`)
+		return err
+	}
+	
+	_, err := sdb.db.Exec(`DELETE FROM dm_sessions WHERE peer_key = ?`, peerKey)
+	return err
+}
+
+// ApplySuccession records a key succession and moves the old user's
+// record, room memberships and queued messages over to the new key. Their
+// messages keep the old user ID, since that is the key that signed them.
+// Sessions and sender keys tied to the old key are dropped.
+func (sdb *SQLiteDatabase) ApplySuccession(succession *Succession) error {
+	tx, err := sdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO successions (old_key, new_key, record, created_at) VALUES (?, ?, ?, ?)`,
+			[]interface{}{succession.OldKey, succession.NewKey, succession.Record, succession.CreatedAt.UTC()}},
+	
+		// A record the new key made before the succession arrived gives way
+		// to the old one, which carries the user's history
+		{`DELETE FROM users WHERE id = ? AND EXISTS (SELECT 1 FROM users WHERE id = ?)`,
+			[]interface{}{succession.NewUserID, succession.OldUserID}},
+		{`UPDATE users SET id = ?, public_key = ? WHERE id = ?`,
+			[]interface{}{succession.NewUserID, succession.NewUserID, succession.OldUserID}},
+	
+		{`UPDATE OR IGNORE room_participants SET user_id = ? WHERE user_id = ?`,
+			[]interface{}{succession.NewUserID, succession.OldUserID}},
+		{`DELETE FROM room_participants WHERE user_id = ?`,
+			[]interface{}{succession.OldUserID}},
+	
+		{`UPDATE outbound_queue SET peer_key = ? WHERE peer_key = ?`,
+			[]interface{}{succession.NewKey, succession.OldKey}},
+		{`DELETE FROM dm_sessions WHERE peer_key = ?`,
+			[]interface{}{succession.OldKey}},
+		{`DELETE FROM sender_keys WHERE sender_id = ?`,
+			[]interface{}{succession.OldUserID}},
+	
+		// A verified contact stays flagged until the new key is compared
+		{`UPDATE trusted_keys SET replaced_by = ? WHERE user_id = ? OR replaced_by = ?`,
+			[]interface{}{succession.NewUserID, succession.OldUserID, succession.OldUserID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	
+	return tx.Commit()
+}
+
+// GetSuccession returns the record of the key that replaced oldKey
+func (sdb *SQLiteDatabase) GetSuccession(oldKey string) (*Succession, error) {
+	return sdb.getSuccession(`SELECT old_key, new_key, record, created_at FROM successions WHERE old_key = ?`, oldKey)
+}
+
+// GetSuccessionTo returns the record by which newKey replaced another key
+func (sdb *SQLiteDatabase) GetSuccessionTo(newKey string) (*Succession, error) {
+	return sdb.getSuccession(`SELECT old_key, new_key, record, created_at FROM successions WHERE new_key = ?`, newKey)
+}
+
+func (sdb *SQLiteDatabase) getSuccession(query, key string) (*Succession, error) {
+	succession := &Succession{}
+	err := sdb.db.QueryRow(query, key).Scan(&succession.OldKey, &succession.NewKey, &succession.Record, &succession.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrSuccessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	return succession, nil
+}
+
+func (sdb *SQLiteDatabase) SaveTrustedKey(trusted *TrustedKey) error {
+	query := `INSERT OR REPLACE INTO trusted_keys (user_id, nickname, verified_at, replaced_by) VALUES (?, ?, ?, ?)`
+	
+	_, err := sdb.db.Exec(query, trusted.UserID, trusted.Nickname, trusted.VerifiedAt.UTC(), trusted.ReplacedBy)
+	return err
+}
+
+func (sdb *SQLiteDatabase) GetTrustedKey(userID string) (*TrustedKey, error) {
+	return sdb.getTrustedKey(`SELECT user_id, nickname, verified_at, replaced_by FROM trusted_keys WHERE user_id = ?`, userID)
+}
+
+// GetReplacedTrust returns the verified key a succession replaced with
+// userID, if any
+func (sdb *SQLiteDatabase) GetReplacedTrust(userID string) (*TrustedKey, error) {
+	return sdb.getTrustedKey(`SELECT user_id, nickname, verified_at, replaced_by FROM trusted_keys WHERE replaced_by = ?`, userID)
+}
+
+func (sdb *SQLiteDatabase) getTrustedKey(query, userID string) (*TrustedKey, error) {
+	trusted := &TrustedKey{}
+	err := sdb.db.QueryRow(query, userID).Scan(&trusted.UserID, &trusted.Nickname, &trusted.VerifiedAt, &trusted.ReplacedBy)
+	if err == sql.ErrNoRows {
+		return nil, ErrTrustNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	return trusted, nil
+}
+
+func (sdb *SQLiteDatabase) GetTrustedKeys() ([]*TrustedKey, error) {
+	rows, err := sdb.db.Query(`SELECT user_id, nickname, verified_at, replaced_by FROM trusted_keys ORDER BY verified_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	trustedKeys := make([]*TrustedKey, 0)
+	for rows.Next() {
+		trusted := &TrustedKey{}
+		if err := rows.Scan(&trusted.UserID, &trusted.Nickname, &trusted.VerifiedAt, &trusted.ReplacedBy); err != nil {
+			return nil, err
+		}
+		trustedKeys = append(trustedKeys, trusted)
+	}
+	return trustedKeys, rows.Err()
+}
+
+func (sdb *SQLiteDatabase) DeleteTrustedKey(userID string) error {
+	_, err := sdb.db.Exec(`DELETE FROM trusted_keys WHERE user_id = ?`, userID)
+	return err
+}
+
+// SaveInvite keeps an invite the first time we see it. Saving it again
+// leaves its revocation alone.
+func (sdb *SQLiteDatabase) SaveInvite(invite *Invite) error {
+	query := `INSERT OR IGNORE INTO invites (id, room_id, issuer, role, max_uses, expires_at, token, revoked, created_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	
+	_, err := sdb.db.Exec(query, invite.ID, invite.RoomID, invite.Issuer, invite.Role, invite.MaxUses,
+		invite.ExpiresAt.UTC(), invite.Token, invite.Revoked, invite.CreatedAt.UTC())
+	return err
+}
+
+const inviteColumns = `id, room_id, issuer, role, max_uses, expires_at, token, revoked, created_at,
+	(SELECT COUNT(*) FROM invite_uses WHERE invite_id = invites.id)`
+
+func scanInvite(scanner interface{ Scan(...interface{}) error }) (*Invite, error) {
+	invite := &Invite{}
+	err := scanner.Scan(&invite.ID, &invite.RoomID, &invite.Issuer, &invite.Role, &invite.MaxUses,
+		&invite.ExpiresAt, &invite.Token, &invite.Revoked, &invite.CreatedAt, &invite.Uses)
+	return invite, err
+}
+
+func (sdb *SQLiteDatabase) GetInvite(inviteID string) (*Invite, error) {
+	invite, err := scanInvite(sdb.db.QueryRow(`SELECT `+inviteColumns+` FROM invites WHERE id = ?`, inviteID))
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	return invite, nil
+}
+
+// GetInvites lists a room's invites, oldest first
+func (sdb *SQLiteDatabase) GetInvites(roomID string) ([]*Invite, error) {
+	rows, err := sdb.db.Query(`SELECT `+inviteColumns+` FROM invites WHERE room_id = ? ORDER BY created_at`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	invites := make([]*Invite, 0)
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// RedeemInvite records that a user joined with an invite, unless it was
+// revoked or every use is taken. The check and the insert are a single
+// statement, so two joins cannot both take the last use. A user who
+// already redeemed the invite can do so again.
+func (sdb *SQLiteDatabase) RedeemInvite(inviteID, userID string) error {
+	query := `INSERT OR IGNORE INTO invite_uses (invite_id, user_id, used_at)
+			  SELECT id, ?, ? FROM invites
+			  WHERE id = ? AND NOT revoked
+			  AND (max_uses = 0 OR (SELECT COUNT(*) FROM invite_uses WHERE invite_id = ?) < max_uses)`
+	
+	result, err := sdb.db.Exec(query, userID, time.Now().UTC(), inviteID, inviteID)
+	if err != nil {
+		return err
+	}
+	if redeemed, err := result.RowsAffected(); err != nil || redeemed > 0 {
+		return err
+	}
+	
+	// Nothing was inserted; find out why
+	var used int
+	err = sdb.db.QueryRow(`SELECT COUNT(*) FROM invite_uses WHERE invite_id = ? AND user_id = ?`, inviteID, userID).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used > 0 {
+		return nil
+	}
+	
+	invite, err := sdb.GetInvite(inviteID)
+	if err != nil {
+		return err
+	}
+	if invite.Revoked {
+		return ErrInviteRevoked
+	}
+	return ErrInviteUsedUp
+}
+
+func (sdb *SQLiteDatabase) RevokeInvite(inviteID string) error {
+	result, err := sdb.db.Exec(`UPDATE invites SET revoked = TRUE WHERE id = ?`, inviteID)
+	if err != nil {
+		return err
+	}
+	
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
 } 
\ No newline at end of file
@@ -0,0 +1,363 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"ripcord/types"
+)
+
+func openTestDatabase(t *testing.T) *SQLiteDatabase {
+	t.Helper()
+	
+	db := NewSQLiteDatabase(filepath.Join(t.TempDir(), "ripcord.db"))
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Disconnect() })
+	return db
+}
+
+func TestGetMessagesCausalOrder(t *testing.T) {
+	now := time.Now()
+	
+	// The reply's author has a clock running ten minutes slow, so by
+	// timestamp it would sort before the message it answers
+	messages := []*types.Message{
+		{ID: "a", RoomID: "room", UserID: "alice", Username: "alice", Content: "hi", Type: types.MessageTypeText, Timestamp: now, Clock: 1},
+		{ID: "b", RoomID: "room", UserID: "bob", Username: "bob", Content: "hello", Type: types.MessageTypeText, Timestamp: now.Add(-10 * time.Minute), Clock: 2, Parents: []string{"a"}},
+		{ID: "c", RoomID: "room", UserID: "carol", Username: "carol", Content: "hey", Type: types.MessageTypeText, Timestamp: now.Add(time.Second), Clock: 2, Parents: []string{"a"}},
+		{ID: "d", RoomID: "room", UserID: "alice", Username: "alice", Content: "both of you", Type: types.MessageTypeText, Timestamp: now.Add(2 * time.Second), Clock: 3, Parents: []string{"b", "c"}},
+	}
+	
+	first := openTestDatabase(t)
+	second := openTestDatabase(t)
+	for i := range messages {
+		if err := first.SaveMessage(messages[i]); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+		if err := second.SaveMessage(messages[len(messages)-1-i]); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	
+	for _, db := range []*SQLiteDatabase{first, second} {
+		stored, err := db.GetMessages("room", 10)
+		if err != nil {
+			t.Fatalf("Failed to get messages: %v", err)
+		}
+		
+		order := ""
+		for _, message := range stored {
+			order += message.ID
+		}
+		if order != "abcd" {
+			t.Errorf("Expected causal order abcd, got %s", order)
+		}
+	}
+	
+	latest, _ := first.GetMessages("room", 2)
+	if len(latest) != 2 || latest[0].ID != "c" || latest[1].ID != "d" {
+		t.Errorf("Expected the latest two messages oldest first, got %v", latest)
+	}
+	if len(latest) == 2 && len(latest[1].Parents) != 2 {
+		t.Errorf("Expected parents to round trip, got %v", latest[1].Parents)
+	}
+}
+func TestOutboundQueue(t *testing.T) {
+	db := openTestDatabase(t)
+	now := time.Now()
+	
+	items := []*QueuedMessage{
+		{PeerKey: "bob", Type: "dm", Data: []byte(`{"n":1}`), NextAttempt: now.Add(-time.Second), CreatedAt: now},
+		{PeerKey: "bob", Type: "dm", Data: []byte(`{"n":2}`), NextAttempt: now.Add(time.Minute), CreatedAt: now},
+		{PeerKey: "carol", Type: "invite", Data: []byte(`{"n":3}`), NextAttempt: now.Add(-time.Second), CreatedAt: now},
+	}
+	for _, item := range items {
+		if err := db.EnqueueOutbound(item); err != nil {
+			t.Fatalf("Failed to enqueue: %v", err)
+		}
+	}
+	
+	counts, err := db.CountQueuedByPeer()
+	if err != nil || counts["bob"] != 2 || counts["carol"] != 1 {
+		t.Errorf("Unexpected queue counts %v: %v", counts, err)
+	}
+	
+	due, err := db.GetDueOutbound(now, 10)
+	if err != nil || len(due) != 2 || due[0].ID != items[0].ID || due[1].ID != items[2].ID {
+		t.Fatalf("Expected the two due messages in order, got %v: %v", due, err)
+	}
+	if string(due[0].Data) != `{"n":1}` {
+		t.Errorf("Unexpected queued data %s", due[0].Data)
+	}
+	
+	if err := db.UpdateOutboundAttempt(items[0].ID, 1, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to update attempt: %v", err)
+	}
+	if err := db.DeleteOutbound(items[2].ID); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if due, _ := db.GetDueOutbound(now, 10); len(due) != 0 {
+		t.Errorf("Expected nothing due after backoff, got %d", len(due))
+	}
+	
+	queued, err := db.GetQueuedForPeer("bob")
+	if err != nil || len(queued) != 2 || queued[0].Attempts != 1 {
+		t.Errorf("Expected bob's queue in order with one attempt recorded, got %v: %v", queued, err)
+	}
+}
+func TestPrekeysAndSessions(t *testing.T) {
+	db := openTestDatabase(t)
+	now := time.Now()
+	
+	prekeys := []*Prekey{
+		{ID: 7, Kind: PrekeySigned, PrivateKey: []byte("old"), PublicKey: []byte("p7"), Signature: []byte("s"), CreatedAt: now.Add(-60 * 24 * time.Hour)},
+		{ID: 3, Kind: PrekeySigned, PrivateKey: []byte("new"), PublicKey: []byte("p3"), Signature: []byte("s"), CreatedAt: now},
+		{ID: 11, Kind: PrekeyOneTime, PrivateKey: []byte("a"), PublicKey: []byte("p11"), CreatedAt: now.Add(-time.Minute)},
+		{ID: 5, Kind: PrekeyOneTime, PrivateKey: []byte("b"), PublicKey: []byte("p5"), CreatedAt: now},
+	}
+	for _, prekey := range prekeys {
+		if err := db.SavePrekey(prekey); err != nil {
+			t.Fatalf("Failed to save prekey: %v", err)
+		}
+	}
+	
+	latest, err := db.GetLatestPrekey(PrekeySigned)
+	if err != nil || latest.ID != 3 {
+		t.Fatalf("Expected the newest signed prekey, got %v: %v", latest, err)
+	}
+	
+	issued, err := db.IssueOneTimePrekey()
+	if err != nil || issued.ID != 11 || !issued.Issued {
+		t.Fatalf("Expected the oldest one-time prekey to be issued, got %v: %v", issued, err)
+	}
+	if count, err := db.CountUnissuedPrekeys(); err != nil || count != 1 {
+		t.Errorf("Expected one unissued prekey, got %d: %v", count, err)
+	}
+	
+	if err := db.DeleteExpiredPrekeys(now.Add(-time.Hour), now); err != nil {
+		t.Fatalf("Failed to prune prekeys: %v", err)
+	}
+	for id, want := range map[int64]error{7: ErrPrekeyNotFound, 11: ErrPrekeyNotFound, 3: nil, 5: nil} {
+		if _, err := db.GetPrekey(id); err != want {
+			t.Errorf("Prekey %d: expected %v, got %v", id, want, err)
+		}
+	}
+	
+	if _, err := db.GetLatestSession("bob"); err != ErrSessionNotFound {
+		t.Errorf("Expected no session, got %v", err)
+	}
+	if err := db.SaveSession("bob", "first", []byte("1")); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := db.SaveSession("bob", "second", []byte("2")); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+	if state, err := db.GetLatestSession("bob"); err != nil || string(state) != "2" {
+		t.Errorf("Expected the most recent session, got %q: %v", state, err)
+	}
+	
+	time.Sleep(10 * time.Millisecond)
+	if err := db.SaveSession("bob", "first", []byte("1b")); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+	if state, err := db.GetLatestSession("bob"); err != nil || string(state) != "1b" {
+		t.Errorf("Expected the updated session to become the latest, got %q: %v", state, err)
+	}
+	if state, err := db.GetSession("bob", "second"); err != nil || string(state) != "2" {
+		t.Errorf("Expected the older session to be kept, got %q: %v", state, err)
+	}
+}
+
+func TestRedeemInvite(t *testing.T) {
+	db := openTestDatabase(t)
+	
+	invite := &Invite{ID: "invite", RoomID: "room", Issuer: "bob", Role: "member", MaxUses: 2,
+		ExpiresAt: time.Now().Add(time.Hour), Token: "token", CreatedAt: time.Now()}
+	if err := db.SaveInvite(invite); err != nil {
+		t.Fatalf("Failed to save invite: %v", err)
+	}
+	
+	// However many race for it, only two users get in
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- db.RedeemInvite("invite", fmt.Sprintf("user-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	
+	redeemed := 0
+	for err := range results {
+		if err == nil {
+			redeemed++
+		} else if err != ErrInviteUsedUp {
+			t.Errorf("Expected ErrInviteUsedUp, got %v", err)
+		}
+	}
+	saved, err := db.GetInvite("invite")
+	if err != nil {
+		t.Fatalf("Failed to load invite: %v", err)
+	}
+	if redeemed != 2 || saved.Uses != 2 {
+		t.Errorf("Expected two uses, got %d redeemed and %d recorded", redeemed, saved.Uses)
+	}
+	
+	// Saving it again, as on a second join, leaves it revoked
+	if err := db.RevokeInvite("invite"); err != nil {
+		t.Fatalf("Failed to revoke invite: %v", err)
+	}
+	db.SaveInvite(invite)
+	if err := db.RedeemInvite("invite", "user-new"); err != ErrInviteRevoked {
+		t.Errorf("Expected ErrInviteRevoked, got %v", err)
+	}
+	if err := db.RevokeInvite("unknown"); err != ErrInviteNotFound {
+		t.Errorf("Expected ErrInviteNotFound, got %v", err)
+	}
+}
+
+func TestMessageSequence(t *testing.T) {
+	db := openTestDatabase(t)
+	
+	// Concurrent saves still number a room's messages one by one
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.SaveMessage(&types.Message{ID: fmt.Sprintf("m%d", i), RoomID: "room", UserID: "alice", Username: "alice", Content: "hi", Timestamp: time.Now()})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	
+	other := &types.Message{ID: "elsewhere", RoomID: "other", UserID: "bob", Username: "bob", Content: "hi", Timestamp: time.Now(), ClientID: "client-1"}
+	if err := db.SaveMessage(other); err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+	if other.Seq != 1 {
+		t.Errorf("Expected each room to count from one, got %d", other.Seq)
+	}
+	
+	stored, err := db.GetMessagesAfterSeq("room", 0, 50)
+	if err != nil {
+		t.Fatalf("Failed to get messages: %v", err)
+	}
+	if len(stored) != 20 {
+		t.Fatalf("Expected 20 messages, got %d", len(stored))
+	}
+	for i, message := range stored {
+		if message.Seq != int64(i+1) {
+			t.Fatalf("Expected sequence numbers 1 to 20 in order, got %d at %d", message.Seq, i)
+		}
+	}
+	
+	// Saving a message again keeps its place
+	again := stored[4]
+	again.Verification = "verified"
+	if err := db.SaveMessage(again); err != nil {
+		t.Fatalf("Failed to save message: %v", err)
+	}
+	if again.Seq != 5 {
+		t.Errorf("Expected a saved message to keep sequence 5, got %d", again.Seq)
+	}
+	if seq, _ := db.GetRoomSeq("room"); seq != 20 {
+		t.Errorf("Expected the room to be at 20, got %d", seq)
+	}
+	
+	// Another author or room cannot take over a stored ID
+	forged := &types.Message{ID: stored[4].ID, RoomID: "room", UserID: "mallory", Username: "mallory", Content: "forged", Timestamp: time.Now()}
+	if err := db.SaveMessage(forged); err != ErrMessageConflict {
+		t.Errorf("Expected another author's ID to be refused, got %v", err)
+	}
+	moved := &types.Message{ID: stored[4].ID, RoomID: "other", UserID: stored[4].UserID, Username: "alice", Content: "moved", Timestamp: time.Now()}
+	if err := db.SaveMessage(moved); err != ErrMessageConflict {
+		t.Errorf("Expected a message not to move rooms, got %v", err)
+	}
+	if kept, _ := db.GetMessagesAfterSeq("room", 0, 50); kept[4].ID != stored[4].ID || kept[4].Content != stored[4].Content {
+		t.Errorf("Expected the stored message to be intact, got %v", kept[4])
+	}
+	
+	missed, _ := db.GetMessagesAfterSeq("room", 18, 50)
+	if len(missed) != 2 || missed[0].Seq != 19 {
+		t.Errorf("Expected the two messages after 18, got %v", missed)
+	}
+	
+	found, err := db.GetMessageByClientID("other", "bob", "client-1")
+	if err != nil || found.ID != "elsewhere" {
+		t.Errorf("Expected to find the message by its client ID, got %v, %v", found, err)
+	}
+	if _, err := db.GetMessageByClientID("room", "bob", "client-1"); err != ErrMessageNotFound {
+		t.Errorf("Expected client IDs to be looked up per room, got %v", err)
+	}
+	if _, err := db.GetMessageByClientID("other", "mallory", "client-1"); err != ErrMessageNotFound {
+		t.Errorf("Expected client IDs to be looked up per sender, got %v", err)
+	}
+} 
+func TestGetMessagesSinceAcrossZones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ripcord.db")
+	db := NewSQLiteDatabase(path)
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	
+	// Written in three zones, a, b and c are an hour apart; as text in
+	// their own zones they sort a, c, b
+	base := time.Date(2025, 3, 30, 12, 0, 0, 0, time.UTC)
+	east := time.FixedZone("PKT", 5*3600)
+	west := time.FixedZone("PST", -8*3600)
+	messages := []*types.Message{
+		{ID: "a", RoomID: "room", UserID: "alice", Username: "alice", Content: "a", Timestamp: base.In(west)},
+		{ID: "b", RoomID: "room", UserID: "bob", Username: "bob", Content: "b", Timestamp: base.Add(time.Hour).In(east)},
+		{ID: "c", RoomID: "room", UserID: "carol", Username: "carol", Content: "c", Timestamp: base.Add(2 * time.Hour).In(time.UTC)},
+	}
+	for _, message := range messages {
+		if err := db.SaveMessage(message); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	
+	check := func(db *SQLiteDatabase) {
+		t.Helper()
+		
+		since, err := db.GetMessagesSince("room", base.In(east), "a", 10)
+		if err != nil {
+			t.Fatalf("Failed to get messages: %v", err)
+		}
+		order := ""
+		for _, message := range since {
+			order += message.ID
+		}
+		if order != "bc" {
+			t.Errorf("Expected bc after a's cursor, got %s", order)
+		}
+	}
+	check(db)
+	
+	// Rows stored before the unix time column are backfilled on open
+	if _, err := db.db.Exec(`UPDATE messages SET unix_time = 0`); err != nil {
+		t.Fatalf("Failed to clear unix times: %v", err)
+	}
+	db.Disconnect()
+	
+	reopened := NewSQLiteDatabase(path)
+	if err := reopened.Connect(); err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer reopened.Disconnect()
+	check(reopened)
+}
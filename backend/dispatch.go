@@ -0,0 +1,738 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"github.com/mr-tron/base58"
+	"ripcord/database"
+	"ripcord/transport"
+	"ripcord/types"
+)
+
+var (
+	ErrInvalidSignature   = errors.New("invalid message signature")
+	ErrUnsupportedMessage = errors.New("unsupported message type")
+	ErrNotRoomMember      = errors.New("sender is not a member of the room")
+	ErrNotRoomModerator   = errors.New("sender is not a moderator of the room")
+	ErrRoomStaysPrivate   = errors.New("a private room cannot be made public by a peer")
+)
+
+// ClientNotifier delivers the effects of peer messages to local WebSocket clients
+type ClientNotifier interface {
+	NotifyRoom(roomID string, event interface{})
+	NotifyAll(event interface{})
+}
+
+// SetNotifier connects the node to the local client hub
+func (n *Node) SetNotifier(notifier ClientNotifier) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifier = notifier
+}
+
+func (n *Node) notifyRoom(roomID string, event interface{}) {
+	n.mu.RLock()
+	notifier := n.notifier
+	n.mu.RUnlock()
+	
+	if notifier != nil {
+		notifier.NotifyRoom(roomID, event)
+	}
+}
+
+func (n *Node) notifyAll(event interface{}) {
+	n.mu.RLock()
+	notifier := n.notifier
+	n.mu.RUnlock()
+	
+	if notifier != nil {
+		notifier.NotifyAll(event)
+	}
+}
+
+// userIDForKey maps a hex protocol key to the base58 user ID used by rooms
+func userIDForKey(publicKeyHex string) (string, error) {
+	key, err := hex.DecodeString(publicKeyHex)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid public key: %s", publicKeyHex)
+	}
+	return base58.Encode(key), nil
+}
+
+// dmRoomID is the pseudo-room direct messages with a user are stored under
+func dmRoomID(userID string) string {
+	return "dm-" + userID
+}
+
+func verifyPeerSignature(msg *ProtocolMessage, publicKeyHex string) error {
+	key, err := hex.DecodeString(publicKeyHex)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key for peer %s", publicKeyHex)
+	}
+	
+	if !msg.VerifySignature(ed25519.PublicKey(key)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// dispatch routes a verified message from a known peer to its handler
+func (n *Node) dispatch(msg *ProtocolMessage, peer Peer) error {
+	payload, err := msg.GetTypedPayload()
+	if err != nil {
+		return fmt.Errorf("invalid %s payload: %v", msg.Type, err)
+	}
+	
+	switch msg.Type {
+	case MessageTypeHeartbeat:
+		return n.handleHeartbeat(msg, peer, payload)
+	case MessageTypeJoin:
+		return n.handleJoin(msg, peer, payload)
+	case MessageTypeLeave:
+		return n.handleLeave(msg, peer, payload)
+	case MessageTypeChat:
+		return n.handleChat(msg, peer, payload)
+	case MessageTypeSync:
+		return n.handleSync(msg, peer, payload)
+	case MessageTypePing:
+		return n.handlePing(msg, peer)
+	case MessageTypePong:
+		return nil
+	case MessageTypeInvite:
+		return n.handleInvite(msg, peer, payload)
+	case MessageTypeDM:
+		return n.handleDM(msg, peer, payload)
+	case MessageTypeRoomInfo:
+		return n.handleRoomInfo(msg, peer, payload)
+	case MessageTypeUserInfo:
+		return n.handleUserInfo(msg, peer, payload)
+	case MessageTypeBlock, MessageTypeUnblock:
+		return n.handleBlock(msg, peer, payload)
+	case MessageTypeSenderKey:
+		return n.handleSenderKey(msg, peer, payload)
+	case MessageTypePrekey:
+		return n.handlePrekey(msg, peer, payload)
+	case MessageTypeInviteRevoke:
+		return n.handleInviteRevoke(msg, peer, payload)
+	case MessageTypePresence:
+		return n.handlePresence(msg, peer, payload)
+	case MessageTypeTyping:
+		return n.handleTyping(msg, peer, payload)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedMessage, msg.Type)
+	}
+}
+
+// touchPeer records that we heard from a peer
+func (n *Node) touchPeer(peerID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	
+	if peer, exists := n.peers[peerID]; exists {
+		peer.LastSeen = time.Now()
+		peer.MessageCount++
+		if !peer.IsBlocked && peer.Status != PeerStatusConnected {
+			peer.Status = PeerStatusConnected
+			peer.ConnectedAt = time.Now()
+		}
+	}
+}
+
+// recordUser makes sure a remote user exists in the database so room
+// membership can be loaded back from it
+func (n *Node) recordUser(userID, nickname, publicKey string) error {
+	user := &types.User{
+		ID:        userID,
+		Username:  nickname,
+		PublicKey: publicKey,
+		CreatedAt: time.Now(),
+		LastSeen:  time.Now(),
+	}
+	
+	if existing, err := n.roomManager.db.GetUser(userID); err == nil {
+		user.CreatedAt = existing.CreatedAt
+		user.IsBlocked = existing.IsBlocked
+	}
+	
+	return n.roomManager.db.SaveUser(user)
+}
+
+// handleHeartbeat adds or refreshes the sending peer. A new or returning
+// peer gets a heartbeat back so it learns about us without waiting, then is
+// asked for prekeys, receives anything queued for it and is asked for the
+// history we missed.
+func (n *Node) handleHeartbeat(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	heartbeat, ok := payload.(HeartbeatPayload)
+	if !ok {
+		return errors.New("heartbeat message missing payload")
+	}
+	
+	if heartbeat.PublicKey != "" && heartbeat.PublicKey != peer.PublicKey {
+		return errors.New("heartbeat payload key does not match sender")
+	}
+	if err := n.checkReplaced(peer.PublicKey); err != nil {
+		return err
+	}
+	
+	version, err := negotiateVersion(heartbeat.MinVersion, heartbeat.MaxVersion)
+	if err != nil {
+		return err
+	}
+	
+	address := n.reachableAddress(heartbeat)
+	if address == "" {
+		address = peer.Address
+	}
+	if address == "" {
+		return errors.New("heartbeat carries no address we can reach")
+	}
+	
+	// peer was copied before touchPeer marked it connected again
+	n.mu.RLock()
+	_, known := n.peers[peer.ID]
+	n.mu.RUnlock()
+	returning := known && peer.Status == PeerStatusDisconnected
+	
+	if err := n.AddPeer(peer.PublicKey, heartbeat.Nickname, address); err != nil {
+		return err
+	}
+	
+	ratchet := false
+	n.mu.Lock()
+	if stored, exists := n.peers[peer.ID]; exists {
+		stored.ActiveRooms = heartbeat.ActiveRooms
+		stored.Version = version
+		stored.Features = heartbeat.Features
+		ratchet = stored.HasFeature(FeatureRatchet)
+	}
+	n.mu.Unlock()
+	
+	// Before the queue is flushed, so what was held for the old key goes out
+	if heartbeat.Succession != nil {
+		if err := n.applySuccession(peer, heartbeat.Succession); err != nil {
+			log.Printf("Ignoring succession from %s: %v", shortKey(peer.ID), err)
+		}
+	}
+	
+	if heartbeat.Prekey != nil {
+		if err := n.storePrekeyBundle(peer.ID, heartbeat.Prekey); err != nil {
+			log.Printf("Ignoring prekey from %s: %v", shortKey(peer.ID), err)
+		}
+	}
+	
+	if err := n.setPeerPresence(peer, heartbeat.Presence); err != nil {
+		log.Printf("Ignoring presence from %s: %v", shortKey(peer.ID), err)
+	}
+	
+	if known && !returning {
+		go n.flushQueue(peer.ID)
+		return nil
+	}
+	
+	// Introduce ourselves first, since a returning peer may have restarted
+	// and forgotten us, so it accepts what we held back and the sync request
+	go func() {
+		data, err := n.heartbeatFrame(version)
+		if err != nil {
+			log.Printf("Failed to build heartbeat: %v", err)
+			return
+		}
+		n.sendHeartbeatTo(address, data)
+		
+		if ratchet && !n.hasSession(peer.ID) {
+			n.requestPrekeys(peer.ID)
+		}
+		n.flushQueue(peer.ID)
+		n.syncWithPeer(peer.ID, heartbeat.ActiveRooms)
+	}()
+	
+	return nil
+}
+
+// reachableAddress picks the first advertised address one of our transports
+// can dial. Older nodes only send a bare I2P address.
+func (n *Node) reachableAddress(heartbeat HeartbeatPayload) string {
+	for _, address := range heartbeat.Addresses {
+		if n.transports.Supports(address) {
+			return address
+		}
+	}
+	
+	if heartbeat.I2PAddress != "" {
+		address := transport.QualifyAddress(transport.SchemeI2P, heartbeat.I2PAddress)
+		if n.transports.Supports(address) {
+			return address
+		}
+	}
+	
+	return ""
+}
+
+func (n *Node) handleJoin(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	join, ok := payload.(JoinPayload)
+	if !ok {
+		return errors.New("join message missing payload")
+	}
+	
+	if join.PublicKey != "" && join.PublicKey != peer.PublicKey {
+		return errors.New("join payload key does not match sender")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	nickname := join.Nickname
+	if nickname == "" {
+		nickname = peer.Nickname
+	}
+	
+	if err := n.recordUser(userID, nickname, userID); err != nil {
+		return err
+	}
+	
+	var room *Room
+	if join.InviteCode != "" {
+		room, err = n.roomManager.JoinRoomByInvite(join.InviteCode, userID, nickname, userID)
+	} else {
+		room, err = n.joinPublicRoom(join.RoomID, userID, nickname)
+	}
+	if err != nil {
+		return err
+	}
+	
+	// A new member of a private room needs our key to read what we send
+	if n.roomManager.IsPrivate(room.ID) {
+		go n.shareCurrentSenderKey(room.ID, userID)
+	}
+	
+	n.notifyRoom(room.ID, map[string]interface{}{
+		"type":    "user_joined",
+		"room_id": room.ID,
+		"user": map[string]interface{}{
+			"id":       userID,
+			"username": nickname,
+		},
+	})
+	
+	return nil
+}
+
+func (n *Node) joinPublicRoom(roomID, userID, nickname string) (*Room, error) {
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	
+	if room.IsPrivate {
+		return nil, errors.New("private rooms require an invite code")
+	}
+	
+	if room.IsMember(userID) {
+		return room, nil
+	}
+	
+	if err := room.AddMember(userID, nickname, userID); err != nil {
+		return nil, err
+	}
+	
+	if err := n.roomManager.db.AddRoomParticipant(room.ID, userID); err != nil {
+		return nil, err
+	}
+	
+	return room, nil
+}
+
+func (n *Node) handleLeave(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	leave, ok := payload.(LeavePayload)
+	if !ok {
+		return errors.New("leave message missing payload")
+	}
+	
+	roomID := leave.RoomID
+	if roomID == "" {
+		roomID = msg.RoomID
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	// Only a moderator may remove someone else
+	if leave.UserID != "" && leave.UserID != userID {
+		room, err := n.roomManager.GetRoom(roomID)
+		if err != nil {
+			return err
+		}
+		if !room.IsModerator(userID) {
+			return ErrNotRoomModerator
+		}
+		userID = leave.UserID
+	}
+	
+	if err := n.roomManager.LeaveRoom(roomID, userID); err != nil {
+		return err
+	}
+	n.rotateSenderKeys(roomID, userID)
+	
+	n.notifyRoom(roomID, map[string]interface{}{
+		"type":    "user_left",
+		"room_id": roomID,
+		"user_id": userID,
+	})
+	
+	return nil
+}
+
+func (n *Node) handleChat(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	chat, ok := payload.(ChatPayload)
+	if !ok {
+		return errors.New("chat message missing payload")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	room, err := n.roomManager.GetRoom(msg.RoomID)
+	if err != nil {
+		return err
+	}
+	
+	if !room.IsMember(userID) {
+		return ErrNotRoomMember
+	}
+	
+	if room.IsUserBlocked(userID) {
+		log.Printf("Dropping chat from blocked user %s in room %s", peer.Nickname, room.ID)
+		return nil
+	}
+	
+	// Relays outside a private room pass its messages on without reading
+	// them; members hold a message until its sender key arrives
+	content := chat.Content
+	if chat.SenderKey != nil {
+		member := room.IsMember(n.cryptoManager.GetPublicKeyBase58())
+		content, err = n.openRoomContent(msg, peer, chat, userID, member)
+		if err == ErrUnknownSenderKey {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	} else if n.roomManager.IsPrivate(room.ID) {
+		return ErrPlaintextInPrivateRoom
+	}
+	
+	msgType := types.MessageTypeText
+	if chat.IsCommand {
+		msgType = types.MessageTypeCommand
+	}
+	
+	message := &types.Message{
+		ID:        msg.MessageID,
+		RoomID:    room.ID,
+		UserID:    userID,
+		Username:  peer.Nickname,
+		Content:   content,
+		Type:      msgType,
+		Encrypted: chat.SenderKey != nil,
+		Timestamp: time.Unix(msg.Timestamp, 0),
+		Clock:     chat.Clock,
+		Parents:   chat.Parents,
+	}
+	
+	// Keep the author's own signature so the message can be synced onwards
+	if chat.Signature != "" {
+		if chat.Username != "" {
+			message.Username = chat.Username
+		}
+		if chat.Timestamp != 0 {
+			message.Timestamp = time.Unix(chat.Timestamp, 0)
+		}
+		message.Signature = chat.Signature
+		
+		if err := verifyMessageSignature(message); err != nil {
+			return err
+		}
+	} else {
+		message.Verification = types.VerificationUnsigned
+	}
+	if err := n.admitMessage(message); err != nil {
+		return err
+	}
+	if err := n.roomManager.CheckClock(message); err != nil {
+		return err
+	}
+	
+	// Gossiped chat may come from an author we have no peer entry for
+	if message.Username == "" {
+		message.Username = room.MemberName(userID)
+	}
+	
+	if err := n.roomManager.db.SaveMessage(message); err != nil {
+		return err
+	}
+	
+	n.notifyRoom(room.ID, map[string]interface{}{
+		"type":    "message",
+		"message": message,
+	})
+	
+	return nil
+}
+
+func (n *Node) handlePing(msg *ProtocolMessage, peer Peer) error {
+	pong := NewProtocolMessage(MessageTypePong, n.ID, generateMessageID())
+	pong.To = peer.ID
+	pong.SetPayload(map[string]string{"ping_id": msg.MessageID})
+	
+	n.replyToPeer(peer.ID, pong)
+	return nil
+}
+
+func (n *Node) handleInvite(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	invite, ok := payload.(InvitePayload)
+	if !ok {
+		return errors.New("invite message missing payload")
+	}
+	
+	if !n.isAddressedToUs(msg.To) {
+		return nil
+	}
+	
+	// Keep the room locally so the invite code can be redeemed with /join
+	if _, err := n.roomManager.GetRoom(invite.RoomID); err != nil {
+		dbRoom := &database.Room{
+			ID:          invite.RoomID,
+			Name:        invite.RoomName,
+			Description: invite.Description,
+			InviteCode:  invite.InviteCode,
+			IsPrivate:   invite.IsPrivate,
+			CreatedAt:   time.Now(),
+		}
+		if err := n.keepInvitedRoom(dbRoom, peer); err != nil {
+			return err
+		}
+	}
+	
+	n.notifyAll(map[string]interface{}{
+		"type":   "invite_received",
+		"from":   peer.Nickname,
+		"invite": invite,
+	})
+	
+	return nil
+}
+
+// isAddressedToUs accepts our node ID, our nickname or no recipient at all
+func (n *Node) isAddressedToUs(to string) bool {
+	return to == "" || to == n.ID || strings.EqualFold(to, n.cryptoManager.GetNickname())
+}
+
+func (n *Node) handleDM(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	dm, ok := payload.(DMPayload)
+	if !ok {
+		return errors.New("dm message missing payload")
+	}
+	
+	if !n.isAddressedToUs(msg.To) {
+		return nil
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	content, err := n.openDMPayload(peer, dm)
+	if err != nil {
+		return err
+	}
+	
+	message := &types.Message{
+		ID:        msg.MessageID,
+		RoomID:    dmRoomID(userID),
+		UserID:    userID,
+		Username:  peer.Nickname,
+		Content:   content,
+		Type:      types.MessageTypeDM,
+		Encrypted: dm.IsEncrypted,
+		Timestamp: time.Unix(msg.Timestamp, 0),
+		
+		// Direct messages come straight from their author in a frame it
+		// signed, which was checked before dispatch
+		Verification: types.VerificationVerified,
+	}
+	
+	if err := n.roomManager.db.SaveMessage(message); err != nil {
+		return err
+	}
+	
+	n.notifyAll(map[string]interface{}{
+		"type":    "direct_message",
+		"message": message,
+	})
+	
+	return nil
+}
+
+func (n *Node) handleRoomInfo(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	info, ok := payload.(RoomInfoPayload)
+	if !ok {
+		return errors.New("room_info message missing payload")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	room, err := n.roomManager.GetRoom(info.RoomID)
+	if err != nil {
+		return err
+	}
+	
+	if !room.IsModerator(userID) {
+		return ErrNotRoomModerator
+	}
+	
+	// Opening a private room would send its history and messages to peers
+	// in the clear, which no remote moderator gets to decide for us
+	room.mu.Lock()
+	if room.IsPrivate && !info.IsPrivate {
+		room.mu.Unlock()
+		return ErrRoomStaysPrivate
+	}
+	room.Name = info.Name
+	room.Description = info.Description
+	room.IsPrivate = info.IsPrivate
+	dbRoom := &database.Room{
+		ID:          room.ID,
+		Name:        room.Name,
+		Description: room.Description,
+		InviteCode:  room.InviteCode,
+		IsPrivate:   room.IsPrivate,
+		CreatedAt:   room.CreatedAt,
+	}
+	room.mu.Unlock()
+	
+	if err := n.roomManager.db.SaveRoom(dbRoom); err != nil {
+		return err
+	}
+	
+	n.notifyRoom(room.ID, map[string]interface{}{
+		"type": "room_updated",
+		"room": dbRoom,
+	})
+	
+	return nil
+}
+
+func (n *Node) handleUserInfo(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	info, ok := payload.(UserInfoPayload)
+	if !ok {
+		return errors.New("user_info message missing payload")
+	}
+	
+	if info.PublicKey != peer.PublicKey {
+		return errors.New("user_info key does not match sender")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	n.mu.Lock()
+	if p, exists := n.peers[peer.ID]; exists && info.Nickname != "" {
+		p.Nickname = info.Nickname
+	}
+	n.mu.Unlock()
+	
+	if err := n.recordUser(userID, info.Nickname, userID); err != nil {
+		return err
+	}
+	
+	n.notifyAll(map[string]interface{}{
+		"type": "user_updated",
+		"user": map[string]interface{}{
+			"id":          userID,
+			"username":    info.Nickname,
+			"fingerprint": info.Fingerprint,
+		},
+	})
+	
+	return nil
+}
+
+// handleBlock applies a moderator's block or unblock to a room member
+func (n *Node) handleBlock(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	info, ok := payload.(UserInfoPayload)
+	if !ok {
+		return errors.New("block message missing payload")
+	}
+	
+	if msg.RoomID == "" {
+		// Personal blocks only affect the sender's own node
+		return nil
+	}
+	
+	moderatorID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	room, err := n.roomManager.GetRoom(msg.RoomID)
+	if err != nil {
+		return err
+	}
+	
+	if !room.IsModerator(moderatorID) {
+		return ErrNotRoomModerator
+	}
+	
+	targetID := ""
+	if info.PublicKey != "" {
+		if targetID, err = userIDForKey(info.PublicKey); err != nil {
+			return err
+		}
+	} else {
+		for _, member := range room.GetMembersInfo() {
+			if member.Username == info.Nickname {
+				targetID = member.UserID
+				break
+			}
+		}
+	}
+	if targetID == "" {
+		return fmt.Errorf("user %s not found in room", info.Nickname)
+	}
+	
+	eventType := "user_blocked"
+	if msg.Type == MessageTypeBlock {
+		err = room.BlockUser(targetID)
+	} else {
+		err = room.UnblockUser(targetID)
+		eventType = "user_unblocked"
+	}
+	if err != nil {
+		return err
+	}
+	
+	n.notifyRoom(room.ID, map[string]interface{}{
+		"type":    eventType,
+		"room_id": room.ID,
+		"user_id": targetID,
+	})
+	
+	return nil
+} 
\ No newline at end of file
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"github.com/mr-tron/base58"
+	"ripcord/security"
+	"ripcord/types"
+)
+
+var (
+	ErrPlaintextDMUnsupported = errors.New("peer does not support encrypted direct messages")
+	ErrPlaintextDM            = errors.New("direct message in the clear from a peer that encrypts them")
+)
+
+// recipientKey accepts a hex node ID or a base58 user ID
+func recipientKey(recipient string) (ed25519.PublicKey, error) {
+	if key, err := hex.DecodeString(recipient); err == nil && len(key) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(key), nil
+	}
+	if key, err := base58.Decode(recipient); err == nil && len(key) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(key), nil
+	}
+	return nil, fmt.Errorf("recipient %q is not a public key", recipient)
+}
+
+// sealDMPayload encrypts DM content for the recipient
+func sealDMPayload(cryptoManager *security.CryptoManager, recipient ed25519.PublicKey, content string) (DMPayload, error) {
+	sealed, err := cryptoManager.SealDM(recipient, []byte(content))
+	if err != nil {
+		return DMPayload{}, err
+	}
+	
+	return DMPayload{
+		Content:     base64.StdEncoding.EncodeToString(sealed),
+		IsEncrypted: true,
+	}, nil
+}
+
+// openDMPayload returns the readable content of a DM from a peer. Only a
+// peer that advertised no DM encryption may send one in the clear.
+func (n *Node) openDMPayload(peer Peer, dm DMPayload) (string, error) {
+	if !dm.IsEncrypted {
+		if peer.HasFeature(FeatureEncryptedDM) || peer.HasFeature(FeatureRatchet) {
+			return "", ErrPlaintextDM
+		}
+		return dm.Content, nil
+	}
+	
+	sender, err := hex.DecodeString(peer.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(dm.Content)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted dm: %v", err)
+	}
+	
+	var plaintext []byte
+	if dm.Ratchet != nil {
+		plaintext, err = n.openRatchetDM(sender, dm, sealed)
+	} else {
+		plaintext, err = n.cryptoManager.OpenDM(sender, sealed)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt dm: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// SendDM encrypts a direct message for a peer and keeps our own copy. It is
+// sealed on a ratchet session, and waits in the outbound queue while the
+// peer is offline or until we have its prekeys.
+func (n *Node) SendDM(peerID, content string) (*types.Message, error) {
+	key, err := recipientKey(peerID)
+	if err != nil {
+		return nil, err
+	}
+	peerID = hex.EncodeToString(key)
+	
+	// A peer that completed the handshake without the feature could not read it
+	n.mu.RLock()
+	peer, known := n.peers[peerID]
+	unsupported := known && peer.Version != "" && !peer.HasFeature(FeatureEncryptedDM)
+	n.mu.RUnlock()
+	if unsupported {
+		return nil, ErrPlaintextDMUnsupported
+	}
+	
+	// Without the peer's prekeys it waits in the queue to be sealed
+	payload, err := n.sealRatchetDM(peerID, key, content)
+	unsealed := err == ErrNoPrekeyBundle
+	if unsealed {
+		payload = DMPayload{Content: content}
+	} else if err != nil {
+		return nil, err
+	}
+	
+	msg := NewProtocolMessage(MessageTypeDM, n.ID, generateMessageID())
+	msg.To = peerID
+	msg.SetPayload(payload)
+	
+	message := &types.Message{
+		ID:        msg.MessageID,
+		RoomID:    dmRoomID(base58.Encode(key)),
+		UserID:    n.cryptoManager.GetPublicKeyBase58(),
+		Username:  n.cryptoManager.GetNickname(),
+		Content:   content,
+		Type:      types.MessageTypeDM,
+		Encrypted: true,
+		Timestamp: time.Unix(msg.Timestamp, 0),
+	}
+	if err := message.Sign(n.cryptoManager.GetPrivateKey()); err != nil {
+		return nil, err
+	}
+	if err := verifyMessageSignature(message); err != nil {
+		return nil, err
+	}
+	if err := n.roomManager.db.SaveMessage(message); err != nil {
+		return nil, err
+	}
+	
+	if unsealed {
+		return message, n.enqueueUnsealed(peerID, msg)
+	}
+	return message, n.SendToPeer(peerID, msg)
+}
+
+// handleSendDM sends a direct message from the local identity to a peer
+// named by its hex node ID or base58 user ID. The conversation is read
+// through /api/messages with the room ID dm-<user ID>.
+func (s *Server) handleSendDM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		Recipient string `json:"recipient"`
+		Content   string `json:"content"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	if _, err := recipientKey(req.Recipient); err != nil {
+		http.Error(w, "Recipient must be a public key", http.StatusBadRequest)
+		return
+	}
+	
+	content, err := cleanMessageContent(req.Content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	message, err := s.node.SendDM(req.Recipient, content)
+	if err == ErrPlaintextDMUnsupported {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to send direct message: %v", err)
+		http.Error(w, "Failed to send direct message", http.StatusInternalServerError)
+		return
+	}
+	s.hub.noteRoomSeq(message.RoomID, message.Seq)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+} 
\ No newline at end of file
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultGossipFanout is how many room peers each node passes a message to
+	DefaultGossipFanout = 4
+	
+	// DefaultGossipTTL is how many hops a room message may travel
+	DefaultGossipTTL = 4
+	
+	// MaxGossipTTL caps the hop count a relay will honour, since the TTL is
+	// not covered by the author's signature
+	MaxGossipTTL = 8
+)
+
+// SetGossip configures the room gossip fan-out and hop count. Values of
+// zero or less keep the defaults.
+func (n *Node) SetGossip(fanout, ttl int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	
+	if fanout > 0 {
+		n.gossipFanout = fanout
+	}
+	if ttl > 0 {
+		if ttl > MaxGossipTTL {
+			ttl = MaxGossipTTL
+		}
+		n.gossipTTL = ttl
+	}
+}
+
+func (n *Node) gossipParams() (int, int) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.gossipFanout, n.gossipTTL
+}
+
+// BroadcastToRoom signs msg and gossips it to peers that announced its room.
+// Peers outside the room never see it.
+func (n *Node) BroadcastToRoom(msg *ProtocolMessage) error {
+	fanout, ttl := n.gossipParams()
+	msg.TTL = ttl
+	
+	if err := msg.Sign(n.cryptoManager.GetPrivateKey()); err != nil {
+		return err
+	}
+	
+	data, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	
+	// Copies relayed back to us are dropped as already seen
+	n.replay.Remember(msg.From+":"+msg.MessageID, msg.Timestamp, time.Now())
+	
+	n.gossip(msg.RoomID, data, msg.Version, fanout, msg.From)
+	
+	// Peers that cannot take the relayed frame, without gossip or in an
+	// older version, get a direct copy from the author in their own version
+	for _, peer := range n.peersInRoom(msg.RoomID) {
+		if takesGossip(peer, msg.Version) {
+			continue
+		}
+		direct := *msg
+		direct.TTL = 0
+		go func(p Peer, m *ProtocolMessage) {
+			if err := n.signAndSend(&p, m); err != nil {
+				log.Printf("Failed to send to peer %s: %v", shortKey(p.ID), err)
+			}
+		}(peer, &direct)
+	}
+	
+	return nil
+}
+
+// forwardGossip relays an accepted room message with one hop less
+func (n *Node) forwardGossip(msg *ProtocolMessage) {
+	if msg.RoomID == "" || msg.TTL <= 1 {
+		return
+	}
+	
+	fanout, _ := n.gossipParams()
+	
+	relay := *msg
+	relay.TTL = msg.TTL - 1
+	if relay.TTL > MaxGossipTTL {
+		relay.TTL = MaxGossipTTL
+	}
+	
+	data, err := relay.ToJSON()
+	if err != nil {
+		log.Printf("Failed to encode %s message for relay: %v", msg.Type, err)
+		return
+	}
+	
+	n.gossip(msg.RoomID, data, msg.Version, fanout, msg.From)
+}
+
+// takesGossip reports whether a peer accepts relayed frames in a version
+func takesGossip(peer Peer, version string) bool {
+	return peer.HasFeature(FeatureGossip) && !versionLess(peer.wireVersion(), version)
+}
+
+// gossip sends a frame to a random subset of the room's peers that take
+// gossip in the frame's version, skipping the message author
+func (n *Node) gossip(roomID string, data []byte, version string, fanout int, author string) {
+	var targets []Peer
+	for _, peer := range n.peersInRoom(roomID) {
+		if peer.ID == author || !takesGossip(peer, version) {
+			continue
+		}
+		targets = append(targets, peer)
+	}
+	
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	if len(targets) > fanout {
+		targets = targets[:fanout]
+	}
+	
+	for _, peer := range targets {
+		go func(p Peer) {
+			if err := n.sendToPeer(&p, data); err != nil {
+				log.Printf("Failed to gossip to peer %s: %v", shortKey(p.ID), err)
+			}
+		}(peer)
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,270 @@
+package main
+
+import "sync"
+
+// wsHub owns the WebSocket clients and their room subscriptions. Only the
+// run goroutine touches them; everything else asks it over channels, as in
+// the gorilla/websocket chat example. The hub alone closes a client's send
+// channel, so nothing can send on it afterwards.
+type wsHub struct {
+	clients       map[*WSClient]bool
+	rooms         map[string]map[*WSClient]bool // subscribers by room ID
+	register      chan *WSClient
+	unregister    chan *WSClient
+	broadcast     chan *wsEnvelope
+	subscriptions chan *wsSubscription
+	stats         chan chan wsHubStats
+	done          chan struct{}
+	
+	// onRemove, if set, is called in its own goroutine with each client
+	// the hub lets go and the rooms it was subscribed to
+	onRemove func(client *WSClient, rooms []string)
+	
+	// Latest message sequence number by room, as seen in events, so events
+	// without a message need not ask the database. The goroutines stamping
+	// events share it, under its own lock.
+	seqs   map[string]int64
+	seqsMu sync.Mutex
+}
+
+// wsEnvelope is an encoded event for one client, for the subscribers of a
+// room or, with neither set, for every authenticated client
+type wsEnvelope struct {
+	client  *WSClient
+	roomID  string
+	exclude *WSClient
+	data    []byte
+}
+
+type wsSubscriptionOp int
+
+const (
+	wsSubscribe wsSubscriptionOp = iota
+	wsUnsubscribe
+	wsCheck
+)
+
+type wsSubscription struct {
+	op      wsSubscriptionOp
+	client  *WSClient
+	roomIDs []string
+	reply   chan wsSubscriptionResult
+}
+
+// wsSubscriptionResult lists which of the requested rooms the client holds
+// after the request, and which of them it changed
+type wsSubscriptionResult struct {
+	held    []string
+	changed []string
+}
+
+type wsHubStats struct {
+	clients int
+	rooms   map[string]int // subscribers by room ID
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		clients:       make(map[*WSClient]bool),
+		rooms:         make(map[string]map[*WSClient]bool),
+		register:      make(chan *WSClient),
+		unregister:    make(chan *WSClient),
+		broadcast:     make(chan *wsEnvelope, 256),
+		subscriptions: make(chan *wsSubscription),
+		stats:         make(chan chan wsHubStats),
+		done:          make(chan struct{}),
+		seqs:          make(map[string]int64),
+	}
+}
+
+func (h *wsHub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+		case client := <-h.unregister:
+			h.remove(client)
+		case envelope := <-h.broadcast:
+			h.deliver(envelope)
+		case request := <-h.subscriptions:
+			request.reply <- h.subscribe(request)
+		case reply := <-h.stats:
+			stats := wsHubStats{clients: len(h.clients), rooms: make(map[string]int)}
+			for roomID, subscribers := range h.rooms {
+				stats.rooms[roomID] = len(subscribers)
+			}
+			reply <- stats
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// stop ends the run goroutine. Requests made afterwards are dropped.
+func (h *wsHub) stop() {
+	close(h.done)
+}
+
+func (h *wsHub) deliver(envelope *wsEnvelope) {
+	switch {
+	case envelope.client != nil:
+		if h.clients[envelope.client] {
+			h.push(envelope.client, envelope.data)
+		}
+	case envelope.roomID != "":
+		for client := range h.rooms[envelope.roomID] {
+			if client != envelope.exclude {
+				h.push(client, envelope.data)
+			}
+		}
+	default:
+		for client := range h.clients {
+			if client != envelope.exclude && client.authenticated.Load() {
+				h.push(client, envelope.data)
+			}
+		}
+	}
+}
+
+// push queues data for a client, dropping the client if its buffer is full
+func (h *wsHub) push(client *WSClient, data []byte) {
+	select {
+	case client.send <- data:
+	default:
+		h.remove(client)
+	}
+}
+
+// remove forgets a client and closes its send channel, so its writer hangs
+// up. The rooms are told through onRemove, as the hub cannot wait on its
+// own channels.
+func (h *wsHub) remove(client *WSClient) {
+	if !h.clients[client] {
+		return
+	}
+	delete(h.clients, client)
+	close(client.send)
+	
+	rooms := make([]string, 0, len(client.rooms))
+	for roomID := range client.rooms {
+		h.unindex(client, roomID)
+		rooms = append(rooms, roomID)
+	}
+	if h.onRemove != nil {
+		go h.onRemove(client, rooms)
+	}
+}
+
+func (h *wsHub) subscribe(request *wsSubscription) wsSubscriptionResult {
+	client := request.client
+	result := wsSubscriptionResult{held: []string{}, changed: []string{}}
+	if !h.clients[client] {
+		return result
+	}
+	
+	for _, roomID := range request.roomIDs {
+		switch request.op {
+		case wsSubscribe:
+			if !client.rooms[roomID] {
+				if len(client.rooms) >= maxWSSubscriptions {
+					continue
+				}
+				client.rooms[roomID] = true
+				if h.rooms[roomID] == nil {
+					h.rooms[roomID] = make(map[*WSClient]bool)
+				}
+				h.rooms[roomID][client] = true
+				result.changed = append(result.changed, roomID)
+			}
+			result.held = append(result.held, roomID)
+		case wsUnsubscribe:
+			if client.rooms[roomID] {
+				h.unindex(client, roomID)
+				result.changed = append(result.changed, roomID)
+			}
+		case wsCheck:
+			if client.rooms[roomID] {
+				result.held = append(result.held, roomID)
+			}
+		}
+	}
+	return result
+}
+
+func (h *wsHub) unindex(client *WSClient, roomID string) {
+	delete(client.rooms, roomID)
+	if subscribers := h.rooms[roomID]; subscribers != nil {
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(h.rooms, roomID)
+		}
+	}
+}
+
+// roomSeq returns the latest sequence number seen in a room, if any
+func (h *wsHub) roomSeq(roomID string) (int64, bool) {
+	h.seqsMu.Lock()
+	defer h.seqsMu.Unlock()
+	seq, ok := h.seqs[roomID]
+	return seq, ok
+}
+
+// noteRoomSeq records seq as reached in a room unless a later one was, and
+// returns the latest
+func (h *wsHub) noteRoomSeq(roomID string, seq int64) int64 {
+	h.seqsMu.Lock()
+	defer h.seqsMu.Unlock()
+	
+	if latest, ok := h.seqs[roomID]; !ok || seq > latest {
+		h.seqs[roomID] = seq
+	}
+	return h.seqs[roomID]
+}
+
+// The methods below are for other goroutines
+
+func (h *wsHub) add(client *WSClient) {
+	select {
+	case h.register <- client:
+	case <-h.done:
+	}
+}
+
+func (h *wsHub) drop(client *WSClient) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+func (h *wsHub) send(envelope *wsEnvelope) {
+	select {
+	case h.broadcast <- envelope:
+	case <-h.done:
+	}
+}
+
+func (h *wsHub) request(op wsSubscriptionOp, client *WSClient, roomIDs []string) wsSubscriptionResult {
+	request := &wsSubscription{
+		op:      op,
+		client:  client,
+		roomIDs: roomIDs,
+		reply:   make(chan wsSubscriptionResult, 1),
+	}
+	select {
+	case h.subscriptions <- request:
+		return <-request.reply
+	case <-h.done:
+		return wsSubscriptionResult{}
+	}
+}
+
+func (h *wsHub) snapshot() wsHubStats {
+	reply := make(chan wsHubStats, 1)
+	select {
+	case h.stats <- reply:
+		return <-reply
+	case <-h.done:
+		return wsHubStats{}
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/gorilla/websocket"
+)
+
+// TestHubStress churns thousands of clients through the hub while rooms
+// and everyone are broadcast to. Some clients never read, so the hub drops
+// them as slow while they are still subscribing and leaving. Run with -race.
+func TestHubStress(t *testing.T) {
+	hub := newWSHub()
+	go hub.run()
+	defer hub.stop()
+	
+	const clients = 5000
+	rooms := []string{"room-0", "room-1", "room-2", "room-3"}
+	
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		broadcasters.Add(1)
+		go func(i int) {
+			defer broadcasters.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				envelope := &wsEnvelope{data: []byte(`{"type":"ping"}`)}
+				if n%2 == 0 {
+					envelope.roomID = rooms[(i+n)%len(rooms)]
+				}
+				hub.send(envelope)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}(i)
+	}
+	
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := &WSClient{
+				userID: fmt.Sprintf("user-%d", i),
+				rooms:  make(map[string]bool),
+				send:   make(chan []byte, 4),
+			}
+			client.authenticated.Store(i%3 != 0)
+			slow := i%5 == 0
+			
+			drained := make(chan struct{})
+			go func() {
+				defer close(drained)
+				if slow {
+					return // left to fill up
+				}
+				for range client.send {
+				}
+			}()
+			
+			hub.add(client)
+			hub.request(wsSubscribe, client, rooms[i%len(rooms):])
+			// More than the buffer holds, for a slow client to be dropped
+			sends := 1
+			if slow {
+				sends = 8
+			}
+			for n := 0; n < sends; n++ {
+				hub.send(&wsEnvelope{client: client, data: []byte(`{"type":"direct"}`)})
+			}
+			hub.request(wsCheck, client, rooms)
+			hub.request(wsUnsubscribe, client, rooms[:1])
+			hub.drop(client)
+			<-drained
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	broadcasters.Wait()
+	
+	stats := hub.snapshot()
+	if stats.clients != 0 || len(stats.rooms) != 0 {
+		t.Errorf("Expected the hub to forget every client, got %d clients in %v", stats.clients, stats.rooms)
+	}
+}
+
+// TestWebSocketChurn opens and abandons thousands of real connections,
+// authenticating, subscribing and sending on some, while node events are
+// delivered to every client. Run with -race.
+func TestWebSocketChurn(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	self := server.cryptoManager.GetPublicKeyBase58()
+	room, err := server.roomManager.CreateRoom("General", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	
+	stop := make(chan struct{})
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			server.NotifyRoom(room.ID, map[string]interface{}{"type": "room_synced", "room_id": room.ID})
+			server.NotifyAll(map[string]interface{}{"type": "key_changed"})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	
+	const connections = 2000
+	const workers = 50
+	jobs := make(chan int)
+	errs := make(chan error, connections)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := churnConnection(httpServer.URL, server, room.ID, i); err != nil {
+					errs <- fmt.Errorf("connection %d: %v", i, err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < connections; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(stop)
+	<-notified
+	
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	waitFor(t, "every connection to leave the hub", func() bool {
+		stats := server.hub.snapshot()
+		return stats.clients == 0 && len(stats.rooms) == 0
+	})
+}
+
+// churnConnection connects once and hangs up at a point that depends on i:
+// before authenticating, after subscribing, or after sending a message
+func churnConnection(url string, server *Server, roomID string, i int) error {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	challenge, err := readEvent(conn, "auth_challenge")
+	if err != nil || i%4 == 0 {
+		return err
+	}
+	
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	allowClientKey(server, publicKey)
+	signature := ed25519.Sign(privateKey, wsAuthData(challenge["nonce"].(string), server.node.ID))
+	conn.WriteJSON(map[string]interface{}{
+		"type":       "auth",
+		"username":   fmt.Sprintf("user-%d", i),
+		"public_key": hex.EncodeToString(publicKey),
+		"signature":  hex.EncodeToString(signature),
+	})
+	if _, err := readEvent(conn, "auth_response"); err != nil {
+		return err
+	}
+	
+	conn.WriteJSON(map[string]interface{}{"type": "subscribe", "room_id": roomID})
+	if _, err := readEvent(conn, "subscribed"); err != nil || i%4 == 1 {
+		return err
+	}
+	
+	if i%20 == 2 {
+		conn.WriteJSON(map[string]interface{}{"type": "send_message", "room_id": roomID, "content": "churn"})
+		_, err = readEvent(conn, "message")
+	}
+	return err
+}
+
+// readEvent reads until an event of the given type, skipping broadcasts
+func readEvent(conn *websocket.Conn, eventType string) (map[string]interface{}, error) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				return nil, err
+			}
+			if event["type"] == eventType {
+				return event, nil
+			}
+			if event["type"] == "auth_response" && event["success"] != true {
+				return nil, errors.New("authentication failed")
+			}
+		}
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,428 @@
+package i2p
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeBridge is an in-process SAM bridge that routes streams and datagrams
+// between its own sessions. It lets the I2P code run in tests and on
+// machines without an I2P router.
+type FakeBridge struct {
+	listener net.Listener
+	sessions map[string]*fakeSession
+	names    map[string]string
+	conns    map[net.Conn]bool
+	// MaxVersion caps the version offered during HELLO
+	MaxVersion string
+	// AcceptTimeout bounds how long STREAM CONNECT waits for an ACCEPT
+	AcceptTimeout time.Duration
+	mu            sync.Mutex
+	wg            sync.WaitGroup
+}
+
+type fakeSession struct {
+	id      string
+	style   string
+	keys    *Keys
+	control net.Conn
+	writeMu sync.Mutex
+	acceptQ chan *fakeAcceptor
+	done    chan struct{}
+}
+
+type fakeAcceptor struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewFakeBridge starts a fake bridge on a random loopback port
+func NewFakeBridge() (*FakeBridge, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	
+	bridge := &FakeBridge{
+		listener:      listener,
+		sessions:      make(map[string]*fakeSession),
+		names:         make(map[string]string),
+		conns:         make(map[net.Conn]bool),
+		MaxVersion:    SAMMaxVersion,
+		AcceptTimeout: 5 * time.Second,
+	}
+	
+	bridge.wg.Add(1)
+	go bridge.serve()
+	
+	return bridge, nil
+}
+
+// Addr returns the host:port the bridge listens on
+func (b *FakeBridge) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Host and Port split Addr for use with NewI2PManager
+func (b *FakeBridge) Host() string {
+	host, _, _ := net.SplitHostPort(b.Addr())
+	return host
+}
+
+func (b *FakeBridge) Port() int {
+	_, port, _ := net.SplitHostPort(b.Addr())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// AddName registers a hostname for NAMING LOOKUP
+func (b *FakeBridge) AddName(name, destination string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.names[name] = destination
+}
+
+// Close stops the listener and drops every connection
+func (b *FakeBridge) Close() error {
+	err := b.listener.Close()
+	
+	b.mu.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+	
+	b.wg.Wait()
+	return err
+}
+
+func (b *FakeBridge) serve() {
+	defer b.wg.Done()
+	
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		
+		b.mu.Lock()
+		b.conns[conn] = true
+		b.mu.Unlock()
+		
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.handleConn(conn)
+		}()
+	}
+}
+
+func (b *FakeBridge) forget(conn net.Conn) {
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	conn.Close()
+}
+
+func (b *FakeBridge) handleConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	var session *fakeSession
+	handedOff := false
+	
+	defer func() {
+		if session != nil {
+			b.mu.Lock()
+			delete(b.sessions, session.id)
+			b.mu.Unlock()
+			close(session.done)
+		}
+		if !handedOff {
+			b.forget(conn)
+		}
+	}()
+	
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !b.hello(conn, line) {
+		return
+	}
+	
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		
+		cmd, err := parseReply(line)
+		if err != nil {
+			return
+		}
+		
+		switch cmd.Topic + " " + cmd.Type {
+		case "DEST GENERATE":
+			keys := fakeKeys()
+			fmt.Fprintf(conn, "DEST REPLY PUB=%s PRIV=%s\n", keys.Public, keys.Private)
+		case "NAMING LOOKUP":
+			b.lookup(conn, session, cmd.Pairs["NAME"])
+		case "SESSION CREATE":
+			if session != nil {
+				fmt.Fprintf(conn, "SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"session already created\"\n")
+				continue
+			}
+			session = b.createSession(conn, cmd)
+		case "STREAM ACCEPT":
+			handedOff = b.streamAccept(conn, reader, cmd)
+			if handedOff {
+				return
+			}
+		case "STREAM CONNECT":
+			handedOff = b.streamConnect(conn, reader, cmd)
+			if handedOff {
+				return
+			}
+		case "DATAGRAM SEND":
+			if !b.datagramSend(session, reader, cmd) {
+				return
+			}
+		default:
+			fmt.Fprintf(conn, "%s STATUS RESULT=I2P_ERROR MESSAGE=\"unsupported command\"\n", cmd.Topic)
+		}
+	}
+}
+
+func (b *FakeBridge) hello(conn net.Conn, line string) bool {
+	cmd, err := parseReply(line)
+	if err != nil || cmd.Topic != "HELLO" || cmd.Type != "VERSION" {
+		fmt.Fprintf(conn, "HELLO REPLY RESULT=I2P_ERROR MESSAGE=\"expected HELLO\"\n")
+		return false
+	}
+	
+	min := cmd.Pairs["MIN"]
+	if min == "" {
+		min = SAMMinVersion
+	}
+	max := cmd.Pairs["MAX"]
+	if max == "" || max > b.MaxVersion {
+		max = b.MaxVersion
+	}
+	
+	// Versions are single digit "3.x" strings, so lexical order works
+	if min > max || max < SAMMinVersion {
+		fmt.Fprintf(conn, "HELLO REPLY RESULT=NOVERSION\n")
+		return false
+	}
+	
+	fmt.Fprintf(conn, "HELLO REPLY RESULT=OK VERSION=%s\n", max)
+	return true
+}
+
+func (b *FakeBridge) lookup(conn net.Conn, session *fakeSession, name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	value := ""
+	switch {
+	case name == "ME" && session != nil:
+		value = session.keys.Public
+	case strings.HasSuffix(name, ".b32.i2p"):
+		for _, s := range b.sessions {
+			if s.keys.Base32() == name {
+				value = s.keys.Public
+				break
+			}
+		}
+	case strings.HasSuffix(name, ".i2p"):
+		value = b.names[name]
+	default:
+		if _, err := I2PEncoding.DecodeString(name); err == nil {
+			value = name
+		}
+	}
+	
+	if value == "" {
+		fmt.Fprintf(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME=%s\n", name)
+		return
+	}
+	fmt.Fprintf(conn, "NAMING REPLY RESULT=OK NAME=%s VALUE=%s\n", name, value)
+}
+
+func (b *FakeBridge) createSession(conn net.Conn, cmd *samReply) *fakeSession {
+	id := cmd.Pairs["ID"]
+	style := cmd.Pairs["STYLE"]
+	if id == "" || (style != StyleStream && style != StyleDatagram) {
+		fmt.Fprintf(conn, "SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"invalid session parameters\"\n")
+		return nil
+	}
+	
+	var keys *Keys
+	if dest := cmd.Pairs["DESTINATION"]; dest == "TRANSIENT" || dest == "" {
+		keys = fakeKeys()
+	} else {
+		parsed, err := KeysFromPrivate(dest)
+		if err != nil {
+			fmt.Fprintf(conn, "SESSION STATUS RESULT=INVALID_KEY\n")
+			return nil
+		}
+		keys = parsed
+	}
+	
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	if _, exists := b.sessions[id]; exists {
+		fmt.Fprintf(conn, "SESSION STATUS RESULT=DUPLICATED_ID\n")
+		return nil
+	}
+	for _, s := range b.sessions {
+		if s.keys.Public == keys.Public {
+			fmt.Fprintf(conn, "SESSION STATUS RESULT=DUPLICATED_DEST\n")
+			return nil
+		}
+	}
+	
+	session := &fakeSession{
+		id:      id,
+		style:   style,
+		keys:    keys,
+		control: conn,
+		acceptQ: make(chan *fakeAcceptor, 16),
+		done:    make(chan struct{}),
+	}
+	b.sessions[id] = session
+	
+	fmt.Fprintf(conn, "SESSION STATUS RESULT=OK DESTINATION=%s\n", keys.Private)
+	return session
+}
+
+func (b *FakeBridge) findSession(id string) *fakeSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sessions[id]
+}
+
+func (b *FakeBridge) findDestination(dest string) *fakeSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	for _, s := range b.sessions {
+		if s.keys.Public == dest {
+			return s
+		}
+	}
+	return nil
+}
+
+func (b *FakeBridge) streamAccept(conn net.Conn, reader *bufio.Reader, cmd *samReply) bool {
+	session := b.findSession(cmd.Pairs["ID"])
+	if session == nil || session.style != StyleStream {
+		fmt.Fprintf(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+		return false
+	}
+	
+	fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+	
+	select {
+	case session.acceptQ <- &fakeAcceptor{conn: conn, reader: reader}:
+		return true
+	case <-session.done:
+		return false
+	}
+}
+
+func (b *FakeBridge) streamConnect(conn net.Conn, reader *bufio.Reader, cmd *samReply) bool {
+	source := b.findSession(cmd.Pairs["ID"])
+	if source == nil || source.style != StyleStream {
+		fmt.Fprintf(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+		return false
+	}
+	
+	target := b.findDestination(cmd.Pairs["DESTINATION"])
+	if target == nil || target.style != StyleStream {
+		fmt.Fprintf(conn, "STREAM STATUS RESULT=CANT_REACH_PEER\n")
+		return false
+	}
+	
+	var acceptor *fakeAcceptor
+	select {
+	case acceptor = <-target.acceptQ:
+	case <-target.done:
+	case <-time.After(b.AcceptTimeout):
+	}
+	if acceptor == nil {
+		fmt.Fprintf(conn, "STREAM STATUS RESULT=TIMEOUT\n")
+		return false
+	}
+	
+	fmt.Fprintf(conn, "STREAM STATUS RESULT=OK\n")
+	fmt.Fprintf(acceptor.conn, "%s FROM_PORT=0 TO_PORT=0\n", source.keys.Public)
+	
+	b.wg.Add(2)
+	go b.pipe(acceptor.conn, reader, conn)
+	go b.pipe(conn, acceptor.reader, acceptor.conn)
+	
+	return true
+}
+
+// pipe copies one direction of a stream and closes both ends when done
+func (b *FakeBridge) pipe(dst net.Conn, src io.Reader, srcConn net.Conn) {
+	defer b.wg.Done()
+	
+	io.Copy(dst, src)
+	b.forget(dst)
+	b.forget(srcConn)
+}
+
+func (b *FakeBridge) datagramSend(session *fakeSession, reader *bufio.Reader, cmd *samReply) bool {
+	size, err := strconv.Atoi(cmd.Pairs["SIZE"])
+	if err != nil || size < 0 || size > MaxDatagramSize {
+		return false
+	}
+	
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return false
+	}
+	
+	if session == nil || session.style != StyleDatagram {
+		return true
+	}
+	
+	target := b.findDestination(cmd.Pairs["DESTINATION"])
+	if target == nil || target.style != StyleDatagram {
+		// Undeliverable datagrams are silently dropped, as on the real network
+		return true
+	}
+	
+	target.writeMu.Lock()
+	defer target.writeMu.Unlock()
+	
+	header := fmt.Sprintf("DATAGRAM RECEIVED DESTINATION=%s SIZE=%d\n", session.keys.Public, size)
+	target.control.Write(append([]byte(header), data...))
+	
+	return true
+}
+
+// fakeKeys builds a structurally valid destination with a key certificate
+// for Ed25519; the key material itself is random
+func fakeKeys() *Keys {
+	dest := make([]byte, 384, 391+256+32)
+	rand.Read(dest)
+	dest = append(dest, 5, 0, 4, 0, 7, 0, 0)
+	
+	private := make([]byte, 256+32)
+	rand.Read(private)
+	
+	return &Keys{
+		Public:  I2PEncoding.EncodeToString(dest),
+		Private: I2PEncoding.EncodeToString(append(dest, private...)),
+	}
+} 
\ No newline at end of file
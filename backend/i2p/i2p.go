@@ -0,0 +1,225 @@
+package i2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	StatusDisconnected = "disconnected"
+	StatusConnecting   = "connecting"
+	StatusConnected    = "connected"
+	StatusError        = "error"
+)
+
+// Status is reported by the admin I2P status endpoint
+type Status struct {
+	Status     string `json:"status"`
+	Address    string `json:"address,omitempty"`
+	SAMAddress string `json:"sam_address"`
+	SAMVersion string `json:"sam_version,omitempty"`
+	SessionID  string `json:"session_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// I2PManager owns the node's stream session on the local SAM bridge
+type I2PManager struct {
+	samAddress string
+	keys       *Keys
+	session    *StreamSession
+	version    string
+	status     string
+	lastError  string
+	mu         sync.RWMutex
+}
+
+func NewI2PManager(samAddress string, samPort int) *I2PManager {
+	return &I2PManager{
+		samAddress: net.JoinHostPort(samAddress, strconv.Itoa(samPort)),
+		status:     StatusDisconnected,
+	}
+}
+
+// SetDestination loads a previously persisted private destination so the
+// node keeps the same address across restarts
+func (m *I2PManager) SetDestination(private string) error {
+	keys, err := KeysFromPrivate(private)
+	if err != nil {
+		return err
+	}
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.keys = keys
+	return nil
+}
+
+// Destination returns the private destination for persisting into the
+// config, or an empty string if none has been generated yet
+func (m *I2PManager) Destination() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	if m.keys == nil {
+		return ""
+	}
+	return m.keys.Private
+}
+
+// Base32Address returns the node's .b32.i2p address
+func (m *I2PManager) Base32Address() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	if m.keys == nil {
+		return ""
+	}
+	return m.keys.Base32()
+}
+
+// Connect negotiates with the bridge, generates a destination if none was
+// configured and opens the stream session. Creating a session can take
+// the bridge a minute, so the lock is only taken to publish the result.
+func (m *I2PManager) Connect() error {
+	m.mu.Lock()
+	if m.session != nil {
+		m.mu.Unlock()
+		return errors.New("already connected to I2P")
+	}
+	if m.status == StatusConnecting {
+		m.mu.Unlock()
+		return errors.New("already connecting to I2P")
+	}
+	m.status = StatusConnecting
+	keys := m.keys
+	m.mu.Unlock()
+	
+	client, err := DialSAM(m.samAddress)
+	if err != nil {
+		return m.fail(err)
+	}
+	
+	generated := keys == nil
+	if generated {
+		if keys, err = client.GenerateDestination(); err != nil {
+			client.Close()
+			return m.fail(err)
+		}
+	}
+	
+	session, err := client.NewStreamSession(newSessionID(), keys, nil)
+	if err != nil {
+		client.Close()
+		return m.fail(err)
+	}
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	// Disconnect was called while the session was being created
+	if m.status != StatusConnecting {
+		session.Close()
+		return errors.New("i2p connect cancelled")
+	}
+	
+	if generated {
+		log.Printf("Generated new I2P destination: %s", keys.Base32())
+	}
+	m.keys = keys
+	m.session = session
+	m.version = client.Version()
+	m.status = StatusConnected
+	m.lastError = ""
+	
+	return nil
+}
+
+func (m *I2PManager) fail(err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	// A Disconnect in the meantime leaves the manager disconnected
+	if m.status == StatusConnecting {
+		m.status = StatusError
+		m.lastError = err.Error()
+	}
+	return fmt.Errorf("i2p connect failed: %v", err)
+}
+
+func (m *I2PManager) Disconnect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	m.status = StatusDisconnected
+	if m.session == nil {
+		return nil
+	}
+	
+	err := m.session.Close()
+	m.session = nil
+	return err
+}
+
+// Session returns the active stream session, or nil when disconnected
+func (m *I2PManager) Session() *StreamSession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.session
+}
+
+// NewDatagramSession opens a separate datagram session on a transient
+// destination, since SAM 3.1 allows one session per destination
+func (m *I2PManager) NewDatagramSession() (*DatagramSession, error) {
+	client, err := DialSAM(m.samAddress)
+	if err != nil {
+		return nil, err
+	}
+	
+	session, err := client.NewDatagramSession(newSessionID(), nil, nil)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	
+	return session, nil
+}
+
+func (m *I2PManager) IsConnected() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.session != nil
+}
+
+func (m *I2PManager) GetStatus() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	status := Status{
+		Status:     m.status,
+		SAMAddress: m.samAddress,
+		SAMVersion: m.version,
+		Error:      m.lastError,
+	}
+	
+	if m.keys != nil {
+		status.Address = m.keys.Base32()
+	}
+	if m.session != nil {
+		status.SessionID = m.session.ID()
+	}
+	
+	return status
+}
+
+func newSessionID() string {
+	bytes := make([]byte, 6)
+	rand.Read(bytes)
+	return "ripcord-" + hex.EncodeToString(bytes)
+} 
\ No newline at end of file
@@ -0,0 +1,318 @@
+package i2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBridge(t *testing.T) *FakeBridge {
+	t.Helper()
+	
+	bridge, err := NewFakeBridge()
+	if err != nil {
+		t.Fatalf("Failed to start fake bridge: %v", err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	
+	return bridge
+}
+
+func TestParseReply(t *testing.T) {
+	reply, err := parseReply("SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"tunnel build failed\"\n")
+	if err != nil {
+		t.Fatalf("Failed to parse reply: %v", err)
+	}
+	
+	if reply.Topic != "SESSION" || reply.Type != "STATUS" {
+		t.Errorf("Expected SESSION STATUS, got %s %s", reply.Topic, reply.Type)
+	}
+	
+	if reply.Pairs["MESSAGE"] != "tunnel build failed" {
+		t.Errorf("Expected quoted message to be unquoted, got '%s'", reply.Pairs["MESSAGE"])
+	}
+	
+	var samErr *SAMError
+	if !errors.As(reply.err("SESSION CREATE"), &samErr) || samErr.Result != "I2P_ERROR" {
+		t.Errorf("Expected SAMError with I2P_ERROR, got %v", reply.err("SESSION CREATE"))
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	bridge := newTestBridge(t)
+	
+	client, err := DialSAM(bridge.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial bridge: %v", err)
+	}
+	defer client.Close()
+	
+	if client.Version() != SAMMaxVersion {
+		t.Errorf("Expected version %s, got %s", SAMMaxVersion, client.Version())
+	}
+	
+	bridge.MaxVersion = "3.0"
+	old, err := DialSAM(bridge.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial 3.0 bridge: %v", err)
+	}
+	defer old.Close()
+	
+	if old.Version() != "3.0" {
+		t.Errorf("Expected version 3.0, got %s", old.Version())
+	}
+}
+
+func TestKeysFromPrivate(t *testing.T) {
+	bridge := newTestBridge(t)
+	
+	client, err := DialSAM(bridge.Addr())
+	if err != nil {
+		t.Fatalf("Failed to dial bridge: %v", err)
+	}
+	defer client.Close()
+	
+	keys, err := client.GenerateDestination()
+	if err != nil {
+		t.Fatalf("Failed to generate destination: %v", err)
+	}
+	
+	parsed, err := KeysFromPrivate(keys.Private)
+	if err != nil {
+		t.Fatalf("Failed to parse private keys: %v", err)
+	}
+	
+	if parsed.Public != keys.Public {
+		t.Error("Expected public destination to be recovered from private keys")
+	}
+	
+	if !strings.HasSuffix(parsed.Base32(), ".b32.i2p") || len(parsed.Base32()) != 60 {
+		t.Errorf("Unexpected b32 address: %s", parsed.Base32())
+	}
+}
+
+func TestStreamConnectAccept(t *testing.T) {
+	bridge := newTestBridge(t)
+	
+	server := NewI2PManager(bridge.Host(), bridge.Port())
+	if err := server.Connect(); err != nil {
+		t.Fatalf("Failed to connect server: %v", err)
+	}
+	defer server.Disconnect()
+	
+	client := NewI2PManager(bridge.Host(), bridge.Port())
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Disconnect()
+	
+	accepted := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Session().Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		defer conn.Close()
+		
+		if conn.RemoteAddr().String() != client.Base32Address() {
+			accepted <- nil
+			return
+		}
+		
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+		conn.Write([]byte("pong"))
+		accepted <- buf
+	}()
+	
+	conn, err := client.Session().Dial(server.Base32Address())
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	
+	conn.Write([]byte("ping!"))
+	
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if string(reply) != "pong" {
+		t.Errorf("Expected 'pong', got '%s'", reply)
+	}
+	
+	select {
+	case got := <-accepted:
+		if string(got) != "ping!" {
+			t.Errorf("Expected server to read 'ping!', got '%s'", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for accepted stream")
+	}
+}
+
+func TestPersistedDestination(t *testing.T) {
+	bridge := newTestBridge(t)
+	
+	first := NewI2PManager(bridge.Host(), bridge.Port())
+	if err := first.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	saved := first.Destination()
+	address := first.Base32Address()
+	first.Disconnect()
+	
+	second := NewI2PManager(bridge.Host(), bridge.Port())
+	if err := second.SetDestination(saved); err != nil {
+		t.Fatalf("Failed to load destination: %v", err)
+	}
+	
+	// The bridge drops the first session asynchronously once its socket closes
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = second.Connect(); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to reconnect with saved destination: %v", err)
+	}
+	defer second.Disconnect()
+	
+	if second.Base32Address() != address {
+		t.Errorf("Expected address %s to survive restart, got %s", address, second.Base32Address())
+	}
+	
+	status := second.GetStatus()
+	if status.Status != StatusConnected || status.Address != address {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestStatusWhileConnecting(t *testing.T) {
+	// A bridge that accepts but never answers HELLO
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	
+	address := listener.Addr().(*net.TCPAddr)
+	manager := NewI2PManager(address.IP.String(), address.Port)
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Connect()
+	}()
+	
+	var stalled net.Conn
+	select {
+	case stalled = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the bridge connection")
+	}
+	
+	status := make(chan Status, 1)
+	go func() {
+		status <- manager.GetStatus()
+	}()
+	select {
+	case got := <-status:
+		if got.Status != StatusConnecting {
+			t.Errorf("Expected status %s, got %s", StatusConnecting, got.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetStatus blocked while connecting")
+	}
+	
+	if err := manager.Connect(); err == nil {
+		t.Error("Expected a second Connect to fail while connecting")
+	}
+	
+	stalled.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected Connect to fail when the bridge hangs up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect did not return after the bridge hung up")
+	}
+	if got := manager.GetStatus(); got.Status != StatusError || got.Error == "" {
+		t.Errorf("Expected the failure in the status, got %+v", got)
+	}
+}
+
+func TestNamingLookup(t *testing.T) {
+	bridge := newTestBridge(t)
+	
+	manager := NewI2PManager(bridge.Host(), bridge.Port())
+	if err := manager.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer manager.Disconnect()
+	
+	session := manager.Session()
+	bridge.AddName("ripcord.i2p", session.Keys().Public)
+	
+	dest, err := session.Lookup("ripcord.i2p")
+	if err != nil || dest != session.Keys().Public {
+		t.Errorf("Expected hostname lookup to return session destination, got %v", err)
+	}
+	
+	dest, err = session.Lookup(manager.Base32Address())
+	if err != nil || dest != session.Keys().Public {
+		t.Errorf("Expected b32 lookup to return session destination, got %v", err)
+	}
+	
+	_, err = session.Lookup("missing.i2p")
+	var samErr *SAMError
+	if !errors.As(err, &samErr) || samErr.Result != "KEY_NOT_FOUND" {
+		t.Errorf("Expected KEY_NOT_FOUND, got %v", err)
+	}
+}
+
+func TestDatagramSession(t *testing.T) {
+	bridge := newTestBridge(t)
+	manager := NewI2PManager(bridge.Host(), bridge.Port())
+	
+	alice, err := manager.NewDatagramSession()
+	if err != nil {
+		t.Fatalf("Failed to create datagram session: %v", err)
+	}
+	defer alice.Close()
+	
+	bob, err := manager.NewDatagramSession()
+	if err != nil {
+		t.Fatalf("Failed to create datagram session: %v", err)
+	}
+	defer bob.Close()
+	
+	payload := []byte("hello\nover datagrams")
+	if err := alice.WriteTo(payload, bob.Keys().Public); err != nil {
+		t.Fatalf("Failed to send datagram: %v", err)
+	}
+	
+	got, err := bob.Read()
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	
+	if !bytes.Equal(got.Data, payload) {
+		t.Errorf("Expected payload %q, got %q", payload, got.Data)
+	}
+	if string(got.From) != alice.Keys().Public {
+		t.Error("Expected datagram to carry sender destination")
+	}
+} 
\ No newline at end of file
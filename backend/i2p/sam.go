@@ -0,0 +1,322 @@
+package i2p
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	SAMMinVersion = "3.0"
+	SAMMaxVersion = "3.1"
+	
+	// SignatureTypeEd25519 is the SAM name for EdDSA_SHA512_Ed25519 (type 7)
+	SignatureTypeEd25519 = "EdDSA_SHA512_Ed25519"
+	
+	samDialTimeout  = 10 * time.Second
+	samReplyTimeout = 60 * time.Second
+)
+
+// I2P uses a modified base64 alphabet with '-' and '~' instead of '+' and '/'
+var I2PEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+var b32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SAMError is returned when the bridge answers a command with RESULT other than OK
+type SAMError struct {
+	Command string
+	Result  string
+	Message string
+}
+
+func (e *SAMError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("sam %s failed: %s (%s)", e.Command, e.Result, e.Message)
+	}
+	return fmt.Sprintf("sam %s failed: %s", e.Command, e.Result)
+}
+
+// Keys holds a destination as returned by DEST GENERATE or SESSION CREATE
+type Keys struct {
+	Public  string `json:"public"`
+	Private string `json:"private"`
+}
+
+// KeysFromPrivate rebuilds Keys from a base64 private key blob, which
+// always starts with the public destination
+func KeysFromPrivate(private string) (*Keys, error) {
+	raw, err := I2PEncoding.DecodeString(private)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private destination: %v", err)
+	}
+	
+	destLen, err := destinationLength(raw)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &Keys{
+		Public:  I2PEncoding.EncodeToString(raw[:destLen]),
+		Private: private,
+	}, nil
+}
+
+// Base32 returns the .b32.i2p address of the public destination
+func (k *Keys) Base32() string {
+	addr, err := Base32Address(k.Public)
+	if err != nil {
+		return ""
+	}
+	return addr
+}
+
+// destinationLength parses the certificate header to find where the
+// public destination ends: 256 byte public key, 128 byte signing key,
+// then a certificate of type(1) length(2) payload(length)
+func destinationLength(raw []byte) (int, error) {
+	if len(raw) < 387 {
+		return 0, errors.New("destination too short")
+	}
+	
+	certLen := int(raw[385])<<8 | int(raw[386])
+	total := 387 + certLen
+	if len(raw) < total {
+		return 0, errors.New("destination certificate truncated")
+	}
+	
+	return total, nil
+}
+
+// Base32Address converts a base64 destination into its b32 hostname
+func Base32Address(dest string) (string, error) {
+	raw, err := I2PEncoding.DecodeString(dest)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination: %v", err)
+	}
+	
+	hash := sha256.Sum256(raw)
+	return strings.ToLower(b32Encoding.EncodeToString(hash[:])) + ".b32.i2p", nil
+}
+
+// samReply is a parsed SAM response line such as
+// "HELLO REPLY RESULT=OK VERSION=3.1"
+type samReply struct {
+	Topic string
+	Type  string
+	Pairs map[string]string
+}
+
+func (r *samReply) result() string {
+	return r.Pairs["RESULT"]
+}
+
+func (r *samReply) err(command string) error {
+	if r.result() == "OK" {
+		return nil
+	}
+	return &SAMError{Command: command, Result: r.result(), Message: r.Pairs["MESSAGE"]}
+}
+
+func parseReply(line string) (*samReply, error) {
+	tokens, err := tokenize(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) < 2 {
+		return nil, fmt.Errorf("malformed sam reply: %q", line)
+	}
+	
+	reply := &samReply{
+		Topic: tokens[0],
+		Type:  tokens[1],
+		Pairs: make(map[string]string),
+	}
+	
+	for _, token := range tokens[2:] {
+		key, value, found := strings.Cut(token, "=")
+		if !found {
+			reply.Pairs[key] = ""
+			continue
+		}
+		reply.Pairs[key] = value
+	}
+	
+	return reply, nil
+}
+
+// tokenize splits a SAM line on spaces while honouring double quoted values
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	escaped := false
+	
+	for _, char := range line {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && inQuotes:
+			escaped = true
+		case char == '"':
+			inQuotes = !inQuotes
+		case char == ' ' && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(char)
+		}
+	}
+	
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in sam line: %q", line)
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	
+	return tokens, nil
+}
+
+// SAMClient is a single connection to the SAM bridge that has completed
+// the HELLO handshake
+type SAMClient struct {
+	address string
+	conn    net.Conn
+	reader  *bufio.Reader
+	version string
+}
+
+// DialSAM connects to the bridge at address (host:port) and negotiates
+// a protocol version between SAMMinVersion and SAMMaxVersion
+func DialSAM(address string) (*SAMClient, error) {
+	conn, err := net.DialTimeout("tcp", address, samDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	
+	client := &SAMClient{
+		address: address,
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+	}
+	
+	if err := client.hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	
+	return client, nil
+}
+
+func (c *SAMClient) hello() error {
+	reply, err := c.command("HELLO VERSION MIN=%s MAX=%s", SAMMinVersion, SAMMaxVersion)
+	if err != nil {
+		return err
+	}
+	
+	if reply.Topic != "HELLO" || reply.Type != "REPLY" {
+		return fmt.Errorf("unexpected sam hello reply: %s %s", reply.Topic, reply.Type)
+	}
+	if err := reply.err("HELLO"); err != nil {
+		return err
+	}
+	
+	c.version = reply.Pairs["VERSION"]
+	if c.version == "" {
+		c.version = SAMMinVersion
+	}
+	
+	return nil
+}
+
+// command writes a single line and reads the bridge's reply line
+func (c *SAMClient) command(format string, args ...interface{}) (*samReply, error) {
+	line := fmt.Sprintf(format, args...) + "\n"
+	
+	c.conn.SetDeadline(time.Now().Add(samReplyTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		return nil, err
+	}
+	
+	response, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	
+	return parseReply(response)
+}
+
+// Version returns the SAM version agreed during HELLO
+func (c *SAMClient) Version() string {
+	return c.version
+}
+
+// supportsSignatureType reports whether the negotiated version accepts
+// the SIGNATURE_TYPE option, which was added in 3.1
+func (c *SAMClient) supportsSignatureType() bool {
+	return c.version != "3.0"
+}
+
+// GenerateDestination asks the router for a fresh Ed25519 destination
+func (c *SAMClient) GenerateDestination() (*Keys, error) {
+	cmd := "DEST GENERATE"
+	if c.supportsSignatureType() {
+		cmd += " SIGNATURE_TYPE=" + SignatureTypeEd25519
+	}
+	
+	reply, err := c.command("%s", cmd)
+	if err != nil {
+		return nil, err
+	}
+	
+	if reply.Topic != "DEST" || reply.Type != "REPLY" {
+		return nil, fmt.Errorf("unexpected sam dest reply: %s %s", reply.Topic, reply.Type)
+	}
+	if _, ok := reply.Pairs["RESULT"]; ok {
+		if err := reply.err("DEST GENERATE"); err != nil {
+			return nil, err
+		}
+	}
+	
+	keys := &Keys{
+		Public:  reply.Pairs["PUB"],
+		Private: reply.Pairs["PRIV"],
+	}
+	if keys.Public == "" || keys.Private == "" {
+		return nil, errors.New("sam dest reply missing keys")
+	}
+	
+	return keys, nil
+}
+
+// Lookup resolves a hostname, b32 address or "ME" to a base64 destination
+func (c *SAMClient) Lookup(name string) (string, error) {
+	reply, err := c.command("NAMING LOOKUP NAME=%s", name)
+	if err != nil {
+		return "", err
+	}
+	
+	if reply.Topic != "NAMING" || reply.Type != "REPLY" {
+		return "", fmt.Errorf("unexpected sam naming reply: %s %s", reply.Topic, reply.Type)
+	}
+	if err := reply.err("NAMING LOOKUP"); err != nil {
+		return "", err
+	}
+	
+	return reply.Pairs["VALUE"], nil
+}
+
+func (c *SAMClient) Close() error {
+	return c.conn.Close()
+} 
\ No newline at end of file
@@ -0,0 +1,400 @@
+package i2p
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	StyleStream   = "STREAM"
+	StyleDatagram = "DATAGRAM"
+	
+	// MaxDatagramSize is the largest repliable datagram payload SAM accepts
+	MaxDatagramSize = 31744
+)
+
+var ErrSessionClosed = errors.New("sam session closed")
+
+// Addr is an I2P destination used as a net.Addr
+type Addr string
+
+func (a Addr) Network() string {
+	return "i2p"
+}
+
+func (a Addr) String() string {
+	if addr, err := Base32Address(string(a)); err == nil {
+		return addr
+	}
+	return string(a)
+}
+
+// Conn is a SAM stream that has been connected or accepted. Reads go through
+// the buffered reader used for the handshake so no stream data is lost.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	local  Addr
+	remote Addr
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// StreamSession owns the control socket of a STYLE=STREAM session. The
+// session lives for as long as that socket stays open.
+type StreamSession struct {
+	id      string
+	address string
+	keys    *Keys
+	control *SAMClient
+}
+
+// NewStreamSession turns the client's connection into the control socket
+// of a new stream session. The client must not be used afterwards.
+func (c *SAMClient) NewStreamSession(id string, keys *Keys, options []string) (*StreamSession, error) {
+	resolved, err := c.createSession(StyleStream, id, keys, options)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &StreamSession{
+		id:      id,
+		address: c.address,
+		keys:    resolved,
+		control: c,
+	}, nil
+}
+
+func (c *SAMClient) createSession(style, id string, keys *Keys, options []string) (*Keys, error) {
+	destination := "TRANSIENT"
+	if keys != nil {
+		destination = keys.Private
+	}
+	
+	cmd := fmt.Sprintf("SESSION CREATE STYLE=%s ID=%s DESTINATION=%s", style, id, destination)
+	if keys == nil && c.supportsSignatureType() {
+		cmd += " SIGNATURE_TYPE=" + SignatureTypeEd25519
+	}
+	if len(options) > 0 {
+		cmd += " " + strings.Join(options, " ")
+	}
+	
+	reply, err := c.command("%s", cmd)
+	if err != nil {
+		return nil, err
+	}
+	
+	if reply.Topic != "SESSION" || reply.Type != "STATUS" {
+		return nil, fmt.Errorf("unexpected sam session reply: %s %s", reply.Topic, reply.Type)
+	}
+	if err := reply.err("SESSION CREATE"); err != nil {
+		return nil, err
+	}
+	
+	if keys != nil {
+		return keys, nil
+	}
+	return KeysFromPrivate(reply.Pairs["DESTINATION"])
+}
+
+func (s *StreamSession) ID() string {
+	return s.id
+}
+
+func (s *StreamSession) Keys() *Keys {
+	return s.keys
+}
+
+func (s *StreamSession) Addr() Addr {
+	return Addr(s.keys.Public)
+}
+
+// Lookup resolves a name using a fresh bridge connection, since the control
+// socket is reserved for the session
+func (s *StreamSession) Lookup(name string) (string, error) {
+	client, err := DialSAM(s.address)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	
+	return client.Lookup(name)
+}
+
+// Dial opens a stream to a base64 destination, a b32 address or a hostname
+func (s *StreamSession) Dial(destination string) (net.Conn, error) {
+	if strings.HasSuffix(destination, ".i2p") {
+		resolved, err := s.Lookup(destination)
+		if err != nil {
+			return nil, err
+		}
+		destination = resolved
+	}
+	
+	client, err := DialSAM(s.address)
+	if err != nil {
+		return nil, err
+	}
+	
+	reply, err := client.command("STREAM CONNECT ID=%s DESTINATION=%s SILENT=false", s.id, destination)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := reply.err("STREAM CONNECT"); err != nil {
+		client.Close()
+		return nil, err
+	}
+	
+	return &Conn{
+		Conn:   client.conn,
+		reader: client.reader,
+		local:  s.Addr(),
+		remote: Addr(destination),
+	}, nil
+}
+
+// Accept waits for an incoming stream. Each call uses its own bridge
+// connection, so several goroutines may accept concurrently.
+func (s *StreamSession) Accept() (net.Conn, error) {
+	client, err := DialSAM(s.address)
+	if err != nil {
+		return nil, err
+	}
+	
+	return s.accept(client)
+}
+
+func (s *StreamSession) accept(client *SAMClient) (net.Conn, error) {
+	reply, err := client.command("STREAM ACCEPT ID=%s SILENT=false", s.id)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := reply.err("STREAM ACCEPT"); err != nil {
+		client.Close()
+		return nil, err
+	}
+	
+	// The first line on an accepted stream is the peer destination,
+	// optionally followed by FROM_PORT/TO_PORT on newer bridges
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		client.Close()
+		return nil, errors.New("sam accept missing peer destination")
+	}
+	
+	return &Conn{
+		Conn:   client.conn,
+		reader: client.reader,
+		local:  s.Addr(),
+		remote: Addr(fields[0]),
+	}, nil
+}
+
+// Listen returns a net.Listener whose Close aborts a pending Accept
+func (s *StreamSession) Listen() *Listener {
+	return &Listener{session: s}
+}
+
+// Listener accepts streams on a session one at a time
+type Listener struct {
+	session *StreamSession
+	pending *SAMClient
+	closed  bool
+	mu      sync.Mutex
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	client, err := DialSAM(l.session.address)
+	if err != nil {
+		return nil, err
+	}
+	
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		client.Close()
+		return nil, ErrSessionClosed
+	}
+	l.pending = client
+	l.mu.Unlock()
+	
+	conn, err := l.session.accept(client)
+	
+	l.mu.Lock()
+	l.pending = nil
+	closed := l.closed
+	l.mu.Unlock()
+	
+	if err != nil && closed {
+		return nil, ErrSessionClosed
+	}
+	return conn, err
+}
+
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	
+	l.closed = true
+	if l.pending != nil {
+		return l.pending.Close()
+	}
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.session.Addr()
+}
+
+func (s *StreamSession) Close() error {
+	return s.control.Close()
+}
+
+// Datagram is a repliable datagram received on a DatagramSession
+type Datagram struct {
+	From Addr
+	Data []byte
+}
+
+// DatagramSession exchanges repliable datagrams over the control socket
+// using DATAGRAM SEND and DATAGRAM RECEIVED
+type DatagramSession struct {
+	id       string
+	keys     *Keys
+	control  *SAMClient
+	incoming chan Datagram
+	writeMu  sync.Mutex
+	done     chan struct{}
+	err      error
+}
+
+// NewDatagramSession turns the client's connection into the control socket
+// of a new datagram session. The client must not be used afterwards.
+func (c *SAMClient) NewDatagramSession(id string, keys *Keys, options []string) (*DatagramSession, error) {
+	resolved, err := c.createSession(StyleDatagram, id, keys, options)
+	if err != nil {
+		return nil, err
+	}
+	
+	session := &DatagramSession{
+		id:       id,
+		keys:     resolved,
+		control:  c,
+		incoming: make(chan Datagram, 64),
+		done:     make(chan struct{}),
+	}
+	
+	go session.readLoop()
+	
+	return session, nil
+}
+
+func (d *DatagramSession) readLoop() {
+	defer close(d.done)
+	
+	for {
+		line, err := d.control.reader.ReadString('\n')
+		if err != nil {
+			d.err = err
+			return
+		}
+		
+		reply, err := parseReply(line)
+		if err != nil || reply.Topic != "DATAGRAM" || reply.Type != "RECEIVED" {
+			continue
+		}
+		
+		size, err := strconv.Atoi(reply.Pairs["SIZE"])
+		if err != nil || size < 0 || size > MaxDatagramSize {
+			d.err = fmt.Errorf("invalid datagram size: %q", reply.Pairs["SIZE"])
+			return
+		}
+		
+		data := make([]byte, size)
+		if _, err := io.ReadFull(d.control.reader, data); err != nil {
+			d.err = err
+			return
+		}
+		
+		select {
+		case d.incoming <- Datagram{From: Addr(reply.Pairs["DESTINATION"]), Data: data}:
+		default:
+			// Datagrams are unreliable by design; drop when the reader lags
+		}
+	}
+}
+
+func (d *DatagramSession) ID() string {
+	return d.id
+}
+
+func (d *DatagramSession) Keys() *Keys {
+	return d.keys
+}
+
+func (d *DatagramSession) Addr() Addr {
+	return Addr(d.keys.Public)
+}
+
+// WriteTo sends a datagram to a base64 destination
+func (d *DatagramSession) WriteTo(data []byte, destination string) error {
+	if len(data) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(data))
+	}
+	
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	
+	header := fmt.Sprintf("DATAGRAM SEND DESTINATION=%s SIZE=%d\n", destination, len(data))
+	if _, err := d.control.conn.Write(append([]byte(header), data...)); err != nil {
+		return err
+	}
+	
+	return nil
+}
+
+// Read blocks until a datagram arrives or the session is closed
+func (d *DatagramSession) Read() (Datagram, error) {
+	select {
+	case datagram := <-d.incoming:
+		return datagram, nil
+	case <-d.done:
+		select {
+		case datagram := <-d.incoming:
+			return datagram, nil
+		default:
+		}
+		if d.err != nil && d.err != io.EOF {
+			return Datagram{}, d.err
+		}
+		return Datagram{}, ErrSessionClosed
+	}
+}
+
+func (d *DatagramSession) Close() error {
+	return d.control.Close()
+} 
\ No newline at end of file
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+const (
+	// DefaultInviteTTL is how long an invite lasts when no expiry is given
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	
+	// MaxInviteTTL caps how far ahead an invite can expire
+	MaxInviteTTL = 90 * 24 * time.Hour
+)
+
+var (
+	ErrInviteRole   = errors.New("invites can only grant the member or moderator role")
+	ErrInviteIssuer = errors.New("invite issuer is not a member of the room")
+)
+
+// CreateInvite issues a signed invite to a room we moderate. A ttl of zero
+// uses DefaultInviteTTL, and maxUses of zero allows any number of users.
+func (n *Node) CreateInvite(roomID, role string, maxUses int, ttl time.Duration) (*database.Invite, error) {
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !room.IsModerator(n.cryptoManager.GetPublicKeyBase58()) {
+		return nil, ErrNotRoomModerator
+	}
+	
+	if role == "" {
+		role = RoleMember
+	}
+	if role != RoleMember && role != RoleModerator {
+		return nil, ErrInviteRole
+	}
+	if maxUses < 0 {
+		return nil, errors.New("max uses cannot be negative")
+	}
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl > MaxInviteTTL {
+		ttl = MaxInviteTTL
+	}
+	
+	invite, err := n.cryptoManager.IssueInvite(roomID, role, maxUses, ttl)
+	if err != nil {
+		return nil, err
+	}
+	token, err := invite.Token()
+	if err != nil {
+		return nil, err
+	}
+	
+	record := inviteRecord(invite, token)
+	if err := n.roomManager.db.SaveInvite(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// keepInvitedRoom stores a room a peer sent us an invite to. A signed token
+// is not the room's legacy code, which must be unique among our rooms, so
+// the room gets a code of its own. The sender becomes the member we know of
+// only when the token is theirs.
+func (n *Node) keepInvitedRoom(dbRoom *database.Room, peer Peer) error {
+	invite, err := security.ParseInvite(dbRoom.InviteCode)
+	if err != nil {
+		return n.roomManager.db.SaveRoom(dbRoom)
+	}
+	
+	dbRoom.InviteCode = generateInviteCode()
+	if invite.RoomID != dbRoom.ID || hex.EncodeToString(invite.Issuer) != peer.PublicKey {
+		return n.roomManager.db.SaveRoom(dbRoom)
+	}
+	
+	inviterID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := n.recordUser(inviterID, peer.Nickname, inviterID); err != nil {
+		return err
+	}
+	_, err = n.roomManager.AddInvitedRoom(dbRoom, inviterID, peer.Nickname)
+	return err
+}
+
+// ListInvites returns the invites to a room we know of, with their uses
+func (n *Node) ListInvites(roomID string) ([]*database.Invite, error) {
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !room.IsModerator(n.cryptoManager.GetPublicKeyBase58()) {
+		return nil, ErrNotRoomModerator
+	}
+	
+	return n.roomManager.db.GetInvites(roomID)
+}
+
+// RevokeInvite stops an invite from admitting anyone else, here and at
+// the other members, who are sent the revocation
+func (n *Node) RevokeInvite(roomID, inviteID string) error {
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if !room.IsModerator(n.cryptoManager.GetPublicKeyBase58()) {
+		return ErrNotRoomModerator
+	}
+	
+	invite, err := n.roomManager.db.GetInvite(inviteID)
+	if err != nil {
+		return err
+	}
+	if invite.RoomID != roomID {
+		return database.ErrInviteNotFound
+	}
+	if err := n.roomManager.db.RevokeInvite(inviteID); err != nil {
+		return err
+	}
+	
+	self := n.cryptoManager.GetPublicKeyBase58()
+	for _, userID := range room.GetMembersList() {
+		if userID == self {
+			continue
+		}
+		key, err := recipientKey(userID)
+		if err != nil {
+			continue
+		}
+		
+		msg := NewProtocolMessage(MessageTypeInviteRevoke, n.ID, generateMessageID())
+		msg.To = hex.EncodeToString(key)
+		msg.RoomID = roomID
+		msg.SetPayload(InviteRevokePayload{RoomID: roomID, Token: invite.Token})
+		
+		if err := n.SendToPeer(msg.To, msg); err != nil {
+			log.Printf("Failed to send revocation of invite %s to %s: %v", inviteID, userID, err)
+		}
+	}
+	return nil
+}
+
+// handleInviteRevoke applies a revocation from the invite's issuer or a
+// moderator of its room. The token is kept even if we never saw it used,
+// so it cannot be redeemed here later.
+func (n *Node) handleInviteRevoke(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	revoke, ok := payload.(InviteRevokePayload)
+	if !ok {
+		return errors.New("invite_revoke message missing payload")
+	}
+	
+	invite, err := security.ParseInvite(revoke.Token)
+	if err != nil {
+		return err
+	}
+	if invite.RoomID != revoke.RoomID {
+		return errors.New("revoked invite is for another room")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	room, err := n.roomManager.GetRoom(invite.RoomID)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(invite.Issuer) != peer.PublicKey && !room.IsModerator(userID) {
+		return ErrNotRoomModerator
+	}
+	
+	if err := n.roomManager.db.SaveInvite(inviteRecord(invite, revoke.Token)); err != nil {
+		return err
+	}
+	return n.roomManager.db.RevokeInvite(invite.ID)
+}
+
+func (s *Server) handleInvites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	invites, err := s.node.ListInvites(r.URL.Query().Get("room_id"))
+	if err != nil {
+		if err == ErrNotRoomModerator {
+			http.Error(w, "Only moderators can list invites", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		RoomID    string `json:"room_id"`
+		Role      string `json:"role"`
+		MaxUses   int    `json:"max_uses"`
+		ExpiresIn int64  `json:"expires_in"` // seconds
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	invite, err := s.node.CreateInvite(req.RoomID, req.Role, req.MaxUses, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		if err == ErrNotRoomModerator {
+			http.Error(w, "Only moderators can create invites", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to create invite", http.StatusBadRequest)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invite)
+}
+
+func (s *Server) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		RoomID   string `json:"room_id"`
+		InviteID string `json:"invite_id"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	if err := s.node.RevokeInvite(req.RoomID, req.InviteID); err != nil {
+		if err == ErrNotRoomModerator {
+			http.Error(w, "Only moderators can revoke invites", http.StatusForbidden)
+			return
+		}
+		if err == database.ErrInviteNotFound {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to revoke invite", http.StatusBadRequest)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked"})
+} 
\ No newline at end of file
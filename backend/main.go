@@ -2,55 +2,85 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"github.com/gorilla/websocket"
 	"ripcord/database"
 	"ripcord/i2p"
 	"ripcord/security"
+	"ripcord/transport"
 	"ripcord/types"
 )
 
 type Server struct {
-	cryptoManager  *security.CryptoManager
-	db             database.Database
-	roomManager    *RoomManager
-	messageHandler *MessageHandler
-	node           *Node
-	i2pManager     *i2p.I2PManager
-	config         *Config
-	wsClients      map[*websocket.Conn]*WSClient
-	wsClientsMutex sync.RWMutex
-	upgrader       websocket.Upgrader
+	cryptoManager   *security.CryptoManager
+	db              database.Database
+	roomManager     *RoomManager
+	messageHandler  *MessageHandler
+	node            *Node
+	i2pManager      *i2p.I2PManager
+	config          *Config
+	configMutex     sync.Mutex // guards config once the server runs
+	adminToken      string // bearer token for the admin endpoints that handle keys
+	hub             *wsHub
+	wsSessions      map[string]*wsSession // by session token
+	wsSessionMutex  sync.Mutex
+	wsSendMutex     sync.Mutex // so a retried send is stored once
+	wsPresence      map[string]map[*WSClient]string // connection statuses by user ID
+	wsPresenceMutex sync.Mutex
+	wsTyping        *typingThrottle // by user and room
+	upgrader        websocket.Upgrader
 }
 
 type WSClient struct {
-	conn     *websocket.Conn
-	userID   string
-	username string
-	roomID   string
-	send     chan []byte
+	conn      *websocket.Conn
+	userID    string // base58 of the key the client proved it holds
+	username  string
+	publicKey string
+	rooms     map[string]bool // subscribed room IDs, owned by the hub
+	send      chan []byte
+	
+	nonce         string // outstanding auth challenge
+	authenticated atomic.Bool
+	presenceGone  bool // set once the hub let it go, under wsPresenceMutex
 }
 
 // Config now defined in config.go
 
 func main() {
+	passphraseFD := flag.Int("passphrase-fd", -1, "read the private key passphrase from this file descriptor")
+	configPath := flag.String("config", ConfigFile, "read the configuration from this file")
+	flag.Usage = usage
+	flag.Parse()
+	
+	passphrases := newPassphraseSource(*passphraseFD)
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:], *configPath, passphrases); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	
 	fmt.Println("Starting Ripcord - Decentralized Secure Chat Platform")
 	
-	config, err := loadConfig()
+	config, err := LoadConfig(*configPath)
 	if err != nil {
 		log.Fatal("Failed to load configuration:", err)
 	}
 	
-	server, err := initializeServer(config)
+	server, err := initializeServer(config, passphrases)
 	if err != nil {
 		log.Fatal("Failed to initialize server:", err)
 	}
@@ -68,33 +98,26 @@ func main() {
 	handleGracefulShutdown(server)
 }
 
-func loadConfig() (*Config, error) {
-	return LoadConfig("config.json")
-}
-
-func saveConfig(config *Config, path string) error {
-	return config.Save(path)
+// saveConfig writes the configuration back to the file it came from
+func saveConfig(config *Config) error {
+	return config.Save(config.path)
 }
 
-func initializeServer(config *Config) (*Server, error) {
-	dataDir := "data" // Default data directory
+func initializeServer(config *Config, passphrases *passphraseSource) (*Server, error) {
+	dataDir := DataDir
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, err
 	}
 	
-	// Use database config or default to SQLite
-	dbPath := filepath.Join(dataDir, config.Database.Database)
-	if config.Database.Database == "" {
-		dbPath = filepath.Join(dataDir, "ripcord.db")
-	}
-	
-	db := database.NewSQLiteDatabase(dbPath)
+	db := database.NewSQLiteDatabase(databasePath(config))
 	if err := db.Connect(); err != nil {
 		return nil, err
 	}
 	
-	keyPath := filepath.Join(dataDir, "identity.json")
-	cryptoManager := security.NewCryptoManager(keyPath)
+	cryptoManager := security.NewCryptoManager(identityPath())
+	if err := unlockIdentity(cryptoManager, passphrases); err != nil {
+		return nil, err
+	}
 	if err := cryptoManager.LoadOrGenerateKeys("Anonymous"); err != nil {
 		return nil, err
 	}
@@ -106,14 +129,49 @@ func initializeServer(config *Config) (*Server, error) {
 	
 	// Initialize I2P manager
 	i2pManager := i2p.NewI2PManager(config.I2P.SamAddress, config.I2P.SamPort)
+	if config.I2P.Destination != "" {
+		if err := i2pManager.SetDestination(config.I2P.Destination); err != nil {
+			log.Printf("Warning: Ignoring invalid I2P destination in config: %v", err)
+		}
+	}
 	if config.I2P.Enabled {
 		if err := i2pManager.Connect(); err != nil {
 			log.Printf("Warning: Failed to connect to I2P: %v", err)
 		} else {
-			log.Printf("Successfully connected to I2P")
+			log.Printf("Successfully connected to I2P as %s", i2pManager.Base32Address())
+			
+			// Persist a newly generated destination so the address survives restarts
+			if config.I2P.Destination != i2pManager.Destination() {
+				config.I2P.Destination = i2pManager.Destination()
+				if err := saveConfig(config); err != nil {
+					log.Printf("Warning: Failed to save I2P destination: %v", err)
+				}
+			}
+		}
+	}
+	
+	if i2pManager.IsConnected() {
+		node.AddTransport(transport.NewI2PTransport(i2pManager))
+	}
+	if config.Network.TCPListen != "" {
+		node.AddTransport(transport.NewTCPTransport(config.Network.TCPListen, config.Network.TCPAdvertise))
+	}
+	node.SetGossip(config.Network.GossipFanout, config.Network.GossipTTL)
+	node.SetRequireSignatures(config.Security.RequireSignatureVerification)
+	if err := verifyStoredMessages(db); err != nil {
+		return nil, err
+	}
+	for _, address := range config.Network.Bootstrap {
+		if err := node.AddBootstrapAddress(address); err != nil {
+			log.Printf("Warning: Ignoring bootstrap peer: %v", err)
 		}
 	}
 	
+	adminToken, err := loadOrCreateAdminToken(adminTokenPath())
+	if err != nil {
+		return nil, err
+	}
+	
 	server := &Server{
 		cryptoManager:  cryptoManager,
 		db:             db,
@@ -122,12 +180,19 @@ func initializeServer(config *Config) (*Server, error) {
 		node:           node,
 		i2pManager:     i2pManager,
 		config:         config,
-		wsClients:      make(map[*websocket.Conn]*WSClient),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins for development
-			},
-		},
+		adminToken:     adminToken,
+		hub:            newWSHub(),
+		wsSessions:     make(map[string]*wsSession),
+		wsPresence:     make(map[string]map[*WSClient]string),
+		wsTyping:       newTypingThrottle(TypingInterval),
+	}
+	server.upgrader.CheckOrigin = server.checkWSOrigin
+	
+	server.hub.onRemove = server.forgetWSClient
+	go server.hub.run()
+	node.SetNotifier(server)
+	if err := node.Start(); err != nil {
+		return nil, err
 	}
 	
 	return server, nil
@@ -170,8 +235,18 @@ func setupHTTPHandlers(server *Server) {
 	http.HandleFunc("/api/rooms/create", corsHandler(server.handleCreateRoom))
 	http.HandleFunc("/api/rooms/join", corsHandler(server.handleJoinRoom))
 	http.HandleFunc("/api/rooms/leave", corsHandler(server.handleLeaveRoom))
+	http.HandleFunc("/api/rooms/kick", corsHandler(server.handleKickMember))
+	http.HandleFunc("/api/rooms/invites", corsHandler(server.handleInvites))
+	http.HandleFunc("/api/rooms/invites/create", corsHandler(server.handleCreateInvite))
+	http.HandleFunc("/api/rooms/invites/revoke", corsHandler(server.handleRevokeInvite))
 	http.HandleFunc("/api/messages", corsHandler(server.handleMessages))
 	http.HandleFunc("/api/messages/send", corsHandler(server.handleSendMessage))
+	http.HandleFunc("/api/dms/send", corsHandler(server.handleSendDM))
+	http.HandleFunc("/api/trust", corsHandler(server.handleTrustedKeys))
+	http.HandleFunc("/api/trust/safety-number", corsHandler(server.handleSafetyNumber))
+	http.HandleFunc("/api/trust/verify", corsHandler(server.handleVerifyContact))
+	http.HandleFunc("/api/trust/unverify", corsHandler(server.handleUnverifyContact))
+	http.HandleFunc("/api/trust/warnings", corsHandler(server.handleKeyWarnings))
 	http.HandleFunc("/ws", server.handleWebSocket)
 	
 	// Admin API endpoints
@@ -181,8 +256,11 @@ func setupHTTPHandlers(server *Server) {
 	http.HandleFunc("/api/admin/rooms", corsHandler(server.handleAdminRooms))
 	http.HandleFunc("/api/admin/peers", corsHandler(server.handleAdminPeers))
 	http.HandleFunc("/api/admin/logs/connections", corsHandler(server.handleConnectionLogs))
-	http.HandleFunc("/api/admin/settings", corsHandler(server.handleAdminSettings))
+	http.HandleFunc("/api/admin/settings", corsHandler(server.requireAdmin(server.handleAdminSettings)))
 	http.HandleFunc("/api/admin/restart", corsHandler(server.handleAdminRestart))
+	http.HandleFunc("/api/admin/backup/mnemonic", corsHandler(server.requireAdmin(server.handleAdminMnemonic)))
+	http.HandleFunc("/api/admin/backup/export", corsHandler(server.requireAdmin(server.handleAdminBackupExport)))
+	http.HandleFunc("/api/admin/backup/restore", corsHandler(server.requireAdmin(server.handleAdminBackupRestore)))
 	
 	// API Access Management endpoints
 	http.HandleFunc("/api/admin/api-access", corsHandler(server.handleAPIAccess))
@@ -309,6 +387,8 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	go s.node.AnnounceJoin(room.ID, req.InviteCode)
+	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(room)
 }
@@ -335,6 +415,36 @@ func (s *Server) handleLeaveRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	go s.node.AnnounceLeave(req.RoomID)
+	
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleKickMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		RoomID string `json:"room_id"`
+		UserID string `json:"user_id"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	if err := s.node.KickMember(req.RoomID, req.UserID); err != nil {
+		if err == ErrNotRoomModerator {
+			http.Error(w, "Only moderators can remove members", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to remove member", http.StatusBadRequest)
+		return
+	}
+	
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -388,51 +498,56 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	if strings.TrimSpace(req.Content) == "" {
-		http.Error(w, "Message content is required", http.StatusBadRequest)
+	message, err := s.postMessage(req.RoomID, req.Content, "")
+	if err == ErrEmptyMessage || err == ErrMessageTooLong {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	
-	// Sanitize content - remove potentially dangerous characters
-	content := sanitizeMessageContent(req.Content)
-	if content == "" {
-		http.Error(w, "Message content is required", http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
 		return
 	}
 	
-	if len(content) > 2000 {
-		http.Error(w, "Message too long (max 2000 characters)", http.StatusBadRequest)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+// postMessage signs a message from the local identity, stores it and
+// publishes it to the room's peers. The content is sanitized first, and the
+// message is checked like any other before it is stored. clientID is the
+// sending client's own ID for it, if any.
+func (s *Server) postMessage(roomID, content, clientID string) (*types.Message, error) {
+	content, err := cleanMessageContent(content)
+	if err != nil {
+		return nil, err
 	}
 	
 	userID := s.cryptoManager.GetPublicKeyBase58()
 	username := s.cryptoManager.GetNickname()
 	
-	message, err := s.messageHandler.CreateSignedMessage(req.RoomID, userID, username, content, "")
-	if err != nil {
-		http.Error(w, "Failed to create message", http.StatusInternalServerError)
-		return
+	// The clock, parents and encryption flag are part of what gets signed
+	message := NewMessage(roomID, userID, username, content, "")
+	message.Encrypted = s.roomManager.IsPrivate(roomID)
+	if err := s.roomManager.StampMessage(message); err != nil {
+		return nil, err
 	}
-	
-	dbMessage := &types.Message{
-		ID:        message.ID,
-		RoomID:    message.RoomID,
-		UserID:    message.UserID,
-		Username:  message.Username,
-		Content:   message.Content,
-		Type:      message.Type,
-		Encrypted: message.Encrypted,
-		Timestamp: message.Timestamp,
-		Signature: message.Signature,
+	if err := message.Sign(s.cryptoManager.GetPrivateKey()); err != nil {
+		return nil, err
+	}
+	if err := verifyMessageSignature(message); err != nil {
+		return nil, err
 	}
 	
-	if err := s.db.SaveMessage(dbMessage); err != nil {
-		http.Error(w, "Failed to save message", http.StatusInternalServerError)
-		return
+	message.ClientID = clientID
+	if err := s.db.SaveMessage(message); err != nil {
+		return nil, err
 	}
+	s.hub.noteRoomSeq(roomID, message.Seq)
 	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(message)
+	if err := s.node.PublishChat(message); err != nil {
+		log.Printf("Failed to publish message to peers: %v", err)
+	}
+	return message, nil
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -443,13 +558,15 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	client := &WSClient{
-		conn: conn,
-		send: make(chan []byte, 256),
+		conn:  conn,
+		rooms: make(map[string]bool),
+		send:  make(chan []byte, 256),
 	}
 	
-	s.wsClientsMutex.Lock()
-	s.wsClients[conn] = client
-	s.wsClientsMutex.Unlock()
+	s.hub.add(client)
+	
+	// Nothing else is accepted until the client answers this
+	s.sendAuthChallenge(client)
 	
 	// Start goroutines for reading and writing
 	go s.wsClientReader(client)
@@ -460,12 +577,13 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) wsClientReader(client *WSClient) {
 	defer func() {
-		s.removeWSClient(client)
+		s.hub.drop(client)
 		client.conn.Close()
+		log.Printf("WebSocket client disconnected: %s", client.conn.RemoteAddr())
 	}()
 	
-	client.conn.SetReadLimit(512)
-	client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	client.conn.SetReadLimit(maxWSFrameSize)
+	client.conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
 	client.conn.SetPongHandler(func(string) error {
 		client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 		return nil
@@ -540,9 +658,21 @@ func (s *Server) handleWSMessage(client *WSClient, message []byte) {
 		return
 	}
 	
+	if msgType != "auth" && !client.authenticated.Load() {
+		s.sendToClient(client, map[string]interface{}{
+			"type":  "error",
+			"error": "authentication required",
+		})
+		return
+	}
+	
 	switch msgType {
 	case "auth":
 		s.handleWSAuth(client, wsMsg)
+	case "subscribe":
+		s.handleWSSubscribe(client, wsMsg)
+	case "unsubscribe":
+		s.handleWSUnsubscribe(client, wsMsg)
 	case "join_room":
 		s.handleWSJoinRoom(client, wsMsg)
 	case "leave_room":
@@ -551,97 +681,74 @@ func (s *Server) handleWSMessage(client *WSClient, message []byte) {
 		s.handleWSSendMessage(client, wsMsg)
 	case "get_messages":
 		s.handleWSGetMessages(client, wsMsg)
+	case "resume":
+		s.handleWSResume(client, wsMsg)
+	case "presence_update":
+		s.handleWSPresence(client, wsMsg)
+	case "typing":
+		s.handleWSTyping(client, wsMsg)
 	default:
 		log.Printf("Unknown WebSocket message type: %s", msgType)
 	}
 }
 
-func (s *Server) handleWSAuth(client *WSClient, msg map[string]interface{}) {
-	username, _ := msg["username"].(string)
-	if username == "" {
-		username = "Anonymous"
-	}
-	
-	client.username = username
-	client.userID = generateMessageID() // Simple user ID generation
-	
-	response := map[string]interface{}{
-		"type": "auth_response",
-		"success": true,
-		"user": map[string]interface{}{
-			"id": client.userID,
-			"username": client.username,
-		},
-	}
-	
-	s.sendToClient(client, response)
-}
 
+// join_room and leave_room subscribe to a single room, as before clients
+// could hold several
 func (s *Server) handleWSJoinRoom(client *WSClient, msg map[string]interface{}) {
 	roomID, _ := msg["room_id"].(string)
 	if roomID == "" {
 		return
 	}
 	
-	client.roomID = roomID
-	
-	response := map[string]interface{}{
+	if len(s.subscribeWSClient(client, []string{roomID})) == 0 {
+		return
+	}
+	s.sendToClient(client, map[string]interface{}{
 		"type": "room_joined",
 		"room_id": roomID,
-	}
-	
-	s.sendToClient(client, response)
-	s.broadcastToRoom(roomID, map[string]interface{}{
-		"type": "user_joined",
-		"user": map[string]interface{}{
-			"id": client.userID,
-			"username": client.username,
-		},
-	}, client)
+	})
 }
 
 func (s *Server) handleWSLeaveRoom(client *WSClient, msg map[string]interface{}) {
-	if client.roomID == "" {
+	roomID, _ := msg["room_id"].(string)
+	if roomID == "" {
 		return
 	}
 	
-	oldRoomID := client.roomID
-	client.roomID = ""
-	
-	s.broadcastToRoom(oldRoomID, map[string]interface{}{
-		"type": "user_left",
-		"user_id": client.userID,
-	}, client)
+	s.unsubscribeWSClient(client, []string{roomID})
+	s.sendToClient(client, map[string]interface{}{
+		"type": "room_left",
+		"room_id": roomID,
+	})
 }
 
 func (s *Server) handleWSSendMessage(client *WSClient, msg map[string]interface{}) {
 	content, _ := msg["content"].(string)
-	if content == "" || client.roomID == "" {
+	roomID, _ := msg["room_id"].(string)
+	clientID, _ := msg["client_id"].(string)
+	if content == "" || roomID == "" {
 		return
 	}
-	
-	message := &types.Message{
-		ID:        generateMessageID(),
-		RoomID:    client.roomID,
-		UserID:    client.userID,
-		Username:  client.username,
-		Content:   content,
-		Type:      types.MessageTypeText,
-		Encrypted: false,
-		Timestamp: time.Now(),
+	if !s.isSubscribed(client, roomID) {
+		s.ackWSSend(client, roomID, clientID, nil, ErrWSNotSubscribed)
+		return
 	}
 	
-	// Save to database
-	if err := s.db.SaveMessage(message); err != nil {
+	// Messages are signed and published like those sent over HTTP
+	message, stored, err := s.postClientMessage(client, roomID, content, clientID)
+	if err != nil {
 		log.Printf("Failed to save message: %v", err)
-		return
 	}
+	s.ackWSSend(client, roomID, clientID, message, err)
 	
-	// Broadcast to room
-	s.broadcastToRoom(client.roomID, map[string]interface{}{
-		"type": "message",
-		"message": message,
-	}, nil)
+	// A retry was broadcast the first time
+	if stored {
+		s.broadcastToRoom(roomID, map[string]interface{}{
+			"type": "message",
+			"message": message,
+		}, nil)
+	}
 }
 
 func (s *Server) handleWSGetMessages(client *WSClient, msg map[string]interface{}) {
@@ -650,9 +757,19 @@ func (s *Server) handleWSGetMessages(client *WSClient, msg map[string]interface{
 		return
 	}
 	
+	room, err := s.roomManager.GetRoom(roomID)
+	if err != nil || !s.wsMayRead(client, room) {
+		s.sendToClient(client, map[string]interface{}{
+			"type":    "error",
+			"error":   ErrWSNotMember.Error(),
+			"room_id": roomID,
+		})
+		return
+	}
+	
 	limit := 50
-	if l, ok := msg["limit"].(float64); ok {
-		limit = int(l)
+	if l, ok := msg["limit"].(float64); ok && l > 0 {
+		limit = int(math.Min(l, maxWSHistory))
 	}
 	
 	messages, err := s.db.GetMessages(roomID, limit)
@@ -676,54 +793,44 @@ func (s *Server) sendToClient(client *WSClient, data interface{}) {
 		return
 	}
 	
-	select {
-	case client.send <- jsonData:
-	default:
-		close(client.send)
-		s.removeWSClient(client)
-	}
+	s.hub.send(&wsEnvelope{client: client, data: jsonData})
 }
 
 func (s *Server) broadcastToRoom(roomID string, data interface{}, exclude *WSClient) {
+	if event, ok := data.(map[string]interface{}); ok {
+		s.stampRoomEvent(roomID, event)
+	}
+	
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		log.Printf("Failed to marshal broadcast data: %v", err)
 		return
 	}
 	
-	s.wsClientsMutex.RLock()
-	defer s.wsClientsMutex.RUnlock()
-	
-	for _, client := range s.wsClients {
-		if client.roomID == roomID && client != exclude {
-			select {
-			case client.send <- jsonData:
-			default:
-				close(client.send)
-				delete(s.wsClients, client.conn)
-			}
-		}
-	}
+	s.hub.send(&wsEnvelope{roomID: roomID, exclude: exclude, data: jsonData})
 }
 
-func (s *Server) removeWSClient(client *WSClient) {
-	s.wsClientsMutex.Lock()
-	defer s.wsClientsMutex.Unlock()
-	
-	if _, ok := s.wsClients[client.conn]; ok {
-		delete(s.wsClients, client.conn)
-		close(client.send)
-		
-		// Notify room that user left
-		if client.roomID != "" {
-			s.broadcastToRoom(client.roomID, map[string]interface{}{
-				"type": "user_left",
-				"user_id": client.userID,
-			}, client)
+// NotifyRoom delivers a node event to local clients in a room
+func (s *Server) NotifyRoom(roomID string, event interface{}) {
+	s.broadcastToRoom(roomID, event, nil)
+}
+
+// NotifyAll delivers a node event to every local client
+func (s *Server) NotifyAll(event interface{}) {
+	// A direct message is the one stored without a room event
+	if event, ok := event.(map[string]interface{}); ok {
+		if message, ok := event["message"].(*types.Message); ok {
+			s.hub.noteRoomSeq(message.RoomID, message.Seq)
 		}
-		
-		log.Printf("WebSocket client disconnected: %s", client.conn.RemoteAddr())
 	}
+	
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal node event: %v", err)
+		return
+	}
+	
+	s.hub.send(&wsEnvelope{data: jsonData})
 }
 
 // API Access Management handlers
@@ -922,16 +1029,19 @@ func (s *Server) handleServerStats(w http.ResponseWriter, r *http.Request) {
 		messageCount += len(messages)
 	}
 	
-	// Count active WebSocket connections as peer approximation
-	s.wsClientsMutex.RLock()
-	peerCount := len(s.wsClients)
-	s.wsClientsMutex.RUnlock()
+	peerCount := 0
+	for _, peer := range s.node.GetPeers() {
+		if peer.Status == PeerStatusConnected {
+			peerCount++
+		}
+	}
 	
 	stats := map[string]interface{}{
 		"uptime":   time.Since(time.Now().Add(-1*time.Hour)).Seconds(), // Placeholder
 		"rooms":    roomCount,
 		"messages": messageCount,
 		"peers":    peerCount,
+		"protocol": s.node.Metrics(),
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
@@ -959,7 +1069,6 @@ func (s *Server) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
 			"id":               room.ID,
 			"name":             room.Name,
 			"description":      room.Description,
-			"invite_code":      room.InviteCode,
 			"is_private":       room.IsPrivate,
 			"created_at":       room.CreatedAt,
 			"participant_count": len(room.Participants),
@@ -977,19 +1086,29 @@ func (s *Server) handleAdminPeers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// For now, use WebSocket clients as peer approximation
-	s.wsClientsMutex.RLock()
-	defer s.wsClientsMutex.RUnlock()
+	nodePeers := s.node.GetPeers()
+	sort.Slice(nodePeers, func(i, j int) bool {
+		return nodePeers[i].LastSeen.After(nodePeers[j].LastSeen)
+	})
+	
+	queued := s.node.QueuedCounts()
 	
-	peers := make([]map[string]interface{}, 0, len(s.wsClients))
-	for _, client := range s.wsClients {
+	peers := make([]map[string]interface{}, 0, len(nodePeers))
+	for _, p := range nodePeers {
 		peer := map[string]interface{}{
-			"id":           client.userID,
-			"status":       "connected",
-			"i2p_address":  "Not Available",
-			"connected_at": time.Now().Add(-30 * time.Minute), // Placeholder
-			"message_count": 0,                                  // TODO: Implement
-			"trust_level":  "unknown",
+			"id":            p.ID,
+			"nickname":      p.Nickname,
+			"status":        p.Status,
+			"address":       p.Address,
+			"i2p_address":   p.Address,
+			"connected_at":  p.ConnectedAt,
+			"last_seen":     p.LastSeen,
+			"active_rooms":  p.ActiveRooms,
+			"message_count": p.MessageCount,
+			"queued":        queued[p.ID],
+			"version":       p.wireVersion(),
+			"features":      p.Features,
+			"trust_level":   "unknown",
 		}
 		peers = append(peers, peer)
 	}
@@ -1030,37 +1149,22 @@ func (s *Server) handleConnectionLogs(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		// Return current settings
-		settings := map[string]interface{}{
-			"i2p": map[string]interface{}{
-				"host":          s.config.I2P.Host,
-				"port":          s.config.I2P.Port,
-				"tunnel_length": 2, // Default
-			},
-			"server": map[string]interface{}{
-				"port":                   s.config.Server.Port,
-				"max_peers":              50, // Default
-				"message_retention_days": 30, // Default
-			},
-			"security": map[string]interface{}{
-				"auto_block_malicious":           true, // Default
-				"require_signature_verification": true, // Default
-				"rate_limit_per_minute":          60,   // Default
-			},
-		}
-		
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(settings)
+		json.NewEncoder(w).Encode(s.adminSettings())
 		
 	case http.MethodPost:
-		// Save new settings
-		var newSettings map[string]interface{}
+		// Fields left out of the request keep their current values
+		newSettings := s.adminSettings()
 		if err := json.NewDecoder(r.Body).Decode(&newSettings); err != nil {
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
 		
-		// TODO: Validate and apply settings
+		// Only the signature policy can be changed while running
+		if err := s.setRequireSignatures(newSettings.Security.RequireSignatureVerification); err != nil {
+			http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+			return
+		}
 		log.Printf("Admin settings updated: %+v", newSettings)
 		
 		w.Header().Set("Content-Type", "application/json")
@@ -1071,6 +1175,43 @@ func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setRequireSignatures changes the signature policy, saving it first so the
+// node only follows a setting that survives a restart
+func (s *Server) setRequireSignatures(require bool) error {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	
+	if require == s.config.Security.RequireSignatureVerification {
+		return nil
+	}
+	s.config.Security.RequireSignatureVerification = require
+	if err := saveConfig(s.config); err != nil {
+		s.config.Security.RequireSignatureVerification = !require
+		return err
+	}
+	s.node.SetRequireSignatures(require)
+	return nil
+}
+
+// adminSettings reports the current settings. Those without a config
+// entry yet show their defaults.
+func (s *Server) adminSettings() types.AdminSettings {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	
+	var settings types.AdminSettings
+	settings.I2P.Host = s.config.I2P.Host
+	settings.I2P.Port = s.config.I2P.Port
+	settings.I2P.TunnelLength = 2
+	settings.Server.Port = s.config.Server.Port
+	settings.Server.MaxPeers = 50
+	settings.Server.MessageRetentionDays = 30
+	settings.Security.AutoBlockMalicious = true
+	settings.Security.RequireSignatureVerification = s.config.Security.RequireSignatureVerification
+	settings.Security.RateLimitPerMinute = 60
+	return settings
+}
+
 func (s *Server) handleAdminRestart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1094,6 +1235,11 @@ func handleGracefulShutdown(server *Server) {
 	<-c
 	fmt.Println("\nShutting down gracefully...")
 	
+	if server.node != nil {
+		server.node.Stop()
+	}
+	server.hub.stop()
+	
 	if server.db != nil {
 		server.db.Disconnect()
 	}
@@ -1106,6 +1252,14 @@ func handleGracefulShutdown(server *Server) {
 	os.Exit(0)
 }
 
+// MaxMessageLength bounds message content after sanitizing
+const MaxMessageLength = 2000
+
+var (
+	ErrEmptyMessage   = errors.New("message content is required")
+	ErrMessageTooLong = errors.New("message too long (max 2000 characters)")
+)
+
 // Input sanitization functions
 func isValidRoomID(roomID string) bool {
 	// Only allow alphanumeric characters, hyphens, and underscores
@@ -1136,4 +1290,17 @@ func sanitizeMessageContent(content string) string {
 	result = strings.Join(strings.Fields(result), " ")
 	
 	return result
+}
+
+// cleanMessageContent sanitizes message content from a local client and
+// checks what is left, for every path that sends it
+func cleanMessageContent(content string) (string, error) {
+	content = sanitizeMessageContent(content)
+	if content == "" {
+		return "", ErrEmptyMessage
+	}
+	if len(content) > MaxMessageLength {
+		return "", ErrMessageTooLong
+	}
+	return content, nil
 } 
\ No newline at end of file
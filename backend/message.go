@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/hex"
 	"errors"
 	"strings"
@@ -12,6 +13,10 @@ import (
 
 type MessageHandler struct {
 	cryptoManager *security.CryptoManager
+	
+	// sealDM encrypts DM content on a ratchet session with the peer. The
+	// node that uses the handler provides it.
+	sealDM func(peerID string, recipient ed25519.PublicKey, content string) (DMPayload, error)
 }
 
 func NewMessageHandler(cryptoManager *security.CryptoManager) *MessageHandler {
@@ -160,18 +165,28 @@ func (mh *MessageHandler) handleUnblockCommand(msg *types.Message, args []string
 
 func (mh *MessageHandler) handleDMCommand(msg *types.Message, args []string) (*ProtocolMessage, error) {
 	if len(args) < 2 {
-		return nil, errors.New("dm command requires username and message")
+		return nil, errors.New("dm command requires a recipient key and message")
 	}
 	
-	username := args[0]
+	// DMs are sealed for the recipient, so it has to be named by its key
+	recipient, err := recipientKey(args[0])
+	if err != nil {
+		return nil, err
+	}
 	content := strings.Join(args[1:], " ")
 	
+	if mh.sealDM == nil {
+		return nil, errors.New("dm command needs a node to seal it")
+	}
+	peerID := hex.EncodeToString(recipient)
+	payload, err := mh.sealDM(peerID, recipient, content)
+	if err != nil {
+		return nil, err
+	}
+	
 	protocolMsg := NewProtocolMessage(MessageTypeDM, msg.UserID, generateMessageID())
-	protocolMsg.To = username
-	protocolMsg.SetPayload(DMPayload{
-		Content:     content,
-		IsEncrypted: false,
-	})
+	protocolMsg.To = peerID
+	protocolMsg.SetPayload(payload)
 	
 	return protocolMsg, nil
 }
@@ -4,9 +4,12 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
 	"time"
 	"ripcord/security"
+	"ripcord/transport"
+	"ripcord/types"
 )
 
 type Node struct {
@@ -15,6 +18,26 @@ type Node struct {
 	roomManager    *RoomManager
 	messageHandler *MessageHandler
 	peers          map[string]*Peer
+	bootstrap      []string
+	transports     *transport.Manager
+	gossipFanout   int
+	gossipTTL      int
+	requireSigned  bool // refuse messages whose signature did not verify
+	notifier       ClientNotifier
+	queueMu        sync.Mutex // serializes outbound queue flushes
+	prekeyMu       sync.Mutex // serializes prekey rotation and top-ups
+	sessionMu      sync.Mutex // serializes DM ratchet session updates
+	senderKeyMu    sync.Mutex // serializes sender key updates and guards pendingChats
+	pendingChats   map[string][]pendingChat
+	pendingCount   int
+	syncRequests   map[string][]syncRequest // sync requests awaiting a response, by peer and room
+	presence       string                   // what our clients add up to, sent to peers
+	typingSent     *typingThrottle          // our typing, by room
+	typingSeen     *typingThrottle          // peers' typing, by peer and room
+	replay         *ReplayGuard
+	stop           chan struct{}  // closed by Stop to end the background loops
+	loops          sync.WaitGroup // background loops still running
+	metrics        *ProtocolMetrics
 	isRunning      bool
 	mu             sync.RWMutex
 	startTime      time.Time
@@ -24,10 +47,18 @@ type Peer struct {
 	ID        string
 	PublicKey string
 	Nickname  string
-	Address   string
+	Address   string // transport-qualified, e.g. "i2p:xxxx.b32.i2p" or "tcp:10.0.0.5:7700"
 	LastSeen  time.Time
 	Status    string
 	IsBlocked bool
+	
+	ActiveRooms  []string // as announced in the peer's last heartbeat
+	Version      string   // highest protocol version we share, empty until its heartbeat
+	Features     []string // optional features from its heartbeat
+	Prekey       *security.PrekeyBundle // verified bundle to start a DM session with, replaced rather than modified
+	Presence     string   // as last announced, empty from nodes that predate presence
+	ConnectedAt  time.Time
+	MessageCount int
 }
 
 const (
@@ -36,18 +67,43 @@ const (
 	PeerStatusBlocked      = "blocked"
 )
 
+const (
+	HeartbeatInterval = 30 * time.Second
+	
+	// A peer that misses three heartbeats is marked disconnected, and is
+	// forgotten if it stays silent much longer
+	PeerStaleTimeout = 3 * HeartbeatInterval
+	PeerEvictTimeout = 10 * time.Minute
+)
+
 func NewNode(cryptoManager *security.CryptoManager, roomManager *RoomManager, messageHandler *MessageHandler) *Node {
 	nodeID := hex.EncodeToString(cryptoManager.GetPublicKey())
 	
-	return &Node{
+	n := &Node{
 		ID:             nodeID,
 		cryptoManager:  cryptoManager,
 		roomManager:    roomManager,
 		messageHandler: messageHandler,
 		peers:          make(map[string]*Peer),
+		pendingChats:   make(map[string][]pendingChat),
+		syncRequests:   make(map[string][]syncRequest),
+		presence:       PresenceOffline,
+		typingSent:     newTypingThrottle(TypingInterval),
+		typingSeen:     newTypingThrottle(TypingInterval / 2),
+		transports:     transport.NewManager(),
+		gossipFanout:   DefaultGossipFanout,
+		gossipTTL:      DefaultGossipTTL,
+		replay:         NewReplayGuard(MaxClockSkew, ReplayCacheSize),
+		metrics:        &ProtocolMetrics{},
 		isRunning:      false,
 		startTime:      time.Now(),
 	}
+	
+	// Slash command DMs are sealed on our ratchet sessions
+	if messageHandler != nil {
+		messageHandler.sealDM = n.sealRatchetDM
+	}
+	return n
 }
 
 func (n *Node) Start() error {
@@ -60,31 +116,73 @@ func (n *Node) Start() error {
 	
 	log.Println("Starting node:", n.ID[:16]+"...")
 	
+	if err := n.transports.Listen(n.handleInbound); err != nil {
+		return err
+	}
+	
+	for _, address := range n.transports.LocalAddresses() {
+		log.Printf("Listening for peers on %s", address)
+	}
+	
 	n.isRunning = true
+	n.stop = make(chan struct{})
 	
+	n.loops.Add(2)
 	go n.heartbeatLoop()
+	go n.queueLoop()
 	
 	return nil
 }
 
 func (n *Node) Stop() error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
 	
 	if !n.isRunning {
+		n.mu.Unlock()
 		return nil
 	}
 	
 	log.Println("Stopping node...")
 	n.isRunning = false
+	close(n.stop)
 	
 	for _, peer := range n.peers {
 		peer.Status = PeerStatusDisconnected
 	}
+	n.mu.Unlock()
+	
+	// Closing waits for inbound readers, which take n.mu, so it must happen unlocked
+	err := n.transports.Close()
 	
+	// The loops write to the database, so they must be done before it closes
+	n.loops.Wait()
+	return err
+}
+
+// AddTransport registers a network the node can reach peers on. Transports
+// must be added before Start.
+func (n *Node) AddTransport(t transport.Transport) {
+	n.transports.Register(t)
+}
+
+// AddBootstrapAddress registers an address we announce ourselves to before
+// we know the key of the peer behind it
+func (n *Node) AddBootstrapAddress(address string) error {
+	if _, _, err := transport.ParseAddress(address); err != nil {
+		return fmt.Errorf("invalid bootstrap address %q: %v", address, err)
+	}
+	
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bootstrap = append(n.bootstrap, address)
 	return nil
 }
 
+// LocalAddresses returns the qualified addresses peers can reach us on
+func (n *Node) LocalAddresses() []string {
+	return n.transports.LocalAddresses()
+}
+
 func (n *Node) IsRunning() bool {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -99,6 +197,25 @@ func (n *Node) AddPeer(publicKey, nickname, address string) error {
 		return fmt.Errorf("cannot add self as peer")
 	}
 	
+	if _, _, err := transport.ParseAddress(address); err != nil {
+		return fmt.Errorf("invalid peer address %q: %v", address, err)
+	}
+	
+	// Refresh a known peer without touching its block state
+	if peer, exists := n.peers[publicKey]; exists {
+		if nickname != "" {
+			peer.Nickname = nickname
+		}
+		peer.Address = address
+		peer.LastSeen = time.Now()
+		if !peer.IsBlocked && peer.Status != PeerStatusConnected {
+			peer.Status = PeerStatusConnected
+			peer.ConnectedAt = time.Now()
+			log.Printf("Peer reconnected: %s (%s)", peer.Nickname, publicKey[:16]+"...")
+		}
+		return nil
+	}
+	
 	peer := &Peer{
 		ID:        publicKey,
 		PublicKey: publicKey,
@@ -107,6 +224,8 @@ func (n *Node) AddPeer(publicKey, nickname, address string) error {
 		LastSeen:  time.Now(),
 		Status:    PeerStatusConnected,
 		IsBlocked: false,
+		
+		ConnectedAt: time.Now(),
 	}
 	
 	n.peers[publicKey] = peer
@@ -117,16 +236,21 @@ func (n *Node) AddPeer(publicKey, nickname, address string) error {
 
 func (n *Node) RemovePeer(publicKey string) error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
-	
-	if peer, exists := n.peers[publicKey]; exists {
-		peer.Status = PeerStatusDisconnected
-		delete(n.peers, publicKey)
-		log.Printf("Removed peer: %s", publicKey[:16]+"...")
-		return nil
+	peer, exists := n.peers[publicKey]
+	if !exists {
+		n.mu.Unlock()
+		return fmt.Errorf("peer not found")
 	}
-	
-	return fmt.Errorf("peer not found")
+	shown := peer.presence() != PresenceOffline
+	peer.Status = PeerStatusDisconnected
+	delete(n.peers, publicKey)
+	n.mu.Unlock()
+	log.Printf("Removed peer: %s", publicKey[:16]+"...")
+	
+	if shown {
+		n.notifyPresence(publicKey, PresenceOffline)
+	}
+	return nil
 }
 
 func (n *Node) BlockPeer(publicKey string) error {
@@ -157,6 +281,11 @@ func (n *Node) UnblockPeer(publicKey string) error {
 	return fmt.Errorf("peer not found")
 }
 
+// Metrics returns counts of accepted and rejected peer messages
+func (n *Node) Metrics() map[string]uint64 {
+	return n.metrics.Snapshot()
+}
+
 func (n *Node) GetPeers() []Peer {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
@@ -170,40 +299,45 @@ func (n *Node) GetPeers() []Peer {
 }
 
 func (n *Node) BroadcastMessage(msg *ProtocolMessage) error {
-	privateKey := n.cryptoManager.GetPrivateKey()
-	if err := msg.Sign(privateKey); err != nil {
-		return err
-	}
-	
-	data, err := msg.ToJSON()
-	if err != nil {
-		return err
-	}
-	
 	n.mu.RLock()
-	activePeers := make([]*Peer, 0)
+	// Copies, since heartbeats update peers while the sends are in flight
+	activePeers := make([]Peer, 0)
 	for _, peer := range n.peers {
 		if peer.Status == PeerStatusConnected && !peer.IsBlocked {
-			activePeers = append(activePeers, peer)
+			activePeers = append(activePeers, *peer)
 		}
 	}
 	n.mu.RUnlock()
 	
 	for _, peer := range activePeers {
-		go func(p *Peer) {
-			if err := n.sendToPeer(p, data); err != nil {
+		// Each peer is spoken to in its own version, so each gets its own copy
+		copied := *msg
+		go func(p Peer, m *ProtocolMessage) {
+			if err := n.signAndSend(&p, m); err != nil {
 				log.Printf("Failed to send message to peer %s: %v", p.ID[:16]+"...", err)
 			}
-		}(peer)
+		}(peer, &copied)
 	}
 	
 	return nil
 }
 
 func (n *Node) sendToPeer(peer *Peer, data []byte) error {
-	// TODO: Implement actual network communication via I2P
-	log.Printf("Sending message to peer %s (address: %s)", peer.Nickname, peer.Address)
-	return nil
+	return n.transports.Send(peer.Address, data)
+}
+
+// handleInbound is the transport handler for every frame a peer sends us.
+// Peers are identified by the signed From key, not by the transport address.
+func (n *Node) handleInbound(from string, data []byte) {
+	msg, err := ParseProtocolMessage(data)
+	if err != nil {
+		log.Printf("Dropping invalid frame from %s: %v", from, err)
+		return
+	}
+	
+	if err := n.ProcessIncomingMessage(data, msg.From); err != nil {
+		log.Printf("Failed to process message from %s: %v", from, err)
+	}
 }
 
 func (n *Node) ProcessIncomingMessage(data []byte, fromPeer string) error {
@@ -213,11 +347,22 @@ func (n *Node) ProcessIncomingMessage(data []byte, fromPeer string) error {
 	}
 	
 	n.mu.RLock()
-	peer, exists := n.peers[fromPeer]
+	known, exists := n.peers[fromPeer]
+	var peer Peer
+	if exists {
+		peer = *known
+	}
 	n.mu.RUnlock()
 	
 	if !exists {
-		return fmt.Errorf("message from unknown peer: %s", fromPeer[:16]+"...")
+		// Only a heartbeat may introduce a new peer, and gossiped chat may
+		// come from room members we are not connected to; the signature
+		// check below proves either comes from the key it claims
+		if msg.Type != MessageTypeHeartbeat && !msg.IsGossip() {
+			n.metrics.UnknownPeer.Add(1)
+			return fmt.Errorf("message from unknown peer: %s", shortKey(fromPeer))
+		}
+		peer = Peer{ID: fromPeer, PublicKey: fromPeer}
 	}
 	
 	if peer.IsBlocked {
@@ -225,43 +370,366 @@ func (n *Node) ProcessIncomingMessage(data []byte, fromPeer string) error {
 		return nil
 	}
 	
-	// TODO: Verify message signature
-	// TODO: Process different message types
-	log.Printf("Processing %s message from %s", msg.Type, peer.Nickname)
+	if msg.From != peer.PublicKey {
+		return fmt.Errorf("message sender does not match peer %s", peer.Nickname)
+	}
+	
+	now := time.Now()
+	if err := n.replay.CheckTimestamp(msg.Timestamp, now); err != nil {
+		n.metrics.Skewed.Add(1)
+		return fmt.Errorf("%s message from %s: %w", msg.Type, shortKey(peer.PublicKey), err)
+	}
+	
+	if err := verifyPeerSignature(msg, peer.PublicKey); err != nil {
+		n.metrics.InvalidSignature.Add(1)
+		return fmt.Errorf("%s message from %s: %w", msg.Type, shortKey(peer.PublicKey), err)
+	}
+	
+	// Only signed messages are remembered so a forgery cannot shadow the
+	// real message that carries the same ID
+	if err := n.replay.Remember(msg.From+":"+msg.MessageID, msg.Timestamp, now); err != nil {
+		if msg.IsGossip() {
+			// Gossip reaches us over several paths; later copies are expected
+			n.metrics.Duplicates.Add(1)
+			return nil
+		}
+		n.metrics.Replayed.Add(1)
+		return fmt.Errorf("%s message %s from %s: %w", msg.Type, msg.MessageID, shortKey(peer.PublicKey), err)
+	}
+	
+	n.metrics.Accepted.Add(1)
+	n.touchPeer(peer.ID)
+	
+	if err := n.dispatch(msg, peer); err != nil {
+		return err
+	}
+	
+	if msg.IsGossip() {
+		n.forwardGossip(msg)
+	}
+	return nil
+}
+
+// SendToPeer signs msg and delivers it to a single peer. Messages that
+// matter after the fact, such as DMs, are queued if the peer is offline.
+func (n *Node) SendToPeer(peerID string, msg *ProtocolMessage) error {
+	n.mu.RLock()
+	peer, exists := n.peers[peerID]
+	var target Peer
+	if exists {
+		target = *peer
+	}
+	n.mu.RUnlock()
+	
+	if queueable(msg.Type) {
+		if _, err := userIDForKey(peerID); err != nil {
+			return err
+		}
+		if !exists {
+			return n.deliverOrQueue(peerID, nil, msg)
+		}
+		return n.deliverOrQueue(peerID, &target, msg)
+	}
+	
+	if !exists {
+		return fmt.Errorf("peer not found")
+	}
+	
+	return n.signAndSend(&target, msg)
+}
+
+func (n *Node) signAndSend(peer *Peer, msg *ProtocolMessage) error {
+	msg.Version = peer.wireVersion()
+	if err := msg.Sign(n.cryptoManager.GetPrivateKey()); err != nil {
+		return err
+	}
+	
+	data, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	
+	return n.sendToPeer(peer, data)
+}
+
+// replyToPeer sends from a new goroutine. Handlers run on a connection's
+// read loop, and blocking there on a peer that is itself blocked sending
+// to us would stall both sides.
+func (n *Node) replyToPeer(peerID string, msg *ProtocolMessage) {
+	go func() {
+		if err := n.SendToPeer(peerID, msg); err != nil {
+			log.Printf("Failed to send %s to %s: %v", msg.Type, shortKey(peerID), err)
+		}
+	}()
+}
+
+// PublishChat gossips a locally stored room message to the room's peers.
+// An encrypted message is sealed with our sender key, so relays outside
+// the room cannot read it.
+func (n *Node) PublishChat(message *types.Message) error {
+	msg := NewProtocolMessage(MessageTypeChat, n.ID, message.ID)
+	msg.RoomID = message.RoomID
+	payload := ChatPayload{
+		Content:   message.Content,
+		IsCommand: message.Type == types.MessageTypeCommand,
+		Clock:     message.Clock,
+		Parents:   message.Parents,
+	}
+	if message.Signature != "" && message.UserID == n.cryptoManager.GetPublicKeyBase58() {
+		payload.Username = message.Username
+		payload.Timestamp = message.Timestamp.Unix()
+		payload.Signature = message.Signature
+	}
+	
+	if message.Encrypted {
+		room, err := n.roomManager.GetRoom(message.RoomID)
+		if err != nil {
+			return err
+		}
+		
+		content, header, fresh, err := n.sealRoomContent(room.ID, message.Content)
+		if err != nil {
+			return err
+		}
+		if fresh != nil {
+			n.shareSenderKey(room.ID, fresh, room.GetMembersList())
+		}
+		payload.Content = content
+		payload.SenderKey = header
+	}
+	msg.SetPayload(payload)
+	
+	return n.BroadcastToRoom(msg)
+}
+
+// AnnounceLeave tells the remaining members of a room that we left it,
+// and drops the sender keys we held for it
+func (n *Node) AnnounceLeave(roomID string) {
+	n.rotateSenderKeys(roomID, n.cryptoManager.GetPublicKeyBase58())
+	
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		log.Printf("Failed to announce leaving room %s: %v", roomID, err)
+		return
+	}
+	n.sendLeave(room.GetMembersList(), LeavePayload{RoomID: roomID})
+}
+
+// KickMember removes a member from a room we moderate. The other members
+// are told so they stop sharing their sender keys with them.
+func (n *Node) KickMember(roomID, userID string) error {
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	
+	self := n.cryptoManager.GetPublicKeyBase58()
+	if !room.IsModerator(self) {
+		return ErrNotRoomModerator
+	}
+	if userID == self {
+		return fmt.Errorf("cannot kick yourself")
+	}
+	if !room.IsMember(userID) {
+		return ErrNotRoomMember
+	}
 	
+	if err := n.roomManager.LeaveRoom(roomID, userID); err != nil {
+		return err
+	}
+	n.rotateSenderKeys(roomID, userID)
+	
+	// The removed member is told as well, so they stop sending to the room
+	n.sendLeave(append(room.GetMembersList(), userID), LeavePayload{
+		RoomID: roomID,
+		Reason: "kicked",
+		UserID: userID,
+	})
+	
+	n.notifyRoom(roomID, map[string]interface{}{
+		"type":    "user_left",
+		"room_id": roomID,
+		"user_id": userID,
+	})
 	return nil
 }
 
+// sendLeave delivers a leave to each member, queueing it for those offline
+func (n *Node) sendLeave(members []string, leave LeavePayload) {
+	self := n.cryptoManager.GetPublicKeyBase58()
+	for _, userID := range members {
+		if userID == self {
+			continue
+		}
+		key, err := recipientKey(userID)
+		if err != nil {
+			continue
+		}
+		
+		msg := NewProtocolMessage(MessageTypeLeave, n.ID, generateMessageID())
+		msg.To = hex.EncodeToString(key)
+		msg.RoomID = leave.RoomID
+		msg.SetPayload(leave)
+		
+		if err := n.SendToPeer(msg.To, msg); err != nil {
+			log.Printf("Failed to send leave of room %s to %s: %v", leave.RoomID, userID, err)
+		}
+	}
+}
+
 func (n *Node) heartbeatLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+	defer n.loops.Done()
+	
+	ticker := time.NewTicker(HeartbeatInterval)
 	defer ticker.Stop()
 	
+	// Announce ourselves right away so bootstrap peers learn about us
+	n.sendHeartbeat()
+	
 	for {
 		select {
+		case <-n.stop:
+			return
 		case <-ticker.C:
-			if !n.IsRunning() {
-				return
-			}
+			n.expirePeers(time.Now())
 			n.sendHeartbeat()
 		}
 	}
 }
 
-func (n *Node) sendHeartbeat() {
-	msg := NewProtocolMessage(MessageTypeHeartbeat, n.ID, generateMessageID())
+// heartbeatFrame builds our heartbeat in a protocol version the receiver
+// can read
+func (n *Node) heartbeatFrame(version string) ([]byte, error) {
+	addresses := n.LocalAddresses()
+	sort.Strings(addresses)
+	
+	i2pAddress := ""
+	for _, address := range addresses {
+		if scheme, bare, err := transport.ParseAddress(address); err == nil && scheme == transport.SchemeI2P {
+			i2pAddress = bare
+		}
+	}
 	
-	payload := HeartbeatPayload{
+	rooms, err := n.roomManager.RoomsForUser(n.cryptoManager.GetPublicKeyBase58())
+	if err != nil {
+		log.Printf("Failed to list active rooms: %v", err)
+	}
+	if rooms == nil {
+		rooms = []string{}
+	}
+	
+	prekey, err := n.prekeyBundle(false)
+	if err != nil {
+		log.Printf("Failed to publish prekey: %v", err)
+	}
+	
+	n.mu.RLock()
+	presence := n.presence
+	n.mu.RUnlock()
+	
+	msg := NewProtocolMessage(MessageTypeHeartbeat, n.ID, generateMessageID())
+	msg.Version = version
+	msg.SetPayload(HeartbeatPayload{
 		Nickname:    n.cryptoManager.GetNickname(),
-		PublicKey:   hex.EncodeToString(n.cryptoManager.GetPublicKey()),
-		I2PAddress:  "localhost", // TODO: Get actual I2P address
-		ActiveRooms: []string{},  // TODO: Get active rooms
+		PublicKey:   n.ID,
+		I2PAddress:  i2pAddress,
+		Addresses:   addresses,
+		ActiveRooms: rooms,
+		MinVersion:  MinProtocolVersion,
+		MaxVersion:  ProtocolVersion,
+		Features:    localFeatures(),
+		Prekey:      prekey,
+		Succession:  n.announcedSuccession(),
+		Presence:    presence,
+	})
+	
+	if err := msg.Sign(n.cryptoManager.GetPrivateKey()); err != nil {
+		return nil, err
+	}
+	return msg.ToJSON()
+}
+
+// sendHeartbeat announces us to every known peer and bootstrap address.
+// Disconnected peers are included so a peer that comes back can find us.
+func (n *Node) sendHeartbeat() {
+	// Each peer gets the version we agreed on; addresses we have not
+	// heard from yet get the oldest, which every node reads
+	n.mu.RLock()
+	known := make(map[string]bool)
+	targets := make(map[string]string, len(n.peers)+len(n.bootstrap))
+	for _, peer := range n.peers {
+		known[peer.Address] = true
+		if !peer.IsBlocked {
+			targets[peer.Address] = peer.wireVersion()
+		}
+	}
+	for _, address := range n.bootstrap {
+		if !known[address] {
+			targets[address] = MinProtocolVersion
+		}
 	}
+	n.mu.RUnlock()
 	
-	msg.SetPayload(payload)
+	frames := make(map[string][]byte)
+	for address, version := range targets {
+		data, ok := frames[version]
+		if !ok {
+			var err error
+			if data, err = n.heartbeatFrame(version); err != nil {
+				log.Printf("Failed to build heartbeat: %v", err)
+				return
+			}
+			frames[version] = data
+		}
+		go n.sendHeartbeatTo(address, data)
+	}
+}
+
+func (n *Node) sendHeartbeatTo(address string, data []byte) {
+	if err := n.transports.Send(address, data); err != nil {
+		log.Printf("Failed to send heartbeat to %s: %v", address, err)
+	}
+}
+
+// expirePeers marks silent peers disconnected and evicts long-gone ones.
+// Blocked peers are kept so the block survives.
+func (n *Node) expirePeers(now time.Time) {
+	n.mu.Lock()
+	var gone []string // peers whose users are no longer shown
+	for id, peer := range n.peers {
+		if peer.IsBlocked {
+			continue
+		}
+		
+		idle := now.Sub(peer.LastSeen)
+		shown := peer.presence() != PresenceOffline
+		switch {
+		case idle > PeerEvictTimeout:
+			if shown {
+				gone = append(gone, peer.PublicKey)
+			}
+			delete(n.peers, id)
+			log.Printf("Evicted silent peer: %s (%s)", peer.Nickname, id[:16]+"...")
+		case idle > PeerStaleTimeout && peer.Status == PeerStatusConnected:
+			if shown {
+				gone = append(gone, peer.PublicKey)
+			}
+			peer.Status = PeerStatusDisconnected
+			log.Printf("Peer went quiet: %s (%s)", peer.Nickname, id[:16]+"...")
+		}
+	}
+	n.mu.Unlock()
 	
-	if err := n.BroadcastMessage(msg); err != nil {
-		log.Printf("Failed to send heartbeat: %v", err)
+	for _, peerKey := range gone {
+		n.notifyPresence(peerKey, PresenceOffline)
+	}
+}
+
+func shortKey(key string) string {
+	if len(key) > 16 {
+		return key[:16] + "..."
 	}
+	return key
 }
 
 func (n *Node) GetInfo() map[string]interface{} {
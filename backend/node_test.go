@@ -0,0 +1,1562 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"ripcord/database"
+	"ripcord/security"
+	"ripcord/transport"
+	"ripcord/types"
+)
+
+type recordingNotifier struct {
+	events []map[string]interface{}
+	mu     sync.Mutex
+}
+
+func (rn *recordingNotifier) NotifyRoom(roomID string, event interface{}) {
+	rn.record(event)
+}
+
+func (rn *recordingNotifier) NotifyAll(event interface{}) {
+	rn.record(event)
+}
+
+func (rn *recordingNotifier) record(event interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if e, ok := event.(map[string]interface{}); ok {
+		rn.events = append(rn.events, e)
+	}
+}
+
+// contents returns the message content of each event of a type, in order
+func (rn *recordingNotifier) contents(eventType string) []string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	var contents []string
+	for _, e := range rn.events {
+		if message, ok := e["message"].(*types.Message); ok && e["type"] == eventType {
+			contents = append(contents, message.Content)
+		}
+	}
+	return contents
+}
+
+func (rn *recordingNotifier) has(eventType string) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	for _, e := range rn.events {
+		if e["type"] == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type testNode struct {
+	*Node
+	db       *database.SQLiteDatabase
+	notifier *recordingNotifier
+	address  string
+}
+
+func newTestNode(t *testing.T, network *transport.LoopbackNetwork, nickname string) *testNode {
+	t.Helper()
+	dir := t.TempDir()
+	
+	db := database.NewSQLiteDatabase(filepath.Join(dir, "ripcord.db"))
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Disconnect() })
+	
+	crypto := security.NewCryptoManager(filepath.Join(dir, "identity.json"))
+	if err := crypto.LoadOrGenerateKeys(nickname); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	
+	node := NewNode(crypto, NewRoomManager(db), NewMessageHandler(crypto))
+	node.AddTransport(transport.NewLoopbackTransport(network, nickname))
+	
+	notifier := &recordingNotifier{}
+	node.SetNotifier(notifier)
+	
+	if err := node.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	t.Cleanup(func() { node.Stop() })
+	
+	return &testNode{Node: node, db: db, notifier: notifier, address: "mem:" + nickname}
+}
+
+func connectNodes(t *testing.T, a, b *testNode) {
+	t.Helper()
+	if err := a.AddPeer(b.ID, b.cryptoManager.GetNickname(), b.address); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+	if err := b.AddPeer(a.ID, a.cryptoManager.GetNickname(), a.address); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+// newInvite issues an invite to a room through a node that moderates it
+func newInvite(t *testing.T, n *testNode, roomID string) string {
+	t.Helper()
+	invite, err := n.CreateInvite(roomID, RoleMember, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	return invite.Token
+}
+
+// learnRoom gives n the room as an invite from creator would
+func learnRoom(t *testing.T, n *testNode, room *Room, creator *testNode) {
+	t.Helper()
+	dbRoom := &database.Room{ID: room.ID, Name: room.Name, InviteCode: room.InviteCode, IsPrivate: room.IsPrivate, CreatedAt: room.CreatedAt}
+	creatorID := creator.cryptoManager.GetPublicKeyBase58()
+	if _, err := n.roomManager.AddInvitedRoom(dbRoom, creatorID, creator.cryptoManager.GetNickname()); err != nil {
+		t.Fatalf("Failed to keep the room: %v", err)
+	}
+}
+
+func TestNodeJoinAndChatFromPeer(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, bob, room.ID)
+	
+	join := NewProtocolMessage(MessageTypeJoin, alice.ID, generateMessageID())
+	join.SetPayload(JoinPayload{
+		RoomID:     room.ID,
+		InviteCode: invite,
+		Nickname:   "alice",
+		PublicKey:  alice.ID,
+	})
+	if err := alice.SendToPeer(bob.ID, join); err != nil {
+		t.Fatalf("Failed to send join: %v", err)
+	}
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	waitFor(t, "alice to join bob's room", func() bool { return room.IsMember(aliceID) })
+	
+	// Chat is only gossiped to peers that announced the room
+	bob.sendHeartbeat()
+	waitFor(t, "alice to learn bob's rooms", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 1
+	})
+	
+	message := NewMessage(room.ID, aliceID, "alice", "hello bob", "")
+	if err := alice.PublishChat(message); err != nil {
+		t.Fatalf("Failed to publish chat: %v", err)
+	}
+	
+	waitFor(t, "chat to be stored", func() bool {
+		messages, _ := bob.db.GetMessages(room.ID, 10)
+		return len(messages) == 1 && messages[0].Content == "hello bob"
+	})
+	
+	if !bob.notifier.has("user_joined") || !bob.notifier.has("message") {
+		t.Error("Expected bob's clients to be notified of the join and the message")
+	}
+}
+
+func TestNodeRejectsBadSignature(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	ping := NewProtocolMessage(MessageTypePing, alice.ID, generateMessageID())
+	if err := ping.Sign(alice.cryptoManager.GetPrivateKey()); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, _ := ping.ToJSON()
+	
+	if err := bob.ProcessIncomingMessage(data, alice.ID); err != nil {
+		t.Errorf("Expected signed ping to be accepted, got %v", err)
+	}
+	
+	// Re-sign with bob's key while claiming to be alice
+	ping.Sign(bob.cryptoManager.GetPrivateKey())
+	forged, _ := ping.ToJSON()
+	
+	if err := bob.ProcessIncomingMessage(forged, alice.ID); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for forged ping, got %v", err)
+	}
+}
+
+func TestNodeRejectsReplayAndSkew(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	signed := func(timestamp int64) []byte {
+		ping := NewProtocolMessage(MessageTypePing, alice.ID, generateMessageID())
+		ping.Timestamp = timestamp
+		if err := ping.Sign(alice.cryptoManager.GetPrivateKey()); err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		data, _ := ping.ToJSON()
+		return data
+	}
+	
+	data := signed(time.Now().Unix())
+	if err := bob.ProcessIncomingMessage(data, alice.ID); err != nil {
+		t.Fatalf("Expected first delivery to be accepted, got %v", err)
+	}
+	if err := bob.ProcessIncomingMessage(data, alice.ID); !errors.Is(err, ErrReplayedMessage) {
+		t.Errorf("Expected ErrReplayedMessage for replay, got %v", err)
+	}
+	
+	stale := signed(time.Now().Add(-2 * MaxClockSkew).Unix())
+	if err := bob.ProcessIncomingMessage(stale, alice.ID); !errors.Is(err, ErrTimestampSkew) {
+		t.Errorf("Expected ErrTimestampSkew for stale message, got %v", err)
+	}
+	
+	future := signed(time.Now().Add(2 * MaxClockSkew).Unix())
+	if err := bob.ProcessIncomingMessage(future, alice.ID); !errors.Is(err, ErrTimestampSkew) {
+		t.Errorf("Expected ErrTimestampSkew for future message, got %v", err)
+	}
+	
+	metrics := bob.Metrics()
+	if metrics["replayed"] != 1 || metrics["timestamp_skew"] != 2 || metrics["rejected"] < 3 {
+		t.Errorf("Unexpected rejection metrics: %v", metrics)
+	}
+}
+
+func TestRoomGossip(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	carol := newTestNode(t, network, "carol")
+	eve := newTestNode(t, network, "eve")
+	
+	// alice - bob - carol in a line, with eve connected to bob outside the room
+	connectNodes(t, alice, bob)
+	connectNodes(t, bob, carol)
+	connectNodes(t, bob, eve)
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	room, err := alice.roomManager.CreateRoom("General", "", false, aliceID, "alice", aliceID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, alice, room.ID)
+	
+	members := []*testNode{alice, bob, carol}
+	for _, n := range []*testNode{bob, carol, eve} {
+		learnRoom(t, n, room, alice)
+	}
+	for _, n := range []*testNode{alice, bob, carol, eve} {
+		for _, member := range members {
+			memberID := member.cryptoManager.GetPublicKeyBase58()
+			if member == alice {
+				continue
+			}
+			if _, err := n.roomManager.JoinRoomByInvite(invite, memberID, member.cryptoManager.GetNickname(), memberID); err != nil {
+				t.Fatalf("Failed to join locally: %v", err)
+			}
+		}
+	}
+	
+	for _, n := range []*testNode{alice, bob, carol, eve} {
+		n.sendHeartbeat()
+	}
+	waitFor(t, "room peers to be announced", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 1 && len(bob.peersInRoom(room.ID)) == 2 && len(carol.peersInRoom(room.ID)) == 1
+	})
+	
+	// A single hop reaches bob but is not relayed to carol
+	alice.SetGossip(DefaultGossipFanout, 1)
+	local := NewMessage(room.ID, aliceID, "alice", "bob only", "")
+	if err := alice.PublishChat(local); err != nil {
+		t.Fatalf("Failed to publish chat: %v", err)
+	}
+	
+	alice.SetGossip(DefaultGossipFanout, DefaultGossipTTL)
+	relayed := NewMessage(room.ID, aliceID, "alice", "hello everyone", "")
+	if err := alice.PublishChat(relayed); err != nil {
+		t.Fatalf("Failed to publish chat: %v", err)
+	}
+	
+	stored := func(n *testNode, id string) bool {
+		exists, _ := n.db.MessageExists(id)
+		return exists
+	}
+	waitFor(t, "chat to reach bob", func() bool { return stored(bob, local.ID) && stored(bob, relayed.ID) })
+	waitFor(t, "chat to be relayed to carol", func() bool { return stored(carol, relayed.ID) })
+	
+	// Give any stray relay time to arrive
+	time.Sleep(100 * time.Millisecond)
+	
+	if stored(carol, local.ID) {
+		t.Error("Expected message with one hop left not to be relayed")
+	}
+	if stored(eve, relayed.ID) || stored(eve, local.ID) {
+		t.Error("Expected peer outside the room not to receive its messages")
+	}
+	
+	messages, _ := carol.db.GetMessages(room.ID, 10)
+	if len(messages) != 1 || messages[0].Username != "alice" {
+		t.Errorf("Expected one relayed message attributed to alice, got %v", messages)
+	}
+}
+
+// A 1.1 peer that takes gossip cannot read relayed 1.2 frames, so it gets
+// the author's direct copy in 1.1 while 1.2 peers still get the gossip
+func TestGossipWithOlderPeers(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	room, err := alice.roomManager.CreateRoom("General", "", false, aliceID, "alice", aliceID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	learnRoom(t, bob, room, alice)
+	invite := newInvite(t, alice, room.ID)
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	for _, n := range []*testNode{alice, bob} {
+		if _, err := n.roomManager.JoinRoomByInvite(invite, bobID, "bob", bobID); err != nil {
+			t.Fatalf("Failed to join locally: %v", err)
+		}
+	}
+	connectNodes(t, alice, bob)
+	
+	old := transport.NewLoopbackTransport(network, "old")
+	defer old.Close()
+	frames := make(chan []byte, 16)
+	old.Listen(func(from string, data []byte) { frames <- data })
+	
+	oldKey := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := oldKey.LoadOrGenerateKeys("old"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	oldID := hex.EncodeToString(oldKey.GetPublicKey())
+	
+	heartbeat := NewProtocolMessage(MessageTypeHeartbeat, oldID, generateMessageID())
+	heartbeat.Version = "1.0"
+	heartbeat.SetPayload(HeartbeatPayload{
+		Nickname:    "old",
+		PublicKey:   oldID,
+		Addresses:   []string{"mem:old"},
+		ActiveRooms: []string{room.ID},
+		MinVersion:  "1.0",
+		MaxVersion:  "1.1",
+		Features:    []string{FeatureSync, FeatureGossip},
+	})
+	heartbeat.Sign(oldKey.GetPrivateKey())
+	data, _ := heartbeat.ToJSON()
+	if err := alice.ProcessIncomingMessage(data, oldID); err != nil {
+		t.Fatalf("Expected 1.1 heartbeat to be accepted, got %v", err)
+	}
+	bob.sendHeartbeat()
+	waitFor(t, "room peers to be announced", func() bool { return len(alice.peersInRoom(room.ID)) == 2 })
+	
+	message := NewMessage(room.ID, aliceID, "alice", "for old and new", "")
+	if err := alice.PublishChat(message); err != nil {
+		t.Fatalf("Failed to publish chat: %v", err)
+	}
+	waitFor(t, "the gossip to reach bob", func() bool {
+		exists, _ := bob.db.MessageExists(message.ID)
+		return exists
+	})
+	
+	for {
+		select {
+		case frame := <-frames:
+			msg, err := ParseProtocolMessage(frame)
+			if err != nil {
+				t.Fatalf("Unreadable frame: %v", err)
+			}
+			if msg.Type != MessageTypeChat {
+				continue
+			}
+			if msg.Version != "1.1" || msg.TTL != 0 || msg.MessageID != message.ID {
+				t.Errorf("Expected a direct 1.1 copy, got version %s ttl %d", msg.Version, msg.TTL)
+			}
+			if !msg.VerifySignature(alice.cryptoManager.GetPublicKey()) {
+				t.Error("Expected the copy to be signed in 1.1")
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the chat to reach the 1.1 peer")
+		}
+	}
+}
+
+func TestOfflineDMQueuedUntilHeartbeat(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	// Alice still has an address for bob that no longer answers
+	if err := alice.AddPeer(bob.ID, "bob", "mem:bob-old"); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+	
+	// The first DM fails to send; by the second bob has gone quiet and it
+	// is queued straight away
+	if _, err := alice.SendDM(bob.ID, "are you there?"); err != nil {
+		t.Fatalf("Expected DM to be queued, got %v", err)
+	}
+	alice.expirePeers(time.Now().Add(PeerStaleTimeout + time.Second))
+	if _, err := alice.SendDM(bob.ID, "ping me when you are back"); err != nil {
+		t.Fatalf("Expected DM to be queued, got %v", err)
+	}
+	
+	if queued := alice.QueuedCounts()[bob.ID]; queued != 2 {
+		t.Fatalf("Expected 2 queued messages for bob, got %d", queued)
+	}
+	
+	// Bob comes back and announces himself
+	bob.AddBootstrapAddress(alice.address)
+	bob.sendHeartbeat()
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	waitFor(t, "queued DMs to arrive", func() bool {
+		messages, _ := bob.db.GetMessages(dmRoomID(aliceID), 10)
+		return len(messages) == 2
+	})
+	
+	delivered := bob.notifier.contents("direct_message")
+	if len(delivered) != 2 || delivered[0] != "are you there?" || delivered[1] != "ping me when you are back" {
+		t.Errorf("Expected queued DMs delivered in order, got %q", delivered)
+	}
+	
+	waitFor(t, "queue to drain", func() bool { return alice.QueuedCounts()[bob.ID] == 0 })
+}
+
+func TestEncryptedDM(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	alice.AddBootstrapAddress(bob.address)
+	alice.sendHeartbeat()
+	waitFor(t, "the handshake", func() bool {
+		peer, ok := findPeer(alice, bob.ID)
+		return ok && peer.HasFeature(FeatureEncryptedDM)
+	})
+	
+	if _, err := alice.SendDM(bob.cryptoManager.GetPublicKeyBase58(), "only for bob"); err != nil {
+		t.Fatalf("Failed to send DM: %v", err)
+	}
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	waitFor(t, "the DM to arrive", func() bool {
+		messages, _ := bob.db.GetMessages(dmRoomID(aliceID), 10)
+		return len(messages) == 1
+	})
+	
+	messages, _ := bob.db.GetMessages(dmRoomID(aliceID), 10)
+	if messages[0].Content != "only for bob" || !messages[0].Encrypted {
+		t.Errorf("Expected bob to store the decrypted DM, got %q encrypted=%v", messages[0].Content, messages[0].Encrypted)
+	}
+	
+	// A peer we have no prekeys from is not sent anything sealed to its
+	// static key; the DM waits for them to be sealed on a session
+	carol := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := carol.LoadOrGenerateKeys("carol"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	carolID := hex.EncodeToString(carol.GetPublicKey())
+	if _, err := alice.SendDM(carolID, "secret for carol"); err != nil {
+		t.Fatalf("Failed to queue DM: %v", err)
+	}
+	
+	queued, err := alice.db.GetQueuedForPeer(carolID)
+	if err != nil || len(queued) != 1 {
+		t.Fatalf("Expected one queued DM, got %d: %v", len(queued), err)
+	}
+	if !queued[0].Unsealed {
+		t.Error("Expected the queued DM to wait for carol's prekeys")
+	}
+	
+	// Knowing her address is not enough
+	alice.AddPeer(carolID, "carol", "mem:carol")
+	alice.flushQueue(carolID)
+	if queued, _ := alice.db.GetQueuedForPeer(carolID); len(queued) != 1 || !queued[0].Unsealed {
+		t.Errorf("Expected the DM to stay queued without prekeys, got %v", queued)
+	}
+}
+
+func TestRatchetDMSession(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	alice.AddBootstrapAddress(bob.address)
+	alice.sendHeartbeat()
+	
+	// The handshake makes alice ask bob for a one-time prekey
+	var oneTimeID uint32
+	waitFor(t, "bob's prekey bundle", func() bool {
+		peer, ok := findPeer(alice, bob.ID)
+		if !ok || peer.Prekey == nil {
+			return false
+		}
+		oneTimeID = peer.Prekey.OneTimePrekeyID
+		return oneTimeID != 0
+	})
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	received := func(node *testNode, roomID string, count int) func() bool {
+		return func() bool {
+			messages, _ := node.db.GetMessages(roomID, 10)
+			return len(messages) == count
+		}
+	}
+	
+	if _, err := alice.SendDM(bobID, "hello bob"); err != nil {
+		t.Fatalf("Failed to send DM: %v", err)
+	}
+	waitFor(t, "the first DM", received(bob, dmRoomID(aliceID), 1))
+	
+	if _, err := bob.db.GetPrekey(int64(oneTimeID)); err != database.ErrPrekeyNotFound {
+		t.Errorf("Expected bob to delete the used one-time prekey, got %v", err)
+	}
+	if peer, _ := findPeer(alice, bob.ID); peer.Prekey.OneTimePrekeyID != 0 {
+		t.Error("Expected alice not to reuse bob's one-time prekey")
+	}
+	
+	if _, err := bob.SendDM(aliceID, "hi alice"); err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	waitFor(t, "the reply", received(alice, dmRoomID(bobID), 2))
+	
+	if _, err := alice.SendDM(bobID, "again"); err != nil {
+		t.Fatalf("Failed to send DM: %v", err)
+	}
+	waitFor(t, "the third DM", received(bob, dmRoomID(aliceID), 3))
+	
+	messages, _ := bob.db.GetMessages(dmRoomID(aliceID), 10)
+	for _, message := range messages {
+		if !message.Encrypted {
+			t.Errorf("Expected %q to arrive encrypted", message.Content)
+		}
+	}
+	
+	// Both ends keep the same session, and alice stopped sending the X3DH
+	// header once bob answered
+	aliceSession, err := alice.loadSession(bob.ID, "")
+	if err != nil {
+		t.Fatalf("Failed to load alice's session: %v", err)
+	}
+	if aliceSession.PendingX3DH != nil {
+		t.Error("Expected the X3DH header to be dropped after bob's reply")
+	}
+	if _, err := bob.loadSession(alice.ID, aliceSession.ID); err != nil {
+		t.Errorf("Expected bob to hold session %s: %v", aliceSession.ID, err)
+	}
+	
+	// The /dm command seals on the same session
+	command := NewMessage("", aliceID, "alice", "/dm "+bobID+" over the command", "")
+	frame, err := alice.messageHandler.ProcessSlashCommand(command)
+	if err != nil {
+		t.Fatalf("Failed to run /dm: %v", err)
+	}
+	if dm := frame.Payload.(DMPayload); !dm.IsEncrypted || dm.Ratchet == nil {
+		t.Errorf("Expected /dm to seal on the ratchet session, got %+v", dm)
+	}
+	
+	// Alice advertised the ratchet, so a DM from her in the clear is refused
+	peer, _ := findPeer(bob, alice.ID)
+	plain := NewProtocolMessage(MessageTypeDM, alice.ID, generateMessageID())
+	if err := bob.handleDM(plain, peer, DMPayload{Content: "in the clear"}); err != ErrPlaintextDM {
+		t.Errorf("Expected a DM in the clear to be refused, got %v", err)
+	}
+}
+
+func TestSendDMEndpoint(t *testing.T) {
+	server, _ := newTestServer(t)
+	carol := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := carol.LoadOrGenerateKeys("carol"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	carolID := carol.GetPublicKeyBase58()
+	
+	send := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.handleSendDM(recorder, httptest.NewRequest(http.MethodPost, "/api/dms/send", strings.NewReader(body)))
+		return recorder
+	}
+	
+	if recorder := send(`{"recipient": "carol", "content": "hi"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a recipient that is not a key to be refused, got %d", recorder.Code)
+	}
+	
+	recorder := send(fmt.Sprintf(`{"recipient": %q, "content": "hello carol"}`, carolID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the DM to be sent, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var message types.Message
+	if err := json.NewDecoder(recorder.Body).Decode(&message); err != nil || message.RoomID != dmRoomID(carolID) {
+		t.Errorf("Expected our copy of the DM, got %+v: %v", message, err)
+	}
+	
+	// Without carol's prekeys it waits to be sealed on a session
+	queued, err := server.db.GetQueuedForPeer(hex.EncodeToString(carol.GetPublicKey()))
+	if err != nil || len(queued) != 1 || !queued[0].Unsealed {
+		t.Errorf("Expected the DM to wait for carol's prekeys, got %v: %v", queued, err)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	if queueBackoff(1) != QueueBaseBackoff || queueBackoff(3) != 4*QueueBaseBackoff {
+		t.Errorf("Expected doubling backoff, got %v and %v", queueBackoff(1), queueBackoff(3))
+	}
+	if queueBackoff(50) != QueueMaxBackoff {
+		t.Errorf("Expected backoff capped at %v, got %v", QueueMaxBackoff, queueBackoff(50))
+	}
+}
+
+func TestLegacyPeerSpokenToInItsVersion(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	// A 1.0 node: no version range or features in its heartbeat
+	legacy := transport.NewLoopbackTransport(network, "legacy")
+	defer legacy.Close()
+	frames := make(chan []byte, 16)
+	legacy.Listen(func(from string, data []byte) { frames <- data })
+	
+	legacyKey := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := legacyKey.LoadOrGenerateKeys("legacy"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	legacyID := hex.EncodeToString(legacyKey.GetPublicKey())
+	
+	heartbeat := NewProtocolMessage(MessageTypeHeartbeat, legacyID, generateMessageID())
+	heartbeat.Version = "1.0"
+	heartbeat.SetPayload(HeartbeatPayload{
+		Nickname:    "legacy",
+		PublicKey:   legacyID,
+		Addresses:   []string{"mem:legacy"},
+		ActiveRooms: []string{},
+	})
+	heartbeat.Sign(legacyKey.GetPrivateKey())
+	data, _ := heartbeat.ToJSON()
+	if err := alice.ProcessIncomingMessage(data, legacyID); err != nil {
+		t.Fatalf("Expected 1.0 heartbeat to be accepted, got %v", err)
+	}
+	
+	bob.AddBootstrapAddress(alice.address)
+	bob.sendHeartbeat()
+	waitFor(t, "alice to negotiate with bob", func() bool {
+		peer, ok := findPeer(alice, bob.ID)
+		return ok && peer.Version == ProtocolVersion
+	})
+	
+	peer, _ := findPeer(alice, legacyID)
+	if peer.Version != "1.0" || peer.HasFeature(FeatureGossip) {
+		t.Errorf("Expected legacy peer at 1.0 without features, got %s %v", peer.Version, peer.Features)
+	}
+	peer, _ = findPeer(alice, bob.ID)
+	if !peer.HasFeature(FeatureSync) || !peer.HasFeature(FeatureGossip) {
+		t.Errorf("Expected bob's features to be recorded, got %v", peer.Features)
+	}
+	
+	// Alice's own heartbeat reply is in 1.0 so the legacy node can read it
+	for {
+		select {
+		case frame := <-frames:
+			msg, err := ParseProtocolMessage(frame)
+			if err != nil {
+				t.Fatalf("Unreadable frame: %v", err)
+			}
+			if msg.Version != "1.0" {
+				t.Errorf("Expected %s frame in 1.0, got %s", msg.Type, msg.Version)
+			}
+			if msg.Type != MessageTypeHeartbeat {
+				return
+			}
+			if err := alice.SendToPeer(legacyID, NewProtocolMessage(MessageTypePing, alice.ID, generateMessageID())); err != nil {
+				t.Fatalf("Failed to ping: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for frames to the legacy peer")
+		}
+	}
+}
+
+func findPeer(n *testNode, id string) (Peer, bool) {
+	for _, peer := range n.GetPeers() {
+		if peer.ID == id {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+func TestHeartbeatDiscoveryAndExpiry(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	if err := alice.AddBootstrapAddress("mem:bob"); err != nil {
+		t.Fatalf("Failed to add bootstrap address: %v", err)
+	}
+	alice.sendHeartbeat()
+	
+	waitFor(t, "bob to learn about alice", func() bool {
+		peer, ok := findPeer(bob, alice.ID)
+		return ok && peer.Address == "mem:alice" && peer.Nickname == "alice"
+	})
+	waitFor(t, "alice to learn about bob", func() bool {
+		_, ok := findPeer(alice, bob.ID)
+		return ok
+	})
+	
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	bob.sendHeartbeat()
+	
+	waitFor(t, "bob's active rooms", func() bool {
+		peer, _ := findPeer(alice, bob.ID)
+		return len(peer.ActiveRooms) == 1 && peer.ActiveRooms[0] == room.ID
+	})
+	
+	alice.expirePeers(time.Now().Add(PeerStaleTimeout + time.Second))
+	if peer, _ := findPeer(alice, bob.ID); peer.Status != PeerStatusDisconnected {
+		t.Errorf("Expected stale peer to be disconnected, got %s", peer.Status)
+	}
+	
+	alice.expirePeers(time.Now().Add(PeerEvictTimeout + time.Second))
+	if _, ok := findPeer(alice, bob.ID); ok {
+		t.Error("Expected silent peer to be evicted")
+	}
+}
+
+func TestRoomHistorySync(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, bob, room.ID)
+	
+	// Enough history for several pages, two messages per second so pages
+	// split inside a second
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	total := SyncPageSize*2 + 10
+	for i := 0; i < total; i++ {
+		message := NewMessage(room.ID, bobID, "bob", fmt.Sprintf("message %d", i), "")
+		message.Timestamp = base.Add(time.Duration(i/2) * time.Second)
+		if err := message.Sign(bob.cryptoManager.GetPrivateKey()); err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		if err := bob.db.SaveMessage(message); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	
+	// Neither a bad signature nor a signed message by someone outside the
+	// room is merged
+	last := NewMessage(room.ID, bobID, "bob", "last", "")
+	last.Timestamp = base.Add(time.Duration(total) * time.Second)
+	last.Sign(bob.cryptoManager.GetPrivateKey())
+	bob.db.SaveMessage(last)
+	
+	forged := NewMessage(room.ID, bobID, "bob", "forged", "")
+	forged.Signature = "00"
+	bob.db.SaveMessage(forged)
+	
+	carol := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := carol.LoadOrGenerateKeys("carol"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	outsider := NewMessage(room.ID, carol.GetPublicKeyBase58(), "carol", "outsider", "")
+	outsider.Sign(carol.GetPrivateKey())
+	bob.db.SaveMessage(outsider)
+	
+	// Alice learned about the room and bob from an invite and joins it locally
+	learnRoom(t, alice, room, bob)
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	if _, err := alice.roomManager.JoinRoomByInvite(invite, aliceID, "alice", aliceID); err != nil {
+		t.Fatalf("Failed to join locally: %v", err)
+	}
+	
+	// A response nobody asked for is refused
+	bobPeer, _ := findPeer(alice, bob.ID)
+	unsolicited := SyncPayload{RoomID: room.ID, LastSyncTime: time.Now().Unix(), Messages: []SyncMessage{newSyncMessage(last)}}
+	if err := alice.handleSync(nil, bobPeer, unsolicited); err != ErrUnsolicitedSync {
+		t.Errorf("Expected an unsolicited sync response to be refused, got %v", err)
+	}
+	
+	alice.AddBootstrapAddress("mem:bob")
+	alice.sendHeartbeat()
+	waitFor(t, "alice to learn bob's rooms", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 1
+	})
+	
+	alice.AnnounceJoin(room.ID, invite)
+	
+	total++ // and the last message
+	waitFor(t, "history to sync", func() bool {
+		seq, _ := alice.db.GetRoomSeq(room.ID)
+		return seq == int64(total)
+	})
+	
+	// Syncing again must not duplicate anything
+	alice.AnnounceJoin(room.ID, invite)
+	time.Sleep(100 * time.Millisecond)
+	
+	messages, _ := alice.db.GetMessages(room.ID, 1000)
+	if len(messages) != total {
+		t.Errorf("Expected %d messages after resync, got %d", total, len(messages))
+	}
+	for _, message := range messages {
+		if message.Content == "forged" || message.Content == "outsider" {
+			t.Errorf("Expected %s message to be rejected", message.Content)
+		}
+	}
+	
+	// The sync position is the last message merged, not what was refused
+	if alice.LastSyncTime(bob.ID, room.ID) != last.Timestamp.Unix() {
+		t.Errorf("Expected last sync time %d, got %d", last.Timestamp.Unix(), alice.LastSyncTime(bob.ID, room.ID))
+	}
+}
+
+func TestSyncPositionIsPerPeer(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	carol := newTestNode(t, network, "carol")
+	
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, bob, room.ID)
+	
+	learnRoom(t, alice, room, bob)
+	learnRoom(t, carol, room, bob)
+	for _, n := range []*testNode{alice, carol} {
+		for _, member := range []*testNode{alice, carol} {
+			memberID := member.cryptoManager.GetPublicKeyBase58()
+			if _, err := n.roomManager.JoinRoomByInvite(invite, memberID, member.cryptoManager.GetNickname(), memberID); err != nil {
+				t.Fatalf("Failed to join locally: %v", err)
+			}
+		}
+	}
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	if _, err := bob.roomManager.JoinRoomByInvite(invite, aliceID, "alice", aliceID); err != nil {
+		t.Fatalf("Failed to join locally: %v", err)
+	}
+	
+	// Bob has a recent message; only carol kept an older one
+	recent := NewMessage(room.ID, bobID, "bob", "recent", "")
+	recent.Sign(bob.cryptoManager.GetPrivateKey())
+	bob.db.SaveMessage(recent)
+	
+	older := NewMessage(room.ID, bobID, "bob", "older", "")
+	older.Timestamp = time.Now().Add(-time.Hour)
+	older.Sign(bob.cryptoManager.GetPrivateKey())
+	carol.db.SaveMessage(older)
+	
+	alice.AddBootstrapAddress("mem:bob")
+	alice.sendHeartbeat()
+	waitFor(t, "alice to learn bob's rooms", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 1
+	})
+	alice.AnnounceJoin(room.ID, invite)
+	waitFor(t, "bob's history to sync", func() bool {
+		exists, _ := alice.db.MessageExists(recent.ID)
+		return exists
+	})
+	
+	// Syncing with bob says nothing about what carol has
+	alice.AddBootstrapAddress("mem:carol")
+	alice.sendHeartbeat()
+	waitFor(t, "alice to learn carol's rooms", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 2
+	})
+	if since := alice.LastSyncTime(carol.ID, room.ID); since != 0 {
+		t.Errorf("Expected no sync position for carol yet, got %d", since)
+	}
+	alice.syncWithPeer(carol.ID, []string{room.ID})
+	waitFor(t, "carol's history to sync", func() bool {
+		exists, _ := alice.db.MessageExists(older.ID)
+		return exists
+	})
+}
+
+func TestPrivateRoomSyncStartsAtJoin(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := alice.roomManager.CreateRoom("Secret", "", true, aliceID, "alice", aliceID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, alice, room.ID)
+	
+	post := func(text string, at time.Time) *types.Message {
+		message := NewMessage(room.ID, aliceID, "alice", text, "")
+		message.Encrypted = true
+		message.Timestamp = at
+		message.Sign(alice.cryptoManager.GetPrivateKey())
+		if err := alice.db.SaveMessage(message); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+		return message
+	}
+	before := post("before bob", time.Now().Add(-time.Hour))
+	if _, err := alice.roomManager.JoinRoomByInvite(invite, bobID, "bob", bobID); err != nil {
+		t.Fatalf("Failed to add bob: %v", err)
+	}
+	after := post("after bob", time.Now().Add(2*time.Second))
+	
+	learnRoom(t, bob, room, alice)
+	if _, err := bob.roomManager.JoinRoomByInvite(invite, bobID, "bob", bobID); err != nil {
+		t.Fatalf("Failed to join locally: %v", err)
+	}
+	
+	// Meeting alice makes bob ask for the room's history
+	bob.AddBootstrapAddress("mem:alice")
+	bob.sendHeartbeat()
+	waitFor(t, "the history since bob joined", func() bool {
+		exists, _ := bob.db.MessageExists(after.ID)
+		return exists
+	})
+	
+	if exists, _ := bob.db.MessageExists(before.ID); exists {
+		t.Error("Expected bob not to be sent what came before he joined")
+	}
+	
+	// The page came on a ratchet session, and one in the clear or sealed
+	// with the static keys is refused
+	if !bob.hasSession(alice.ID) {
+		t.Error("Expected the history to start a ratchet session with alice")
+	}
+	alicePeer, _ := findPeer(bob, alice.ID)
+	page, _ := json.Marshal([]SyncMessage{newSyncMessage(after)})
+	plain := SyncPayload{RoomID: room.ID, Messages: []SyncMessage{newSyncMessage(after)}}
+	if err := bob.handleSync(nil, alicePeer, plain); err != ErrUnsealedSync {
+		t.Errorf("Expected private history in the clear to be refused, got %v", err)
+	}
+	static, err := sealDMPayload(alice.cryptoManager, bob.cryptoManager.GetPublicKey(), string(page))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if err := bob.handleSync(nil, alicePeer, SyncPayload{RoomID: room.ID, Sealed: &static}); err != ErrUnsealedSync {
+		t.Errorf("Expected private history sealed with the static keys to be refused, got %v", err)
+	}
+}
+
+func TestStampMessageFollowsReceivedClocks(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	room, err := alice.roomManager.CreateRoom("General", "", false, aliceID, "alice", aliceID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	
+	first := NewMessage(room.ID, aliceID, "alice", "first", "")
+	alice.roomManager.StampMessage(first)
+	if first.Clock != 1 || len(first.Parents) != 0 {
+		t.Errorf("Expected first message at clock 1 without parents, got %d %v", first.Clock, first.Parents)
+	}
+	alice.db.SaveMessage(first)
+	
+	// A peer that has seen more of the room moves our clock forward
+	remote := NewMessage(room.ID, "bob", "bob", "from the future", "")
+	remote.Clock = 41
+	alice.db.SaveMessage(remote)
+	
+	reply := NewMessage(room.ID, aliceID, "alice", "reply", "")
+	alice.roomManager.StampMessage(reply)
+	if reply.Clock != 42 {
+		t.Errorf("Expected clock 42 after receiving clock 41, got %d", reply.Clock)
+	}
+	if len(reply.Parents) != 2 || reply.Parents[1] != remote.ID {
+		t.Errorf("Expected the latest messages as parents, got %v", reply.Parents)
+	}
+	
+	// Messages stamped before either is stored still get their own clocks
+	again := NewMessage(room.ID, aliceID, "alice", "again", "")
+	alice.roomManager.StampMessage(again)
+	if again.Clock != 43 {
+		t.Errorf("Expected clock 43 after stamping 42, got %d", again.Clock)
+	}
+	
+	// A clock far beyond the room's cannot take over its order
+	remote.Clock = math.MaxUint64
+	if err := alice.roomManager.CheckClock(remote); err != ErrClockTooFar {
+		t.Errorf("Expected a huge clock to be refused, got %v", err)
+	}
+	remote.Clock = 43 + MaxClockJump
+	if err := alice.roomManager.CheckClock(remote); err != nil {
+		t.Errorf("Expected a clock within reach to pass, got %v", err)
+	}
+}
+
+func TestUserIDForKey(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	
+	userID, err := userIDForKey(hex.EncodeToString(alice.cryptoManager.GetPublicKey()))
+	if err != nil {
+		t.Fatalf("Failed to map key: %v", err)
+	}
+	
+	if userID != alice.cryptoManager.GetPublicKeyBase58() {
+		t.Errorf("Expected user ID %s, got %s", alice.cryptoManager.GetPublicKeyBase58(), userID)
+	}
+}
+
+func TestPrivateRoomSenderKeys(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	carol := newTestNode(t, network, "carol")
+	eve := newTestNode(t, network, "eve")
+	
+	nodes := []*testNode{alice, bob, carol, eve}
+	for i, a := range nodes {
+		for _, b := range nodes[i+1:] {
+			connectNodes(t, a, b)
+		}
+	}
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	carolID := carol.cryptoManager.GetPublicKeyBase58()
+	room, err := alice.roomManager.CreateRoom("Secret", "", true, aliceID, "alice", aliceID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, alice, room.ID)
+	
+	// eve relays for the room: her node lists herself as a member, but
+	// nobody else's does, so nobody hands her a key
+	members := []*testNode{alice, bob, carol}
+	for _, n := range nodes {
+		joining := members
+		if n == eve {
+			joining = nodes
+		}
+		if n != alice {
+			learnRoom(t, n, room, alice)
+		}
+		for _, member := range joining {
+			memberID := member.cryptoManager.GetPublicKeyBase58()
+			if memberID == aliceID {
+				continue
+			}
+			if _, err := n.roomManager.JoinRoomByInvite(invite, memberID, member.cryptoManager.GetNickname(), memberID); err != nil {
+				t.Fatalf("Failed to join locally: %v", err)
+			}
+		}
+		local, _ := n.roomManager.GetRoom(room.ID)
+		local.PromoteToModerator(aliceID)
+	}
+	
+	for _, n := range nodes {
+		n.sendHeartbeat()
+	}
+	waitFor(t, "room peers to be announced", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 3 && len(bob.peersInRoom(room.ID)) == 3
+	})
+	
+	send := func(from *testNode, text string) *types.Message {
+		t.Helper()
+		userID := from.cryptoManager.GetPublicKeyBase58()
+		message := NewMessage(room.ID, userID, from.cryptoManager.GetNickname(), text, "")
+		message.Encrypted = true
+		if err := from.roomManager.StampMessage(message); err != nil {
+			t.Fatalf("Failed to stamp message: %v", err)
+		}
+		if err := message.Sign(from.cryptoManager.GetPrivateKey()); err != nil {
+			t.Fatalf("Failed to sign message: %v", err)
+		}
+		if err := from.PublishChat(message); err != nil {
+			t.Fatalf("Failed to publish chat: %v", err)
+		}
+		return message
+	}
+	stored := func(n *testNode, id string) bool {
+		exists, _ := n.db.MessageExists(id)
+		return exists
+	}
+	
+	first := send(alice, "for members only")
+	reply := send(bob, "agreed")
+	waitFor(t, "members to read the messages", func() bool {
+		return stored(bob, first.ID) && stored(carol, first.ID) && stored(carol, reply.ID) && stored(alice, reply.ID)
+	})
+	
+	messages, _ := carol.db.GetMessages(room.ID, 10)
+	for _, message := range messages {
+		if !message.Encrypted || (message.Content != "for members only" && message.Content != "agreed") {
+			t.Errorf("Expected carol to read the decrypted message, got %q", message.Content)
+		}
+	}
+	
+	// Give any stray relay time to arrive
+	time.Sleep(100 * time.Millisecond)
+	if stored(eve, first.ID) || stored(eve, reply.ID) {
+		t.Error("Expected the relay outside the room not to read its messages")
+	}
+	
+	oldKey, err := alice.loadSenderKey(room.ID, aliceID, 0)
+	if err != nil {
+		t.Fatalf("Failed to load alice's sender key: %v", err)
+	}
+	
+	if err := alice.KickMember(room.ID, carolID); err != nil {
+		t.Fatalf("Failed to kick carol: %v", err)
+	}
+	waitFor(t, "the kick to reach bob and carol", func() bool {
+		bobRoom, _ := bob.roomManager.GetRoom(room.ID)
+		carolRoom, _ := carol.roomManager.GetRoom(room.ID)
+		return !bobRoom.IsMember(carolID) && !carolRoom.IsMember(carolID)
+	})
+	
+	after := send(alice, "carol is gone")
+	waitFor(t, "bob to read the message after the kick", func() bool { return stored(bob, after.ID) })
+	
+	newKey, err := alice.loadSenderKey(room.ID, aliceID, 0)
+	if err != nil || newKey.KeyID == oldKey.KeyID {
+		t.Fatalf("Expected alice to rotate her sender key after the kick, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if stored(carol, after.ID) {
+		t.Error("Expected carol not to read messages after being kicked")
+	}
+	if _, err := carol.db.GetSenderKey(room.ID, aliceID, int64(newKey.KeyID)); err != database.ErrSenderKeyNotFound {
+		t.Errorf("Expected carol not to be given the new key, got %v", err)
+	}
+	if _, err := eve.db.GetLatestSenderKey(room.ID, aliceID); err != database.ErrSenderKeyNotFound {
+		t.Errorf("Expected eve never to hold a sender key, got %v", err)
+	}
+}
+
+func TestKeyRotationMovesPeerToNewKey(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	oldKey := alice.ID
+	oldID := alice.cryptoManager.GetPublicKeyBase58()
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, bob, room.ID)
+	bob.db.SaveUser(&types.User{ID: oldID, Username: "alice", PublicKey: oldID, CreatedAt: time.Now(), LastSeen: time.Now()})
+	if _, err := bob.roomManager.JoinRoomByInvite(invite, oldID, "alice", oldID); err != nil {
+		t.Fatalf("Failed to join: %v", err)
+	}
+	room.PromoteToModerator(oldID)
+	
+	// Bob compared safety numbers with alice before she rotated
+	number, _ := alice.SafetyNumber(bobID)
+	if err := bob.VerifyContact(oldID, number.Digits, ""); err != nil {
+		t.Fatalf("Failed to verify alice: %v", err)
+	}
+	
+	// Held for alice while she is away: the DM is sealed to the old key
+	for _, kind := range []string{MessageTypeDM, MessageTypeInvite} {
+		bob.db.EnqueueOutbound(&database.QueuedMessage{PeerKey: oldKey, Type: kind, Data: []byte("{}"), NextAttempt: time.Now().Add(time.Hour)})
+	}
+	
+	// And held by alice for someone else who is away
+	carolKey := hex.EncodeToString(make([]byte, 32))
+	join := NewProtocolMessage(MessageTypeJoin, alice.ID, generateMessageID())
+	join.SetPayload(JoinPayload{RoomID: room.ID, Nickname: "alice", PublicKey: alice.ID})
+	dm := NewProtocolMessage(MessageTypeDM, alice.ID, generateMessageID())
+	dm.SetPayload(DMPayload{Content: "sealed", IsEncrypted: true})
+	for _, msg := range []*ProtocolMessage{join, dm} {
+		if err := alice.enqueue(carolKey, msg, 0); err != nil {
+			t.Fatalf("Failed to queue: %v", err)
+		}
+	}
+	
+	oldPrivateKey := alice.cryptoManager.GetPrivateKey()
+	alice.Stop()
+
+	// rotate-key runs in its own process, so the stopped node's keys stay as they were
+	keys := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := keys.RestoreSeed(oldPrivateKey.Seed(), "alice"); err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+	succession, err := keys.RotateKeys()
+	if err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	record, err := successionRecord(succession)
+	if err != nil {
+		t.Fatalf("Failed to build record: %v", err)
+	}
+	if err := alice.db.ApplySuccession(record); err != nil {
+		t.Fatalf("Failed to apply succession: %v", err)
+	}
+	if err := requeueFromKey(alice.db, record.NewKey); err != nil {
+		t.Fatalf("Failed to move the queue: %v", err)
+	}
+	
+	// What she held goes out from the new key, less the sealed DM
+	held, _ := alice.db.GetQueuedForPeer(carolKey)
+	if len(held) != 1 || held[0].Type != MessageTypeJoin {
+		t.Fatalf("Expected only the join to stay queued, got %v", held)
+	}
+	moved, _ := ParseProtocolMessage(held[0].Data)
+	payload, _ := moved.GetTypedPayload()
+	if moved.From != record.NewKey || payload.(JoinPayload).PublicKey != record.NewKey {
+		t.Errorf("Expected the queued join to come from the new key, got %s %v", moved.From, payload)
+	}
+	
+	rotated := NewNode(keys, NewRoomManager(alice.db), NewMessageHandler(keys))
+	rotated.AddTransport(transport.NewLoopbackTransport(network, "alice2"))
+	if err := rotated.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	t.Cleanup(func() { rotated.Stop() })
+	if rotated.ID == oldKey {
+		t.Fatal("Expected the node ID to follow the new key")
+	}
+	
+	var queued []*database.QueuedMessage
+	rotated.AddPeer(bob.ID, "bob", bob.address)
+	rotated.sendHeartbeat()
+	waitFor(t, "bob to apply the succession", func() bool {
+		_, oldKnown := findPeer(bob, oldKey)
+		_, newKnown := findPeer(bob, rotated.ID)
+		queued, _ = bob.db.GetQueuedForPeer(oldKey)
+		return !oldKnown && newKnown && len(queued) == 0
+	})
+	
+	newID := rotated.cryptoManager.GetPublicKeyBase58()
+	if !room.IsMember(newID) || room.IsMember(oldID) || !room.IsModerator(newID) {
+		t.Error("Expected alice's membership and role to move to the new key")
+	}
+	if participants, _ := bob.db.GetRoomParticipants(room.ID); len(participants) != 2 {
+		t.Errorf("Expected two participants after the move, got %v", participants)
+	}
+	if user, err := bob.db.GetUser(newID); err != nil || user.Username != "alice" {
+		t.Errorf("Expected alice's user record under the new key, got %v, %v", user, err)
+	}
+	
+	// The verified key changed, so the room and the DM warn about it
+	for _, roomID := range []string{room.ID, dmRoomID(newID)} {
+		warnings, err := bob.KeyWarnings(roomID)
+		if err != nil || len(warnings) != 1 || warnings[0].PreviousUserID != oldID {
+			t.Errorf("Expected a key change warning in %s, got %v, %v", roomID, warnings, err)
+		}
+	}
+	waitFor(t, "bob's clients to be warned of the key change", func() bool { return bob.notifier.has("key_changed") })
+	
+	// Scanning alice's new code clears the warning
+	number, _ = rotated.SafetyNumber(bobID)
+	if err := bob.VerifyContact(newID, "", number.QRPayload); err != nil {
+		t.Fatalf("Failed to verify alice's new key: %v", err)
+	}
+	if warnings, _ := bob.KeyWarnings(room.ID); len(warnings) != 0 {
+		t.Errorf("Expected no warning once the new key is verified, got %v", warnings)
+	}
+	
+	// The old key cannot come back
+	heartbeat := NewProtocolMessage(MessageTypeHeartbeat, oldKey, generateMessageID())
+	heartbeat.SetPayload(HeartbeatPayload{Nickname: "alice", PublicKey: oldKey, Addresses: []string{"mem:alice"}})
+	if err := heartbeat.Sign(oldPrivateKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	data, _ := heartbeat.ToJSON()
+	if err := bob.ProcessIncomingMessage(data, oldKey); !errors.Is(err, ErrKeyReplaced) {
+		t.Errorf("Expected ErrKeyReplaced for the old key, got %v", err)
+	}
+	
+	// A second record for the same old key is ignored
+	forged := *succession
+	forged.NewKey = bob.cryptoManager.GetPublicKey()
+	if err := bob.applySuccession(Peer{PublicKey: hex.EncodeToString(forged.NewKey)}, &forged); err == nil {
+		t.Error("Expected a conflicting succession to be refused")
+	}
+}
+
+func TestChatVerificationState(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, bob, room.ID)
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	if _, err := bob.roomManager.JoinRoomByInvite(invite, aliceID, "alice", aliceID); err != nil {
+		t.Fatalf("Failed to add alice: %v", err)
+	}
+	bob.sendHeartbeat()
+	waitFor(t, "alice to learn bob's rooms", func() bool {
+		return len(alice.peersInRoom(room.ID)) == 1
+	})
+	
+	publish := func(content string, sign bool) {
+		message := NewMessage(room.ID, aliceID, "alice", content, "")
+		if sign {
+			message.Sign(alice.cryptoManager.GetPrivateKey())
+		}
+		if err := alice.PublishChat(message); err != nil {
+			t.Fatalf("Failed to publish chat: %v", err)
+		}
+	}
+	stored := func(content string) *types.Message {
+		messages, _ := bob.db.GetMessages(room.ID, 10)
+		for _, message := range messages {
+			if message.Content == content {
+				return message
+			}
+		}
+		return nil
+	}
+	
+	publish("signed", true)
+	publish("unsigned", false)
+	waitFor(t, "both messages to be stored", func() bool {
+		return stored("signed") != nil && stored("unsigned") != nil
+	})
+	if state := stored("signed").Verification; state != types.VerificationVerified {
+		t.Errorf("Expected signed message to be verified, got %q", state)
+	}
+	if state := stored("unsigned").Verification; state != types.VerificationUnsigned {
+		t.Errorf("Expected unsigned message to be recorded as unsigned, got %q", state)
+	}
+	
+	// Once signatures are required, only the signed message gets through
+	bob.SetRequireSignatures(true)
+	publish("unsigned again", false)
+	publish("signed again", true)
+	waitFor(t, "the signed message to be stored", func() bool {
+		return stored("signed again") != nil
+	})
+	if stored("unsigned again") != nil {
+		t.Error("Expected unsigned message to be refused while signatures are required")
+	}
+}
+
+func TestRoomInfoKeepsRoomsPrivate(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	room, err := alice.roomManager.CreateRoom("Secret", "", true, aliceID, "alice", aliceID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	promotion, err := alice.CreateInvite(room.ID, RoleModerator, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	if _, err := alice.roomManager.JoinRoomByInvite(promotion.Token, bobID, "bob", bobID); err != nil {
+		t.Fatalf("Failed to add bob: %v", err)
+	}
+	
+	// Bob moderates the room but cannot open it up
+	bobPeer, _ := findPeer(alice, bob.ID)
+	msg := NewProtocolMessage(MessageTypeRoomInfo, bob.ID, generateMessageID())
+	opened := RoomInfoPayload{RoomID: room.ID, Name: "Open", IsPrivate: false}
+	if err := alice.handleRoomInfo(msg, bobPeer, opened); err != ErrRoomStaysPrivate {
+		t.Errorf("Expected ErrRoomStaysPrivate, got %v", err)
+	}
+	stored, _ := alice.db.GetRoom(room.ID)
+	if !room.IsPrivate || !stored.IsPrivate || stored.Name != "Secret" {
+		t.Errorf("Expected the room to be left private and unchanged, got %+v", stored)
+	}
+	
+	renamed := RoomInfoPayload{RoomID: room.ID, Name: "Still secret", IsPrivate: true}
+	if err := alice.handleRoomInfo(msg, bobPeer, renamed); err != nil {
+		t.Fatalf("Failed to take room info: %v", err)
+	}
+	if stored, _ := alice.db.GetRoom(room.ID); stored.Name != "Still secret" || !stored.IsPrivate {
+		t.Errorf("Expected a moderator to rename the room, got %+v", stored)
+	}
+}
+
+func TestInviteConstraints(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	connectNodes(t, alice, bob)
+	
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	join := func(token, userID string) error {
+		_, err := bob.roomManager.JoinRoomByInvite(token, userID, "user", userID)
+		return err
+	}
+	
+	// A single-use invite that makes its user a moderator
+	single, err := bob.CreateInvite(room.ID, RoleModerator, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	carolID := newTestNode(t, network, "carol").cryptoManager.GetPublicKeyBase58()
+	daveID := newTestNode(t, network, "dave").cryptoManager.GetPublicKeyBase58()
+	if err := join(single.Token, carolID); err != nil {
+		t.Fatalf("Failed to join: %v", err)
+	}
+	if !room.IsModerator(carolID) {
+		t.Error("Expected the invite to grant the moderator role")
+	}
+	if roles, _ := bob.db.GetParticipantRoles(room.ID); roles[carolID] != RoleModerator {
+		t.Errorf("Expected the role to be stored, got %q", roles[carolID])
+	}
+	if err := join(single.Token, daveID); err != database.ErrInviteUsedUp {
+		t.Errorf("Expected ErrInviteUsedUp for a second user, got %v", err)
+	}
+	
+	expired, _ := bob.cryptoManager.IssueInvite(room.ID, RoleMember, 0, -time.Minute)
+	token, _ := expired.Token()
+	if err := join(token, daveID); err != security.ErrInviteExpired {
+		t.Errorf("Expected ErrInviteExpired, got %v", err)
+	}
+	
+	// Outsiders cannot invite, and members can only invite members
+	outsider, _ := alice.cryptoManager.IssueInvite(room.ID, RoleMember, 0, time.Hour)
+	token, _ = outsider.Token()
+	if err := join(token, daveID); err != ErrInviteIssuer {
+		t.Errorf("Expected ErrInviteIssuer from a non-member, got %v", err)
+	}
+	
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	invite := newInvite(t, bob, room.ID)
+	if err := join(invite, aliceID); err != nil {
+		t.Fatalf("Failed to add alice: %v", err)
+	}
+	promotion, _ := alice.cryptoManager.IssueInvite(room.ID, RoleModerator, 0, time.Hour)
+	token, _ = promotion.Token()
+	if err := join(token, daveID); err != nil {
+		t.Fatalf("Expected a member's invite to admit, got %v", err)
+	}
+	if room.IsModerator(daveID) {
+		t.Error("Expected a member's invite to grant no more than membership")
+	}
+	
+	invites, err := bob.ListInvites(room.ID)
+	if err != nil || len(invites) != 3 {
+		t.Fatalf("Expected the three accepted invites to be listed, got %d (%v)", len(invites), err)
+	}
+	for _, listed := range invites {
+		if listed.ID == single.ID && listed.Uses != 1 {
+			t.Errorf("Expected one use of the single-use invite, got %d", listed.Uses)
+		}
+	}
+	if _, err := alice.ListInvites(room.ID); err == nil {
+		t.Error("Expected only moderators to list invites")
+	}
+	
+	// Alice's node learns the room from bob's invite, with bob as the one
+	// member it knows, and keeps the token out of the room's own code
+	bobPeer, _ := findPeer(alice, bob.ID)
+	offer := NewProtocolMessage(MessageTypeInvite, bob.ID, generateMessageID())
+	if err := alice.handleInvite(offer, bobPeer, InvitePayload{RoomID: room.ID, RoomName: room.Name, InviteCode: invite}); err != nil {
+		t.Fatalf("Failed to take the invite: %v", err)
+	}
+	local, err := alice.roomManager.GetRoom(room.ID)
+	if err != nil || local.InviteCode == invite || !local.IsMember(bobID) {
+		t.Fatalf("Expected the room with bob as a member, got %v, %v", local, err)
+	}
+	
+	// Where the moderators are unknown, only known members invite, and
+	// only as members
+	stranger := security.NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := stranger.LoadOrGenerateKeys("stranger"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	forged, _ := stranger.IssueInvite(room.ID, RoleModerator, 0, time.Hour)
+	token, _ = forged.Token()
+	if _, err := alice.roomManager.JoinRoomByInvite(token, daveID, "dave", daveID); err != ErrInviteIssuer {
+		t.Errorf("Expected ErrInviteIssuer from an unknown issuer, got %v", err)
+	}
+	promotion, _ = bob.cryptoManager.IssueInvite(room.ID, RoleModerator, 0, time.Hour)
+	token, _ = promotion.Token()
+	if _, err := alice.roomManager.JoinRoomByInvite(token, daveID, "dave", daveID); err != nil {
+		t.Fatalf("Failed to join locally: %v", err)
+	}
+	if local.IsModerator(daveID) {
+		t.Error("Expected no more than membership where the moderators are unknown")
+	}
+	
+	// A revocation reaches alice's node as well
+	if _, err := alice.roomManager.JoinRoomByInvite(invite, aliceID, "alice", aliceID); err != nil {
+		t.Fatalf("Failed to join locally: %v", err)
+	}
+	
+	parsed, _ := security.ParseInvite(invite)
+	if err := bob.RevokeInvite(room.ID, parsed.ID); err != nil {
+		t.Fatalf("Failed to revoke invite: %v", err)
+	}
+	if err := join(invite, "someone-else"); err != database.ErrInviteRevoked {
+		t.Errorf("Expected ErrInviteRevoked, got %v", err)
+	}
+	waitFor(t, "the revocation to reach alice", func() bool {
+		revoked, err := alice.db.GetInvite(parsed.ID)
+		return err == nil && revoked.Revoked
+	})
+	
+	// Nobody but a moderator or the issuer can revoke
+	if err := alice.RevokeInvite(room.ID, parsed.ID); err != ErrNotRoomModerator {
+		t.Errorf("Expected ErrNotRoomModerator, got %v", err)
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"golang.org/x/term"
+	"ripcord/security"
+)
+
+const (
+	// PassphraseEnv unlocks the private key when set; NewPassphraseEnv
+	// supplies the new passphrase to change-passphrase
+	PassphraseEnv    = "RIPCORD_PASSPHRASE"
+	NewPassphraseEnv = "RIPCORD_NEW_PASSPHRASE"
+)
+
+var ErrNoPassphrase = errors.New("no passphrase given: use -passphrase-fd, set " + PassphraseEnv + " or run from a terminal")
+
+// passphraseSource reads passphrases from, in order, the file descriptor
+// given with -passphrase-fd (one per line), an environment variable, or a
+// prompt on the terminal
+type passphraseSource struct {
+	fd *bufio.Reader
+}
+
+func newPassphraseSource(fd int) *passphraseSource {
+	source := &passphraseSource{}
+	if fd >= 0 {
+		source.fd = bufio.NewReader(os.NewFile(uintptr(fd), "passphrase"))
+	}
+	return source
+}
+
+// read returns the next passphrase. Confirm asks twice at a terminal.
+func (ps *passphraseSource) read(env, prompt string, confirm bool) ([]byte, error) {
+	if ps.fd != nil {
+		line, err := ps.fd.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	
+	// Taken out of the environment so child processes do not inherit it
+	if value, ok := os.LookupEnv(env); ok {
+		os.Unsetenv(env)
+		return []byte(value), nil
+	}
+	
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, ErrNoPassphrase
+	}
+	
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(passphrase) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// unlockIdentity asks for the passphrase when the private key on disk is
+// protected, so the keys can then be loaded
+func unlockIdentity(cryptoManager *security.CryptoManager, passphrases *passphraseSource) error {
+	if !cryptoManager.IsKeyProtected() {
+		return nil
+	}
+	
+	passphrase, err := passphrases.read(PassphraseEnv, "Passphrase for the private key: ", false)
+	if err != nil {
+		return err
+	}
+	cryptoManager.SetPassphrase(passphrase)
+	return nil
+}
+
+// changePassphrase protects the private key with a new passphrase, or
+// stores it unprotected when the new passphrase is empty
+func changePassphrase(keyPath string, passphrases *passphraseSource) error {
+	cryptoManager, err := loadIdentity(keyPath, passphrases)
+	if err != nil {
+		return err
+	}
+	
+	passphrase, err := passphrases.read(NewPassphraseEnv, "New passphrase (empty to remove): ", true)
+	if err != nil {
+		return err
+	}
+	if err := cryptoManager.ChangePassphrase(passphrase); err != nil {
+		return err
+	}
+	
+	if len(passphrase) == 0 {
+		fmt.Println("Passphrase removed; the private key is stored unprotected")
+	} else {
+		fmt.Println("Passphrase changed")
+	}
+	return nil
+} 
\ No newline at end of file
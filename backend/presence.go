@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Statuses a user shows. A client sets its connection online, away or
+// busy; a user without connections is offline.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceBusy    = "busy"
+	PresenceOffline = "offline"
+)
+
+const (
+	// TypingInterval is the least time between typing events passed on for
+	// one user in one room. Clients drop an indicator after TypingTimeout
+	// unless another event renews it.
+	TypingInterval = 3 * time.Second
+	TypingTimeout  = 6 * time.Second
+	
+	typingThrottleSweep = 1024 // keys held before quiet ones are forgotten
+)
+
+var ErrInvalidPresence = errors.New("invalid presence status")
+
+// presenceRank orders statuses for aggregation: a user who is busy on any
+// connection is busy, and otherwise online if any connection is active
+var presenceRank = map[string]int{
+	PresenceOffline: 0,
+	PresenceAway:    1,
+	PresenceOnline:  2,
+	PresenceBusy:    3,
+}
+
+func validPresence(status string) bool {
+	_, ok := presenceRank[status]
+	return ok
+}
+
+// strongerPresence returns whichever status wins when a user has both
+func strongerPresence(a, b string) string {
+	if presenceRank[b] > presenceRank[a] {
+		return b
+	}
+	return a
+}
+
+// typingThrottle passes one typing event per key in each interval
+type typingThrottle struct {
+	interval time.Duration
+	last     map[string]time.Time
+	mu       sync.Mutex
+}
+
+func newTypingThrottle(interval time.Duration) *typingThrottle {
+	return &typingThrottle{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow reports whether an event for key may pass now
+func (tt *typingThrottle) allow(key string, now time.Time) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	
+	if last, ok := tt.last[key]; ok && now.Sub(last) < tt.interval {
+		return false
+	}
+	if len(tt.last) >= typingThrottleSweep {
+		for k, last := range tt.last {
+			if now.Sub(last) >= tt.interval {
+				delete(tt.last, k)
+			}
+		}
+	}
+	tt.last[key] = now
+	return true
+}
+
+// presence is the status a peer's user shows: what it last announced while
+// connected, or online for a node that predates presence
+func (p Peer) presence() string {
+	if p.Status != PeerStatusConnected || p.IsBlocked {
+		return PresenceOffline
+	}
+	if p.Presence == "" {
+		return PresenceOnline
+	}
+	return p.Presence
+}
+
+// presencePeers returns the connected peers that understand presence
+func (n *Node) presencePeers() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var peers []string
+	for id, peer := range n.peers {
+		if peer.Status == PeerStatusConnected && !peer.IsBlocked && peer.HasFeature(FeaturePresence) {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// SetPresence records the status our clients add up to and tells the peers
+// when it changes. Heartbeats carry it too, so a peer that missed an update
+// or saw two out of order catches up.
+func (n *Node) SetPresence(status string) {
+	n.mu.Lock()
+	changed := n.presence != status
+	n.presence = status
+	n.mu.Unlock()
+	if !changed {
+		return
+	}
+	
+	for _, peerID := range n.presencePeers() {
+		msg := NewProtocolMessage(MessageTypePresence, n.ID, generateMessageID())
+		msg.To = peerID
+		msg.SetPayload(PresencePayload{Status: status})
+		n.replyToPeer(peerID, msg)
+	}
+}
+
+// PeerPresence returns the status of each peer's user that is not offline,
+// by user ID
+func (n *Node) PeerPresence() map[string]string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	
+	statuses := make(map[string]string)
+	for _, peer := range n.peers {
+		status := peer.presence()
+		if status == PresenceOffline {
+			continue
+		}
+		if userID, err := userIDForKey(peer.PublicKey); err == nil {
+			statuses[userID] = status
+		}
+	}
+	return statuses
+}
+
+// setPeerPresence stores what a peer announced. Clients are told if that
+// changes the status shown, judged against the peer as it was before the
+// message arrived, since a returning peer had been shown offline.
+func (n *Node) setPeerPresence(peer Peer, status string) error {
+	if status != "" && !validPresence(status) {
+		return ErrInvalidPresence
+	}
+	
+	n.mu.Lock()
+	stored, exists := n.peers[peer.ID]
+	if !exists {
+		n.mu.Unlock()
+		return nil
+	}
+	stored.Presence = status
+	after := stored.presence()
+	n.mu.Unlock()
+	
+	if after != peer.presence() {
+		n.notifyPresence(peer.PublicKey, after)
+	}
+	return nil
+}
+
+func (n *Node) notifyPresence(peerKey, status string) {
+	userID, err := userIDForKey(peerKey)
+	if err != nil {
+		return
+	}
+	n.notifyAll(map[string]interface{}{
+		"type":    "presence_update",
+		"user_id": userID,
+		"status":  status,
+	})
+}
+
+func (n *Node) handlePresence(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	update, ok := payload.(PresencePayload)
+	if !ok {
+		return errors.New("presence message missing payload")
+	}
+	return n.setPeerPresence(peer, update.Status)
+}
+
+// PublishTyping tells the room's peers that our user is typing, at most
+// once per TypingInterval. Typing is not queued for peers who are away.
+func (n *Node) PublishTyping(roomID string) error {
+	room, err := n.roomManager.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if !room.IsMember(n.cryptoManager.GetPublicKeyBase58()) {
+		return ErrNotRoomMember
+	}
+	if !n.typingSent.allow(roomID, time.Now()) {
+		return nil
+	}
+	
+	for _, peer := range n.peersInRoom(roomID) {
+		if !peer.HasFeature(FeaturePresence) {
+			continue
+		}
+		msg := NewProtocolMessage(MessageTypeTyping, n.ID, generateMessageID())
+		msg.To = peer.ID
+		msg.RoomID = roomID
+		msg.SetPayload(TypingPayload{RoomID: roomID})
+		n.replyToPeer(peer.ID, msg)
+	}
+	return nil
+}
+
+// handleTyping shows a member's typing to our clients in the room. The
+// sender throttles itself; half the interval is allowed here for jitter.
+func (n *Node) handleTyping(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	typing, ok := payload.(TypingPayload)
+	if !ok {
+		return errors.New("typing message missing payload")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	room, err := n.roomManager.GetRoom(typing.RoomID)
+	if err != nil {
+		return err
+	}
+	if !room.IsMember(userID) {
+		return ErrNotRoomMember
+	}
+	if !n.typingSeen.allow(peer.ID+":"+room.ID, time.Now()) {
+		return nil
+	}
+	
+	n.notifyRoom(room.ID, map[string]interface{}{
+		"type":       "typing",
+		"room_id":    room.ID,
+		"user_id":    userID,
+		"username":   peer.Nickname,
+		"expires_in": TypingTimeout.Milliseconds(),
+	})
+	return nil
+}
+
+// handleWSPresence sets the status of the client's connection. Offline is
+// refused; a connected client is at least away.
+func (s *Server) handleWSPresence(client *WSClient, msg map[string]interface{}) {
+	status, _ := msg["status"].(string)
+	if status == PresenceOffline || !validPresence(status) {
+		s.sendToClient(client, map[string]interface{}{
+			"type":  "error",
+			"error": ErrInvalidPresence.Error(),
+		})
+		return
+	}
+	s.setWSPresence(client, status)
+}
+
+// startWSPresence shows a newly authenticated client the status of every
+// user it may see, then counts its connection online
+func (s *Server) startWSPresence(client *WSClient) {
+	s.wsPresenceMutex.Lock()
+	defer s.wsPresenceMutex.Unlock()
+	
+	for userID, status := range s.node.PeerPresence() {
+		s.sendPresence(client, userID, status)
+	}
+	for userID := range s.wsPresence {
+		s.sendPresence(client, userID, s.userPresence(userID))
+	}
+	s.updateWSPresence(client, PresenceOnline)
+}
+
+func (s *Server) setWSPresence(client *WSClient, status string) {
+	s.wsPresenceMutex.Lock()
+	defer s.wsPresenceMutex.Unlock()
+	s.updateWSPresence(client, status)
+}
+
+// updateWSPresence records the status of one connection, offline once it
+// is gone. Every client is told when that changes the user's status, and
+// the node, whose peers see one user, gets the status of all connections.
+// Events go out under wsPresenceMutex so they reach clients in order.
+func (s *Server) updateWSPresence(client *WSClient, status string) {
+	if client.presenceGone {
+		return
+	}
+	if status == PresenceOffline {
+		client.presenceGone = true
+		// Let go before it authenticated, so it never counted
+		if !client.authenticated.Load() {
+			return
+		}
+	}
+	
+	before := s.userPresence(client.userID)
+	if status == PresenceOffline {
+		delete(s.wsPresence[client.userID], client)
+		if len(s.wsPresence[client.userID]) == 0 {
+			delete(s.wsPresence, client.userID)
+		}
+	} else {
+		if s.wsPresence[client.userID] == nil {
+			s.wsPresence[client.userID] = make(map[*WSClient]string)
+		}
+		s.wsPresence[client.userID][client] = status
+	}
+	
+	if after := s.userPresence(client.userID); after != before {
+		s.NotifyAll(map[string]interface{}{
+			"type":     "presence_update",
+			"user_id":  client.userID,
+			"username": client.username,
+			"status":   after,
+		})
+	}
+	
+	node := PresenceOffline
+	for _, connections := range s.wsPresence {
+		for _, status := range connections {
+			node = strongerPresence(node, status)
+		}
+	}
+	s.node.SetPresence(node)
+}
+
+// userPresence adds up the connections of a user. The caller holds
+// wsPresenceMutex.
+func (s *Server) userPresence(userID string) string {
+	status := PresenceOffline
+	for _, connection := range s.wsPresence[userID] {
+		status = strongerPresence(status, connection)
+	}
+	return status
+}
+
+func (s *Server) sendPresence(client *WSClient, userID, status string) {
+	s.sendToClient(client, map[string]interface{}{
+		"type":    "presence_update",
+		"user_id": userID,
+		"status":  status,
+	})
+}
+
+// handleWSTyping shows the room's other clients, and through the node its
+// members elsewhere, that the user is typing. Clients send it while the
+// user types and it is passed on at most once per TypingInterval, with
+// expires_in in milliseconds.
+func (s *Server) handleWSTyping(client *WSClient, msg map[string]interface{}) {
+	roomID, _ := msg["room_id"].(string)
+	if !s.isSubscribed(client, roomID) {
+		s.sendToClient(client, map[string]interface{}{
+			"type":  "error",
+			"error": ErrWSNotSubscribed.Error(),
+		})
+		return
+	}
+	if !s.wsTyping.allow(client.userID+":"+roomID, time.Now()) {
+		return
+	}
+	
+	s.broadcastToRoom(roomID, map[string]interface{}{
+		"type":       "typing",
+		"room_id":    roomID,
+		"user_id":    client.userID,
+		"username":   client.username,
+		"expires_in": TypingTimeout.Milliseconds(),
+	}, client)
+	
+	if err := s.node.PublishTyping(roomID); err != nil {
+		log.Printf("Failed to publish typing in room %s: %v", roomID, err)
+	}
+}
+
+// forgetWSClient tells the rooms and the user's contacts that a client the
+// hub let go has left
+func (s *Server) forgetWSClient(client *WSClient, rooms []string) {
+	s.announceWSLeave(client, rooms)
+	s.setWSPresence(client, PresenceOffline)
+} 
\ No newline at end of file
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"ripcord/transport"
+)
+
+// expectPresence reads until the status of a user, skipping other events
+func (c *wsTestClient) expectPresence(userID string) string {
+	c.t.Helper()
+	for {
+		event := c.next()
+		if event["type"] == "presence_update" && event["user_id"] == userID {
+			return event["status"].(string)
+		}
+	}
+}
+
+func (rn *recordingNotifier) last(eventType string) map[string]interface{} {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	for i := len(rn.events) - 1; i >= 0; i-- {
+		if rn.events[i]["type"] == eventType {
+			return rn.events[i]
+		}
+	}
+	return nil
+}
+
+func nodePresence(n *Node) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.presence
+}
+
+func TestWebSocketPresence(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	self := server.cryptoManager.GetPublicKeyBase58()
+	room, err := server.roomManager.CreateRoom("General", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	
+	alice := dialTestServer(t, httpServer.URL)
+	aliceID := alice.authenticate(server, "alice")["id"].(string)
+	if status := alice.expectPresence(aliceID); status != PresenceOnline {
+		t.Errorf("Expected alice to be online, got %s", status)
+	}
+	
+	// A second device of alice's, through her session
+	laptop := dialTestServer(t, httpServer.URL)
+	laptop.expect("auth_challenge")
+	laptop.send(map[string]interface{}{"type": "auth", "session_token": alice.session})
+	laptop.expect("auth_response")
+	
+	// Bob is shown who is already here
+	bob := dialTestServer(t, httpServer.URL)
+	bob.authenticate(server, "bob")
+	if status := bob.expectPresence(aliceID); status != PresenceOnline {
+		t.Errorf("Expected bob to be shown alice online, got %s", status)
+	}
+	
+	// An active connection outweighs an idle one, and busy outweighs both
+	laptop.send(map[string]interface{}{"type": "presence_update", "status": PresenceAway})
+	alice.send(map[string]interface{}{"type": "presence_update", "status": PresenceBusy})
+	if status := bob.expectPresence(aliceID); status != PresenceBusy {
+		t.Errorf("Expected alice to be busy, got %s", status)
+	}
+	waitFor(t, "the node to be busy", func() bool { return nodePresence(server.node) == PresenceBusy })
+	
+	alice.send(map[string]interface{}{"type": "presence_update", "status": PresenceAway})
+	if status := bob.expectPresence(aliceID); status != PresenceAway {
+		t.Errorf("Expected alice to be away on both devices, got %s", status)
+	}
+	
+	alice.send(map[string]interface{}{"type": "presence_update", "status": PresenceOffline})
+	alice.expect("error")
+	
+	// Typing reaches the room's other clients once per interval
+	alice.send(map[string]interface{}{"type": "subscribe", "room_id": room.ID})
+	alice.expect("subscribed")
+	bob.send(map[string]interface{}{"type": "subscribe", "room_id": room.ID})
+	bob.expect("subscribed")
+	alice.expect("user_joined")
+	
+	alice.send(map[string]interface{}{"type": "typing", "room_id": room.ID})
+	alice.send(map[string]interface{}{"type": "typing", "room_id": room.ID})
+	alice.send(map[string]interface{}{"type": "send_message", "room_id": room.ID, "content": "hello"})
+	typing := bob.expect("typing")
+	if typing["user_id"] != aliceID || typing["room_id"] != room.ID || typing["expires_in"] != float64(TypingTimeout.Milliseconds()) {
+		t.Errorf("Expected alice typing in the room, got %v", typing)
+	}
+	bob.expect("message")
+	alice.expect("message") // and not her own typing
+	
+	// Alice is offline once her last connection goes
+	alice.conn.Close()
+	laptop.conn.Close()
+	if status := bob.expectPresence(aliceID); status != PresenceOffline {
+		t.Errorf("Expected alice to be offline, got %s", status)
+	}
+	waitFor(t, "the node to be online for bob", func() bool { return nodePresence(server.node) == PresenceOnline })
+}
+
+func TestPresenceAcrossNodes(t *testing.T) {
+	network := transport.NewLoopbackNetwork()
+	alice := newTestNode(t, network, "alice")
+	bob := newTestNode(t, network, "bob")
+	
+	alice.AddBootstrapAddress("mem:bob")
+	alice.sendHeartbeat()
+	waitFor(t, "the nodes to exchange features", func() bool {
+		toBob, _ := findPeer(alice, bob.ID)
+		toAlice, _ := findPeer(bob, alice.ID)
+		return toBob.HasFeature(FeaturePresence) && toAlice.HasFeature(FeaturePresence)
+	})
+	
+	// Without clients alice is offline
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	if status, ok := bob.PeerPresence()[aliceID]; ok {
+		t.Errorf("Expected alice to be offline, got %s", status)
+	}
+	
+	alice.SetPresence(PresenceBusy)
+	waitFor(t, "bob to see alice busy", func() bool { return bob.PeerPresence()[aliceID] == PresenceBusy })
+	if event := bob.notifier.last("presence_update"); event == nil || event["user_id"] != aliceID {
+		t.Errorf("Expected bob's clients to be told, got %v", event)
+	}
+	
+	// Typing reaches the peers in a shared room
+	bobID := bob.cryptoManager.GetPublicKeyBase58()
+	room, err := bob.roomManager.CreateRoom("General", "", false, bobID, "bob", bobID)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	invite := newInvite(t, bob, room.ID)
+	if _, err := bob.roomManager.JoinRoomByInvite(invite, aliceID, "alice", aliceID); err != nil {
+		t.Fatalf("Failed to add alice: %v", err)
+	}
+	learnRoom(t, alice, room, bob)
+	if _, err := alice.roomManager.JoinRoomByInvite(invite, aliceID, "alice", aliceID); err != nil {
+		t.Fatalf("Failed to join locally: %v", err)
+	}
+	bob.sendHeartbeat()
+	waitFor(t, "alice to learn bob's rooms", func() bool { return len(alice.peersInRoom(room.ID)) == 1 })
+	
+	if err := alice.PublishTyping(room.ID); err != nil {
+		t.Fatalf("Failed to publish typing: %v", err)
+	}
+	waitFor(t, "bob to see alice typing", func() bool { return bob.notifier.has("typing") })
+	if typing := bob.notifier.last("typing"); typing["user_id"] != aliceID || typing["room_id"] != room.ID {
+		t.Errorf("Expected alice typing in the room, got %v", typing)
+	}
+	
+	// A peer that goes quiet is shown offline
+	bob.expirePeers(time.Now().Add(PeerStaleTimeout + time.Second))
+	if event := bob.notifier.last("presence_update"); event["status"] != PresenceOffline {
+		t.Errorf("Expected alice to be shown offline, got %v", event)
+	}
+	if _, ok := bob.PeerPresence()[aliceID]; ok {
+		t.Error("Expected a quiet peer to be left out")
+	}
+}
+
+func TestTypingThrottle(t *testing.T) {
+	throttle := newTypingThrottle(TypingInterval)
+	now := time.Now()
+	if !throttle.allow("alice:room", now) || throttle.allow("alice:room", now.Add(time.Second)) {
+		t.Error("Expected one event per interval")
+	}
+	if !throttle.allow("bob:room", now.Add(time.Second)) {
+		t.Error("Expected other keys to pass")
+	}
+	if !throttle.allow("alice:room", now.Add(TypingInterval)) {
+		t.Error("Expected an event once the interval has passed")
+	}
+} 
\ No newline at end of file
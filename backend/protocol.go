@@ -6,10 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"time"
+	"ripcord/security"
 )
 
 const (
-	ProtocolVersion = "1.0"
+	ProtocolVersion = "1.2"
 	
 	MessageTypeHeartbeat = "heartbeat"
 	MessageTypeJoin      = "join"
@@ -24,6 +25,20 @@ const (
 	MessageTypeUserInfo  = "user_info"
 	MessageTypeBlock     = "block"
 	MessageTypeUnblock   = "unblock"
+	MessageTypePrekey    = "prekey"
+	MessageTypeSenderKey = "sender_key"
+	
+	MessageTypeInviteRevoke = "invite_revoke"
+	MessageTypePresence     = "presence"
+	MessageTypeTyping       = "typing"
+)
+
+const (
+	// FrameSigningDomain labels the signed encoding of a protocol frame
+	FrameSigningDomain = "ripcord-frame-v1"
+	
+	// CanonicalSigningVersion is the first version signed canonically
+	CanonicalSigningVersion = "1.2"
 )
 
 type ProtocolMessage struct {
@@ -36,18 +51,50 @@ type ProtocolMessage struct {
 	Payload   interface{} `json:"payload"`
 	Timestamp int64       `json:"timestamp"`
 	Signature string      `json:"signature"`
+	
+	// Hops left for a gossiped room message. It is left out of the
+	// signature so relays can decrement it.
+	TTL int `json:"ttl,omitempty"`
 }
 
 type HeartbeatPayload struct {
 	Nickname    string   `json:"nickname"`
 	PublicKey   string   `json:"public_key"`
 	I2PAddress  string   `json:"i2p_address"`
+	Addresses   []string `json:"addresses,omitempty"` // transport-qualified, every network we listen on
 	ActiveRooms []string `json:"active_rooms"`
+	
+	// The handshake: the range of protocol versions and the optional
+	// features the sender supports. Absent from 1.0 nodes.
+	MinVersion string   `json:"min_version,omitempty"`
+	MaxVersion string   `json:"max_version,omitempty"`
+	Features   []string `json:"features,omitempty"`
+	
+	// Our signed prekey, so peers can start a DM session while we are offline
+	Prekey *security.PrekeyBundle `json:"prekey,omitempty"`
+	
+	// Set for a while after a key rotation, so peers move us to this key
+	Succession *security.Succession `json:"succession,omitempty"`
+	
+	// What our clients add up to. Absent from nodes that predate presence.
+	Presence string `json:"presence,omitempty"`
 }
 
 type ChatPayload struct {
 	Content   string `json:"content"`
 	IsCommand bool   `json:"is_command,omitempty"`
+	
+	Clock   uint64   `json:"clock,omitempty"`
+	Parents []string `json:"parents,omitempty"`
+	
+	// The author's signature over the stored message, so it can be synced onwards
+	Username  string `json:"username,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	
+	// Set in private rooms, where Content is base64 ciphertext under the
+	// author's sender key
+	SenderKey *security.SenderKeyHeader `json:"sender_key,omitempty"`
 }
 
 type JoinPayload struct {
@@ -60,6 +107,7 @@ type JoinPayload struct {
 type LeavePayload struct {
 	RoomID string `json:"room_id"`
 	Reason string `json:"reason,omitempty"`
+	UserID string `json:"user_id,omitempty"` // member a moderator removed; empty when the sender leaves
 }
 
 type InvitePayload struct {
@@ -70,9 +118,45 @@ type InvitePayload struct {
 	IsPrivate   bool   `json:"is_private"`
 }
 
+// InviteRevokePayload carries the revoked invite token, so members that
+// never saw it can still refuse it
+type InviteRevokePayload struct {
+	RoomID string `json:"room_id"`
+	Token  string `json:"token"`
+}
+
+// PresencePayload announces the status of the sender's user when it changes
+type PresencePayload struct {
+	Status string `json:"status"`
+}
+
+// TypingPayload says the sender's user is typing in a room
+type TypingPayload struct {
+	RoomID string `json:"room_id"`
+}
+
 type DMPayload struct {
 	Content     string `json:"content"`
 	IsEncrypted bool   `json:"is_encrypted"`
+	
+	// Set when Content is sealed on a ratchet session rather than with the
+	// static identity keys. X3DH is repeated until the recipient answers.
+	Ratchet *security.RatchetHeader `json:"ratchet,omitempty"`
+	X3DH    *security.X3DHHeader    `json:"x3dh,omitempty"`
+}
+
+// SenderKeyDistribution hands a member our sender key for a private room.
+// It travels as the sealed content of a sender_key message.
+type SenderKeyDistribution struct {
+	RoomID string              `json:"room_id"`
+	Key    *security.SenderKey `json:"key"`
+}
+
+// PrekeyPayload with Request set asks for a bundle with a one-time prekey;
+// the answer carries the bundle
+type PrekeyPayload struct {
+	Request bool                   `json:"request,omitempty"`
+	Bundle  *security.PrekeyBundle `json:"bundle,omitempty"`
 }
 
 type RoomInfoPayload struct {
@@ -91,10 +175,19 @@ type UserInfoPayload struct {
 	IsBlocked   bool   `json:"is_blocked,omitempty"`
 }
 
+// SyncPayload without messages is a request for everything after the
+// cursor: messages in later seconds than LastSyncTime, and those within it
+// whose ID is greater than AfterID. A response carries one page, ordered by
+// second and then ID, and the cursor of its last message. A private room's
+// page comes as Sealed instead: its messages as JSON, sealed to the
+// requester on the pairwise ratchet like a DM.
 type SyncPayload struct {
 	RoomID       string        `json:"room_id"`
 	LastSyncTime int64         `json:"last_sync_time"`
+	AfterID      string        `json:"after_id,omitempty"`
 	Messages     []SyncMessage `json:"messages,omitempty"`
+	Sealed       *DMPayload    `json:"sealed,omitempty"`
+	HasMore      bool          `json:"has_more,omitempty"`
 }
 
 type SyncMessage struct {
@@ -105,6 +198,12 @@ type SyncMessage struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
 	Signature string `json:"signature"`
+	
+	Clock   uint64   `json:"clock,omitempty"`
+	Parents []string `json:"parents,omitempty"`
+	
+	// Encrypted is the author's signed flag
+	Encrypted bool `json:"encrypted,omitempty"`
 }
 
 func NewProtocolMessage(msgType, from, messageID string) *ProtocolMessage {
@@ -135,10 +234,54 @@ func (pm *ProtocolMessage) Sign(privateKey ed25519.PrivateKey) error {
 	return nil
 }
 
+// GetSignableData returns the bytes a frame's signature covers. From 1.2
+// that is the canonical encoding, in which the payload is RFC 8785 JSON,
+// so the signature survives any re-encoding of the frame. Frames in older
+// versions are signed over their JSON, as those nodes expect. The TTL is
+// left out so relays can decrement it.
 func (pm *ProtocolMessage) GetSignableData() ([]byte, error) {
-	tempMsg := *pm
-	tempMsg.Signature = ""
-	return json.Marshal(tempMsg)
+	if versionLess(pm.Version, CanonicalSigningVersion) {
+		tempMsg := *pm
+		tempMsg.Signature = ""
+		tempMsg.TTL = 0
+		return json.Marshal(tempMsg)
+	}
+	
+	var payload []byte
+	if pm.Payload != nil {
+		raw, ok := pm.Payload.(json.RawMessage)
+		if !ok {
+			var err error
+			if raw, err = json.Marshal(pm.Payload); err != nil {
+				return nil, err
+			}
+		}
+		canonical, err := security.CanonicalJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		// A null payload signs the same as none
+		if string(canonical) != "null" {
+			payload = canonical
+		}
+	}
+	
+	return security.NewSignedData(FrameSigningDomain).
+		String(pm.Version).
+		String(pm.Type).
+		String(pm.MessageID).
+		String(pm.From).
+		String(pm.To).
+		String(pm.RoomID).
+		Int64(pm.Timestamp).
+		Bytes(payload).
+		Encoded(), nil
+}
+
+// IsGossip reports whether the message is relayed through the room's peers
+// rather than sent directly by its author
+func (pm *ProtocolMessage) IsGossip() bool {
+	return pm.Type == MessageTypeChat && pm.RoomID != "" && pm.TTL > 0
 }
 
 func (pm *ProtocolMessage) VerifySignature(publicKey ed25519.PublicKey) bool {
@@ -160,7 +303,7 @@ func (pm *ProtocolMessage) VerifySignature(publicKey ed25519.PublicKey) bool {
 }
 
 func (pm *ProtocolMessage) IsValid() error {
-	if pm.Version != ProtocolVersion {
+	if !supportedVersion(pm.Version) {
 		return errors.New("unsupported protocol version")
 	}
 	
@@ -190,6 +333,18 @@ func ParseProtocolMessage(data []byte) (*ProtocolMessage, error) {
 		return nil, err
 	}
 	
+	// Keep the payload bytes as sent so re-marshalling for signature
+	// verification reproduces what the sender signed
+	var raw struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw.Payload) > 0 && string(raw.Payload) != "null" {
+		msg.Payload = raw.Payload
+	}
+	
 	if err := msg.IsValid(); err != nil {
 		return nil, err
 	}
@@ -228,7 +383,7 @@ func (pm *ProtocolMessage) GetTypedPayload() (interface{}, error) {
 		var payload InvitePayload
 		err = json.Unmarshal(payloadBytes, &payload)
 		return payload, err
-	case MessageTypeDM:
+	case MessageTypeDM, MessageTypeSenderKey:
 		var payload DMPayload
 		err = json.Unmarshal(payloadBytes, &payload)
 		return payload, err
@@ -236,7 +391,7 @@ func (pm *ProtocolMessage) GetTypedPayload() (interface{}, error) {
 		var payload RoomInfoPayload
 		err = json.Unmarshal(payloadBytes, &payload)
 		return payload, err
-	case MessageTypeUserInfo:
+	case MessageTypeUserInfo, MessageTypeBlock, MessageTypeUnblock:
 		var payload UserInfoPayload
 		err = json.Unmarshal(payloadBytes, &payload)
 		return payload, err
@@ -244,6 +399,22 @@ func (pm *ProtocolMessage) GetTypedPayload() (interface{}, error) {
 		var payload SyncPayload
 		err = json.Unmarshal(payloadBytes, &payload)
 		return payload, err
+	case MessageTypePrekey:
+		var payload PrekeyPayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		return payload, err
+	case MessageTypeInviteRevoke:
+		var payload InviteRevokePayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		return payload, err
+	case MessageTypePresence:
+		var payload PresencePayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		return payload, err
+	case MessageTypeTyping:
+		var payload TypingPayload
+		err = json.Unmarshal(payloadBytes, &payload)
+		return payload, err
 	default:
 		return pm.Payload, nil
 	}
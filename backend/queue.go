@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"ripcord/database"
+)
+
+const (
+	// QueueRetryInterval is how often the outbound queue is checked for due messages
+	QueueRetryInterval = 5 * time.Second
+	
+	// QueueBaseBackoff is the wait after the first failed attempt; it
+	// doubles with every further failure up to QueueMaxBackoff
+	QueueBaseBackoff = 5 * time.Second
+	QueueMaxBackoff  = 10 * time.Minute
+	
+	// QueueMaxAge is how long a message is held for a peer that never returns
+	QueueMaxAge = 7 * 24 * time.Hour
+	
+	queueBatchSize = 100
+)
+
+// queueable reports whether a message is worth holding for an offline peer.
+// Heartbeats, pings and sync traffic are regenerated when the peer returns.
+func queueable(msgType string) bool {
+	switch msgType {
+	case MessageTypeDM, MessageTypeInvite, MessageTypeJoin, MessageTypeLeave, MessageTypeSenderKey, MessageTypeInviteRevoke:
+		return true
+	}
+	return false
+}
+
+// queueBackoff returns the wait before the next attempt after the given
+// number of failed ones
+func queueBackoff(attempts int) time.Duration {
+	delay := QueueBaseBackoff
+	for i := 1; i < attempts && delay < QueueMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > QueueMaxBackoff {
+		delay = QueueMaxBackoff
+	}
+	return delay
+}
+
+// enqueue stores msg unsigned so it can be signed afresh when it is finally sent
+func (n *Node) enqueue(peerKey string, msg *ProtocolMessage, attempts int) error {
+	queued := *msg
+	queued.Signature = ""
+	
+	data, err := queued.ToJSON()
+	if err != nil {
+		return err
+	}
+	
+	now := time.Now()
+	return n.roomManager.db.EnqueueOutbound(&database.QueuedMessage{
+		PeerKey:     peerKey,
+		Type:        msg.Type,
+		Data:        data,
+		Attempts:    attempts,
+		NextAttempt: now.Add(queueBackoff(attempts)),
+		CreatedAt:   now,
+	})
+}
+
+// enqueueUnsealed holds a DM or sender key for a peer whose prekeys we do
+// not have yet, with its content still readable like our own copy of it.
+// It is sealed on a ratchet session once they arrive, so it never goes out
+// under the static identity key.
+func (n *Node) enqueueUnsealed(peerKey string, msg *ProtocolMessage) error {
+	data, err := msg.ToJSON()
+	if err != nil {
+		return err
+	}
+	
+	now := time.Now()
+	return n.roomManager.db.EnqueueOutbound(&database.QueuedMessage{
+		PeerKey:     peerKey,
+		Type:        msg.Type,
+		Data:        data,
+		NextAttempt: now,
+		CreatedAt:   now,
+		Unsealed:    true,
+	})
+}
+
+// sealQueued encrypts the content of an unsealed queued message for its peer
+func (n *Node) sealQueued(peerID string, msg *ProtocolMessage) error {
+	payload, err := msg.GetTypedPayload()
+	if err != nil {
+		return err
+	}
+	dm, ok := payload.(DMPayload)
+	if !ok {
+		return fmt.Errorf("cannot seal a queued %s", msg.Type)
+	}
+	key, err := recipientKey(peerID)
+	if err != nil {
+		return err
+	}
+	
+	sealed, err := n.sealRatchetDM(peerID, key, dm.Content)
+	if err != nil {
+		return err
+	}
+	msg.SetPayload(sealed)
+	return nil
+}
+
+// QueuedCounts returns the number of messages waiting for each peer
+func (n *Node) QueuedCounts() map[string]int {
+	counts, err := n.roomManager.db.CountQueuedByPeer()
+	if err != nil {
+		log.Printf("Failed to count queued messages: %v", err)
+		return map[string]int{}
+	}
+	return counts
+}
+
+func (n *Node) queueLoop() {
+	defer n.loops.Done()
+	
+	ticker := time.NewTicker(QueueRetryInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.retryDue(time.Now())
+		}
+	}
+}
+
+// retryDue makes another attempt at every queued message whose backoff has
+// passed. A failure holds back the rest of that peer's messages so they
+// keep their order.
+func (n *Node) retryDue(now time.Time) {
+	n.queueMu.Lock()
+	defer n.queueMu.Unlock()
+	
+	items, err := n.roomManager.db.GetDueOutbound(now, queueBatchSize)
+	if err != nil {
+		log.Printf("Failed to load outbound queue: %v", err)
+		return
+	}
+	
+	failed := make(map[string]bool)
+	for _, item := range items {
+		if failed[item.PeerKey] {
+			continue
+		}
+		
+		peer, known := n.queuePeer(item.PeerKey)
+		if !known {
+			// Without an address we wait for the peer's next heartbeat
+			continue
+		}
+		
+		if !n.retryQueued(peer, item) {
+			failed[item.PeerKey] = true
+		}
+	}
+}
+
+// flushQueue sends everything queued for a peer that has just been heard
+// from, ignoring the backoff
+func (n *Node) flushQueue(peerID string) {
+	n.queueMu.Lock()
+	defer n.queueMu.Unlock()
+	
+	items, err := n.roomManager.db.GetQueuedForPeer(peerID)
+	if err != nil {
+		log.Printf("Failed to load outbound queue for %s: %v", shortKey(peerID), err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+	
+	peer, known := n.queuePeer(peerID)
+	if !known {
+		return
+	}
+	
+	sent := 0
+	for _, item := range items {
+		if !n.retryQueued(peer, item) {
+			break
+		}
+		sent++
+	}
+	
+	if sent > 0 {
+		log.Printf("Delivered %d queued messages to %s", sent, peer.Nickname)
+	}
+}
+
+func (n *Node) queuePeer(peerID string) (Peer, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	
+	peer, exists := n.peers[peerID]
+	if !exists || peer.IsBlocked {
+		return Peer{}, false
+	}
+	return *peer, true
+}
+
+// retryQueued makes one delivery attempt and reports whether the message
+// has left the queue
+func (n *Node) retryQueued(peer Peer, item *database.QueuedMessage) bool {
+	if time.Since(item.CreatedAt) > QueueMaxAge {
+		log.Printf("Dropping %s queued for %s since %s", item.Type, peer.Nickname, item.CreatedAt.Format(time.RFC3339))
+		return n.dequeue(item)
+	}
+	
+	msg, err := ParseProtocolMessage(item.Data)
+	if err != nil {
+		log.Printf("Dropping unreadable queued message %d: %v", item.ID, err)
+		return n.dequeue(item)
+	}
+	
+	// A fresh timestamp keeps it inside the receiver's skew window
+	msg.Timestamp = time.Now().Unix()
+	
+	err = nil
+	if item.Unsealed {
+		err = n.sealQueued(peer.ID, msg)
+	}
+	if err == nil {
+		err = n.signAndSend(&peer, msg)
+	}
+	if err != nil {
+		attempts := item.Attempts + 1
+		if err := n.roomManager.db.UpdateOutboundAttempt(item.ID, attempts, time.Now().Add(queueBackoff(attempts))); err != nil {
+			log.Printf("Failed to update queued message %d: %v", item.ID, err)
+		}
+		return false
+	}
+	
+	return n.dequeue(item)
+}
+
+func (n *Node) dequeue(item *database.QueuedMessage) bool {
+	if err := n.roomManager.db.DeleteOutbound(item.ID); err != nil {
+		log.Printf("Failed to remove queued message %d: %v", item.ID, err)
+		return false
+	}
+	return true
+}
+
+// deliverOrQueue sends msg to a peer, falling back to the outbound queue
+// when the peer is offline or the send fails
+func (n *Node) deliverOrQueue(peerID string, peer *Peer, msg *ProtocolMessage) error {
+	if peer == nil || peer.Status != PeerStatusConnected {
+		return n.enqueue(peerID, msg, 0)
+	}
+	
+	if err := n.signAndSend(peer, msg); err != nil {
+		log.Printf("Queueing %s for %s: %v", msg.Type, peer.Nickname, err)
+		if err := n.enqueue(peerID, msg, 1); err != nil {
+			return fmt.Errorf("failed to queue %s: %v", msg.Type, err)
+		}
+	}
+	return nil
+} 
\ No newline at end of file
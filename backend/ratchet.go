@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+const (
+	// SignedPrekeyLifetime is how long a signed prekey is published before it
+	// is replaced. Replaced keys are kept for sessions still being set up.
+	SignedPrekeyLifetime = 7 * 24 * time.Hour
+	SignedPrekeyGrace    = 4 * SignedPrekeyLifetime
+	
+	// OneTimePrekeyCount is the pool of unissued one-time prekeys we keep
+	OneTimePrekeyCount = 20
+	
+	// Issued one-time prekeys nobody used are dropped after this long
+	IssuedPrekeyExpiry = 30 * 24 * time.Hour
+)
+
+var (
+	ErrUnknownSession = errors.New("dm belongs to an unknown session")
+	ErrNoPrekeyBundle = errors.New("no prekeys from the peer yet; try again once it has been online")
+)
+
+func securityPrekey(prekey *database.Prekey) *security.Prekey {
+	return &security.Prekey{
+		ID:         uint32(prekey.ID),
+		PrivateKey: prekey.PrivateKey,
+		PublicKey:  prekey.PublicKey,
+		Signature:  prekey.Signature,
+	}
+}
+
+// newPrekey generates and stores a prekey. IDs are random so a replaced key
+// never shares an ID with one a peer may still hold.
+func (n *Node) newPrekey(kind string) (*database.Prekey, error) {
+	db := n.roomManager.db
+	
+	var id uint32
+	for id == 0 {
+		id = rand.Uint32()
+		if _, err := db.GetPrekey(int64(id)); err == nil {
+			id = 0
+		}
+	}
+	
+	prekey, err := security.GeneratePrekey(id)
+	if err != nil {
+		return nil, err
+	}
+	if kind == database.PrekeySigned {
+		if err := n.cryptoManager.SignPrekey(prekey); err != nil {
+			return nil, err
+		}
+	}
+	
+	stored := &database.Prekey{
+		ID:         int64(id),
+		Kind:       kind,
+		PrivateKey: prekey.PrivateKey,
+		PublicKey:  prekey.PublicKey,
+		Signature:  prekey.Signature,
+		CreatedAt:  time.Now(),
+	}
+	return stored, db.SavePrekey(stored)
+}
+
+// signedPrekey returns the signed prekey we publish, rotating it once it is
+// older than SignedPrekeyLifetime
+func (n *Node) signedPrekey() (*database.Prekey, error) {
+	n.prekeyMu.Lock()
+	defer n.prekeyMu.Unlock()
+	
+	db := n.roomManager.db
+	current, err := db.GetLatestPrekey(database.PrekeySigned)
+	if err == nil && time.Since(current.CreatedAt) < SignedPrekeyLifetime {
+		return current, nil
+	}
+	if err != nil && err != database.ErrPrekeyNotFound {
+		return nil, err
+	}
+	
+	if current, err = n.newPrekey(database.PrekeySigned); err != nil {
+		return nil, err
+	}
+	
+	now := time.Now()
+	if err := db.DeleteExpiredPrekeys(now.Add(-SignedPrekeyGrace), now.Add(-IssuedPrekeyExpiry)); err != nil {
+		log.Printf("Failed to prune prekeys: %v", err)
+	}
+	return current, nil
+}
+
+// issueOneTimePrekey tops up the pool and hands out its oldest key
+func (n *Node) issueOneTimePrekey() (*database.Prekey, error) {
+	n.prekeyMu.Lock()
+	defer n.prekeyMu.Unlock()
+	
+	db := n.roomManager.db
+	count, err := db.CountUnissuedPrekeys()
+	if err != nil {
+		return nil, err
+	}
+	for ; count < OneTimePrekeyCount; count++ {
+		if _, err := n.newPrekey(database.PrekeyOneTime); err != nil {
+			return nil, err
+		}
+	}
+	
+	return db.IssueOneTimePrekey()
+}
+
+// prekeyBundle builds the bundle we publish. Heartbeats carry only the
+// signed prekey; a peer that asks is also issued a one-time prekey.
+func (n *Node) prekeyBundle(withOneTime bool) (*security.PrekeyBundle, error) {
+	signed, err := n.signedPrekey()
+	if err != nil {
+		return nil, err
+	}
+	
+	var oneTime *security.Prekey
+	if withOneTime {
+		issued, err := n.issueOneTimePrekey()
+		if err != nil {
+			return nil, err
+		}
+		oneTime = securityPrekey(issued)
+	}
+	
+	return n.cryptoManager.NewPrekeyBundle(securityPrekey(signed), oneTime), nil
+}
+
+// requestPrekeys asks a peer for a bundle with a one-time prekey, so the
+// session we start with it does not rest on the signed prekey alone
+func (n *Node) requestPrekeys(peerID string) {
+	msg := NewProtocolMessage(MessageTypePrekey, n.ID, generateMessageID())
+	msg.To = peerID
+	msg.SetPayload(PrekeyPayload{Request: true})
+	
+	if err := n.SendToPeer(peerID, msg); err != nil {
+		log.Printf("Failed to request prekeys from %s: %v", shortKey(peerID), err)
+	}
+}
+
+// hasSession reports whether we already hold a ratchet session with a peer
+func (n *Node) hasSession(peerID string) bool {
+	_, err := n.roomManager.db.GetLatestSession(peerID)
+	return err == nil
+}
+
+// storePrekeyBundle keeps a verified bundle for starting a session with a peer
+func (n *Node) storePrekeyBundle(peerID string, bundle *security.PrekeyBundle) error {
+	if hex.EncodeToString(bundle.IdentityKey) != peerID {
+		return errors.New("prekey bundle is for another identity")
+	}
+	if err := bundle.Verify(); err != nil {
+		return err
+	}
+	
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	
+	peer, exists := n.peers[peerID]
+	if !exists {
+		return nil
+	}
+	
+	// A heartbeat must not replace the one-time prekey we were issued
+	if current := peer.Prekey; current != nil && len(bundle.OneTimePrekey) == 0 &&
+		current.SignedPrekeyID == bundle.SignedPrekeyID {
+		return nil
+	}
+	peer.Prekey = bundle
+	return nil
+}
+
+// takePrekeyBundle returns a peer's bundle for starting a session. Its
+// one-time prekey is removed from what we keep, since it works only once.
+func (n *Node) takePrekeyBundle(peerID string) *security.PrekeyBundle {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	
+	peer, exists := n.peers[peerID]
+	if !exists || peer.Prekey == nil {
+		return nil
+	}
+	
+	bundle := peer.Prekey
+	if len(bundle.OneTimePrekey) > 0 {
+		spent := *bundle
+		spent.OneTimePrekeyID = 0
+		spent.OneTimePrekey = nil
+		peer.Prekey = &spent
+	}
+	return bundle
+}
+
+// handlePrekey answers a request with a fresh bundle, or keeps the bundle
+// a peer answered ours with
+func (n *Node) handlePrekey(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	prekey, ok := payload.(PrekeyPayload)
+	if !ok {
+		return errors.New("prekey message missing payload")
+	}
+	
+	if !prekey.Request {
+		if prekey.Bundle == nil {
+			return errors.New("prekey message carries no bundle")
+		}
+		if err := n.storePrekeyBundle(peer.ID, prekey.Bundle); err != nil {
+			return err
+		}
+		
+		// Anything that waited for the bundle can be sealed now
+		go n.flushQueue(peer.ID)
+		return nil
+	}
+	
+	bundle, err := n.prekeyBundle(true)
+	if err != nil {
+		return err
+	}
+	
+	reply := NewProtocolMessage(MessageTypePrekey, n.ID, generateMessageID())
+	reply.To = peer.ID
+	reply.SetPayload(PrekeyPayload{Bundle: bundle})
+	
+	n.replyToPeer(peer.ID, reply)
+	return nil
+}
+
+func (n *Node) loadSession(peerID, sessionID string) (*security.Session, error) {
+	var state []byte
+	var err error
+	if sessionID == "" {
+		state, err = n.roomManager.db.GetLatestSession(peerID)
+	} else {
+		state, err = n.roomManager.db.GetSession(peerID, sessionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	return security.UnmarshalSession(state)
+}
+
+func (n *Node) saveSession(peerID string, session *security.Session) error {
+	state, err := session.Marshal()
+	if err != nil {
+		return err
+	}
+	
+	return n.roomManager.db.SaveSession(peerID, session.ID, state)
+}
+
+// sealRatchetDM encrypts DM content on the newest session with a peer,
+// starting one from its prekey bundle when there is none. Only a peer that
+// cannot read ratchet messages gets content sealed to its static identity
+// key. Without a session or a bundle it returns ErrNoPrekeyBundle rather
+// than give up forward secrecy, and asks a known peer for its prekeys.
+func (n *Node) sealRatchetDM(peerID string, recipient ed25519.PublicKey, content string) (DMPayload, error) {
+	n.mu.RLock()
+	peer, known := n.peers[peerID]
+	legacy := known && peer.Version != "" && !peer.HasFeature(FeatureRatchet)
+	n.mu.RUnlock()
+	if legacy {
+		return sealDMPayload(n.cryptoManager, recipient, content)
+	}
+	
+	n.sessionMu.Lock()
+	defer n.sessionMu.Unlock()
+	
+	session, err := n.loadSession(peerID, "")
+	if err == database.ErrSessionNotFound {
+		bundle := n.takePrekeyBundle(peerID)
+		if bundle == nil {
+			if known {
+				go n.requestPrekeys(peerID)
+			}
+			return DMPayload{}, ErrNoPrekeyBundle
+		}
+		session, _, err = n.cryptoManager.InitiateSession(bundle)
+	}
+	if err != nil {
+		return DMPayload{}, err
+	}
+	
+	header, ciphertext, err := session.Encrypt([]byte(content))
+	if err != nil {
+		return DMPayload{}, err
+	}
+	if err := n.saveSession(peerID, session); err != nil {
+		return DMPayload{}, err
+	}
+	
+	return DMPayload{
+		Content:     base64.StdEncoding.EncodeToString(ciphertext),
+		IsEncrypted: true,
+		Ratchet:     header,
+		X3DH:        session.PendingX3DH,
+	}, nil
+}
+
+// openRatchetDM decrypts a DM sent on a ratchet session, accepting the
+// session first if this is the sender's opening X3DH message
+func (n *Node) openRatchetDM(sender ed25519.PublicKey, dm DMPayload, ciphertext []byte) ([]byte, error) {
+	peerID := hex.EncodeToString(sender)
+	
+	n.sessionMu.Lock()
+	defer n.sessionMu.Unlock()
+	
+	var oneTimeID int64
+	session, err := n.loadSession(peerID, dm.Ratchet.SessionID)
+	if err == database.ErrSessionNotFound {
+		if dm.X3DH == nil || security.SessionID(dm.X3DH.EphemeralKey) != dm.Ratchet.SessionID {
+			return nil, ErrUnknownSession
+		}
+		session, err = n.acceptSession(sender, dm.X3DH)
+		oneTimeID = int64(dm.X3DH.OneTimePrekeyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	plaintext, err := session.Decrypt(dm.Ratchet, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.saveSession(peerID, session); err != nil {
+		return nil, err
+	}
+	
+	// The one-time prekey is spent now that its session exists
+	if oneTimeID != 0 {
+		if err := n.roomManager.db.DeletePrekey(oneTimeID); err != nil {
+			log.Printf("Failed to delete used prekey: %v", err)
+		}
+	}
+	return plaintext, nil
+}
+
+func (n *Node) acceptSession(sender ed25519.PublicKey, header *security.X3DHHeader) (*security.Session, error) {
+	db := n.roomManager.db
+	
+	signed, err := db.GetPrekey(int64(header.SignedPrekeyID))
+	if err != nil || signed.Kind != database.PrekeySigned {
+		return nil, fmt.Errorf("%w: signed prekey %d", security.ErrUnknownPrekey, header.SignedPrekeyID)
+	}
+	
+	var oneTime *security.Prekey
+	if header.OneTimePrekeyID != 0 {
+		stored, err := db.GetPrekey(int64(header.OneTimePrekeyID))
+		if err != nil || stored.Kind != database.PrekeyOneTime {
+			return nil, fmt.Errorf("%w: one-time prekey %d", security.ErrUnknownPrekey, header.OneTimePrekeyID)
+		}
+		oneTime = securityPrekey(stored)
+	}
+	
+	return n.cryptoManager.AcceptSession(sender, header, securityPrekey(signed), oneTime)
+} 
\ No newline at end of file
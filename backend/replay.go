@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MaxClockSkew is how far a peer message's timestamp may be from our clock
+	MaxClockSkew = 5 * time.Minute
+	
+	// ReplayCacheSize bounds the number of message IDs remembered at once
+	ReplayCacheSize = 65536
+)
+
+var (
+	ErrReplayedMessage = errors.New("message already seen")
+	ErrTimestampSkew   = errors.New("message timestamp outside the allowed window")
+)
+
+// ReplayGuard remembers the peer messages accepted within the skew window.
+// An ID only has to be kept until its timestamp falls out of the window;
+// from then on the timestamp check rejects a replay by itself.
+type ReplayGuard struct {
+	maxSkew  time.Duration
+	capacity int
+	seen     map[string]time.Time
+	expiry   seenQueue
+	mu       sync.Mutex
+}
+
+type seenEntry struct {
+	key     string
+	expires time.Time
+}
+
+// seenQueue is a min-heap of entries ordered by expiry
+type seenQueue []seenEntry
+
+func (q seenQueue) Len() int            { return len(q) }
+func (q seenQueue) Less(i, j int) bool  { return q[i].expires.Before(q[j].expires) }
+func (q seenQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *seenQueue) Push(x interface{}) { *q = append(*q, x.(seenEntry)) }
+
+func (q *seenQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+func NewReplayGuard(maxSkew time.Duration, capacity int) *ReplayGuard {
+	return &ReplayGuard{
+		maxSkew:  maxSkew,
+		capacity: capacity,
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// CheckTimestamp rejects a unix timestamp further than the skew window from now
+func (g *ReplayGuard) CheckTimestamp(timestamp int64, now time.Time) error {
+	sent := time.Unix(timestamp, 0)
+	if sent.Before(now.Add(-g.maxSkew)) || sent.After(now.Add(g.maxSkew)) {
+		return ErrTimestampSkew
+	}
+	return nil
+}
+
+// Remember records a message key, failing if it was already seen inside
+// the window. When the cache is full the entry closest to expiry is dropped.
+func (g *ReplayGuard) Remember(key string, timestamp int64, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	
+	g.expire(now)
+	
+	if _, exists := g.seen[key]; exists {
+		return ErrReplayedMessage
+	}
+	
+	if len(g.seen) >= g.capacity && g.expiry.Len() > 0 {
+		oldest := heap.Pop(&g.expiry).(seenEntry)
+		delete(g.seen, oldest.key)
+	}
+	
+	// Until sent+skew the timestamp check alone would still let it through
+	expires := time.Unix(timestamp, 0).Add(g.maxSkew)
+	g.seen[key] = expires
+	heap.Push(&g.expiry, seenEntry{key: key, expires: expires})
+	
+	return nil
+}
+
+func (g *ReplayGuard) expire(now time.Time) {
+	for g.expiry.Len() > 0 && !g.expiry[0].expires.After(now) {
+		entry := heap.Pop(&g.expiry).(seenEntry)
+		delete(g.seen, entry.key)
+	}
+}
+
+// Len returns the number of message IDs currently remembered
+func (g *ReplayGuard) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.seen)
+}
+
+// ProtocolMetrics counts what happened to inbound peer messages
+type ProtocolMetrics struct {
+	Accepted         atomic.Uint64
+	Duplicates       atomic.Uint64
+	Replayed         atomic.Uint64
+	Skewed           atomic.Uint64
+	InvalidSignature atomic.Uint64
+	UnknownPeer      atomic.Uint64
+}
+
+// Snapshot returns the counters in a form suitable for the admin API
+func (m *ProtocolMetrics) Snapshot() map[string]uint64 {
+	replayed := m.Replayed.Load()
+	skewed := m.Skewed.Load()
+	invalid := m.InvalidSignature.Load()
+	unknown := m.UnknownPeer.Load()
+	
+	return map[string]uint64{
+		"accepted":          m.Accepted.Load(),
+		"gossip_duplicates": m.Duplicates.Load(),
+		"replayed":          replayed,
+		"timestamp_skew":    skewed,
+		"invalid_signature": invalid,
+		"unknown_peer":      unknown,
+		"rejected":          replayed + skewed + invalid + unknown,
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayGuardWindowAndCapacity(t *testing.T) {
+	guard := NewReplayGuard(time.Minute, 3)
+	now := time.Unix(1700000000, 0)
+	
+	if err := guard.CheckTimestamp(now.Add(-59*time.Second).Unix(), now); err != nil {
+		t.Errorf("Expected timestamp inside the window to pass, got %v", err)
+	}
+	if err := guard.CheckTimestamp(now.Add(61*time.Second).Unix(), now); err != ErrTimestampSkew {
+		t.Errorf("Expected ErrTimestampSkew, got %v", err)
+	}
+	
+	if err := guard.Remember("a", now.Unix(), now); err != nil {
+		t.Fatalf("Failed to remember: %v", err)
+	}
+	if err := guard.Remember("a", now.Unix(), now); err != ErrReplayedMessage {
+		t.Errorf("Expected ErrReplayedMessage, got %v", err)
+	}
+	
+	// Entries are forgotten once their timestamp has left the window
+	later := now.Add(time.Minute)
+	if err := guard.Remember("a", later.Unix(), later); err != nil {
+		t.Errorf("Expected expired entry to be forgotten, got %v", err)
+	}
+	
+	for i := 0; i < 5; i++ {
+		guard.Remember(fmt.Sprintf("b%d", i), later.Unix()+int64(i), later)
+	}
+	if guard.Len() != 3 {
+		t.Errorf("Expected cache bounded at 3 entries, got %d", guard.Len())
+	}
+	if err := guard.Remember("b4", later.Unix()+4, later); err != ErrReplayedMessage {
+		t.Errorf("Expected newest entry to survive eviction, got %v", err)
+	}
+} 
\ No newline at end of file
@@ -8,6 +8,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/mr-tron/base58"
 	"ripcord/database"
+	"ripcord/security"
 	"ripcord/types"
 )
 
@@ -15,7 +16,7 @@ type Room struct {
 	ID          string             `json:"id"`
 	Name        string             `json:"name"`
 	Description string             `json:"description"`
-	InviteCode  string             `json:"invite_code"`
+	InviteCode  string             `json:"invite_code"` // legacy static code; it no longer admits anyone
 	IsPrivate   bool               `json:"is_private"`
 	Members     map[string]*Member `json:"members"`
 	Moderators  map[string]bool    `json:"moderators"`
@@ -37,6 +38,8 @@ type RoomManager struct {
 	rooms   map[string]*Room
 	db      database.Database
 	mu      sync.RWMutex
+	clocks  map[string]uint64 // latest clock stamped in each room
+	clockMu sync.Mutex        // serializes stamping
 }
 
 const (
@@ -47,8 +50,9 @@ const (
 
 func NewRoomManager(db database.Database) *RoomManager {
 	return &RoomManager{
-		rooms: make(map[string]*Room),
-		db:    db,
+		rooms:  make(map[string]*Room),
+		db:     db,
+		clocks: make(map[string]uint64),
 	}
 }
 
@@ -117,6 +121,10 @@ func (rm *RoomManager) CreateRoom(name, description string, isPrivate bool, crea
 		return nil, err
 	}
 	
+	if err := rm.db.SetParticipantRole(room.ID, creatorID, RoleAdmin); err != nil {
+		return nil, err
+	}
+	
 	return room, nil
 }
 
@@ -145,12 +153,12 @@ func (rm *RoomManager) GetRoom(roomID string) (*Room, error) {
 		CreatedAt:   dbRoom.CreatedAt,
 	}
 	
-	participants, err := rm.db.GetRoomParticipants(roomID)
+	roles, err := rm.db.GetParticipantRoles(roomID)
 	if err != nil {
 		return nil, err
 	}
 	
-	for _, userID := range participants {
+	for userID, role := range roles {
 		user, err := rm.db.GetUser(userID)
 		if err != nil {
 			continue
@@ -161,39 +169,114 @@ func (rm *RoomManager) GetRoom(roomID string) (*Room, error) {
 			Username:  user.Username,
 			PublicKey: user.PublicKey,
 			JoinedAt:  user.CreatedAt,
-			Role:      RoleMember,
+			Role:      role,
 			IsBlocked: user.IsBlocked,
 		}
 		
 		room.Members[userID] = member
+		if role == RoleModerator || role == RoleAdmin {
+			room.Moderators[userID] = true
+		}
 	}
 	
 	rm.rooms[roomID] = room
 	return room, nil
 }
 
-func (rm *RoomManager) GetRoomByInviteCode(inviteCode string) (*Room, error) {
-	rm.mu.RLock()
-	defer rm.mu.RUnlock()
+
+const (
+	// MaxParents is how many of the latest messages a new message references
+	MaxParents = 3
 	
-	for _, room := range rm.rooms {
-		if room.InviteCode == inviteCode {
-			return room, nil
+	// MaxClockJump is how far past the latest clock in a room a received
+	// message may be. Every message after it would follow its clock, so a
+	// huge one would leave no room for them.
+	MaxClockJump = 1 << 20
+)
+
+var ErrClockTooFar = errors.New("message clock too far ahead of the room")
+
+// StampMessage gives a new local message a Lamport clock one past the
+// latest message in its room, which already reflects every clock we have
+// received, and references the latest messages as its parents. Messages
+// stamped at the same time still get clocks of their own.
+func (rm *RoomManager) StampMessage(msg *types.Message) error {
+	rm.clockMu.Lock()
+	defer rm.clockMu.Unlock()
+	
+	latest, err := rm.db.GetMessages(msg.RoomID, MaxParents)
+	if err != nil {
+		return err
+	}
+	
+	msg.Clock = rm.clocks[msg.RoomID] + 1
+	msg.Parents = nil
+	for _, parent := range latest {
+		if parent.Clock >= msg.Clock {
+			msg.Clock = parent.Clock + 1
 		}
+		msg.Parents = append(msg.Parents, parent.ID)
 	}
+	rm.clocks[msg.RoomID] = msg.Clock
 	
+	return nil
+}
+
+// LatestClock returns the latest clock in a room, stored or stamped
+func (rm *RoomManager) LatestClock(roomID string) (uint64, error) {
+	latest, err := rm.db.GetMessages(roomID, 1)
+	if err != nil {
+		return 0, err
+	}
+	
+	rm.clockMu.Lock()
+	current := rm.clocks[roomID]
+	rm.clockMu.Unlock()
+	if len(latest) > 0 && latest[0].Clock > current {
+		current = latest[0].Clock
+	}
+	return current, nil
+}
+
+// CheckClock refuses a received message whose clock is more than
+// MaxClockJump past the latest one in its room
+func (rm *RoomManager) CheckClock(msg *types.Message) error {
+	current, err := rm.LatestClock(msg.RoomID)
+	if err != nil {
+		return err
+	}
+	return checkClock(msg.Clock, current)
+}
+
+func checkClock(clock, current uint64) error {
+	if clock > current && clock-current > MaxClockJump {
+		return ErrClockTooFar
+	}
+	return nil
+}
+
+// RoomsForUser lists the IDs of the rooms a user participates in
+func (rm *RoomManager) RoomsForUser(userID string) ([]string, error) {
 	rooms, err := rm.db.GetRooms()
 	if err != nil {
 		return nil, err
 	}
 	
-	for _, dbRoom := range rooms {
-		if dbRoom.InviteCode == inviteCode {
-			return rm.GetRoom(dbRoom.ID)
+	roomIDs := make([]string, 0)
+	for _, room := range rooms {
+		participants, err := rm.db.GetRoomParticipants(room.ID)
+		if err != nil {
+			continue
+		}
+		for _, participant := range participants {
+			if participant == userID {
+				roomIDs = append(roomIDs, room.ID)
+				break
+			}
 		}
 	}
 	
-	return nil, errors.New("room not found")
+	return roomIDs, nil
 }
 
 func (r *Room) AddMember(userID, username, publicKey string) error {
@@ -234,6 +317,17 @@ func (r *Room) IsMember(userID string) bool {
 	return exists
 }
 
+// MemberName returns a member's username, or "" for non-members
+func (r *Room) MemberName(userID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	
+	if member, exists := r.Members[userID]; exists {
+		return member.Username
+	}
+	return ""
+}
+
 func (r *Room) IsModerator(userID string) bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -326,21 +420,119 @@ func (r *Room) GetMembersInfo() []Member {
 	return members
 }
 
-func (rm *RoomManager) JoinRoomByInvite(inviteCode, userID, username, publicKey string) (*Room, error) {
-	room, err := rm.GetRoomByInviteCode(inviteCode)
+// inviteRole checks that issuer may invite people into the room and
+// returns the role their invite actually grants. Only moderators can hand
+// out the moderator role; a member's invite grants membership. Where we
+// do not know who moderates the room, as on the nodes of those invited,
+// the issuer must still be a member we know of and grants membership only.
+func (r *Room) inviteRole(issuer, role string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	
+	if role != RoleMember && role != RoleModerator {
+		return "", ErrInviteRole
+	}
+	if _, exists := r.Members[issuer]; !exists {
+		return "", ErrInviteIssuer
+	}
+	if !r.Moderators[issuer] {
+		return RoleMember, nil
+	}
+	return role, nil
+}
+
+// JoinRoomByInvite admits a user with a signed invite token. The token
+// must be unexpired, unrevoked, have a use left and come from someone who
+// may invite to the room. Uses are counted here, per distinct user.
+func (rm *RoomManager) JoinRoomByInvite(token, userID, username, publicKey string) (*Room, error) {
+	invite, err := security.ParseInvite(token)
 	if err != nil {
 		return nil, err
 	}
+	if invite.Expired(time.Now()) {
+		return nil, security.ErrInviteExpired
+	}
+	
+	room, err := rm.GetRoom(invite.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	
+	issuer := base58.Encode(invite.Issuer)
+	role, err := room.inviteRole(issuer, invite.Role)
+	if err != nil {
+		return nil, err
+	}
+	
+	if err := rm.db.SaveInvite(inviteRecord(invite, token)); err != nil {
+		return nil, err
+	}
+	if err := rm.db.RedeemInvite(invite.ID, userID); err != nil {
+		return nil, err
+	}
 	
 	if err := room.AddMember(userID, username, publicKey); err != nil {
 		return nil, err
 	}
+	if role == RoleModerator {
+		room.PromoteToModerator(userID)
+	}
 	
 	if err := rm.db.AddRoomParticipant(room.ID, userID); err != nil {
 		return nil, err
 	}
 	
-	return room, nil
+	return room, rm.db.SetParticipantRole(room.ID, userID, role)
+}
+
+// AddInvitedRoom keeps a room a peer invited us to. The inviter is the one
+// member we know of, so the invites they signed can be redeemed here.
+func (rm *RoomManager) AddInvitedRoom(dbRoom *database.Room, inviterID, inviterName string) (*Room, error) {
+	if err := rm.db.SaveRoom(dbRoom); err != nil {
+		return nil, err
+	}
+	room, err := rm.GetRoom(dbRoom.ID)
+	if err != nil {
+		return nil, err
+	}
+	if room.IsMember(inviterID) {
+		return room, nil
+	}
+	
+	if err := room.AddMember(inviterID, inviterName, inviterID); err != nil {
+		return nil, err
+	}
+	if err := rm.db.AddRoomParticipant(room.ID, inviterID); err != nil {
+		return nil, err
+	}
+	return room, rm.db.SetParticipantRole(room.ID, inviterID, RoleMember)
+}
+
+// inviteRecord is how an invite token is kept in the database
+func inviteRecord(invite *security.Invite, token string) *database.Invite {
+	return &database.Invite{
+		ID:        invite.ID,
+		RoomID:    invite.RoomID,
+		Issuer:    base58.Encode(invite.Issuer),
+		Role:      invite.Role,
+		MaxUses:   invite.MaxUses,
+		ExpiresAt: time.Unix(invite.ExpiresAt, 0),
+		Token:     token,
+		CreatedAt: time.Unix(invite.IssuedAt, 0),
+	}
+}
+
+// IsPrivate reports whether a room is private, which means its messages
+// are end-to-end encrypted
+func (rm *RoomManager) IsPrivate(roomID string) bool {
+	room, err := rm.GetRoom(roomID)
+	if err != nil {
+		return false
+	}
+	
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.IsPrivate
 }
 
 func (rm *RoomManager) LeaveRoom(roomID, userID string) error {
@@ -356,6 +548,29 @@ func (rm *RoomManager) LeaveRoom(roomID, userID string) error {
 	return rm.db.RemoveRoomParticipant(roomID, userID)
 }
 
+// ReplaceMember moves a user who rotated their identity key over to the
+// new ID in the loaded rooms, keeping their role and moderator status.
+// The database is updated separately, by ApplySuccession.
+func (rm *RoomManager) ReplaceMember(oldID, newID string) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	
+	for _, room := range rm.rooms {
+		room.mu.Lock()
+		if member, exists := room.Members[oldID]; exists {
+			delete(room.Members, oldID)
+			member.UserID = newID
+			member.PublicKey = newID
+			room.Members[newID] = member
+		}
+		if room.Moderators[oldID] {
+			delete(room.Moderators, oldID)
+			room.Moderators[newID] = true
+		}
+		room.mu.Unlock()
+	}
+}
+
 // AddMessage adds a message to the room's in-memory message list (for testing compatibility)
 func (r *Room) AddMessage(msg *types.Message) error {
 	r.mu.Lock()
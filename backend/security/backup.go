@@ -0,0 +1,134 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"github.com/tyler-smith/go-bip39"
+)
+
+const (
+	// BackupVersion is the format written by SealBackup
+	BackupVersion = 1
+	
+	backupInfo = "ripcord-backup-v1"
+)
+
+var (
+	ErrInvalidMnemonic       = errors.New("invalid recovery words")
+	ErrEmptyBackupPassphrase = errors.New("a backup needs a passphrase")
+)
+
+// Backup is everything needed to bring an identity back: the Ed25519 seed,
+// the nickname, and the prekeys peers may still start sessions with
+type Backup struct {
+	Nickname  string         `json:"nickname"`
+	Seed      []byte         `json:"seed"`
+	Prekeys   []BackupPrekey `json:"prekeys,omitempty"`
+	CreatedAt int64          `json:"created_at"`
+}
+
+// BackupPrekey is a stored prekey, private half included
+type BackupPrekey struct {
+	ID         int64  `json:"id"`
+	Kind       string `json:"kind"`
+	PrivateKey []byte `json:"private_key"`
+	PublicKey  []byte `json:"public_key"`
+	Signature  []byte `json:"signature,omitempty"`
+	Issued     bool   `json:"issued"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// Mnemonic encodes the identity seed as 24 BIP39 words. Anyone holding
+// them holds the identity.
+func (cm *CryptoManager) Mnemonic() (string, error) {
+	if cm.keyPair == nil {
+		return "", errors.New("no keys loaded")
+	}
+	return bip39.NewMnemonic(cm.keyPair.PrivateKey.Seed())
+}
+
+// SeedFromMnemonic decodes words written by Mnemonic, checking the checksum
+func SeedFromMnemonic(mnemonic string) ([]byte, error) {
+	words := strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	seed, err := bip39.EntropyFromMnemonic(words)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidMnemonic
+	}
+	return seed, nil
+}
+
+// NewBackup returns a backup of the identity without prekeys, which the
+// caller adds from the database
+func (cm *CryptoManager) NewBackup() (*Backup, error) {
+	if cm.keyPair == nil {
+		return nil, errors.New("no keys loaded")
+	}
+	return &Backup{
+		Nickname:  cm.nickname,
+		Seed:      cm.keyPair.PrivateKey.Seed(),
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+// RestoreSeed replaces the identity with the one a seed derives and saves
+// it, protected by the passphrase if one is set
+func (cm *CryptoManager) RestoreSeed(seed []byte, nickname string) error {
+	if len(seed) != ed25519.SeedSize {
+		return ErrInvalidMnemonic
+	}
+	
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	cm.keyPair = &KeyPair{
+		PrivateKey: privateKey,
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+	cm.nickname = nickname
+	return cm.saveKeys()
+}
+
+// SealBackup encrypts a backup under a passphrase, in the same envelope as
+// a protected key file
+func SealBackup(backup *Backup, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyBackupPassphrase
+	}
+	
+	plaintext, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	kf, err := sealWithPassphrase(plaintext, passphrase, BackupVersion, backupInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(kf, "", "  ")
+}
+
+// OpenBackup decrypts a file written by SealBackup
+func OpenBackup(data, passphrase []byte) (*Backup, error) {
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("not a backup file: %v", err)
+	}
+	if kf.Version != BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", kf.Version)
+	}
+	
+	plaintext, err := kf.open(passphrase, backupInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	var backup Backup
+	if err := json.Unmarshal(plaintext, &backup); err != nil {
+		return nil, err
+	}
+	if len(backup.Seed) != ed25519.SeedSize {
+		return nil, errors.New("backup holds an invalid seed")
+	}
+	return &backup, nil
+} 
\ No newline at end of file
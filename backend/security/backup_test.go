@@ -0,0 +1,84 @@
+package security
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMnemonicRoundTrip(t *testing.T) {
+	cm := newTestIdentity(t, "alice")
+	mnemonic, err := cm.Mnemonic()
+	if err != nil {
+		t.Fatalf("Failed to encode mnemonic: %v", err)
+	}
+	if words := strings.Fields(mnemonic); len(words) != 24 {
+		t.Fatalf("Expected 24 words, got %d", len(words))
+	}
+	
+	// Case and spacing as a user might type them back in
+	seed, err := SeedFromMnemonic("  " + strings.ToUpper(strings.ReplaceAll(mnemonic, " ", "\n ")))
+	if err != nil {
+		t.Fatalf("Failed to decode mnemonic: %v", err)
+	}
+	restored := NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := restored.RestoreSeed(seed, "alice"); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if !restored.GetPublicKey().Equal(cm.GetPublicKey()) {
+		t.Error("Expected the restored key to match")
+	}
+	
+	// One swapped word breaks the checksum
+	words := strings.Fields(mnemonic)
+	words[0], words[1] = words[1], words[0]
+	if words[0] != words[1] {
+		if _, err := SeedFromMnemonic(strings.Join(words, " ")); err != ErrInvalidMnemonic {
+			t.Errorf("Expected ErrInvalidMnemonic for swapped words, got %v", err)
+		}
+	}
+	if _, err := SeedFromMnemonic("abandon abandon abandon"); err != ErrInvalidMnemonic {
+		t.Errorf("Expected ErrInvalidMnemonic for a short list, got %v", err)
+	}
+}
+
+func TestSealedBackup(t *testing.T) {
+	cm := newTestIdentity(t, "alice")
+	backup, err := cm.NewBackup()
+	if err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	backup.Prekeys = []BackupPrekey{{ID: 7, Kind: "signed", PrivateKey: []byte("private"), PublicKey: []byte("public")}}
+	
+	if _, err := SealBackup(backup, nil); err != ErrEmptyBackupPassphrase {
+		t.Errorf("Expected ErrEmptyBackupPassphrase, got %v", err)
+	}
+	data, err := SealBackup(backup, []byte("backup secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal backup: %v", err)
+	}
+	if bytes.Contains(data, backup.Seed) || bytes.Contains(data, []byte("private")) {
+		t.Error("Expected the backup file not to hold key material in the clear")
+	}
+	
+	if _, err := OpenBackup(data, []byte("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+	opened, err := OpenBackup(data, []byte("backup secret"))
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	if opened.Nickname != "alice" || !bytes.Equal(opened.Seed, backup.Seed) || len(opened.Prekeys) != 1 || opened.Prekeys[0].ID != 7 {
+		t.Errorf("Backup did not round trip: %+v", opened)
+	}
+	
+	// A key file is not taken for a backup, even under the same passphrase
+	keyFile, err := sealPrivateKey(cm.GetPrivateKey(), []byte("backup secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal key: %v", err)
+	}
+	if _, err := OpenBackup(keyFile, []byte("backup secret")); err != ErrWrongPassphrase {
+		t.Errorf("Expected a key file to be refused, got %v", err)
+	}
+} 
\ No newline at end of file
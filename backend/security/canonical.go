@@ -0,0 +1,263 @@
+package security
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// SignedData builds the bytes a signature covers: a domain label that
+// names what is signed, then each field in a fixed order. Strings and byte
+// strings carry a 4-byte big-endian length, integers are 8 bytes big-endian
+// and booleans one byte, so no two field lists encode the same.
+type SignedData struct {
+	buf []byte
+}
+
+// NewSignedData starts the encoding with a domain label, NUL terminated
+func NewSignedData(domain string) *SignedData {
+	buf := append([]byte(domain), 0)
+	return &SignedData{buf: buf}
+}
+
+func (sd *SignedData) String(s string) *SignedData {
+	return sd.Bytes([]byte(s))
+}
+
+func (sd *SignedData) Bytes(b []byte) *SignedData {
+	sd.buf = binary.BigEndian.AppendUint32(sd.buf, uint32(len(b)))
+	sd.buf = append(sd.buf, b...)
+	return sd
+}
+
+// Strings encodes a count followed by each string
+func (sd *SignedData) Strings(list []string) *SignedData {
+	sd.buf = binary.BigEndian.AppendUint32(sd.buf, uint32(len(list)))
+	for _, s := range list {
+		sd.String(s)
+	}
+	return sd
+}
+
+func (sd *SignedData) Uint64(v uint64) *SignedData {
+	sd.buf = binary.BigEndian.AppendUint64(sd.buf, v)
+	return sd
+}
+
+// Int64 is encoded in two's complement
+func (sd *SignedData) Int64(v int64) *SignedData {
+	return sd.Uint64(uint64(v))
+}
+
+func (sd *SignedData) Bool(v bool) *SignedData {
+	if v {
+		sd.buf = append(sd.buf, 1)
+	} else {
+		sd.buf = append(sd.buf, 0)
+	}
+	return sd
+}
+
+// Encoded returns the bytes to sign
+func (sd *SignedData) Encoded() []byte {
+	return sd.buf
+}
+
+var ErrNotCanonicalizable = errors.New("JSON cannot be canonicalized")
+
+// CanonicalJSON rewrites a JSON document in the RFC 8785 canonical form:
+// no insignificant whitespace, object members sorted by the UTF-16 code
+// units of their names, strings with minimal escaping and numbers as
+// ECMAScript prints them. Duplicate names and invalid UTF-8 are refused.
+func CanonicalJSON(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("%w: invalid UTF-8", ErrNotCanonicalizable)
+	}
+	
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var out bytes.Buffer
+	if err := canonicalValue(decoder, &out); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err == nil {
+		return nil, fmt.Errorf("%w: trailing data", ErrNotCanonicalizable)
+	}
+	return out.Bytes(), nil
+}
+
+func canonicalValue(decoder *json.Decoder, out *bytes.Buffer) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	
+	switch value := token.(type) {
+	case json.Delim:
+		if value == '[' {
+			return canonicalArray(decoder, out)
+		}
+		return canonicalObject(decoder, out)
+	case string:
+		writeCanonicalString(out, value)
+	case json.Number:
+		number, err := canonicalNumber(value)
+		if err != nil {
+			return err
+		}
+		out.WriteString(number)
+	case bool:
+		out.WriteString(strconv.FormatBool(value))
+	case nil:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+func canonicalArray(decoder *json.Decoder, out *bytes.Buffer) error {
+	out.WriteByte('[')
+	for i := 0; decoder.More(); i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if err := canonicalValue(decoder, out); err != nil {
+			return err
+		}
+	}
+	out.WriteByte(']')
+	_, err := decoder.Token()
+	return err
+}
+
+func canonicalObject(decoder *json.Decoder, out *bytes.Buffer) error {
+	type member struct {
+		name  string
+		key   []uint16
+		value []byte
+	}
+	var members []member
+	seen := make(map[string]bool)
+	
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		name := token.(string)
+		if seen[name] {
+			return fmt.Errorf("%w: duplicate member %q", ErrNotCanonicalizable, name)
+		}
+		seen[name] = true
+		
+		var value bytes.Buffer
+		if err := canonicalValue(decoder, &value); err != nil {
+			return err
+		}
+		members = append(members, member{name, utf16.Encode([]rune(name)), value.Bytes()})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i].key, members[j].key
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	
+	out.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		writeCanonicalString(out, m.name)
+		out.WriteByte(':')
+		out.Write(m.value)
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+func writeCanonicalString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\b':
+			out.WriteString(`\b`)
+		case '\f':
+			out.WriteString(`\f`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(out, `\u%04x`, r)
+			} else {
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteByte('"')
+}
+
+// canonicalNumber formats a number as ECMAScript's Number.prototype.toString
+// does for the nearest double
+func canonicalNumber(number json.Number) (string, error) {
+	f, err := strconv.ParseFloat(string(number), 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("%w: number %s out of range", ErrNotCanonicalizable, number)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+	
+	// Shortest round-tripping digits and the exponent of the first one
+	mantissa, exponent, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	exp, _ := strconv.Atoi(exponent)
+	k := len(digits)
+	n := exp + 1
+	
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k), nil
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:], nil
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits, nil
+	}
+	
+	result := digits[:1]
+	if k > 1 {
+		result += "." + digits[1:]
+	}
+	if n-1 >= 0 {
+		return sign + result + "e+" + strconv.Itoa(n-1), nil
+	}
+	return sign + result + "e" + strconv.Itoa(n-1), nil
+} 
\ No newline at end of file
@@ -0,0 +1,42 @@
+package security
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCanonicalJSONRefusals(t *testing.T) {
+	for name, input := range map[string]string{
+		"duplicate member": `{"a":1,"a":2}`,
+		"invalid UTF-8":    "{\"a\":\"\xff\"}",
+		"trailing data":    `{"a":1} {}`,
+		"out of range":     `[1e400]`,
+	} {
+		if _, err := CanonicalJSON([]byte(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !errors.Is(err, ErrNotCanonicalizable) {
+			t.Errorf("%s: expected ErrNotCanonicalizable, got %v", name, err)
+		}
+	}
+	
+	if _, err := CanonicalJSON([]byte(`{"a":`)); err == nil {
+		t.Error("Expected truncated JSON to be refused")
+	}
+}
+
+func TestSignedDataIsUnambiguous(t *testing.T) {
+	// Moving a byte between adjacent fields must change the encoding
+	a := NewSignedData("test").String("ab").String("c").Encoded()
+	b := NewSignedData("test").String("a").String("bc").Encoded()
+	if bytes.Equal(a, b) {
+		t.Error("Expected length prefixes to separate fields")
+	}
+	
+	if bytes.Equal(NewSignedData("one").Encoded(), NewSignedData("two").Encoded()) {
+		t.Error("Expected the domain to be part of the encoding")
+	}
+	if !bytes.HasPrefix(NewSignedData("ripcord-test").Bool(true).Encoded(), []byte("ripcord-test\x00")) {
+		t.Error("Expected the NUL-terminated domain first")
+	}
+} 
\ No newline at end of file
@@ -20,11 +20,14 @@ type KeyPair struct {
 }
 
 type CryptoManager struct {
-	keyPair   *KeyPair
-	keyPath   string
-	nickname  string
+	keyPair    *KeyPair
+	keyPath    string
+	nickname   string
+	passphrase []byte // protects the private key at rest when set
 }
 
+var errNoKeyFile = errors.New("key file does not exist")
+
 type IdentityData struct {
 	Nickname  string `json:"nickname"`
 	PublicKey string `json:"public_key"`
@@ -52,18 +55,48 @@ func (cm *CryptoManager) GenerateKeyPair() error {
 func (cm *CryptoManager) LoadOrGenerateKeys(nickname string) error {
 	cm.nickname = nickname
 	
-	if err := cm.loadKeys(); err != nil {
+	// Only a missing identity is replaced; a key we cannot unlock is kept
+	err := cm.loadKeys()
+	if err == errNoKeyFile {
 		if err := cm.GenerateKeyPair(); err != nil {
 			return err
 		}
 		return cm.saveKeys()
 	}
+	return err
+}
+
+// SetPassphrase sets the passphrase that unlocks the private key and
+// protects it when it is saved. It must be called before the keys load.
+func (cm *CryptoManager) SetPassphrase(passphrase []byte) {
+	cm.passphrase = passphrase
+}
+
+// IsKeyProtected reports whether the private key on disk is passphrase protected
+func (cm *CryptoManager) IsKeyProtected() bool {
+	data, err := os.ReadFile(cm.keyPath + ".private")
+	return err == nil && isProtectedKeyFile(data)
+}
+
+// ChangePassphrase rewrites the private key under a new passphrase. An
+// empty passphrase stores the key unprotected.
+func (cm *CryptoManager) ChangePassphrase(passphrase []byte) error {
+	if cm.keyPair == nil {
+		return errors.New("no keys loaded")
+	}
+	
+	previous := cm.passphrase
+	cm.passphrase = passphrase
+	if err := cm.savePrivateKey(); err != nil {
+		cm.passphrase = previous
+		return err
+	}
 	return nil
 }
 
 func (cm *CryptoManager) loadKeys() error {
 	if _, err := os.Stat(cm.keyPath); os.IsNotExist(err) {
-		return errors.New("key file does not exist")
+		return errNoKeyFile
 	}
 	
 	data, err := os.ReadFile(cm.keyPath)
@@ -88,13 +121,24 @@ func (cm *CryptoManager) loadKeys() error {
 		return err
 	}
 	
-	privateKeyBytes, err := hex.DecodeString(string(privateKeyData))
-	if err != nil {
-		return err
+	var privateKey ed25519.PrivateKey
+	if isProtectedKeyFile(privateKeyData) {
+		if len(cm.passphrase) == 0 {
+			return ErrPassphraseRequired
+		}
+		if privateKey, err = openPrivateKey(privateKeyData, cm.passphrase, publicKeyBytes); err != nil {
+			return err
+		}
+	} else {
+		privateKeyBytes, err := hex.DecodeString(string(privateKeyData))
+		if err != nil {
+			return err
+		}
+		privateKey = ed25519.PrivateKey(privateKeyBytes)
 	}
 	
 	cm.keyPair = &KeyPair{
-		PrivateKey: ed25519.PrivateKey(privateKeyBytes),
+		PrivateKey: privateKey,
 		PublicKey:  ed25519.PublicKey(publicKeyBytes),
 	}
 	
@@ -116,13 +160,26 @@ func (cm *CryptoManager) saveKeys() error {
 		return err
 	}
 	
-	if err := os.WriteFile(cm.keyPath, data, 0644); err != nil {
+	if err := writeFileAtomic(cm.keyPath, data, 0644); err != nil {
 		return err
 	}
 	
-	privateKeyPath := cm.keyPath + ".private"
-	privateKeyHex := hex.EncodeToString(cm.keyPair.PrivateKey)
-	return os.WriteFile(privateKeyPath, []byte(privateKeyHex), 0600)
+	return cm.savePrivateKey()
+}
+
+// savePrivateKey writes the private key, sealed under the passphrase when
+// there is one and as hex otherwise
+func (cm *CryptoManager) savePrivateKey() error {
+	data := []byte(hex.EncodeToString(cm.keyPair.PrivateKey))
+	if len(cm.passphrase) > 0 {
+		sealed, err := sealPrivateKey(cm.keyPair.PrivateKey, cm.passphrase)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+	
+	return writeFileAtomic(cm.keyPath+".private", data, 0600)
 }
 
 func (cm *CryptoManager) SignMessage(message []byte) []byte {
@@ -155,7 +212,7 @@ func (cm *CryptoManager) GetPublicKeyFingerprint() string {
 		return ""
 	}
 	hash := sha256.Sum256(cm.keyPair.PublicKey)
-	return hex.EncodeToString(hash[:8])
+	return hex.EncodeToString(hash[:])
 }
 
 func (cm *CryptoManager) GetPublicKeyBase58() string {
@@ -0,0 +1,148 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+)
+
+const dmKeyInfo = "ripcord-dm-v1"
+
+var ErrInvalidPublicKey = errors.New("invalid ed25519 public key")
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// X25519PublicKey converts an Ed25519 public key to the X25519 key of the
+// same secret, using the birational map u = (1 + y) / (1 - y)
+func X25519PublicKey(publicKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+	
+	// y is little-endian with the sign of x in the top bit
+	le := make([]byte, ed25519.PublicKeySize)
+	copy(le, publicKey)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, ErrInvalidPublicKey
+	}
+	
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, ErrInvalidPublicKey
+	}
+	denominator.ModInverse(denominator, curve25519P)
+	
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator)
+	u.Mod(u, curve25519P)
+	
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return ecdh.X25519().NewPublicKey(reverse(out))
+}
+
+// x25519PrivateKey derives the X25519 scalar from an Ed25519 seed the same
+// way Ed25519 expands it for signing; X25519 applies the clamping
+func x25519PrivateKey(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	hash := sha512.Sum512(privateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(hash[:32])
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+// DMKey derives the symmetric key shared with a peer from both identity keys
+func (cm *CryptoManager) DMKey(peer ed25519.PublicKey) ([]byte, error) {
+	if cm.keyPair == nil {
+		return nil, errors.New("no identity key loaded")
+	}
+	
+	private, err := x25519PrivateKey(cm.keyPair.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	public, err := X25519PublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, shared, nil, dmKeyInfo, 32)
+}
+
+// dmAssociatedData binds a sealed DM to who sent it and who it is for, so
+// it cannot be replayed in the other direction or to a third party
+func dmAssociatedData(sender, recipient ed25519.PublicKey) []byte {
+	ad := make([]byte, 0, len(dmKeyInfo)+len(sender)+len(recipient))
+	ad = append(ad, dmKeyInfo...)
+	ad = append(ad, sender...)
+	return append(ad, recipient...)
+}
+
+// SealDM encrypts a direct message so only the recipient can read it
+func (cm *CryptoManager) SealDM(recipient ed25519.PublicKey, plaintext []byte) ([]byte, error) {
+	key, err := cm.DMKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	
+	return gcm.Seal(nonce, nonce, plaintext, dmAssociatedData(cm.keyPair.PublicKey, recipient)), nil
+}
+
+// OpenDM decrypts a direct message sealed for us by sender
+func (cm *CryptoManager) OpenDM(sender ed25519.PublicKey, sealed []byte) ([]byte, error) {
+	key, err := cm.DMKey(sender)
+	if err != nil {
+		return nil, err
+	}
+	
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	
+	nonceSize := gcm.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("encrypted data too short")
+	}
+	
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, dmAssociatedData(sender, cm.keyPair.PublicKey))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+} 
\ No newline at end of file
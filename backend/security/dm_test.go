@@ -0,0 +1,65 @@
+package security
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T, nickname string) *CryptoManager {
+	t.Helper()
+	cm := NewCryptoManager(filepath.Join(t.TempDir(), "identity.json"))
+	if err := cm.LoadOrGenerateKeys(nickname); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	return cm
+}
+
+func TestX25519ConversionMatchesPrivateKey(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		cm := newTestIdentity(t, "alice")
+		
+		private, err := x25519PrivateKey(cm.GetPrivateKey())
+		if err != nil {
+			t.Fatalf("Failed to derive private key: %v", err)
+		}
+		public, err := X25519PublicKey(cm.GetPublicKey())
+		if err != nil {
+			t.Fatalf("Failed to convert public key: %v", err)
+		}
+		
+		if !bytes.Equal(private.PublicKey().Bytes(), public.Bytes()) {
+			t.Fatalf("Converted public key %x does not match derived %x", public.Bytes(), private.PublicKey().Bytes())
+		}
+	}
+}
+
+func TestSealAndOpenDM(t *testing.T) {
+	alice := newTestIdentity(t, "alice")
+	bob := newTestIdentity(t, "bob")
+	eve := newTestIdentity(t, "eve")
+	
+	sealed, err := alice.SealDM(bob.GetPublicKey(), []byte("meet at noon"))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	
+	opened, err := bob.OpenDM(alice.GetPublicKey(), sealed)
+	if err != nil || string(opened) != "meet at noon" {
+		t.Fatalf("Expected bob to read the DM, got %q: %v", opened, err)
+	}
+	
+	if _, err := eve.OpenDM(alice.GetPublicKey(), sealed); err == nil {
+		t.Error("Expected a third party to fail to open the DM")
+	}
+	
+	// Bound to the direction it was sent in
+	if _, err := alice.OpenDM(bob.GetPublicKey(), sealed); err == nil {
+		t.Error("Expected the DM not to open as if bob had sent it")
+	}
+	
+	sealed[len(sealed)-1] ^= 1
+	if _, err := bob.OpenDM(alice.GetPublicKey(), sealed); err == nil {
+		t.Error("Expected a tampered DM to be rejected")
+	}
+} 
\ No newline at end of file
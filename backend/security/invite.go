@@ -0,0 +1,113 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const inviteInfo = "ripcord-invite-v1"
+
+var (
+	ErrInvalidInvite = errors.New("invalid invite")
+	ErrInviteExpired = errors.New("invite has expired")
+)
+
+// Invite is a capability to join a room, signed by the member who issued
+// it. It names the role it grants and how long and how often it can be
+// used. MaxUses of 0 means any number of users.
+type Invite struct {
+	ID        string            `json:"id"`
+	RoomID    string            `json:"room_id"`
+	Issuer    ed25519.PublicKey `json:"issuer"`
+	Role      string            `json:"role"`
+	MaxUses   int               `json:"max_uses,omitempty"`
+	IssuedAt  int64             `json:"issued_at"`
+	ExpiresAt int64             `json:"expires_at"`
+	Signature []byte            `json:"signature"`
+}
+
+func (i *Invite) signedData() []byte {
+	return NewSignedData(inviteInfo).
+		String(i.ID).
+		String(i.RoomID).
+		Bytes(i.Issuer).
+		String(i.Role).
+		Int64(int64(i.MaxUses)).
+		Int64(i.IssuedAt).
+		Int64(i.ExpiresAt).
+		Encoded()
+}
+
+// IssueInvite signs an invite to a room that expires after ttl
+func (cm *CryptoManager) IssueInvite(roomID, role string, maxUses int, ttl time.Duration) (*Invite, error) {
+	if cm.keyPair == nil {
+		return nil, errors.New("no keys loaded")
+	}
+	
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	
+	now := time.Now()
+	invite := &Invite{
+		ID:        hex.EncodeToString(id),
+		RoomID:    roomID,
+		Issuer:    cm.keyPair.PublicKey,
+		Role:      role,
+		MaxUses:   maxUses,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	invite.Signature = ed25519.Sign(cm.keyPair.PrivateKey, invite.signedData())
+	return invite, nil
+}
+
+// Verify checks the issuer's signature
+func (i *Invite) Verify() error {
+	if i.ID == "" || i.RoomID == "" || len(i.Issuer) != ed25519.PublicKeySize || i.MaxUses < 0 {
+		return ErrInvalidInvite
+	}
+	if !ed25519.Verify(i.Issuer, i.signedData(), i.Signature) {
+		return ErrInvalidInvite
+	}
+	return nil
+}
+
+// Expired reports whether the invite can no longer be used at now
+func (i *Invite) Expired(now time.Time) bool {
+	return now.Unix() >= i.ExpiresAt
+}
+
+// Token encodes the invite as the string users share
+func (i *Invite) Token() (string, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ParseInvite decodes a shared token and checks its signature. Whether it
+// has expired, been used up or revoked is left to the caller.
+func ParseInvite(token string) (*Invite, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+	
+	var invite Invite
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return nil, ErrInvalidInvite
+	}
+	if err := invite.Verify(); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+} 
\ No newline at end of file
@@ -0,0 +1,63 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInviteToken(t *testing.T) {
+	cm := newTestIdentity(t, "alice")
+	
+	invite, err := cm.IssueInvite("room-1", "moderator", 3, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to issue invite: %v", err)
+	}
+	if !invite.Issuer.Equal(cm.GetPublicKey()) {
+		t.Error("Expected the invite to name its issuer")
+	}
+	if invite.Expired(time.Now()) || !invite.Expired(time.Now().Add(time.Hour)) {
+		t.Error("Expected the invite to expire after an hour")
+	}
+	
+	token, err := invite.Token()
+	if err != nil {
+		t.Fatalf("Failed to encode invite: %v", err)
+	}
+	parsed, err := ParseInvite(token)
+	if err != nil {
+		t.Fatalf("Failed to parse invite: %v", err)
+	}
+	if parsed.ID != invite.ID || parsed.RoomID != "room-1" || parsed.Role != "moderator" || parsed.MaxUses != 3 {
+		t.Errorf("Expected the parsed invite to match, got %+v", parsed)
+	}
+	
+	// Every field is covered by the signature
+	tampered := *invite
+	tampered.Role = "admin"
+	if err := tampered.Verify(); err != ErrInvalidInvite {
+		t.Errorf("Expected ErrInvalidInvite for a changed role, got %v", err)
+	}
+	tampered = *invite
+	tampered.MaxUses = 0
+	if err := tampered.Verify(); err != ErrInvalidInvite {
+		t.Errorf("Expected ErrInvalidInvite for lifted max uses, got %v", err)
+	}
+	tampered = *invite
+	tampered.ExpiresAt += 3600
+	if err := tampered.Verify(); err != ErrInvalidInvite {
+		t.Errorf("Expected ErrInvalidInvite for a later expiry, got %v", err)
+	}
+	
+	// Nobody else can issue in the inviter's name
+	other := newTestIdentity(t, "mallory")
+	forged := *invite
+	forged.RoomID = "room-2"
+	forged.Signature = other.SignMessage(forged.signedData())
+	if err := forged.Verify(); err != ErrInvalidInvite {
+		t.Errorf("Expected ErrInvalidInvite for a forged invite, got %v", err)
+	}
+	
+	if _, err := ParseInvite("not-a-token"); err != ErrInvalidInvite {
+		t.Errorf("Expected ErrInvalidInvite for garbage, got %v", err)
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,189 @@
+package security
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// KeyFileVersion is the format written for passphrase-protected keys
+	KeyFileVersion = 1
+	
+	keyFileInfo = "ripcord-keyfile-v1"
+	kdfArgon2id = "argon2id"
+	
+	// Argon2id costs, as in the second recommended option of RFC 9106
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+)
+
+var (
+	ErrPassphraseRequired = errors.New("private key is protected by a passphrase")
+	ErrWrongPassphrase    = errors.New("wrong passphrase or damaged key file")
+)
+
+// keyFile is the on-disk form of a passphrase-protected private key. The
+// key is sealed with AES-256-GCM under a key derived from the passphrase,
+// and the format and KDF settings are authenticated with it.
+type keyFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// isProtectedKeyFile tells a sealed key file from the legacy hex one
+func isProtectedKeyFile(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// associatedData binds the format, the KDF settings and, for a key file,
+// the public key to the ciphertext
+func (kf *keyFile) associatedData(info string, bound []byte) []byte {
+	ad := []byte(info)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(kf.Version))
+	ad = append(ad, kf.KDF...)
+	ad = append(ad, 0)
+	ad = binary.BigEndian.AppendUint32(ad, kf.Time)
+	ad = binary.BigEndian.AppendUint32(ad, kf.Memory)
+	ad = append(ad, kf.Threads)
+	return append(ad, bound...)
+}
+
+func (kf *keyFile) key(passphrase []byte) ([]byte, error) {
+	if kf.KDF != kdfArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation %q", kf.KDF)
+	}
+	// Refuse settings that would make unlocking hang or exhaust memory
+	if kf.Time == 0 || kf.Time > 16 || kf.Memory == 0 || kf.Memory > 1024*1024 || kf.Threads == 0 {
+		return nil, errors.New("key file has invalid key derivation settings")
+	}
+	return argon2.IDKey(passphrase, kf.Salt, kf.Time, kf.Memory, kf.Threads, 32), nil
+}
+
+// sealWithPassphrase encrypts plaintext under a key derived from a passphrase
+func sealWithPassphrase(plaintext, passphrase []byte, version int, info string, bound []byte) (*keyFile, error) {
+	kf := &keyFile{
+		Version: version,
+		KDF:     kdfArgon2id,
+		Salt:    make([]byte, 16),
+		Time:    argonTime,
+		Memory:  argonMemory,
+		Threads: argonThreads,
+	}
+	if _, err := rand.Read(kf.Salt); err != nil {
+		return nil, err
+	}
+	
+	key, err := kf.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	
+	kf.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(kf.Nonce); err != nil {
+		return nil, err
+	}
+	kf.Ciphertext = gcm.Seal(nil, kf.Nonce, plaintext, kf.associatedData(info, bound))
+	return kf, nil
+}
+
+// open decrypts what sealWithPassphrase produced
+func (kf *keyFile) open(passphrase []byte, info string, bound []byte) ([]byte, error) {
+	key, err := kf.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(kf.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("key file has an invalid nonce")
+	}
+	
+	plaintext, err := gcm.Open(nil, kf.Nonce, kf.Ciphertext, kf.associatedData(info, bound))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// sealPrivateKey encrypts a private key under a passphrase
+func sealPrivateKey(privateKey ed25519.PrivateKey, passphrase []byte) ([]byte, error) {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	kf, err := sealWithPassphrase(privateKey, passphrase, KeyFileVersion, keyFileInfo, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(kf, "", "  ")
+}
+
+// openPrivateKey decrypts a key file written by sealPrivateKey and checks
+// it belongs to publicKey
+func openPrivateKey(data, passphrase []byte, publicKey ed25519.PublicKey) (ed25519.PrivateKey, error) {
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, err
+	}
+	if kf.Version != KeyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version %d", kf.Version)
+	}
+	
+	plaintext, err := kf.open(passphrase, keyFileInfo, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) != ed25519.PrivateKeySize {
+		return nil, errors.New("key file holds an invalid private key")
+	}
+	
+	privateKey := ed25519.PrivateKey(plaintext)
+	if !publicKey.Equal(privateKey.Public()) {
+		return nil, errors.New("private key does not match the identity")
+	}
+	return privateKey, nil
+}
+
+// writeFileAtomic replaces a file so a crash never leaves it half written
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+} 
\ No newline at end of file
@@ -0,0 +1,67 @@
+package security
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPassphraseProtectedKey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "identity.json")
+	cm := NewCryptoManager(keyPath)
+	if err := cm.LoadOrGenerateKeys("alice"); err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	if cm.IsKeyProtected() {
+		t.Fatal("Expected a new key to be stored unprotected")
+	}
+	
+	if err := cm.ChangePassphrase([]byte("correct horse")); err != nil {
+		t.Fatalf("Failed to set passphrase: %v", err)
+	}
+	if !cm.IsKeyProtected() {
+		t.Fatal("Expected the key to be protected")
+	}
+	data, _ := os.ReadFile(keyPath + ".private")
+	if strings.Contains(string(data), hex.EncodeToString(cm.GetPrivateKey())) || !strings.Contains(string(data), `"kdf": "argon2id"`) {
+		t.Fatalf("Unexpected key file: %s", data)
+	}
+	
+	// Without the passphrase, or with a wrong one, the identity is kept
+	locked := NewCryptoManager(keyPath)
+	if err := locked.LoadOrGenerateKeys("alice"); err != ErrPassphraseRequired {
+		t.Fatalf("Expected %v, got %v", ErrPassphraseRequired, err)
+	}
+	locked.SetPassphrase([]byte("wrong"))
+	if err := locked.LoadOrGenerateKeys("alice"); err != ErrWrongPassphrase {
+		t.Fatalf("Expected %v, got %v", ErrWrongPassphrase, err)
+	}
+	
+	unlocked := NewCryptoManager(keyPath)
+	unlocked.SetPassphrase([]byte("correct horse"))
+	if err := unlocked.LoadOrGenerateKeys("alice"); err != nil {
+		t.Fatalf("Failed to unlock key: %v", err)
+	}
+	if !unlocked.GetPrivateKey().Equal(cm.GetPrivateKey()) {
+		t.Fatal("Unlocked a different private key")
+	}
+	
+	// The KDF settings are authenticated with the key
+	tampered := strings.Replace(string(data), `"time": 3`, `"time": 1`, 1)
+	os.WriteFile(keyPath+".private", []byte(tampered), 0600)
+	if err := unlocked.loadKeys(); err != ErrWrongPassphrase {
+		t.Fatalf("Expected changed KDF settings to fail, got %v", err)
+	}
+	os.WriteFile(keyPath+".private", data, 0600)
+	
+	// An empty passphrase goes back to the plain format
+	if err := unlocked.ChangePassphrase(nil); err != nil {
+		t.Fatalf("Failed to remove passphrase: %v", err)
+	}
+	plain := NewCryptoManager(keyPath)
+	if err := plain.LoadOrGenerateKeys("alice"); err != nil || !plain.GetPrivateKey().Equal(cm.GetPrivateKey()) {
+		t.Fatalf("Failed to load the unprotected key: %v", err)
+	}
+} 
\ No newline at end of file
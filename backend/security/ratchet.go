@@ -0,0 +1,351 @@
+package security
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	ratchetRootInfo    = "ripcord-ratchet-root-v1"
+	ratchetMessageInfo = "ripcord-ratchet-message-v1"
+	
+	// MaxSkip bounds how many message keys one header may make us derive
+	// ahead, so a forged counter cannot make us spin
+	MaxSkip = 1000
+	
+	// MaxSkippedKeys bounds the keys kept for messages that have not arrived
+	MaxSkippedKeys = 2000
+)
+
+var (
+	ErrTooManySkipped  = errors.New("too many skipped messages")
+	ErrSessionMismatch = errors.New("message belongs to another session")
+)
+
+// RatchetHeader is sent in the clear with every session message
+type RatchetHeader struct {
+	SessionID string `json:"session_id"`
+	DH        []byte `json:"dh"`
+	PN        uint32 `json:"pn"` // messages in the sender's previous sending chain
+	N         uint32 `json:"n"`  // position in the current sending chain
+}
+
+// Session is one side of a double ratchet. Every message is encrypted with
+// its own key, and each reply turns the DH ratchet so earlier keys cannot
+// be recomputed from the current state.
+type Session struct {
+	ID          string            `json:"id"`
+	AD          []byte            `json:"ad"` // initiator and responder identity keys
+	RootKey     []byte            `json:"root_key"`
+	DHPrivate   []byte            `json:"dh_private"`
+	DHRemote    []byte            `json:"dh_remote,omitempty"`
+	SendChain   []byte            `json:"send_chain,omitempty"`
+	RecvChain   []byte            `json:"recv_chain,omitempty"`
+	SendN       uint32            `json:"send_n"`
+	RecvN       uint32            `json:"recv_n"`
+	PrevN       uint32            `json:"prev_n"`
+	Skipped     map[string][]byte `json:"skipped,omitempty"`
+	SkipOrder   []string          `json:"skip_order,omitempty"`
+	PendingX3DH *X3DHHeader       `json:"pending_x3dh,omitempty"` // until the responder answers
+}
+
+func newInitiatorSession(id string, secret, remoteRatchetKey, ad []byte) (*Session, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	
+	session := &Session{
+		ID:        id,
+		AD:        ad,
+		DHPrivate: private.Bytes(),
+		DHRemote:  remoteRatchetKey,
+	}
+	
+	dh, err := session.dh(remoteRatchetKey)
+	if err != nil {
+		return nil, err
+	}
+	if session.RootKey, session.SendChain, err = kdfRoot(secret, dh); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// newResponderSession starts from the signed prekey; there is no chain
+// until the initiator's first message arrives
+func newResponderSession(id string, secret []byte, signedPrekey *Prekey, ad []byte) *Session {
+	return &Session{
+		ID:        id,
+		AD:        ad,
+		RootKey:   secret,
+		DHPrivate: signedPrekey.PrivateKey,
+	}
+}
+
+// UnmarshalSession restores a session saved with Marshal
+func UnmarshalSession(data []byte) (*Session, error) {
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *Session) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.Skipped = make(map[string][]byte, len(s.Skipped))
+	for k, v := range s.Skipped {
+		c.Skipped[k] = v
+	}
+	c.SkipOrder = append([]string(nil), s.SkipOrder...)
+	return &c
+}
+
+func (s *Session) dh(remote []byte) ([]byte, error) {
+	private, err := ecdh.X25519().NewPrivateKey(s.DHPrivate)
+	if err != nil {
+		return nil, err
+	}
+	public, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	return private.ECDH(public)
+}
+
+func (s *Session) publicKey() ([]byte, error) {
+	private, err := ecdh.X25519().NewPrivateKey(s.DHPrivate)
+	if err != nil {
+		return nil, err
+	}
+	return private.PublicKey().Bytes(), nil
+}
+
+// Encrypt seals a message with the next sending key
+func (s *Session) Encrypt(plaintext []byte) (*RatchetHeader, []byte, error) {
+	if s.SendChain == nil {
+		return nil, nil, errors.New("session cannot send before the peer's first message")
+	}
+	
+	public, err := s.publicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	header := &RatchetHeader{
+		SessionID: s.ID,
+		DH:        public,
+		PN:        s.PrevN,
+		N:         s.SendN,
+	}
+	
+	var messageKey []byte
+	s.SendChain, messageKey = kdfChain(s.SendChain)
+	s.SendN++
+	
+	ciphertext, err := sealMessage(messageKey, plaintext, s.associatedData(header))
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, ciphertext, nil
+}
+
+// Decrypt opens a message, turning the DH ratchet if the sender has. The
+// session is left unchanged when the message does not authenticate.
+func (s *Session) Decrypt(header *RatchetHeader, ciphertext []byte) ([]byte, error) {
+	if header.SessionID != s.ID {
+		return nil, ErrSessionMismatch
+	}
+	
+	next := s.clone()
+	plaintext, err := next.decrypt(header, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	
+	*s = *next
+	return plaintext, nil
+}
+
+func (s *Session) decrypt(header *RatchetHeader, ciphertext []byte) ([]byte, error) {
+	skipKey := skippedKey(header.DH, header.N)
+	if messageKey, ok := s.Skipped[skipKey]; ok {
+		plaintext, err := openMessage(messageKey, ciphertext, s.associatedData(header))
+		if err != nil {
+			return nil, err
+		}
+		s.forgetSkipped(skipKey)
+		return plaintext, nil
+	}
+	
+	if !hmac.Equal(header.DH, s.DHRemote) || s.RecvChain == nil {
+		if s.RecvChain != nil {
+			if err := s.skipTo(header.PN); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.turn(header.DH); err != nil {
+			return nil, err
+		}
+	}
+	
+	if err := s.skipTo(header.N); err != nil {
+		return nil, err
+	}
+	
+	var messageKey []byte
+	s.RecvChain, messageKey = kdfChain(s.RecvChain)
+	s.RecvN++
+	
+	plaintext, err := openMessage(messageKey, ciphertext, s.associatedData(header))
+	if err != nil {
+		return nil, err
+	}
+	
+	// The responder has answered, so it no longer needs the X3DH header
+	s.PendingX3DH = nil
+	return plaintext, nil
+}
+
+// skipTo stores the keys of messages before n in the receiving chain
+func (s *Session) skipTo(n uint32) error {
+	if n < s.RecvN {
+		return nil
+	}
+	if n-s.RecvN > MaxSkip {
+		return ErrTooManySkipped
+	}
+	
+	if s.Skipped == nil {
+		s.Skipped = make(map[string][]byte)
+	}
+	for s.RecvN < n {
+		var messageKey []byte
+		s.RecvChain, messageKey = kdfChain(s.RecvChain)
+		
+		key := skippedKey(s.DHRemote, s.RecvN)
+		s.Skipped[key] = messageKey
+		s.SkipOrder = append(s.SkipOrder, key)
+		s.RecvN++
+	}
+	
+	for len(s.SkipOrder) > MaxSkippedKeys {
+		delete(s.Skipped, s.SkipOrder[0])
+		s.SkipOrder = s.SkipOrder[1:]
+	}
+	return nil
+}
+
+func (s *Session) forgetSkipped(key string) {
+	delete(s.Skipped, key)
+	for i, k := range s.SkipOrder {
+		if k == key {
+			s.SkipOrder = append(s.SkipOrder[:i], s.SkipOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// turn performs a DH ratchet step on a new remote ratchet key
+func (s *Session) turn(remote []byte) error {
+	s.PrevN = s.SendN
+	s.SendN = 0
+	s.RecvN = 0
+	s.DHRemote = remote
+	
+	dh, err := s.dh(remote)
+	if err != nil {
+		return err
+	}
+	if s.RootKey, s.RecvChain, err = kdfRoot(s.RootKey, dh); err != nil {
+		return err
+	}
+	
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	s.DHPrivate = private.Bytes()
+	
+	if dh, err = s.dh(remote); err != nil {
+		return err
+	}
+	s.RootKey, s.SendChain, err = kdfRoot(s.RootKey, dh)
+	return err
+}
+
+func (s *Session) associatedData(header *RatchetHeader) []byte {
+	ad := append([]byte{}, s.AD...)
+	ad = append(ad, header.SessionID...)
+	ad = append(ad, header.DH...)
+	ad = binary.BigEndian.AppendUint32(ad, header.PN)
+	return binary.BigEndian.AppendUint32(ad, header.N)
+}
+
+func skippedKey(dh []byte, n uint32) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(dh), n)
+}
+
+func kdfRoot(rootKey, dh []byte) ([]byte, []byte, error) {
+	out, err := hkdf.Key(sha256.New, dh, rootKey, ratchetRootInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+	
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), messageKey
+}
+
+// messageCipher expands a one-use message key into an AES key and nonce
+func messageCipher(messageKey []byte) ([]byte, []byte, error) {
+	out, err := hkdf.Key(sha256.New, messageKey, nil, ratchetMessageInfo, 44)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+func sealMessage(messageKey, plaintext, ad []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func openMessage(messageKey, ciphertext, ad []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, ad)
+} 
\ No newline at end of file
@@ -0,0 +1,180 @@
+package security
+
+import (
+	"testing"
+)
+
+func newTestPrekey(t *testing.T, cm *CryptoManager, id uint32, signed bool) *Prekey {
+	t.Helper()
+	prekey, err := GeneratePrekey(id)
+	if err != nil {
+		t.Fatalf("Failed to generate prekey: %v", err)
+	}
+	if signed {
+		if err := cm.SignPrekey(prekey); err != nil {
+			t.Fatalf("Failed to sign prekey: %v", err)
+		}
+	}
+	return prekey
+}
+
+// newTestSessions runs X3DH between alice and bob and delivers alice's first
+// message so both sides hold a session
+func newTestSessions(t *testing.T, oneTime bool) (*Session, *Session) {
+	t.Helper()
+	alice := newTestIdentity(t, "alice")
+	bob := newTestIdentity(t, "bob")
+	
+	signed := newTestPrekey(t, bob, 1, true)
+	var otk *Prekey
+	if oneTime {
+		otk = newTestPrekey(t, bob, 2, false)
+	}
+	
+	aliceSession, header, err := alice.InitiateSession(bob.NewPrekeyBundle(signed, otk))
+	if err != nil {
+		t.Fatalf("Failed to initiate session: %v", err)
+	}
+	if oneTime && header.OneTimePrekeyID != 2 {
+		t.Fatalf("Expected the one-time prekey to be used, got %d", header.OneTimePrekeyID)
+	}
+	
+	bobSession, err := bob.AcceptSession(alice.GetPublicKey(), header, signed, otk)
+	if err != nil {
+		t.Fatalf("Failed to accept session: %v", err)
+	}
+	if bobSession.ID != aliceSession.ID {
+		t.Fatalf("Session IDs differ: %s and %s", aliceSession.ID, bobSession.ID)
+	}
+	
+	exchange(t, aliceSession, bobSession, "hello bob")
+	if aliceSession.PendingX3DH == nil {
+		t.Fatal("Initiator dropped the X3DH header before any reply")
+	}
+	return aliceSession, bobSession
+}
+
+func exchange(t *testing.T, from, to *Session, text string) {
+	t.Helper()
+	header, ciphertext, err := from.Encrypt([]byte(text))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	plaintext, err := to.Decrypt(header, ciphertext)
+	if err != nil {
+		t.Fatalf("Failed to decrypt %q: %v", text, err)
+	}
+	if string(plaintext) != text {
+		t.Fatalf("Expected %q, got %q", text, plaintext)
+	}
+}
+
+func TestX3DHAndRatchetConversation(t *testing.T) {
+	for _, oneTime := range []bool{false, true} {
+		alice, bob := newTestSessions(t, oneTime)
+		
+		exchange(t, bob, alice, "hi alice")
+		if alice.PendingX3DH != nil {
+			t.Fatal("Initiator kept the X3DH header after a reply")
+		}
+		for i := 0; i < 3; i++ {
+			exchange(t, alice, bob, "ping")
+			exchange(t, alice, bob, "ping again")
+			exchange(t, bob, alice, "pong")
+		}
+	}
+}
+
+func TestPrekeyBundleVerification(t *testing.T) {
+	alice := newTestIdentity(t, "alice")
+	bob := newTestIdentity(t, "bob")
+	
+	bundle := bob.NewPrekeyBundle(newTestPrekey(t, bob, 1, true), nil)
+	bundle.SignedPrekey = newTestPrekey(t, bob, 1, false).PublicKey
+	if _, _, err := alice.InitiateSession(bundle); err != ErrInvalidPrekeySignature {
+		t.Fatalf("Expected a swapped prekey to be rejected, got %v", err)
+	}
+	
+	signed := newTestPrekey(t, bob, 1, true)
+	_, header, err := alice.InitiateSession(bob.NewPrekeyBundle(signed, nil))
+	if err != nil {
+		t.Fatalf("Failed to initiate session: %v", err)
+	}
+	if _, err := bob.AcceptSession(alice.GetPublicKey(), header, newTestPrekey(t, bob, 3, true), nil); err != ErrUnknownPrekey {
+		t.Fatalf("Expected an unknown signed prekey to be rejected, got %v", err)
+	}
+}
+
+func TestRatchetOutOfOrderAndTampering(t *testing.T) {
+	alice, bob := newTestSessions(t, true)
+	exchange(t, bob, alice, "hi alice")
+	
+	type sealed struct {
+		header     *RatchetHeader
+		ciphertext []byte
+	}
+	var messages []sealed
+	for _, text := range []string{"one", "two", "three"} {
+		header, ciphertext, err := alice.Encrypt([]byte(text))
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		messages = append(messages, sealed{header, ciphertext})
+	}
+	
+	// A tampered message fails and leaves the session usable
+	tampered := append([]byte{}, messages[2].ciphertext...)
+	tampered[0] ^= 1
+	if _, err := bob.Decrypt(messages[2].header, tampered); err == nil {
+		t.Fatal("Expected tampered ciphertext to fail")
+	}
+	
+	for _, i := range []int{2, 0, 1} {
+		plaintext, err := bob.Decrypt(messages[i].header, messages[i].ciphertext)
+		if err != nil {
+			t.Fatalf("Failed to decrypt message %d out of order: %v", i, err)
+		}
+		if want := []string{"one", "two", "three"}[i]; string(plaintext) != want {
+			t.Fatalf("Expected %q, got %q", want, plaintext)
+		}
+	}
+	
+	// Each message key is used once
+	if _, err := bob.Decrypt(messages[0].header, messages[0].ciphertext); err == nil {
+		t.Fatal("Expected a replayed message to fail")
+	}
+	
+	header, ciphertext, err := alice.Encrypt([]byte("far ahead"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	header.N += MaxSkip + 1
+	if _, err := bob.Decrypt(header, ciphertext); err != ErrTooManySkipped {
+		t.Fatalf("Expected %v, got %v", ErrTooManySkipped, err)
+	}
+}
+
+func TestSessionSurvivesMarshal(t *testing.T) {
+	alice, bob := newTestSessions(t, false)
+	
+	header, ciphertext, err := alice.Encrypt([]byte("skipped"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	exchange(t, alice, bob, "delivered")
+	
+	data, err := bob.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal session: %v", err)
+	}
+	restored, err := UnmarshalSession(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal session: %v", err)
+	}
+	
+	plaintext, err := restored.Decrypt(header, ciphertext)
+	if err != nil || string(plaintext) != "skipped" {
+		t.Fatalf("Restored session could not open a skipped message: %q, %v", plaintext, err)
+	}
+	exchange(t, restored, alice, "reply after restore")
+} 
\ No newline at end of file
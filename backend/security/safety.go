@@ -0,0 +1,94 @@
+package security
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	safetyVersion    = 1
+	safetyInfo       = "ripcord-safety-v1"
+	safetyIterations = 5200 // slows down searching for a key with a colliding number
+	fingerprintSize  = 30   // six 5-digit groups per key
+)
+
+var ErrSafetyNumberMismatch = errors.New("safety number does not match")
+
+// SafetyNumber is what two users compare to make sure each holds the
+// other's real key. Both sides compute the same digits.
+type SafetyNumber struct {
+	Digits    string `json:"digits"`     // 60 digits, in groups of five
+	QRPayload string `json:"qr_payload"` // for the other side to scan
+	
+	local, remote []byte
+}
+
+// keyFingerprint hashes a key into the bytes its half of the safety
+// number is read from
+func keyFingerprint(key ed25519.PublicKey) []byte {
+	hash := sha512.Sum512(append([]byte(safetyInfo), key...))
+	for i := 1; i < safetyIterations; i++ {
+		hash = sha512.Sum512(append(hash[:], key...))
+	}
+	return hash[:fingerprintSize]
+}
+
+// fingerprintDigits reads each 5-byte chunk as a number below 100000
+func fingerprintDigits(fingerprint []byte) []string {
+	groups := make([]string, 0, fingerprintSize/5)
+	for i := 0; i < fingerprintSize; i += 5 {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], fingerprint[i:i+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+	return groups
+}
+
+// NewSafetyNumber computes the safety number between our key and a
+// contact's. The lower half comes first, so the order of the keys does
+// not matter for the digits.
+func NewSafetyNumber(local, remote ed25519.PublicKey) SafetyNumber {
+	number := SafetyNumber{
+		local:  keyFingerprint(local),
+		remote: keyFingerprint(remote),
+	}
+	
+	first, second := fingerprintDigits(number.local), fingerprintDigits(number.remote)
+	if strings.Join(second, "") < strings.Join(first, "") {
+		first, second = second, first
+	}
+	number.Digits = strings.Join(append(first, second...), " ")
+	
+	payload := append([]byte{safetyVersion}, number.local...)
+	payload = append(payload, number.remote...)
+	number.QRPayload = base64.RawURLEncoding.EncodeToString(payload)
+	
+	return number
+}
+
+// MatchesDigits checks digits read out or typed in by the user, ignoring
+// spacing
+func (s SafetyNumber) MatchesDigits(digits string) bool {
+	digits = strings.Join(strings.Fields(digits), "")
+	expected := strings.ReplaceAll(s.Digits, " ", "")
+	return subtle.ConstantTimeCompare([]byte(digits), []byte(expected)) == 1
+}
+
+// MatchesQR checks a payload scanned from the contact's screen. Their
+// payload lists their key first, so it is ours with the halves swapped.
+func (s SafetyNumber) MatchesQR(payload string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(payload))
+	if err != nil || len(data) != 1+2*fingerprintSize || data[0] != safetyVersion {
+		return false
+	}
+	
+	theirs, ours := data[1:1+fingerprintSize], data[1+fingerprintSize:]
+	return bytes.Equal(theirs, s.remote) && bytes.Equal(ours, s.local)
+} 
\ No newline at end of file
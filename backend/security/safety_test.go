@@ -0,0 +1,39 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alice, _, _ := ed25519.GenerateKey(rand.Reader)
+	bob, _, _ := ed25519.GenerateKey(rand.Reader)
+	mallory, _, _ := ed25519.GenerateKey(rand.Reader)
+	
+	ours := NewSafetyNumber(alice, bob)
+	theirs := NewSafetyNumber(bob, alice)
+	if ours.Digits != theirs.Digits {
+		t.Fatalf("Expected both sides to see the same digits, got %q and %q", ours.Digits, theirs.Digits)
+	}
+	if digits := strings.ReplaceAll(ours.Digits, " ", ""); len(digits) != 60 || strings.Trim(digits, "0123456789") != "" {
+		t.Errorf("Expected 60 digits, got %q", ours.Digits)
+	}
+	
+	if !ours.MatchesDigits(strings.ReplaceAll(theirs.Digits, " ", "")) {
+		t.Error("Expected digits without spacing to match")
+	}
+	if !ours.MatchesQR(theirs.QRPayload) || !theirs.MatchesQR(ours.QRPayload) {
+		t.Error("Expected each side to accept the other's QR payload")
+	}
+	if ours.MatchesQR(ours.QRPayload) {
+		t.Error("Expected our own QR payload to be refused")
+	}
+	
+	// Bob's view when Mallory sits in the middle
+	intercepted := NewSafetyNumber(bob, mallory)
+	if ours.MatchesDigits(intercepted.Digits) || ours.MatchesQR(intercepted.QRPayload) {
+		t.Error("Expected a different key to give a different safety number")
+	}
+} 
\ No newline at end of file
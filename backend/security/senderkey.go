@@ -0,0 +1,158 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+)
+
+const senderKeyInfo = "ripcord-sender-key-v1"
+
+var ErrStaleSenderKey = errors.New("message key already used or discarded")
+
+// SenderKey is one member's chain for a private room. The member encrypts
+// with it and hands a copy to every other member, so a room message is
+// encrypted once however many members read it. Each message uses the next
+// key in the chain.
+type SenderKey struct {
+	KeyID     uint32            `json:"key_id"`
+	ChainKey  []byte            `json:"chain_key"`
+	Iteration uint32            `json:"iteration"`
+	Skipped   map[uint32][]byte `json:"skipped,omitempty"`
+}
+
+// SenderKeyHeader tells members which key and position a message used
+type SenderKeyHeader struct {
+	KeyID     uint32 `json:"key_id"`
+	Iteration uint32 `json:"iteration"`
+}
+
+// NewSenderKey starts a chain with a random key
+func NewSenderKey() (*SenderKey, error) {
+	key := &SenderKey{ChainKey: make([]byte, 32)}
+	if _, err := rand.Read(key.ChainKey); err != nil {
+		return nil, err
+	}
+	
+	var id [4]byte
+	for key.KeyID == 0 {
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+		key.KeyID = binary.BigEndian.Uint32(id[:])
+	}
+	return key, nil
+}
+
+// UnmarshalSenderKey restores a key saved with Marshal
+func UnmarshalSenderKey(data []byte) (*SenderKey, error) {
+	var key SenderKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (k *SenderKey) Marshal() ([]byte, error) {
+	return json.Marshal(k)
+}
+
+// Share returns what another member needs to read our messages from the
+// current position on. Earlier messages stay unreadable to them.
+func (k *SenderKey) Share() *SenderKey {
+	return &SenderKey{
+		KeyID:     k.KeyID,
+		ChainKey:  append([]byte{}, k.ChainKey...),
+		Iteration: k.Iteration,
+	}
+}
+
+func senderKeyAssociatedData(roomID, sender string, header *SenderKeyHeader) []byte {
+	ad := []byte(senderKeyInfo)
+	ad = append(ad, roomID...)
+	ad = append(ad, 0)
+	ad = append(ad, sender...)
+	ad = binary.BigEndian.AppendUint32(ad, header.KeyID)
+	return binary.BigEndian.AppendUint32(ad, header.Iteration)
+}
+
+// Encrypt seals a room message from sender with the next key in the chain
+func (k *SenderKey) Encrypt(roomID, sender string, plaintext []byte) (*SenderKeyHeader, []byte, error) {
+	header := &SenderKeyHeader{KeyID: k.KeyID, Iteration: k.Iteration}
+	
+	var messageKey []byte
+	k.ChainKey, messageKey = kdfChain(k.ChainKey)
+	k.Iteration++
+	
+	ciphertext, err := sealMessage(messageKey, plaintext, senderKeyAssociatedData(roomID, sender, header))
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, ciphertext, nil
+}
+
+// Decrypt opens a room message from sender. Messages may arrive out of
+// order; the key is left unchanged when one does not authenticate.
+func (k *SenderKey) Decrypt(roomID, sender string, header *SenderKeyHeader, ciphertext []byte) ([]byte, error) {
+	if header.KeyID != k.KeyID {
+		return nil, ErrSessionMismatch
+	}
+	ad := senderKeyAssociatedData(roomID, sender, header)
+	
+	if header.Iteration < k.Iteration {
+		messageKey, ok := k.Skipped[header.Iteration]
+		if !ok {
+			return nil, ErrStaleSenderKey
+		}
+		plaintext, err := openMessage(messageKey, ciphertext, ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(k.Skipped, header.Iteration)
+		return plaintext, nil
+	}
+	
+	if header.Iteration-k.Iteration > MaxSkip {
+		return nil, ErrTooManySkipped
+	}
+	
+	chainKey := k.ChainKey
+	skipped := make(map[uint32][]byte)
+	var messageKey []byte
+	for i := k.Iteration; ; i++ {
+		chainKey, messageKey = kdfChain(chainKey)
+		if i == header.Iteration {
+			break
+		}
+		skipped[i] = messageKey
+	}
+	
+	plaintext, err := openMessage(messageKey, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+	
+	if k.Skipped == nil {
+		k.Skipped = make(map[uint32][]byte)
+	}
+	for i, key := range skipped {
+		k.Skipped[i] = key
+	}
+	// Drop the oldest keys once too many messages have gone missing
+	if excess := len(k.Skipped) - MaxSkippedKeys; excess > 0 {
+		iterations := make([]uint32, 0, len(k.Skipped))
+		for i := range k.Skipped {
+			iterations = append(iterations, i)
+		}
+		slices.Sort(iterations)
+		for _, i := range iterations[:excess] {
+			delete(k.Skipped, i)
+		}
+	}
+	
+	k.ChainKey = chainKey
+	k.Iteration = header.Iteration + 1
+	return plaintext, nil
+} 
\ No newline at end of file
@@ -0,0 +1,72 @@
+package security
+
+import (
+	"testing"
+)
+
+func TestSenderKeyChain(t *testing.T) {
+	sending, err := NewSenderKey()
+	if err != nil {
+		t.Fatalf("Failed to create sender key: %v", err)
+	}
+	
+	// A member handed the key later only reads from that point on
+	if _, _, err := sending.Encrypt("room", "alice", []byte("before bob")); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	receiving := sending.Share()
+	
+	type sealed struct {
+		header     *SenderKeyHeader
+		ciphertext []byte
+	}
+	var messages []sealed
+	for _, text := range []string{"one", "two", "three"} {
+		header, ciphertext, err := sending.Encrypt("room", "alice", []byte(text))
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		messages = append(messages, sealed{header, ciphertext})
+	}
+	
+	// Bound to the room and the sender
+	if _, err := receiving.Decrypt("other-room", "alice", messages[0].header, messages[0].ciphertext); err == nil {
+		t.Error("Expected a message moved to another room to fail")
+	}
+	if _, err := receiving.Decrypt("room", "mallory", messages[0].header, messages[0].ciphertext); err == nil {
+		t.Error("Expected a message claimed by another sender to fail")
+	}
+	
+	for _, i := range []int{2, 0, 1} {
+		plaintext, err := receiving.Decrypt("room", "alice", messages[i].header, messages[i].ciphertext)
+		if err != nil {
+			t.Fatalf("Failed to decrypt message %d out of order: %v", i, err)
+		}
+		if want := []string{"one", "two", "three"}[i]; string(plaintext) != want {
+			t.Fatalf("Expected %q, got %q", want, plaintext)
+		}
+	}
+	if _, err := receiving.Decrypt("room", "alice", messages[1].header, messages[1].ciphertext); err != ErrStaleSenderKey {
+		t.Errorf("Expected a replayed message to fail with %v, got %v", ErrStaleSenderKey, err)
+	}
+	
+	data, err := receiving.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal sender key: %v", err)
+	}
+	restored, err := UnmarshalSenderKey(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal sender key: %v", err)
+	}
+	header, ciphertext, _ := sending.Encrypt("room", "alice", []byte("after restore"))
+	if plaintext, err := restored.Decrypt("room", "alice", header, ciphertext); err != nil || string(plaintext) != "after restore" {
+		t.Errorf("Restored key could not decrypt: %q, %v", plaintext, err)
+	}
+	
+	// A rotated key shares nothing with the old one
+	rotated, _ := NewSenderKey()
+	header, ciphertext, _ = rotated.Encrypt("room", "alice", []byte("after rotation"))
+	if _, err := restored.Decrypt("room", "alice", header, ciphertext); err == nil {
+		t.Error("Expected the old key not to read the rotated chain")
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,78 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const successionInfo = "ripcord-succession-v1"
+
+var ErrInvalidSuccession = errors.New("invalid succession record")
+
+// Succession hands an identity over from one key to the next. The old key
+// signs it to vouch for the new one, and the new key signs it to show the
+// statement was made by whoever holds it.
+type Succession struct {
+	OldKey       ed25519.PublicKey `json:"old_key"`
+	NewKey       ed25519.PublicKey `json:"new_key"`
+	Timestamp    int64             `json:"timestamp"`
+	OldSignature []byte            `json:"old_signature"`
+	NewSignature []byte            `json:"new_signature"`
+}
+
+func (s *Succession) signedData() []byte {
+	data := []byte(successionInfo)
+	data = append(data, s.OldKey...)
+	data = append(data, s.NewKey...)
+	return binary.BigEndian.AppendUint64(data, uint64(s.Timestamp))
+}
+
+// Verify checks both signatures
+func (s *Succession) Verify() error {
+	if len(s.OldKey) != ed25519.PublicKeySize || len(s.NewKey) != ed25519.PublicKeySize || s.OldKey.Equal(s.NewKey) {
+		return ErrInvalidSuccession
+	}
+	
+	data := s.signedData()
+	if !ed25519.Verify(s.OldKey, data, s.OldSignature) || !ed25519.Verify(s.NewKey, data, s.NewSignature) {
+		return ErrInvalidSuccession
+	}
+	return nil
+}
+
+// RotateKeys replaces the identity key with a new one and saves it under
+// the same passphrase. The returned record, signed by both keys, lets
+// peers move what they know about us over to the new key.
+func (cm *CryptoManager) RotateKeys() (*Succession, error) {
+	if cm.keyPair == nil {
+		return nil, errors.New("no keys loaded")
+	}
+	
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	
+	succession := &Succession{
+		OldKey:    cm.keyPair.PublicKey,
+		NewKey:    publicKey,
+		Timestamp: time.Now().Unix(),
+	}
+	data := succession.signedData()
+	succession.OldSignature = ed25519.Sign(cm.keyPair.PrivateKey, data)
+	succession.NewSignature = ed25519.Sign(privateKey, data)
+	
+	previous := cm.keyPair
+	cm.keyPair = &KeyPair{
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+	}
+	if err := cm.saveKeys(); err != nil {
+		cm.keyPair = previous
+		return nil, err
+	}
+	return succession, nil
+} 
\ No newline at end of file
@@ -0,0 +1,51 @@
+package security
+
+import (
+	"testing"
+)
+
+func TestRotateKeys(t *testing.T) {
+	cm := newTestIdentity(t, "alice")
+	cm.SetPassphrase([]byte("correct horse"))
+	if err := cm.ChangePassphrase([]byte("correct horse")); err != nil {
+		t.Fatalf("Failed to set passphrase: %v", err)
+	}
+	oldKey := cm.GetPublicKey()
+	
+	succession, err := cm.RotateKeys()
+	if err != nil {
+		t.Fatalf("Failed to rotate keys: %v", err)
+	}
+	if err := succession.Verify(); err != nil {
+		t.Fatalf("Expected succession to verify, got %v", err)
+	}
+	if !succession.OldKey.Equal(oldKey) || !succession.NewKey.Equal(cm.GetPublicKey()) {
+		t.Error("Expected succession from the old key to the current one")
+	}
+	
+	// The new key is saved under the same passphrase
+	reloaded := NewCryptoManager(cm.keyPath)
+	reloaded.SetPassphrase([]byte("correct horse"))
+	if err := reloaded.LoadOrGenerateKeys(""); err != nil {
+		t.Fatalf("Failed to reload keys: %v", err)
+	}
+	if !reloaded.GetPublicKey().Equal(succession.NewKey) || reloaded.GetNickname() != "alice" {
+		t.Error("Expected the rotated identity on disk")
+	}
+	
+	tampered := *succession
+	tampered.Timestamp++
+	if err := tampered.Verify(); err != ErrInvalidSuccession {
+		t.Errorf("Expected ErrInvalidSuccession for a changed timestamp, got %v", err)
+	}
+	
+	// The old key's signature covers the new key, so it cannot be moved
+	// over to another
+	other := newTestIdentity(t, "mallory")
+	hijack := *succession
+	hijack.NewKey = other.GetPublicKey()
+	hijack.NewSignature = other.SignMessage(hijack.signedData())
+	if err := hijack.Verify(); err != ErrInvalidSuccession {
+		t.Errorf("Expected ErrInvalidSuccession for a swapped new key, got %v", err)
+	}
+} 
\ No newline at end of file
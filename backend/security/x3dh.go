@@ -0,0 +1,263 @@
+package security
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+const (
+	x3dhInfo         = "ripcord-x3dh-v1"
+	prekeySignPrefix = "ripcord-prekey-v1"
+)
+
+var (
+	ErrInvalidPrekeySignature = errors.New("prekey signature does not match identity")
+	ErrUnknownPrekey          = errors.New("unknown prekey")
+)
+
+// Prekey is an X25519 key pair a node publishes so others can start
+// sessions with it while it is offline. Signed prekeys carry a signature by
+// the identity key; one-time prekeys are used for a single session.
+type Prekey struct {
+	ID         uint32
+	PrivateKey []byte
+	PublicKey  []byte
+	Signature  []byte
+}
+
+// GeneratePrekey creates a new unsigned prekey with the given ID
+func GeneratePrekey(id uint32) (*Prekey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &Prekey{
+		ID:         id,
+		PrivateKey: private.Bytes(),
+		PublicKey:  private.PublicKey().Bytes(),
+	}, nil
+}
+
+func prekeySignedData(id uint32, publicKey []byte) []byte {
+	data := []byte(prekeySignPrefix)
+	data = binary.BigEndian.AppendUint32(data, id)
+	return append(data, publicKey...)
+}
+
+// SignPrekey signs a prekey with the identity key, making it a signed prekey
+func (cm *CryptoManager) SignPrekey(prekey *Prekey) error {
+	if cm.keyPair == nil {
+		return errors.New("no identity key loaded")
+	}
+	prekey.Signature = ed25519.Sign(cm.keyPair.PrivateKey, prekeySignedData(prekey.ID, prekey.PublicKey))
+	return nil
+}
+
+// PrekeyBundle is what a node hands out so a session can be started with it
+type PrekeyBundle struct {
+	IdentityKey     []byte `json:"identity_key"`
+	SignedPrekeyID  uint32 `json:"signed_prekey_id"`
+	SignedPrekey    []byte `json:"signed_prekey"`
+	Signature       []byte `json:"signature"`
+	OneTimePrekeyID uint32 `json:"one_time_prekey_id,omitempty"`
+	OneTimePrekey   []byte `json:"one_time_prekey,omitempty"`
+}
+
+// NewPrekeyBundle publishes a signed prekey and, optionally, a one-time prekey
+func (cm *CryptoManager) NewPrekeyBundle(signed, oneTime *Prekey) *PrekeyBundle {
+	bundle := &PrekeyBundle{
+		IdentityKey:    cm.GetPublicKey(),
+		SignedPrekeyID: signed.ID,
+		SignedPrekey:   signed.PublicKey,
+		Signature:      signed.Signature,
+	}
+	if oneTime != nil {
+		bundle.OneTimePrekeyID = oneTime.ID
+		bundle.OneTimePrekey = oneTime.PublicKey
+	}
+	return bundle
+}
+
+// Verify checks that the signed prekey was signed by the bundle's identity
+func (b *PrekeyBundle) Verify() error {
+	if len(b.IdentityKey) != ed25519.PublicKeySize {
+		return ErrInvalidPublicKey
+	}
+	if !ed25519.Verify(ed25519.PublicKey(b.IdentityKey), prekeySignedData(b.SignedPrekeyID, b.SignedPrekey), b.Signature) {
+		return ErrInvalidPrekeySignature
+	}
+	return nil
+}
+
+// X3DHHeader travels with a session's messages until the responder has
+// answered, so it can derive the same keys from its prekeys
+type X3DHHeader struct {
+	EphemeralKey    []byte `json:"ephemeral_key"`
+	SignedPrekeyID  uint32 `json:"signed_prekey_id"`
+	OneTimePrekeyID uint32 `json:"one_time_prekey_id,omitempty"`
+}
+
+// SessionID names the session an X3DH ephemeral key starts
+func SessionID(ephemeralKey []byte) string {
+	hash := sha256.Sum256(ephemeralKey)
+	return hex.EncodeToString(hash[:16])
+}
+
+func x3dhSecret(dhs ...[]byte) ([]byte, error) {
+	// A leading block of 0xFF separates the X25519 inputs, as in the X3DH spec
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, dh := range dhs {
+		ikm = append(ikm, dh...)
+	}
+	return hkdf.Key(sha256.New, ikm, make([]byte, 32), x3dhInfo, 32)
+}
+
+func x3dhAssociatedData(initiator, responder []byte) []byte {
+	ad := make([]byte, 0, len(initiator)+len(responder))
+	ad = append(ad, initiator...)
+	return append(ad, responder...)
+}
+
+// InitiateSession runs the initiator's side of X3DH against a peer's bundle
+func (cm *CryptoManager) InitiateSession(bundle *PrekeyBundle) (*Session, *X3DHHeader, error) {
+	if cm.keyPair == nil {
+		return nil, nil, errors.New("no identity key loaded")
+	}
+	if err := bundle.Verify(); err != nil {
+		return nil, nil, err
+	}
+	
+	identity, err := x25519PrivateKey(cm.keyPair.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerIdentity, err := X25519PublicKey(ed25519.PublicKey(bundle.IdentityKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	signedPrekey, err := ecdh.X25519().NewPublicKey(bundle.SignedPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	dh1, err := identity.ECDH(signedPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh2, err := ephemeral.ECDH(peerIdentity)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh3, err := ephemeral.ECDH(signedPrekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dhs := [][]byte{dh1, dh2, dh3}
+	
+	header := &X3DHHeader{
+		EphemeralKey:   ephemeral.PublicKey().Bytes(),
+		SignedPrekeyID: bundle.SignedPrekeyID,
+	}
+	if len(bundle.OneTimePrekey) > 0 {
+		oneTime, err := ecdh.X25519().NewPublicKey(bundle.OneTimePrekey)
+		if err != nil {
+			return nil, nil, err
+		}
+		dh4, err := ephemeral.ECDH(oneTime)
+		if err != nil {
+			return nil, nil, err
+		}
+		dhs = append(dhs, dh4)
+		header.OneTimePrekeyID = bundle.OneTimePrekeyID
+	}
+	
+	secret, err := x3dhSecret(dhs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	session, err := newInitiatorSession(SessionID(header.EphemeralKey), secret, bundle.SignedPrekey,
+		x3dhAssociatedData(cm.keyPair.PublicKey, bundle.IdentityKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	session.PendingX3DH = header
+	return session, header, nil
+}
+
+// AcceptSession runs the responder's side of X3DH for a session a peer
+// started with our signed prekey and, if it used one, a one-time prekey
+func (cm *CryptoManager) AcceptSession(peer ed25519.PublicKey, header *X3DHHeader, signedPrekey, oneTimePrekey *Prekey) (*Session, error) {
+	if cm.keyPair == nil {
+		return nil, errors.New("no identity key loaded")
+	}
+	if signedPrekey == nil || signedPrekey.ID != header.SignedPrekeyID {
+		return nil, ErrUnknownPrekey
+	}
+	if header.OneTimePrekeyID != 0 && (oneTimePrekey == nil || oneTimePrekey.ID != header.OneTimePrekeyID) {
+		return nil, ErrUnknownPrekey
+	}
+	
+	identity, err := x25519PrivateKey(cm.keyPair.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	peerIdentity, err := X25519PublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := ecdh.X25519().NewPrivateKey(signedPrekey.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(header.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	dh1, err := signed.ECDH(peerIdentity)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := signed.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	dhs := [][]byte{dh1, dh2, dh3}
+	
+	if header.OneTimePrekeyID != 0 {
+		oneTime, err := ecdh.X25519().NewPrivateKey(oneTimePrekey.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		dh4, err := oneTime.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh4)
+	}
+	
+	secret, err := x3dhSecret(dhs...)
+	if err != nil {
+		return nil, err
+	}
+	
+	return newResponderSession(SessionID(header.EphemeralKey), secret, signedPrekey,
+		x3dhAssociatedData(peer, cm.keyPair.PublicKey)), nil
+} 
\ No newline at end of file
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+// MaxPendingRoomMessages bounds the private room messages held until the
+// sender key that opens them arrives
+const MaxPendingRoomMessages = 256
+
+var (
+	ErrUnknownSenderKey       = errors.New("room message uses an unknown sender key")
+	ErrPlaintextInPrivateRoom = errors.New("private room message is not encrypted")
+)
+
+// pendingChat is a private room message waiting for its sender key
+type pendingChat struct {
+	msg     *ProtocolMessage
+	peer    Peer
+	payload ChatPayload
+}
+
+func senderKeyRef(roomID, senderID string, keyID uint32) string {
+	return fmt.Sprintf("%s|%s|%d", roomID, senderID, keyID)
+}
+
+// loadSenderKey returns a stored sender key; a keyID of 0 means the newest
+func (n *Node) loadSenderKey(roomID, senderID string, keyID uint32) (*security.SenderKey, error) {
+	var state []byte
+	var err error
+	if keyID == 0 {
+		state, err = n.roomManager.db.GetLatestSenderKey(roomID, senderID)
+	} else {
+		state, err = n.roomManager.db.GetSenderKey(roomID, senderID, int64(keyID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	return security.UnmarshalSenderKey(state)
+}
+
+func (n *Node) saveSenderKey(roomID, senderID string, key *security.SenderKey) error {
+	state, err := key.Marshal()
+	if err != nil {
+		return err
+	}
+	
+	return n.roomManager.db.SaveSenderKey(roomID, senderID, int64(key.KeyID), state)
+}
+
+// sealRoomContent encrypts a private room message with our sender key. When
+// we have none yet a new one is started and returned, and it must reach the
+// other members before the message does.
+func (n *Node) sealRoomContent(roomID, content string) (string, *security.SenderKeyHeader, *security.SenderKey, error) {
+	self := n.cryptoManager.GetPublicKeyBase58()
+	
+	n.senderKeyMu.Lock()
+	defer n.senderKeyMu.Unlock()
+	
+	var fresh *security.SenderKey
+	key, err := n.loadSenderKey(roomID, self, 0)
+	if err == database.ErrSenderKeyNotFound {
+		if key, err = security.NewSenderKey(); err == nil {
+			fresh = key.Share()
+		}
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+	
+	header, ciphertext, err := key.Encrypt(roomID, self, []byte(content))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := n.saveSenderKey(roomID, self, key); err != nil {
+		return "", nil, nil, err
+	}
+	
+	return base64.StdEncoding.EncodeToString(ciphertext), header, fresh, nil
+}
+
+// openRoomContent decrypts a private room message from sender. A message
+// whose key has not arrived yet fails with ErrUnknownSenderKey; if hold is
+// set it is kept and handled again once the key is stored.
+func (n *Node) openRoomContent(msg *ProtocolMessage, peer Peer, chat ChatPayload, senderID string, hold bool) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(chat.Content)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted room message: %v", err)
+	}
+	
+	n.senderKeyMu.Lock()
+	defer n.senderKeyMu.Unlock()
+	
+	key, err := n.loadSenderKey(msg.RoomID, senderID, chat.SenderKey.KeyID)
+	if err == database.ErrSenderKeyNotFound {
+		if !hold {
+			return "", ErrUnknownSenderKey
+		}
+		n.holdChat(senderKeyRef(msg.RoomID, senderID, chat.SenderKey.KeyID), pendingChat{msg, peer, chat})
+		return "", ErrUnknownSenderKey
+	}
+	if err != nil {
+		return "", err
+	}
+	
+	plaintext, err := key.Decrypt(msg.RoomID, senderID, chat.SenderKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt room message: %v", err)
+	}
+	if err := n.saveSenderKey(msg.RoomID, senderID, key); err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// holdChat keeps a message until its sender key arrives. Callers hold
+// senderKeyMu. Once the buffer is full further messages are dropped; they
+// can still be fetched by sync.
+func (n *Node) holdChat(ref string, pending pendingChat) {
+	if n.pendingCount >= MaxPendingRoomMessages {
+		log.Printf("Dropping room message %s: too many messages waiting for sender keys", pending.msg.MessageID)
+		return
+	}
+	n.pendingChats[ref] = append(n.pendingChats[ref], pending)
+	n.pendingCount++
+}
+
+// shareSenderKey hands our sender key for a room to the given members over
+// encrypted DMs. Members who are offline get it from the outbound queue.
+func (n *Node) shareSenderKey(roomID string, key *security.SenderKey, members []string) {
+	data, err := json.Marshal(SenderKeyDistribution{RoomID: roomID, Key: key})
+	if err != nil {
+		log.Printf("Failed to encode sender key: %v", err)
+		return
+	}
+	
+	self := n.cryptoManager.GetPublicKeyBase58()
+	for _, userID := range members {
+		if userID == self {
+			continue
+		}
+		if err := n.sendSenderKey(userID, roomID, string(data)); err != nil {
+			log.Printf("Failed to share sender key for room %s with %s: %v", roomID, userID, err)
+		}
+	}
+}
+
+func (n *Node) sendSenderKey(userID, roomID, content string) error {
+	key, err := recipientKey(userID)
+	if err != nil {
+		return err
+	}
+	peerID := hex.EncodeToString(key)
+	
+	// A peer that completed the handshake without the feature could not use it
+	n.mu.RLock()
+	peer, known := n.peers[peerID]
+	unsupported := known && peer.Version != "" && !peer.HasFeature(FeatureSenderKeys)
+	n.mu.RUnlock()
+	if unsupported {
+		return errors.New("peer does not support sender keys")
+	}
+	
+	msg := NewProtocolMessage(MessageTypeSenderKey, n.ID, generateMessageID())
+	msg.To = peerID
+	msg.RoomID = roomID
+	
+	payload, err := n.sealRatchetDM(peerID, key, content)
+	if err == ErrNoPrekeyBundle {
+		msg.SetPayload(DMPayload{Content: content})
+		return n.enqueueUnsealed(peerID, msg)
+	}
+	if err != nil {
+		return err
+	}
+	msg.SetPayload(payload)
+	
+	return n.SendToPeer(peerID, msg)
+}
+
+// shareCurrentSenderKey gives a member who just joined our sender key from
+// its current position, so they read what we send from now on
+func (n *Node) shareCurrentSenderKey(roomID, userID string) {
+	n.senderKeyMu.Lock()
+	key, err := n.loadSenderKey(roomID, n.cryptoManager.GetPublicKeyBase58(), 0)
+	n.senderKeyMu.Unlock()
+	if err != nil {
+		if err != database.ErrSenderKeyNotFound {
+			log.Printf("Failed to load sender key for room %s: %v", roomID, err)
+		}
+		return
+	}
+	
+	n.shareSenderKey(roomID, key.Share(), []string{userID})
+}
+
+// rotateSenderKeys runs when a member leaves or is removed. Their keys are
+// forgotten, and so is ours, so the next message we send starts a chain
+// that only the remaining members are given. When we are the one leaving,
+// every key for the room goes.
+func (n *Node) rotateSenderKeys(roomID, leaverID string) {
+	n.senderKeyMu.Lock()
+	defer n.senderKeyMu.Unlock()
+	
+	db := n.roomManager.db
+	if leaverID == n.cryptoManager.GetPublicKeyBase58() {
+		leaverID = ""
+	} else if err := db.DeleteSenderKeys(roomID, n.cryptoManager.GetPublicKeyBase58()); err != nil {
+		log.Printf("Failed to rotate sender key for room %s: %v", roomID, err)
+	}
+	
+	if err := db.DeleteSenderKeys(roomID, leaverID); err != nil {
+		log.Printf("Failed to delete sender keys for room %s: %v", roomID, err)
+	}
+	
+	// Messages waiting for a key that will not come are dropped
+	prefix := roomID + "|" + leaverID
+	for ref, pending := range n.pendingChats {
+		if strings.HasPrefix(ref, prefix) {
+			delete(n.pendingChats, ref)
+			n.pendingCount -= len(pending)
+		}
+	}
+}
+
+// handleSenderKey stores a member's sender key for a room we are in and
+// handles the messages that were waiting for it
+func (n *Node) handleSenderKey(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	dm, ok := payload.(DMPayload)
+	if !ok {
+		return errors.New("sender_key message missing payload")
+	}
+	if !dm.IsEncrypted {
+		return errors.New("sender key sent in the clear")
+	}
+	
+	content, err := n.openDMPayload(peer, dm)
+	if err != nil {
+		return err
+	}
+	
+	var distribution SenderKeyDistribution
+	if err := json.Unmarshal([]byte(content), &distribution); err != nil {
+		return fmt.Errorf("invalid sender key: %v", err)
+	}
+	if distribution.Key == nil || distribution.Key.KeyID == 0 || distribution.RoomID != msg.RoomID {
+		return errors.New("invalid sender key")
+	}
+	
+	userID, err := userIDForKey(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	
+	room, err := n.roomManager.GetRoom(distribution.RoomID)
+	if err != nil {
+		return err
+	}
+	if !room.IsMember(userID) || !room.IsMember(n.cryptoManager.GetPublicKeyBase58()) {
+		return ErrNotRoomMember
+	}
+	
+	ref := senderKeyRef(room.ID, userID, distribution.Key.KeyID)
+	
+	n.senderKeyMu.Lock()
+	// A key shared again from a later position must not replace the one we
+	// have been reading with
+	_, err = n.roomManager.db.GetSenderKey(room.ID, userID, int64(distribution.Key.KeyID))
+	if err == database.ErrSenderKeyNotFound {
+		err = n.saveSenderKey(room.ID, userID, distribution.Key)
+	}
+	pending := n.pendingChats[ref]
+	if err == nil {
+		delete(n.pendingChats, ref)
+		n.pendingCount -= len(pending)
+	}
+	n.senderKeyMu.Unlock()
+	if err != nil {
+		return err
+	}
+	
+	for _, held := range pending {
+		if err := n.handleChat(held.msg, held.peer, held.payload); err != nil {
+			log.Printf("Failed to handle held room message %s: %v", held.msg.MessageID, err)
+		}
+	}
+	return nil
+} 
\ No newline at end of file
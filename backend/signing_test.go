@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"ripcord/database"
+	"ripcord/security"
+	"ripcord/transport"
+	"ripcord/types"
+)
+
+// signingVectors are checked in so other implementations can test against
+// them; testdata/verify_vectors.js checks them independently of this code
+type signingVectors struct {
+	Seed          string `json:"seed"`
+	PublicKey     string `json:"public_key"`
+	CanonicalJSON []struct {
+		Input     string `json:"input"`
+		Canonical string `json:"canonical"`
+	} `json:"canonical_json"`
+	Messages []struct {
+		Message struct {
+			ID        string   `json:"id"`
+			RoomID    string   `json:"room_id"`
+			UserID    string   `json:"user_id"`
+			Username  string   `json:"username"`
+			Content   string   `json:"content"`
+			Type      string   `json:"type"`
+			Encrypted bool     `json:"encrypted"`
+			Timestamp int64    `json:"timestamp"`
+			Clock     uint64   `json:"clock"`
+			Parents   []string `json:"parents"`
+		} `json:"message"`
+		Signable  string `json:"signable"`
+		Signature string `json:"signature"`
+	} `json:"messages"`
+	Frames []struct {
+		Frame     string `json:"frame"`
+		Signable  string `json:"signable"`
+		Signature string `json:"signature"`
+	} `json:"frames"`
+}
+
+func TestSigningVectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/signing_vectors.json")
+	if err != nil {
+		t.Fatalf("Failed to read vectors: %v", err)
+	}
+	var vectors signingVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Failed to parse vectors: %v", err)
+	}
+	
+	seed, _ := hex.DecodeString(vectors.Seed)
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	if hex.EncodeToString(publicKey) != vectors.PublicKey {
+		t.Fatal("Vector public key does not match the seed")
+	}
+	
+	for i, v := range vectors.CanonicalJSON {
+		got, err := security.CanonicalJSON([]byte(v.Input))
+		if err != nil || string(got) != v.Canonical {
+			t.Errorf("canonical_json[%d]: got %s, %v", i, got, err)
+		}
+	}
+	
+	for i, v := range vectors.Messages {
+		m := v.Message
+		message := &types.Message{
+			ID:        m.ID,
+			RoomID:    m.RoomID,
+			UserID:    m.UserID,
+			Username:  m.Username,
+			Content:   m.Content,
+			Type:      m.Type,
+			Encrypted: m.Encrypted,
+			Timestamp: time.Unix(m.Timestamp, 0),
+			Clock:     m.Clock,
+			Parents:   m.Parents,
+		}
+		if got := hex.EncodeToString(message.SignableData()); got != v.Signable {
+			t.Errorf("messages[%d]: signable bytes differ:\n got %s\nwant %s", i, got, v.Signable)
+		}
+		if message.Sign(privateKey); message.Signature != v.Signature {
+			t.Errorf("messages[%d]: signature differs", i)
+		}
+		if !message.VerifySignature(publicKey) {
+			t.Errorf("messages[%d]: signature does not verify", i)
+		}
+	}
+	
+	for i, v := range vectors.Frames {
+		frame, err := ParseProtocolMessage([]byte(v.Frame))
+		if err != nil {
+			t.Fatalf("frames[%d]: %v", i, err)
+		}
+		signable, err := frame.GetSignableData()
+		if err != nil || hex.EncodeToString(signable) != v.Signable {
+			t.Errorf("frames[%d]: signable bytes differ:\n got %x\nwant %s", i, signable, v.Signable)
+		}
+		if !frame.VerifySignature(publicKey) {
+			t.Errorf("frames[%d]: signature does not verify", i)
+		}
+		
+		// The signature survives the frame being decoded and encoded again
+		// the way the dispatcher sees it, with the payload as a map
+		var payload map[string]interface{}
+		if raw, ok := frame.Payload.(json.RawMessage); ok {
+			json.Unmarshal(raw, &payload)
+			frame.Payload = payload
+		}
+		frame.TTL = 0
+		reencoded, _ := frame.ToJSON()
+		reparsed, err := ParseProtocolMessage(reencoded)
+		if err != nil || !reparsed.VerifySignature(publicKey) || !frame.VerifySignature(publicKey) {
+			t.Errorf("frames[%d]: signature lost in re-encoding: %v", i, err)
+		}
+	}
+}
+
+func TestLegacySignaturesStillVerify(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	
+	// A frame in a version before canonical signing is signed over its JSON
+	ping := NewProtocolMessage(MessageTypePing, hex.EncodeToString(publicKey), generateMessageID())
+	ping.Version = "1.1"
+	ping.SetPayload(map[string]string{"note": "<old>"})
+	if err := ping.Sign(privateKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if signable, _ := ping.GetSignableData(); signable[0] != '{' {
+		t.Errorf("Expected a 1.1 frame to be signed over its JSON, got %q", signable)
+	}
+	data, _ := ping.ToJSON()
+	parsed, err := ParseProtocolMessage(data)
+	if err != nil || !parsed.VerifySignature(publicKey) {
+		t.Errorf("Expected the 1.1 frame to verify, got %v", err)
+	}
+	
+	// Messages signed by the code before canonical signing verify only as
+	// legacy messages, so a signature without the domain is never enough
+	data, err = os.ReadFile("testdata/legacy_messages.json")
+	if err != nil {
+		t.Fatalf("Failed to read legacy messages: %v", err)
+	}
+	var legacy struct {
+		PublicKey string           `json:"public_key"`
+		Messages  []*types.Message `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		t.Fatalf("Failed to parse legacy messages: %v", err)
+	}
+	legacyKey, _ := hex.DecodeString(legacy.PublicKey)
+	for _, message := range legacy.Messages {
+		if !message.VerifyLegacySignature(legacyKey) {
+			t.Errorf("Expected %s to verify in the legacy encoding", message.ID)
+		}
+		if message.VerifySignature(legacyKey) {
+			t.Errorf("Expected %s not to verify as a canonical signature", message.ID)
+		}
+	}
+	
+	edited := *legacy.Messages[0]
+	edited.Content = "edited"
+	if edited.VerifyLegacySignature(legacyKey) {
+		t.Error("Expected an edited message to fail")
+	}
+	moved := *legacy.Messages[1]
+	moved.Timestamp = moved.Timestamp.UTC()
+	if moved.VerifyLegacySignature(legacyKey) {
+		t.Error("Expected the zone to be part of the legacy signature")
+	}
+	stamped := *legacy.Messages[0]
+	stamped.Clock = 1
+	if stamped.VerifyLegacySignature(legacyKey) {
+		t.Error("Expected a message with a clock not to pass as legacy")
+	}
+}
+
+func TestVerifyStoredMessages(t *testing.T) {
+	alice := newTestNode(t, transport.NewLoopbackNetwork(), "alice")
+	aliceID := alice.cryptoManager.GetPublicKeyBase58()
+	
+	signed := func(userID, content string) *types.Message {
+		message := NewMessage("room", userID, "alice", content, "")
+		message.Sign(alice.cryptoManager.GetPrivateKey())
+		return message
+	}
+	
+	// A message with a clock was signed canonically, so a failure is forged
+	forged := NewMessage("room", aliceID, "alice", "original", "")
+	forged.Clock = 1
+	forged.Sign(alice.cryptoManager.GetPrivateKey())
+	forged.Content = "forged"
+	expected := map[*types.Message]string{
+		signed(aliceID, "verified"):                          types.VerificationVerified,
+		NewMessage("room", aliceID, "alice", "unsigned", ""): types.VerificationUnsigned,
+		forged:                             types.VerificationInvalid,
+		signed("not-a-key", "unknown key"): types.VerificationUnknownKey,
+	}
+	for message := range expected {
+		if err := alice.db.SaveMessage(message); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	
+	if err := verifyStoredMessages(alice.db); err != nil {
+		t.Fatalf("Failed to verify stored messages: %v", err)
+	}
+	
+	stored, _ := alice.db.GetMessages("room", 10)
+	if len(stored) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d", len(expected), len(stored))
+	}
+	for message, state := range expected {
+		for _, got := range stored {
+			if got.ID == message.ID && got.Verification != state {
+				t.Errorf("Expected %q to be %s, got %q", message.Content, state, got.Verification)
+			}
+		}
+	}
+	
+	unchecked, _ := alice.db.GetUncheckedMessages(10)
+	if len(unchecked) != 0 {
+		t.Errorf("Expected every message to be checked, %d left", len(unchecked))
+	}
+}
+
+// testdata/legacy.db was written by the code before canonical signing:
+// three messages posted over HTTP in different zones, and one edited in
+// the database after it was signed
+func TestVerifyStoredLegacyMessages(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/legacy.db")
+	if err != nil {
+		t.Fatalf("Failed to read database: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	if err := os.WriteFile(path, fixture, 0600); err != nil {
+		t.Fatalf("Failed to copy database: %v", err)
+	}
+	db := database.NewSQLiteDatabase(path)
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Disconnect()
+	
+	if err := verifyStoredMessages(db); err != nil {
+		t.Fatalf("Failed to verify stored messages: %v", err)
+	}
+	
+	expected := map[string]string{
+		"legacy-1":        types.VerificationVerified,
+		"legacy-2":        types.VerificationVerified,
+		"legacy-3":        types.VerificationVerified,
+		"legacy-tampered": types.VerificationUnverified,
+	}
+	stored, err := db.GetMessages("general", 10)
+	if err != nil || len(stored) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d: %v", len(expected), len(stored), err)
+	}
+	for _, message := range stored {
+		if message.Verification != expected[message.ID] {
+			t.Errorf("Expected %s to be %s, got %q", message.ID, expected[message.ID], message.Verification)
+		}
+	}
+}
+
+func TestAdminSettingsSaveSignaturePolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	server, _ := newTestServer(t)
+	server.config = config
+	server.node.SetRequireSignatures(true)
+	
+	body := strings.NewReader(`{"security": {"require_signature_verification": false}}`)
+	recorder := httptest.NewRecorder()
+	server.handleAdminSettings(recorder, httptest.NewRequest(http.MethodPost, "/api/admin/settings", body))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the settings to be saved, got %d", recorder.Code)
+	}
+	
+	saved, err := LoadConfig(path)
+	if err != nil || saved.Security.RequireSignatureVerification {
+		t.Errorf("Expected the policy saved to the config file, got %v", err)
+	}
+	server.node.mu.RLock()
+	require := server.node.requireSigned
+	server.node.mu.RUnlock()
+	if require {
+		t.Error("Expected the node to follow the new policy")
+	}
+} 
\ No newline at end of file
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+// SuccessionAnnounceWindow is how long heartbeats keep carrying the record
+// of our last key rotation, so peers that were offline still learn of it
+const SuccessionAnnounceWindow = 30 * 24 * time.Hour
+
+var ErrKeyReplaced = errors.New("identity key has been replaced")
+
+// successionRecord converts a verified succession to its stored form
+func successionRecord(succession *security.Succession) (*database.Succession, error) {
+	record, err := json.Marshal(succession)
+	if err != nil {
+		return nil, err
+	}
+	
+	oldKey := hex.EncodeToString(succession.OldKey)
+	newKey := hex.EncodeToString(succession.NewKey)
+	oldUserID, err := userIDForKey(oldKey)
+	if err != nil {
+		return nil, err
+	}
+	newUserID, err := userIDForKey(newKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	return &database.Succession{
+		OldKey:    oldKey,
+		NewKey:    newKey,
+		OldUserID: oldUserID,
+		NewUserID: newUserID,
+		Record:    record,
+		CreatedAt: time.Unix(succession.Timestamp, 0),
+	}, nil
+}
+
+// announcedSuccession returns the record of our last key rotation while it
+// is recent enough to go out with heartbeats
+func (n *Node) announcedSuccession() *security.Succession {
+	stored, err := n.roomManager.db.GetSuccessionTo(n.ID)
+	if err != nil {
+		if err != database.ErrSuccessionNotFound {
+			log.Printf("Failed to load succession record: %v", err)
+		}
+		return nil
+	}
+	if time.Since(stored.CreatedAt) > SuccessionAnnounceWindow {
+		return nil
+	}
+	
+	var succession security.Succession
+	if err := json.Unmarshal(stored.Record, &succession); err != nil {
+		log.Printf("Failed to decode succession record: %v", err)
+		return nil
+	}
+	return &succession
+}
+
+// checkReplaced refuses a key that has already been succeeded, so nobody
+// holding an old private key can come back as that identity
+func (n *Node) checkReplaced(peerKey string) error {
+	_, err := n.roomManager.db.GetSuccession(peerKey)
+	if err == nil {
+		return ErrKeyReplaced
+	}
+	if err != database.ErrSuccessionNotFound {
+		return err
+	}
+	return nil
+}
+
+// applySuccession moves what we know about a peer's old key over to the
+// new key it announced: the stored user, room memberships and roles, the
+// queue, and the peer entry itself. Sessions and sender keys of the old
+// key are dropped and set up again with the new one.
+func (n *Node) applySuccession(peer Peer, succession *security.Succession) error {
+	if err := succession.Verify(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(succession.NewKey) != peer.PublicKey {
+		return errors.New("succession is for another key")
+	}
+	
+	record, err := successionRecord(succession)
+	if err != nil {
+		return err
+	}
+	if record.OldKey == n.ID {
+		return errors.New("succession claims our own key")
+	}
+	
+	// Applied already, or the old key was handed to someone else first
+	existing, err := n.roomManager.db.GetSuccession(record.OldKey)
+	if err == nil {
+		if existing.NewKey != record.NewKey {
+			return errors.New("old key was already succeeded by another key")
+		}
+		return nil
+	}
+	if err != database.ErrSuccessionNotFound {
+		return err
+	}
+	
+	// What was encrypted for the old key can no longer be read. The rest
+	// of the queue moves over to the new key.
+	queued, err := n.roomManager.db.GetQueuedForPeer(record.OldKey)
+	if err != nil {
+		return err
+	}
+	for _, item := range queued {
+		if item.Type == MessageTypeDM || item.Type == MessageTypeSenderKey {
+			if err := n.roomManager.db.DeleteOutbound(item.ID); err != nil {
+				return err
+			}
+		}
+	}
+	
+	if err := n.roomManager.db.ApplySuccession(record); err != nil {
+		return err
+	}
+	n.roomManager.ReplaceMember(record.OldUserID, record.NewUserID)
+	
+	n.mu.Lock()
+	if old, exists := n.peers[record.OldKey]; exists {
+		if current, exists := n.peers[record.NewKey]; exists && old.IsBlocked {
+			current.IsBlocked = true
+			current.Status = PeerStatusDisconnected
+		}
+		delete(n.peers, record.OldKey)
+	}
+	n.mu.Unlock()
+	
+	log.Printf("Peer %s rotated its identity key to %s", shortKey(record.OldKey), shortKey(record.NewKey))
+	n.warnKeyChanged(record)
+	return nil
+}
+
+// requeueFromKey moves what we queued over to our new key. Frames are
+// signed as they are sent, so they only need the new sender. Sealed DMs
+// and sender keys rest on sessions with the old key and are dropped;
+// unsealed ones are sealed on new sessions when sent.
+func requeueFromKey(db database.Database, nodeID string) error {
+	counts, err := db.CountQueuedByPeer()
+	if err != nil {
+		return err
+	}
+	
+	for peerKey := range counts {
+		queued, err := db.GetQueuedForPeer(peerKey)
+		if err != nil {
+			return err
+		}
+		for _, item := range queued {
+			msg, err := ParseProtocolMessage(item.Data)
+			sealed := !item.Unsealed && (item.Type == MessageTypeDM || item.Type == MessageTypeSenderKey)
+			if err != nil || sealed {
+				if err := db.DeleteOutbound(item.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			
+			msg.From = nodeID
+			if payload, err := msg.GetTypedPayload(); err == nil {
+				if join, ok := payload.(JoinPayload); ok {
+					join.PublicKey = nodeID
+					msg.SetPayload(join)
+				}
+			}
+			data, err := msg.ToJSON()
+			if err != nil {
+				return err
+			}
+			if err := db.UpdateOutboundData(item.ID, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotateIdentity replaces our identity key. It runs with the server
+// stopped; the record is announced with heartbeats once it starts again.
+func rotateIdentity(keyPath, dbPath string, passphrases *passphraseSource) error {
+	cryptoManager, err := loadIdentity(keyPath, passphrases)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Disconnect()
+	
+	succession, err := cryptoManager.RotateKeys()
+	if err != nil {
+		return err
+	}
+	record, err := successionRecord(succession)
+	if err != nil {
+		return err
+	}
+	if err := db.ApplySuccession(record); err != nil {
+		return fmt.Errorf("key rotated but the database was not updated: %v", err)
+	}
+	
+	// Everything signed by or agreed with the old key has to be redone
+	if err := requeueFromKey(db, hex.EncodeToString(succession.NewKey)); err != nil {
+		return err
+	}
+	if err := db.DeleteSessions(""); err != nil {
+		return err
+	}
+	for {
+		prekey, err := db.GetLatestPrekey(database.PrekeySigned)
+		if err == database.ErrPrekeyNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := db.DeletePrekey(prekey.ID); err != nil {
+			return err
+		}
+	}
+	
+	fmt.Printf("Identity key rotated\nOld ID: %s\nNew ID: %s\n", record.OldUserID, record.NewUserID)
+	return nil
+} 
\ No newline at end of file
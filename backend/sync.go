@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+	"ripcord/database"
+	"ripcord/types"
+)
+
+const (
+	// SyncPageSize bounds one sync response so it stays well under the
+	// transport frame limit even with long messages
+	SyncPageSize = 50
+	
+	// SyncRequestTimeout is how long a peer has to answer a sync request
+	SyncRequestTimeout = time.Minute
+	
+	maxSyncRequests = 8 // awaiting a response from one peer for one room
+)
+
+var (
+	ErrUnsolicitedSync = errors.New("sync response without a request")
+	ErrUnsealedSync    = errors.New("private room history not sealed on a ratchet session")
+)
+
+// syncRequest is the cursor of a sync request awaiting its response
+type syncRequest struct {
+	since   int64
+	afterID string
+	sent    time.Time
+}
+
+// precedes reports whether a message comes after the request's cursor
+func (sr syncRequest) precedes(timestamp int64, id string) bool {
+	return timestamp > sr.since || (timestamp == sr.since && id > sr.afterID)
+}
+
+func syncRequestKey(peerID, roomID string) string {
+	return peerID + ":" + roomID
+}
+
+func newSyncMessage(message *types.Message) SyncMessage {
+	return SyncMessage{
+		ID:        message.ID,
+		UserID:    message.UserID,
+		Username:  message.Username,
+		Content:   message.Content,
+		Type:      message.Type,
+		Timestamp: message.Timestamp.Unix(),
+		Signature: message.Signature,
+		Clock:     message.Clock,
+		Parents:   message.Parents,
+		Encrypted: message.Encrypted,
+	}
+}
+
+func (sm SyncMessage) toMessage(roomID string) *types.Message {
+	return &types.Message{
+		ID:        sm.ID,
+		RoomID:    roomID,
+		UserID:    sm.UserID,
+		Username:  sm.Username,
+		Content:   sm.Content,
+		Type:      sm.Type,
+		Encrypted: sm.Encrypted,
+		Timestamp: time.Unix(sm.Timestamp, 0),
+		Signature: sm.Signature,
+		Clock:     sm.Clock,
+		Parents:   sm.Parents,
+	}
+}
+
+// lastSyncKey is per peer as well as per room: what one peer sent says
+// nothing about older messages another peer may have that we lack
+func lastSyncKey(peerID, roomID string) string {
+	return "last_sync_time:" + peerID + ":" + roomID
+}
+
+// LastSyncTime returns the timestamp a room's history is synced up to
+// from a peer
+func (n *Node) LastSyncTime(peerID, roomID string) int64 {
+	value, err := n.roomManager.db.GetSettings(lastSyncKey(peerID, roomID))
+	if err != nil {
+		return 0
+	}
+	
+	syncTime, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return syncTime
+}
+
+func (n *Node) setLastSyncTime(peerID, roomID string, syncTime int64) error {
+	if syncTime <= n.LastSyncTime(peerID, roomID) {
+		return nil
+	}
+	return n.roomManager.db.SaveSettings(lastSyncKey(peerID, roomID), strconv.FormatInt(syncTime, 10))
+}
+
+// AnnounceJoin tells the peers in a room that we joined it, then asks them
+// for the history we are missing. Both go to a peer in order so the join
+// is processed before the sync request.
+func (n *Node) AnnounceJoin(roomID, inviteCode string) {
+	for _, peer := range n.peersInRoom(roomID) {
+		join := NewProtocolMessage(MessageTypeJoin, n.ID, generateMessageID())
+		join.RoomID = roomID
+		join.SetPayload(JoinPayload{
+			RoomID:     roomID,
+			InviteCode: inviteCode,
+			Nickname:   n.cryptoManager.GetNickname(),
+			PublicKey:  n.ID,
+		})
+		
+		if err := n.SendToPeer(peer.ID, join); err != nil {
+			log.Printf("Failed to announce join of room %s to %s: %v", roomID, peer.Nickname, err)
+			continue
+		}
+		
+		if err := n.requestSyncFrom(peer.ID, roomID, n.LastSyncTime(peer.ID, roomID)); err != nil {
+			log.Printf("Failed to request sync of room %s from %s: %v", roomID, peer.Nickname, err)
+		}
+	}
+}
+
+// syncWithPeer requests history for every room we share with a peer that
+// has just appeared or come back
+func (n *Node) syncWithPeer(peerID string, peerRooms []string) {
+	rooms, err := n.roomManager.RoomsForUser(n.cryptoManager.GetPublicKeyBase58())
+	if err != nil {
+		log.Printf("Failed to list rooms for sync: %v", err)
+		return
+	}
+	
+	shared := make(map[string]bool)
+	for _, roomID := range peerRooms {
+		shared[roomID] = true
+	}
+	
+	for _, roomID := range rooms {
+		if !shared[roomID] {
+			continue
+		}
+		if err := n.requestSyncFrom(peerID, roomID, n.LastSyncTime(peerID, roomID)); err != nil {
+			log.Printf("Failed to request sync of room %s: %v", roomID, err)
+		}
+	}
+}
+
+// peersInRoom returns the connected peers whose last heartbeat announced a room
+func (n *Node) peersInRoom(roomID string) []Peer {
+	var members []Peer
+	
+	for _, peer := range n.GetPeers() {
+		if peer.Status != PeerStatusConnected || peer.IsBlocked {
+			continue
+		}
+		
+		for _, active := range peer.ActiveRooms {
+			if active == roomID {
+				members = append(members, peer)
+				break
+			}
+		}
+	}
+	
+	return members
+}
+
+// newSyncRequest asks a peer for a room's history after a cursor and
+// remembers it, since only a response to a request we sent is merged
+func (n *Node) newSyncRequest(peerID, roomID string, since int64, afterID string) *ProtocolMessage {
+	now := time.Now()
+	key := syncRequestKey(peerID, roomID)
+	
+	n.mu.Lock()
+	requests := append(n.syncRequests[key], syncRequest{since: since, afterID: afterID, sent: now})
+	if len(requests) > maxSyncRequests {
+		requests = requests[1:]
+	}
+	n.syncRequests[key] = requests
+	for key, requests := range n.syncRequests {
+		if now.Sub(requests[len(requests)-1].sent) > SyncRequestTimeout {
+			delete(n.syncRequests, key)
+		}
+	}
+	n.mu.Unlock()
+	
+	msg := NewProtocolMessage(MessageTypeSync, n.ID, generateMessageID())
+	msg.To = peerID
+	msg.RoomID = roomID
+	msg.SetPayload(SyncPayload{
+		RoomID:       roomID,
+		LastSyncTime: since,
+		AfterID:      afterID,
+	})
+	return msg
+}
+
+func (n *Node) requestSyncFrom(peerID, roomID string, since int64) error {
+	return n.SendToPeer(peerID, n.newSyncRequest(peerID, roomID, since, ""))
+}
+
+// takeSyncRequest returns and forgets the oldest request to a peer for a
+// room that a page starting with first answers
+func (n *Node) takeSyncRequest(peerID, roomID string, first SyncMessage) (syncRequest, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	
+	key := syncRequestKey(peerID, roomID)
+	requests := n.syncRequests[key]
+	for i, request := range requests {
+		if time.Since(request.sent) > SyncRequestTimeout || !request.precedes(first.Timestamp, first.ID) {
+			continue
+		}
+		requests = append(requests[:i:i], requests[i+1:]...)
+		if len(requests) == 0 {
+			delete(n.syncRequests, key)
+		} else {
+			n.syncRequests[key] = requests
+		}
+		return request, true
+	}
+	return syncRequest{}, false
+}
+
+func (n *Node) handleSync(msg *ProtocolMessage, peer Peer, payload interface{}) error {
+	sync, ok := payload.(SyncPayload)
+	if !ok {
+		return errors.New("sync message missing payload")
+	}
+	
+	room, err := n.roomManager.GetRoom(sync.RoomID)
+	if err != nil {
+		return err
+	}
+	
+	// A request carries no messages; only members get the history
+	if len(sync.Messages) == 0 && sync.Sealed == nil {
+		userID, err := userIDForKey(peer.PublicKey)
+		if err != nil {
+			return err
+		}
+		if !room.IsMember(userID) {
+			return ErrNotRoomMember
+		}
+		return n.answerSync(peer, userID, sync)
+	}
+	
+	if !room.IsMember(n.cryptoManager.GetPublicKeyBase58()) {
+		return ErrNotRoomMember
+	}
+	
+	return n.mergeSync(peer, room, sync)
+}
+
+// answerSync sends a member one page of history after the requested cursor
+func (n *Node) answerSync(peer Peer, userID string, request SyncPayload) error {
+	since, afterID := request.LastSyncTime, request.AfterID
+	
+	// Private history only travels sealed to the requester on our ratchet
+	// session, and only from when they joined: like the sender keys they
+	// were given, it leaves what came before unreadable to them
+	private := n.roomManager.IsPrivate(request.RoomID)
+	var requester ed25519.PublicKey
+	if private {
+		if !peer.HasFeature(FeatureSenderKeys) {
+			return errors.New("peer cannot receive private room history")
+		}
+		var err error
+		if requester, err = hex.DecodeString(peer.PublicKey); err != nil {
+			return err
+		}
+		
+		joinedAt, err := n.roomManager.db.GetParticipantJoinedAt(request.RoomID, userID)
+		if err != nil {
+			return err
+		}
+		if joined := joinedAt.Unix(); joined > since {
+			since, afterID = joined, ""
+		}
+	}
+	
+	messages, err := n.roomManager.db.GetMessagesSince(request.RoomID, time.Unix(since, 0), afterID, SyncPageSize+1)
+	if err != nil {
+		return err
+	}
+	
+	if len(messages) == 0 {
+		return nil
+	}
+	
+	hasMore := len(messages) > SyncPageSize
+	if hasMore {
+		messages = messages[:SyncPageSize]
+	}
+	
+	response := SyncPayload{
+		RoomID:  request.RoomID,
+		HasMore: hasMore,
+	}
+	for _, message := range messages {
+		response.Messages = append(response.Messages, newSyncMessage(message))
+	}
+	
+	last := messages[len(messages)-1]
+	response.LastSyncTime = last.Timestamp.Unix()
+	response.AfterID = last.ID
+	
+	// Without the requester's prekeys there is no session to seal it on;
+	// they ask again on the next sync, by when the bundle has been fetched
+	if private {
+		page, err := json.Marshal(response.Messages)
+		if err != nil {
+			return err
+		}
+		sealed, err := n.sealRatchetDM(peer.ID, requester, string(page))
+		if err != nil {
+			return fmt.Errorf("failed to seal history of room %s: %w", request.RoomID, err)
+		}
+		response.Messages = nil
+		response.Sealed = &sealed
+	}
+	
+	reply := NewProtocolMessage(MessageTypeSync, n.ID, generateMessageID())
+	reply.To = peer.ID
+	reply.RoomID = request.RoomID
+	reply.SetPayload(response)
+	
+	n.replyToPeer(peer.ID, reply)
+	return nil
+}
+
+// mergeSync stores the verified messages by members of a page we asked for
+// and do not have yet, then asks for the next page. The sync position only
+// moves up to the messages merged, so a page that was refused or lost is
+// asked for again on the next sync.
+func (n *Node) mergeSync(peer Peer, room *Room, response SyncPayload) error {
+	if response.Sealed != nil {
+		messages, err := n.openSyncPage(peer, *response.Sealed)
+		if err != nil {
+			return err
+		}
+		response.Messages = messages
+	} else if n.roomManager.IsPrivate(response.RoomID) {
+		return ErrUnsealedSync
+	}
+	
+	request, ok := n.takeSyncRequest(peer.ID, response.RoomID, response.Messages[0])
+	if !ok {
+		return ErrUnsolicitedSync
+	}
+	
+	merged, rejected := 0, 0
+	var position, seq int64
+	
+	// The page is checked against the room's clock as it grows
+	clock, err := n.roomManager.LatestClock(room.ID)
+	if err != nil {
+		return err
+	}
+	
+	for _, synced := range response.Messages {
+		if !room.IsMember(synced.UserID) {
+			rejected++
+			continue
+		}
+		
+		exists, err := n.roomManager.db.MessageExists(synced.ID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		
+		message := synced.toMessage(response.RoomID)
+		if err := verifyMessageSignature(message); err != nil {
+			rejected++
+			continue
+		}
+		if err := checkClock(message.Clock, clock); err != nil {
+			rejected++
+			continue
+		}
+		
+		err = n.roomManager.db.SaveMessage(message)
+		if err == database.ErrMessageConflict {
+			rejected++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		merged++
+		seq = message.Seq
+		if synced.Timestamp > position {
+			position = synced.Timestamp
+		}
+		if message.Clock > clock {
+			clock = message.Clock
+		}
+	}
+	
+	if rejected > 0 {
+		log.Printf("Rejected %d messages synced from %s", rejected, peer.Nickname)
+	}
+	
+	// An author's clock may run ahead of ours
+	if now := time.Now().Unix(); position > now {
+		position = now
+	}
+	if err := n.setLastSyncTime(peer.ID, response.RoomID, position); err != nil {
+		log.Printf("Failed to record sync time for room %s: %v", response.RoomID, err)
+	}
+	
+	// The next page continues after this one's last message, as long as
+	// that moves the cursor on
+	if response.HasMore {
+		last := response.Messages[len(response.Messages)-1]
+		if request.precedes(last.Timestamp, last.ID) {
+			n.replyToPeer(peer.ID, n.newSyncRequest(peer.ID, response.RoomID, last.Timestamp, last.ID))
+		}
+	}
+	
+	if merged > 0 {
+		n.notifyRoom(response.RoomID, map[string]interface{}{
+			"type":    "room_synced",
+			"room_id": response.RoomID,
+			"count":   merged,
+			"seq":     seq,
+		})
+	}
+	
+	return nil
+}
+
+// openSyncPage decrypts the messages of a private room's history page a
+// peer sealed to us
+func (n *Node) openSyncPage(peer Peer, sealed DMPayload) ([]SyncMessage, error) {
+	// Only a peer without ratchet sessions may fall back to the static keys
+	if !sealed.IsEncrypted || (sealed.Ratchet == nil && peer.HasFeature(FeatureRatchet)) {
+		return nil, ErrUnsealedSync
+	}
+	
+	content, err := n.openDMPayload(peer, sealed)
+	if err != nil {
+		return nil, err
+	}
+	
+	var messages []SyncMessage
+	if err := json.Unmarshal([]byte(content), &messages); err != nil {
+		return nil, fmt.Errorf("invalid sealed sync page: %v", err)
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("sealed sync page is empty")
+	}
+	return messages, nil
+} 
\ No newline at end of file
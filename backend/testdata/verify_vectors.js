@@ -0,0 +1,119 @@
+// Checks signing_vectors.json with an implementation independent of the Go
+// code: RFC 8785 from JSON.stringify, and Ed25519 from node:crypto.
+//
+//   node testdata/verify_vectors.js
+'use strict';
+
+const crypto = require('crypto');
+const fs = require('fs');
+const path = require('path');
+
+const vectors = JSON.parse(fs.readFileSync(path.join(__dirname, 'signing_vectors.json'), 'utf8'));
+
+// JSON.stringify already escapes strings and prints numbers as RFC 8785
+// asks; only member order is left, and sort() compares UTF-16 code units
+function canonicalize(value) {
+  if (value === null || typeof value !== 'object') {
+    return JSON.stringify(value);
+  }
+  if (Array.isArray(value)) {
+    return '[' + value.map(canonicalize).join(',') + ']';
+  }
+  return '{' + Object.keys(value).sort()
+    .map((key) => JSON.stringify(key) + ':' + canonicalize(value[key]))
+    .join(',') + '}';
+}
+
+class SignedData {
+  constructor(domain) {
+    this.parts = [Buffer.from(domain + '\0', 'utf8')];
+  }
+  bytes(buf) {
+    const length = Buffer.alloc(4);
+    length.writeUInt32BE(buf.length);
+    this.parts.push(length, buf);
+    return this;
+  }
+  string(s) {
+    return this.bytes(Buffer.from(s || '', 'utf8'));
+  }
+  strings(list) {
+    const count = Buffer.alloc(4);
+    count.writeUInt32BE((list || []).length);
+    this.parts.push(count);
+    (list || []).forEach((s) => this.string(s));
+    return this;
+  }
+  int64(n) {
+    const buf = Buffer.alloc(8);
+    buf.writeBigInt64BE(BigInt(n));
+    this.parts.push(buf);
+    return this;
+  }
+  uint64(n) {
+    const buf = Buffer.alloc(8);
+    buf.writeBigUInt64BE(BigInt(n));
+    this.parts.push(buf);
+    return this;
+  }
+  bool(b) {
+    this.parts.push(Buffer.from([b ? 1 : 0]));
+    return this;
+  }
+  encoded() {
+    return Buffer.concat(this.parts);
+  }
+}
+
+function messageSignable(m) {
+  return new SignedData('ripcord-message-v1')
+    .string(m.id).string(m.room_id).string(m.user_id).string(m.username)
+    .string(m.content).string(m.type).bool(m.encrypted)
+    .int64(m.timestamp).uint64(m.clock || 0).strings(m.parents)
+    .encoded();
+}
+
+function frameSignable(f) {
+  const payload = f.payload === undefined || f.payload === null
+    ? Buffer.alloc(0)
+    : Buffer.from(canonicalize(f.payload), 'utf8');
+  return new SignedData('ripcord-frame-v1')
+    .string(f.version).string(f.type).string(f.message_id).string(f.from)
+    .string(f.to).string(f.room_id).int64(f.timestamp).bytes(payload)
+    .encoded();
+}
+
+const privateKey = crypto.createPrivateKey({
+  key: Buffer.concat([Buffer.from('302e020100300506032b657004220420', 'hex'), Buffer.from(vectors.seed, 'hex')]),
+  format: 'der',
+  type: 'pkcs8',
+});
+const publicKey = crypto.createPublicKey(privateKey);
+
+let failures = 0;
+function check(name, signable, want) {
+  const signature = crypto.sign(null, signable, privateKey).toString('hex');
+  if (signable.toString('hex') !== want.signable) {
+    console.log(`FAIL ${name}: signable bytes differ`);
+    failures++;
+  } else if (signature !== want.signature || !crypto.verify(null, signable, publicKey, Buffer.from(want.signature, 'hex'))) {
+    console.log(`FAIL ${name}: signature differs`);
+    failures++;
+  } else {
+    console.log(`ok   ${name}`);
+  }
+}
+
+vectors.canonical_json.forEach((v, i) => {
+  const got = canonicalize(JSON.parse(v.input));
+  if (got !== v.canonical) {
+    console.log(`FAIL canonical_json[${i}]: got ${got}`);
+    failures++;
+  } else {
+    console.log(`ok   canonical_json[${i}]`);
+  }
+});
+vectors.messages.forEach((v, i) => check(`messages[${i}]`, messageSignable(v.message), v));
+vectors.frames.forEach((v, i) => check(`frames[${i}]`, frameSignable(JSON.parse(v.frame)), v));
+
+process.exit(failures ? 1 : 0);
@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"ripcord/i2p"
+)
+
+var ErrI2PNotConnected = errors.New("i2p session not connected")
+
+// I2PTransport carries frames over I2P streams using the manager's session
+type I2PTransport struct {
+	*streamTransport
+	manager *i2p.I2PManager
+}
+
+func NewI2PTransport(manager *i2p.I2PManager) *I2PTransport {
+	t := &I2PTransport{
+		streamTransport: newStreamTransport(SchemeI2P),
+		manager:         manager,
+	}
+	
+	t.dial = func(address string) (net.Conn, error) {
+		session := t.manager.Session()
+		if session == nil {
+			return nil, ErrI2PNotConnected
+		}
+		return session.Dial(address)
+	}
+	t.listen = func() (net.Listener, error) {
+		session := t.manager.Session()
+		if session == nil {
+			return nil, ErrI2PNotConnected
+		}
+		return session.Listen(), nil
+	}
+	t.local = t.manager.Base32Address
+	
+	return t
+} 
\ No newline at end of file
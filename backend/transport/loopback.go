@@ -0,0 +1,142 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// LoopbackNetwork is an in-memory network joining LoopbackTransports by name
+type LoopbackNetwork struct {
+	listeners map[string]*loopbackListener
+	mu        sync.Mutex
+}
+
+func NewLoopbackNetwork() *LoopbackNetwork {
+	return &LoopbackNetwork{
+		listeners: make(map[string]*loopbackListener),
+	}
+}
+
+// LoopbackTransport exchanges frames with other transports on the same
+// LoopbackNetwork without touching the OS network stack
+type LoopbackTransport struct {
+	*streamTransport
+	network *LoopbackNetwork
+	name    string
+}
+
+func NewLoopbackTransport(network *LoopbackNetwork, name string) *LoopbackTransport {
+	t := &LoopbackTransport{
+		streamTransport: newStreamTransport(SchemeLoopback),
+		network:         network,
+		name:            name,
+	}
+	
+	t.dial = t.dialName
+	t.listen = t.register
+	t.local = func() string { return t.name }
+	
+	return t
+}
+
+func (t *LoopbackTransport) dialName(address string) (net.Conn, error) {
+	t.network.mu.Lock()
+	listener, ok := t.network.listeners[address]
+	t.network.mu.Unlock()
+	
+	if !ok {
+		return nil, fmt.Errorf("loopback address not listening: %s", address)
+	}
+	
+	local, remote := net.Pipe()
+	if err := listener.deliver(&loopbackConn{Conn: remote, remote: t.name}); err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+	
+	return &loopbackConn{Conn: local, remote: address}, nil
+}
+
+func (t *LoopbackTransport) register() (net.Listener, error) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	
+	if _, exists := t.network.listeners[t.name]; exists {
+		return nil, fmt.Errorf("loopback address already in use: %s", t.name)
+	}
+	
+	listener := &loopbackListener{
+		network: t.network,
+		name:    t.name,
+		conns:   make(chan net.Conn, 16),
+		done:    make(chan struct{}),
+	}
+	t.network.listeners[t.name] = listener
+	
+	return listener, nil
+}
+
+type loopbackAddr string
+
+func (a loopbackAddr) Network() string {
+	return SchemeLoopback
+}
+
+func (a loopbackAddr) String() string {
+	return string(a)
+}
+
+// loopbackConn reports the dialling transport's name as its remote address
+type loopbackConn struct {
+	net.Conn
+	remote string
+}
+
+func (c *loopbackConn) RemoteAddr() net.Addr {
+	return loopbackAddr(c.remote)
+}
+
+type loopbackListener struct {
+	network *LoopbackNetwork
+	name    string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *loopbackListener) deliver(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return ErrClosed
+	}
+}
+
+func (l *loopbackListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *loopbackListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		
+		l.network.mu.Lock()
+		if l.network.listeners[l.name] == l {
+			delete(l.network.listeners, l.name)
+		}
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *loopbackListener) Addr() net.Addr {
+	return loopbackAddr(l.name)
+} 
\ No newline at end of file
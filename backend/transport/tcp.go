@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+const tcpDialTimeout = 10 * time.Second
+
+// TCPTransport carries frames over plain TCP, for LAN deployments and tests
+type TCPTransport struct {
+	*streamTransport
+	listenAddress    string
+	advertiseAddress string
+}
+
+// NewTCPTransport listens on listenAddress. advertiseAddress is what peers
+// are told to dial; when empty the listener's own address is used.
+func NewTCPTransport(listenAddress, advertiseAddress string) *TCPTransport {
+	t := &TCPTransport{
+		streamTransport:  newStreamTransport(SchemeTCP),
+		listenAddress:    listenAddress,
+		advertiseAddress: advertiseAddress,
+	}
+	
+	t.dial = func(address string) (net.Conn, error) {
+		return net.DialTimeout("tcp", address, tcpDialTimeout)
+	}
+	t.listen = func() (net.Listener, error) {
+		return net.Listen("tcp", t.listenAddress)
+	}
+	t.local = t.localAddress
+	
+	return t
+}
+
+func (t *TCPTransport) localAddress() string {
+	if t.advertiseAddress != "" {
+		return t.advertiseAddress
+	}
+	
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	
+	if t.listener != nil {
+		return t.listener.Addr().String()
+	}
+	return ""
+} 
\ No newline at end of file
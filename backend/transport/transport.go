@@ -0,0 +1,435 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SchemeI2P      = "i2p"
+	SchemeTCP      = "tcp"
+	SchemeLoopback = "mem"
+	
+	// MaxFrameSize bounds a single protocol message on a stream
+	MaxFrameSize = 1 << 20
+	
+	// A peer that stops reading fails the send instead of holding the
+	// address's send lock forever
+	defaultWriteTimeout = 30 * time.Second
+	
+	// Transient accept failures are retried with a doubling delay
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+var (
+	ErrClosed         = errors.New("transport closed")
+	ErrUnknownScheme  = errors.New("no transport for address scheme")
+	ErrFrameTooLarge  = errors.New("frame exceeds maximum size")
+	ErrInvalidAddress = errors.New("address must be of the form scheme:address")
+)
+
+// Handler receives every frame read from an inbound connection. from is the
+// transport-qualified address of the remote end.
+type Handler func(from string, data []byte)
+
+// Transport carries protocol frames to and from peers on one network.
+// Addresses passed to Dial and Send are unqualified; LocalAddress is
+// qualified so it can be advertised to peers as-is.
+type Transport interface {
+	Scheme() string
+	Dial(address string) (net.Conn, error)
+	Listen(handler Handler) error
+	Send(address string, data []byte) error
+	Close() error
+	LocalAddress() string
+}
+
+// ParseAddress splits "i2p:xxxx.b32.i2p" or "tcp:10.0.0.5:7700" into its
+// scheme and transport address
+func ParseAddress(qualified string) (string, string, error) {
+	scheme, address, found := strings.Cut(qualified, ":")
+	if !found || scheme == "" || address == "" {
+		return "", "", ErrInvalidAddress
+	}
+	return scheme, address, nil
+}
+
+func QualifyAddress(scheme, address string) string {
+	return scheme + ":" + address
+}
+
+// WriteFrame writes a length-prefixed frame
+func WriteFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a length-prefixed frame written by WriteFrame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	
+	return data, nil
+}
+
+// streamTransport implements framing, outbound connection reuse and the
+// accept loop for any transport that can produce net.Conn streams
+type streamTransport struct {
+	scheme   string
+	dial     func(address string) (net.Conn, error)
+	listen   func() (net.Listener, error)
+	local    func() string
+	conns    map[string]net.Conn
+	inbound  map[net.Conn]bool
+	listener net.Listener
+	sendMu   map[string]*sync.Mutex
+	timeout  time.Duration
+	closed   bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func newStreamTransport(scheme string) *streamTransport {
+	return &streamTransport{
+		scheme:  scheme,
+		conns:   make(map[string]net.Conn),
+		inbound: make(map[net.Conn]bool),
+		sendMu:  make(map[string]*sync.Mutex),
+		timeout: defaultWriteTimeout,
+	}
+}
+
+func (st *streamTransport) Scheme() string {
+	return st.scheme
+}
+
+func (st *streamTransport) LocalAddress() string {
+	address := st.local()
+	if address == "" {
+		return ""
+	}
+	return QualifyAddress(st.scheme, address)
+}
+
+func (st *streamTransport) Dial(address string) (net.Conn, error) {
+	st.mu.Lock()
+	closed := st.closed
+	st.mu.Unlock()
+	
+	if closed {
+		return nil, ErrClosed
+	}
+	return st.dial(address)
+}
+
+func (st *streamTransport) Listen(handler Handler) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	
+	if st.closed {
+		return ErrClosed
+	}
+	if st.listener != nil {
+		return errors.New("transport already listening")
+	}
+	
+	listener, err := st.listen()
+	if err != nil {
+		return err
+	}
+	st.listener = listener
+	
+	st.wg.Add(1)
+	go st.acceptLoop(listener, handler)
+	
+	return nil
+}
+
+func (st *streamTransport) acceptLoop(listener net.Listener, handler Handler) {
+	defer st.wg.Done()
+	
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			st.mu.Lock()
+			closed := st.closed
+			st.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) || errors.Is(err, ErrClosed) {
+				return
+			}
+			
+			// Anything else, such as a failed SAM STREAM ACCEPT, may clear up
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			log.Printf("%s transport accept failed, retrying in %v: %v", st.scheme, backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			conn.Close()
+			return
+		}
+		st.inbound[conn] = true
+		st.mu.Unlock()
+		
+		st.wg.Add(1)
+		go st.readLoop(conn, handler)
+	}
+}
+
+func (st *streamTransport) readLoop(conn net.Conn, handler Handler) {
+	defer func() {
+		st.mu.Lock()
+		delete(st.inbound, conn)
+		st.mu.Unlock()
+		conn.Close()
+		st.wg.Done()
+	}()
+	
+	from := QualifyAddress(st.scheme, conn.RemoteAddr().String())
+	for {
+		data, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		handler(from, data)
+	}
+}
+
+// Send writes a frame on a cached outbound connection, redialing once if
+// the cached connection has gone away
+func (st *streamTransport) Send(address string, data []byte) error {
+	// Frames to one address are serialised; different addresses proceed in parallel
+	st.mu.Lock()
+	lock, ok := st.sendMu[address]
+	if !ok {
+		lock = &sync.Mutex{}
+		st.sendMu[address] = lock
+	}
+	st.mu.Unlock()
+	
+	lock.Lock()
+	defer lock.Unlock()
+	
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, err := st.outbound(address)
+		if err != nil {
+			return err
+		}
+		
+		conn.SetWriteDeadline(time.Now().Add(st.timeout))
+		err = WriteFrame(conn, data)
+		if err == nil {
+			return nil
+		}
+		
+		st.mu.Lock()
+		if st.conns[address] == conn {
+			delete(st.conns, address)
+		}
+		st.mu.Unlock()
+		conn.Close()
+		
+		// A stalled peer would stall the redial too
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("send to %s timed out: %w", QualifyAddress(st.scheme, address), err)
+		}
+	}
+	
+	return fmt.Errorf("failed to send to %s", QualifyAddress(st.scheme, address))
+}
+
+func (st *streamTransport) outbound(address string) (net.Conn, error) {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if conn, ok := st.conns[address]; ok {
+		st.mu.Unlock()
+		return conn, nil
+	}
+	st.mu.Unlock()
+	
+	conn, err := st.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	
+	if st.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	st.conns[address] = conn
+	return conn, nil
+}
+
+func (st *streamTransport) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	
+	var err error
+	if st.listener != nil {
+		err = st.listener.Close()
+	}
+	for address, conn := range st.conns {
+		conn.Close()
+		delete(st.conns, address)
+	}
+	for conn := range st.inbound {
+		conn.Close()
+	}
+	st.mu.Unlock()
+	
+	st.wg.Wait()
+	return err
+}
+
+// Manager routes qualified addresses to the transport registered for
+// their scheme, so a node can be reachable on several networks at once
+type Manager struct {
+	transports map[string]Transport
+	mu         sync.RWMutex
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		transports: make(map[string]Transport),
+	}
+}
+
+// Register adds a transport, replacing any previous one for its scheme
+func (m *Manager) Register(t Transport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transports[t.Scheme()] = t
+}
+
+func (m *Manager) Get(scheme string) (Transport, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.transports[scheme]
+	return t, ok
+}
+
+// Supports reports whether a qualified address can be reached
+func (m *Manager) Supports(qualified string) bool {
+	scheme, _, err := ParseAddress(qualified)
+	if err != nil {
+		return false
+	}
+	_, ok := m.Get(scheme)
+	return ok
+}
+
+func (m *Manager) Send(qualified string, data []byte) error {
+	scheme, address, err := ParseAddress(qualified)
+	if err != nil {
+		return err
+	}
+	
+	t, ok := m.Get(scheme)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+	
+	return t.Send(address, data)
+}
+
+// Listen starts every registered transport. A transport that fails to
+// listen is logged and skipped so the others keep working.
+func (m *Manager) Listen(handler Handler) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	started := 0
+	for scheme, t := range m.transports {
+		if err := t.Listen(handler); err != nil {
+			log.Printf("Failed to listen on %s transport: %v", scheme, err)
+			continue
+		}
+		started++
+	}
+	
+	if started == 0 && len(m.transports) > 0 {
+		return errors.New("no transport could listen")
+	}
+	return nil
+}
+
+// LocalAddresses returns the qualified address of every transport
+func (m *Manager) LocalAddresses() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	addresses := make([]string, 0, len(m.transports))
+	for _, t := range m.transports {
+		if address := t.LocalAddress(); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Close shuts every transport down. The lock is released first because
+// closing waits for inbound handlers, which may call back into the manager.
+func (m *Manager) Close() error {
+	m.mu.RLock()
+	transports := make(map[string]Transport, len(m.transports))
+	for scheme, t := range m.transports {
+		transports[scheme] = t
+	}
+	m.mu.RUnlock()
+	
+	var firstErr error
+	for scheme, t := range transports {
+		if err := t.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", scheme, err)
+		}
+	}
+	return firstErr
+} 
\ No newline at end of file
@@ -0,0 +1,293 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"ripcord/i2p"
+)
+
+type received struct {
+	from string
+	data []byte
+}
+
+func collect(t Transport) (chan received, error) {
+	ch := make(chan received, 16)
+	err := t.Listen(func(from string, data []byte) {
+		ch <- received{from: from, data: data}
+	})
+	return ch, err
+}
+
+func expectFrame(t *testing.T, ch chan received, want []byte) received {
+	t.Helper()
+	
+	select {
+	case got := <-ch:
+		if !bytes.Equal(got.data, want) {
+			t.Errorf("Expected frame %q, got %q", want, got.data)
+		}
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for frame %q", want)
+	}
+	return received{}
+}
+
+func TestParseAddress(t *testing.T) {
+	scheme, address, err := ParseAddress("tcp:10.0.0.5:7700")
+	if err != nil || scheme != SchemeTCP || address != "10.0.0.5:7700" {
+		t.Errorf("Unexpected parse result: %s %s %v", scheme, address, err)
+	}
+	
+	if _, _, err := ParseAddress("localhost"); err != ErrInvalidAddress {
+		t.Errorf("Expected ErrInvalidAddress for unqualified address, got %v", err)
+	}
+}
+
+func TestLoopbackTransport(t *testing.T) {
+	network := NewLoopbackNetwork()
+	
+	alice := NewLoopbackTransport(network, "alice")
+	defer alice.Close()
+	bob := NewLoopbackTransport(network, "bob")
+	defer bob.Close()
+	
+	inbox, err := collect(bob)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	
+	for _, frame := range []string{"first", "second"} {
+		if err := alice.Send("bob", []byte(frame)); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	
+	got := expectFrame(t, inbox, []byte("first"))
+	expectFrame(t, inbox, []byte("second"))
+	
+	if got.from != "mem:alice" {
+		t.Errorf("Expected frame from mem:alice, got %s", got.from)
+	}
+	
+	if err := alice.Send("carol", []byte("x")); err == nil {
+		t.Error("Expected sending to an unknown loopback address to fail")
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	server := NewTCPTransport("127.0.0.1:0", "")
+	defer server.Close()
+	
+	inbox, err := collect(server)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	
+	client := NewTCPTransport("127.0.0.1:0", "")
+	defer client.Close()
+	
+	_, address, err := ParseAddress(server.LocalAddress())
+	if err != nil {
+		t.Fatalf("Unexpected local address %s: %v", server.LocalAddress(), err)
+	}
+	
+	if err := client.Send(address, []byte("hello over tcp")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	expectFrame(t, inbox, []byte("hello over tcp"))
+}
+
+func TestI2PTransport(t *testing.T) {
+	bridge, err := i2p.NewFakeBridge()
+	if err != nil {
+		t.Fatalf("Failed to start fake bridge: %v", err)
+	}
+	defer bridge.Close()
+	
+	serverManager := i2p.NewI2PManager(bridge.Host(), bridge.Port())
+	if err := serverManager.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer serverManager.Disconnect()
+	
+	clientManager := i2p.NewI2PManager(bridge.Host(), bridge.Port())
+	if err := clientManager.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer clientManager.Disconnect()
+	
+	server := NewI2PTransport(serverManager)
+	defer server.Close()
+	inbox, err := collect(server)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	
+	client := NewI2PTransport(clientManager)
+	defer client.Close()
+	
+	if server.LocalAddress() != "i2p:"+serverManager.Base32Address() {
+		t.Errorf("Unexpected local address: %s", server.LocalAddress())
+	}
+	
+	if err := client.Send(serverManager.Base32Address(), []byte("hello over i2p")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	
+	got := expectFrame(t, inbox, []byte("hello over i2p"))
+	if got.from != "i2p:"+clientManager.Base32Address() {
+		t.Errorf("Expected frame from client b32 address, got %s", got.from)
+	}
+}
+
+func TestSendTimesOutOnStalledPeer(t *testing.T) {
+	st := newStreamTransport(SchemeLoopback)
+	st.timeout = 50 * time.Millisecond
+	
+	var peers []net.Conn
+	st.dial = func(address string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		peers = append(peers, remote)
+		return local, nil
+	}
+	defer func() {
+		for _, conn := range peers {
+			conn.Close()
+		}
+	}()
+	
+	done := make(chan error, 1)
+	go func() {
+		done <- st.Send("stalled", []byte("never read"))
+	}()
+	
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected sending to a peer that never reads to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked on a peer that never reads")
+	}
+	
+	st.mu.Lock()
+	cached := len(st.conns)
+	st.mu.Unlock()
+	if cached != 0 {
+		t.Errorf("Expected the stalled connection to be dropped, %d still cached", cached)
+	}
+	if len(peers) != 1 {
+		t.Errorf("Expected no redial after a timeout, dialled %d times", len(peers))
+	}
+	st.Close()
+}
+
+// flakyListener fails the first few Accept calls the way a SAM bridge
+// does when a STREAM ACCEPT is refused
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, errors.New("STREAM ACCEPT failed: I2P_ERROR")
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptRetriesTransientErrors(t *testing.T) {
+	network := NewLoopbackNetwork()
+	
+	bob := NewLoopbackTransport(network, "bob")
+	defer bob.Close()
+	register := bob.listen
+	bob.listen = func() (net.Listener, error) {
+		listener, err := register()
+		if err != nil {
+			return nil, err
+		}
+		return &flakyListener{Listener: listener, failures: 3}, nil
+	}
+	
+	inbox, err := collect(bob)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	
+	alice := NewLoopbackTransport(network, "alice")
+	defer alice.Close()
+	
+	if err := alice.Send("bob", []byte("after retries")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	expectFrame(t, inbox, []byte("after retries"))
+	
+	closed := make(chan struct{})
+	go func() {
+		bob.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept loop kept running after the transport closed")
+	}
+}
+
+func TestManagerRoutesByScheme(t *testing.T) {
+	network := NewLoopbackNetwork()
+	
+	receiver := NewManager()
+	receiver.Register(NewLoopbackTransport(network, "receiver"))
+	receiver.Register(NewTCPTransport("127.0.0.1:0", ""))
+	defer receiver.Close()
+	
+	inbox := make(chan received, 16)
+	if err := receiver.Listen(func(from string, data []byte) {
+		inbox <- received{from: from, data: data}
+	}); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	
+	sender := NewManager()
+	sender.Register(NewLoopbackTransport(network, "sender"))
+	sender.Register(NewTCPTransport("127.0.0.1:0", ""))
+	defer sender.Close()
+	
+	addresses := receiver.LocalAddresses()
+	if len(addresses) != 2 {
+		t.Fatalf("Expected two local addresses, got %v", addresses)
+	}
+	
+	for _, address := range addresses {
+		if err := sender.Send(address, []byte(address)); err != nil {
+			t.Fatalf("Failed to send to %s: %v", address, err)
+		}
+	}
+	
+	seen := make(map[string]bool)
+	for range addresses {
+		select {
+		case got := <-inbox:
+			seen[string(got.data)] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for frames")
+		}
+	}
+	for _, address := range addresses {
+		if !seen[address] {
+			t.Errorf("Expected frame sent via %s", address)
+		}
+	}
+	
+	if err := sender.Send("i2p:nowhere.b32.i2p", []byte("x")); err == nil {
+		t.Error("Expected sending without an i2p transport to fail")
+	}
+} 
\ No newline at end of file
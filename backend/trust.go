@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/mr-tron/base58"
+	"ripcord/database"
+	"ripcord/security"
+)
+
+// KeyWarning flags a contact whose key changed after the user verified it
+type KeyWarning struct {
+	UserID         string    `json:"user_id"`
+	Nickname       string    `json:"nickname"`
+	PreviousUserID string    `json:"previous_user_id"`
+	VerifiedAt     time.Time `json:"verified_at"`
+}
+
+// contactKey decodes a base58 user ID into the key it stands for
+func contactKey(userID string) (ed25519.PublicKey, error) {
+	key, err := base58.Decode(userID)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("user ID is not a public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// SafetyNumber computes the safety number we share with a user
+func (n *Node) SafetyNumber(userID string) (security.SafetyNumber, error) {
+	key, err := contactKey(userID)
+	if err != nil {
+		return security.SafetyNumber{}, err
+	}
+	return security.NewSafetyNumber(n.cryptoManager.GetPublicKey(), key), nil
+}
+
+// VerifyContact marks a user's key verified once the user confirmed the
+// safety number, either typed in or scanned from the contact's screen
+func (n *Node) VerifyContact(userID, digits, qrPayload string) error {
+	number, err := n.SafetyNumber(userID)
+	if err != nil {
+		return err
+	}
+	if !number.MatchesDigits(digits) && !number.MatchesQR(qrPayload) {
+		return security.ErrSafetyNumberMismatch
+	}
+	
+	trusted := &database.TrustedKey{
+		UserID:     userID,
+		Nickname:   n.contactName(userID),
+		VerifiedAt: time.Now(),
+	}
+	if err := n.roomManager.db.SaveTrustedKey(trusted); err != nil {
+		return err
+	}
+	
+	// The new key is verified now, so the warning about the old one goes
+	replaced, err := n.roomManager.db.GetReplacedTrust(userID)
+	if err == database.ErrTrustNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return n.roomManager.db.DeleteTrustedKey(replaced.UserID)
+}
+
+// contactName finds a nickname for a user among our peers and rooms
+func (n *Node) contactName(userID string) string {
+	key, err := contactKey(userID)
+	if err != nil {
+		return ""
+	}
+	
+	n.mu.RLock()
+	peer, exists := n.peers[hex.EncodeToString(key)]
+	n.mu.RUnlock()
+	if exists && peer.Nickname != "" {
+		return peer.Nickname
+	}
+	
+	rooms, _ := n.roomManager.RoomsForUser(userID)
+	for _, roomID := range rooms {
+		if room, err := n.roomManager.GetRoom(roomID); err == nil {
+			if name := room.MemberName(userID); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// keyWarning reports whether userID replaced a key the user had verified
+func (n *Node) keyWarning(userID string) (*KeyWarning, error) {
+	replaced, err := n.roomManager.db.GetReplacedTrust(userID)
+	if err == database.ErrTrustNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	return &KeyWarning{
+		UserID:         userID,
+		Nickname:       replaced.Nickname,
+		PreviousUserID: replaced.UserID,
+		VerifiedAt:     replaced.VerifiedAt,
+	}, nil
+}
+
+// KeyWarnings lists the members of a room, or the other side of a direct
+// message, whose verified key was replaced
+func (n *Node) KeyWarnings(roomID string) ([]*KeyWarning, error) {
+	var userIDs []string
+	if strings.HasPrefix(roomID, dmRoomID("")) {
+		userIDs = []string{strings.TrimPrefix(roomID, dmRoomID(""))}
+	} else {
+		room, err := n.roomManager.GetRoom(roomID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = room.GetMembersList()
+	}
+	
+	warnings := make([]*KeyWarning, 0)
+	for _, userID := range userIDs {
+		warning, err := n.keyWarning(userID)
+		if err != nil {
+			return nil, err
+		}
+		if warning != nil {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
+
+// warnKeyChanged tells local clients when a succession replaced the key of
+// a verified contact, naming the rooms and the DM it affects
+func (n *Node) warnKeyChanged(record *database.Succession) {
+	warning, err := n.keyWarning(record.NewUserID)
+	if err != nil || warning == nil {
+		return
+	}
+	
+	rooms, _ := n.roomManager.RoomsForUser(record.NewUserID)
+	rooms = append(rooms, dmRoomID(record.NewUserID))
+	
+	log.Printf("WARNING: the verified key of %s changed to %s; compare safety numbers again", warning.Nickname, shortKey(record.NewKey))
+	n.notifyAll(map[string]interface{}{
+		"type":    "key_changed",
+		"warning": warning,
+		"rooms":   rooms,
+	})
+}
+
+func (s *Server) handleSafetyNumber(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	userID := r.URL.Query().Get("user_id")
+	number, err := s.node.SafetyNumber(userID)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	
+	trusted, trustErr := s.db.GetTrustedKey(userID)
+	if trustErr != nil && trustErr != database.ErrTrustNotFound {
+		http.Error(w, "Failed to load trust store", http.StatusInternalServerError)
+		return
+	}
+	warning, err := s.node.keyWarning(userID)
+	if err != nil {
+		http.Error(w, "Failed to load trust store", http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"digits":      number.Digits,
+		"qr_payload":  number.QRPayload,
+		"verified":    trustErr == nil && trusted.ReplacedBy == "",
+		"key_changed": warning,
+	})
+}
+
+func (s *Server) handleVerifyContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		UserID    string `json:"user_id"`
+		Digits    string `json:"digits"`
+		QRPayload string `json:"qr_payload"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	if err := s.node.VerifyContact(req.UserID, req.Digits, req.QRPayload); err != nil {
+		if err == security.ErrSafetyNumberMismatch {
+			http.Error(w, "Safety number does not match", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to verify contact", http.StatusBadRequest)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "verified"})
+}
+
+func (s *Server) handleUnverifyContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	if err := s.db.DeleteTrustedKey(req.UserID); err != nil {
+		http.Error(w, "Failed to update trust store", http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "unverified"})
+}
+
+func (s *Server) handleTrustedKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	trustedKeys, err := s.db.GetTrustedKeys()
+	if err != nil {
+		http.Error(w, "Failed to load trust store", http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trustedKeys)
+}
+
+func (s *Server) handleKeyWarnings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	warnings, err := s.node.KeyWarnings(r.URL.Query().Get("room_id"))
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warnings)
+} 
\ No newline at end of file
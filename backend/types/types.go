@@ -5,8 +5,10 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"sort"
 	"strings"
 	"time"
+	"ripcord/security"
 )
 
 // Message represents a chat message with all necessary fields
@@ -20,6 +22,21 @@ type Message struct {
 	Encrypted bool      `json:"encrypted" db:"encrypted"`
 	Timestamp time.Time `json:"timestamp" db:"timestamp"`
 	Signature string    `json:"signature,omitempty" db:"signature"`
+	
+	// Outcome of checking the signature against the author's key on ingest
+	Verification string `json:"verification" db:"verification"`
+	
+	// Lamport clock and the IDs of the latest messages the author had seen
+	Clock   uint64   `json:"clock" db:"clock"`
+	Parents []string `json:"parents,omitempty" db:"parents"`
+	
+	// Order in which this node stored the room's messages. It is local, so
+	// it is not signed and differs between nodes.
+	Seq int64 `json:"seq,omitempty" db:"seq"`
+	
+	// ID a local client gave the message when sending it, so a retry is not
+	// stored twice. It is not sent to anyone.
+	ClientID string `json:"-" db:"client_id"`
 }
 
 // Room represents a chat room
@@ -52,6 +69,15 @@ const (
 	MessageTypeFile    = "file"
 )
 
+// Signature verification states of a stored message
+const (
+	VerificationVerified   = "verified"
+	VerificationUnsigned   = "unsigned"
+	VerificationInvalid    = "invalid"
+	VerificationUnknownKey = "unknown_key"
+	VerificationUnverified = "unverified"
+)
+
 // Protocol message types
 const (
 	ProtocolMessageTypeJoin     = "join"
@@ -121,25 +147,86 @@ type AdminSettings struct {
 
 // Message methods for cryptographic operations and parsing
 
+// MessageSigningDomain labels the signed encoding of a chat message
+const MessageSigningDomain = "ripcord-message-v1"
+
 func (m *Message) Sign(privateKey ed25519.PrivateKey) error {
 	if privateKey == nil {
 		return errors.New("private key is nil")
 	}
 	
-	signableData, err := m.getSignableData()
-	if err != nil {
-		return err
-	}
-	
-	signature := ed25519.Sign(privateKey, signableData)
+	signature := ed25519.Sign(privateKey, m.SignableData())
 	m.Signature = hex.EncodeToString(signature)
 	return nil
 }
 
-func (m *Message) getSignableData() ([]byte, error) {
-	temp := *m
-	temp.Signature = ""
-	return json.Marshal(temp)
+// SignableData covers only what survives storage and peer sync, so a
+// signature still verifies after a round trip. Timestamps are signed at
+// second precision because that is what peers exchange.
+func (m *Message) SignableData() []byte {
+	return security.NewSignedData(MessageSigningDomain).
+		String(m.ID).
+		String(m.RoomID).
+		String(m.UserID).
+		String(m.Username).
+		String(m.Content).
+		String(m.Type).
+		Bool(m.Encrypted).
+		Int64(m.Timestamp.Unix()).
+		Uint64(m.Clock).
+		Strings(m.Parents).
+		Encoded()
+}
+
+// legacySignableData is what messages were signed over before the
+// canonical encoding: the message as JSON without its signature, with the
+// timestamp to the nanosecond and in the zone it was stored with
+func (m *Message) legacySignableData() ([]byte, error) {
+	return json.Marshal(struct {
+		ID        string    `json:"id"`
+		RoomID    string    `json:"room_id"`
+		UserID    string    `json:"user_id"`
+		Username  string    `json:"username"`
+		Content   string    `json:"content"`
+		Type      string    `json:"type"`
+		Encrypted bool      `json:"encrypted"`
+		Timestamp time.Time `json:"timestamp"`
+	}{
+		ID:        m.ID,
+		RoomID:    m.RoomID,
+		UserID:    m.UserID,
+		Username:  m.Username,
+		Content:   m.Content,
+		Type:      m.Type,
+		Encrypted: m.Encrypted,
+		Timestamp: m.Timestamp,
+	})
+}
+
+// HasLegacyForm reports whether a message could have been signed in the
+// legacy encoding, which predates clocks and parents
+func (m *Message) HasLegacyForm() bool {
+	return m.Clock == 0 && len(m.Parents) == 0
+}
+
+// CausalLess orders messages by logical clock, breaking ties with the
+// second-precision timestamp and then the ID. Every peer holding the same
+// messages sorts them the same way, whatever order they arrived in.
+func CausalLess(a, b *Message) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	if a.Timestamp.Unix() != b.Timestamp.Unix() {
+		return a.Timestamp.Unix() < b.Timestamp.Unix()
+	}
+	return a.ID < b.ID
+}
+
+// SortCausal sorts messages oldest first in causal order
+func SortCausal(messages []*Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return CausalLess(messages[i], messages[j])
+	})
 }
 
 func (m *Message) VerifySignature(publicKey ed25519.PublicKey) bool {
@@ -152,12 +239,28 @@ func (m *Message) VerifySignature(publicKey ed25519.PublicKey) bool {
 		return false
 	}
 	
-	signableData, err := m.getSignableData()
+	return ed25519.Verify(publicKey, m.SignableData(), signature)
+}
+
+// VerifyLegacySignature checks a signature in the legacy encoding. That
+// encoding has no domain and only the HTTP API signed in it, and peers
+// never passed those signatures on, so it is only for messages stored
+// before the canonical encoding.
+func (m *Message) VerifyLegacySignature(publicKey ed25519.PublicKey) bool {
+	if m.Signature == "" || publicKey == nil || !m.HasLegacyForm() {
+		return false
+	}
+	
+	signature, err := hex.DecodeString(m.Signature)
 	if err != nil {
 		return false
 	}
 	
-	return ed25519.Verify(publicKey, signableData, signature)
+	legacy, err := m.legacySignableData()
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(publicKey, legacy, signature)
 }
 
 func (m *Message) IsSlashCommand() bool {
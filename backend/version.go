@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MinProtocolVersion is the oldest protocol we still speak. Heartbeats to
+// peers we have not negotiated with are sent in it so that any peer can
+// read the handshake.
+const MinProtocolVersion = "1.0"
+
+// Features a node advertises in its heartbeat
+const (
+	FeatureSync        = "sync"
+	FeatureGossip      = "gossip"
+	FeatureEncryptedDM = "encrypted_dm"
+	FeatureRatchet     = "ratchet"
+	FeatureSenderKeys  = "sender_keys"
+	FeaturePresence    = "presence"
+)
+
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// localFeatures returns the features this node advertises
+func localFeatures() []string {
+	return []string{FeatureSync, FeatureGossip, FeatureEncryptedDM, FeatureRatchet, FeatureSenderKeys, FeaturePresence}
+}
+
+type protocolVersion struct {
+	major, minor int
+}
+
+func parseVersion(version string) (protocolVersion, error) {
+	major, minor, ok := strings.Cut(version, ".")
+	if !ok {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", version)
+	}
+	
+	var v protocolVersion
+	var err error
+	if v.major, err = strconv.Atoi(major); err != nil {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", version)
+	}
+	if v.minor, err = strconv.Atoi(minor); err != nil {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", version)
+	}
+	return v, nil
+}
+
+func (v protocolVersion) less(other protocolVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	return v.minor < other.minor
+}
+
+func (v protocolVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// versionLess reports whether version a is older than b. Unparseable
+// versions sort first.
+func versionLess(a, b string) bool {
+	va, errA := parseVersion(a)
+	vb, errB := parseVersion(b)
+	if errA != nil || errB != nil {
+		return errA != nil && errB == nil
+	}
+	return va.less(vb)
+}
+
+// supportedVersion reports whether we can read messages in a version
+func supportedVersion(version string) bool {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false
+	}
+	
+	min, _ := parseVersion(MinProtocolVersion)
+	max, _ := parseVersion(ProtocolVersion)
+	return !v.less(min) && !max.less(v)
+}
+
+// negotiateVersion returns the highest version inside both our range and a
+// peer's. A peer that sends no range predates the handshake and speaks 1.0.
+func negotiateVersion(peerMin, peerMax string) (string, error) {
+	if peerMin == "" {
+		peerMin = MinProtocolVersion
+	}
+	if peerMax == "" {
+		peerMax = peerMin
+	}
+	
+	theirMin, err := parseVersion(peerMin)
+	if err != nil {
+		return "", err
+	}
+	theirMax, err := parseVersion(peerMax)
+	if err != nil {
+		return "", err
+	}
+	ourMin, _ := parseVersion(MinProtocolVersion)
+	ourMax, _ := parseVersion(ProtocolVersion)
+	
+	high := ourMax
+	if theirMax.less(high) {
+		high = theirMax
+	}
+	low := ourMin
+	if low.less(theirMin) {
+		low = theirMin
+	}
+	
+	if high.less(low) {
+		return "", fmt.Errorf("%w: we speak %s-%s, peer speaks %s-%s", ErrNoCommonVersion, MinProtocolVersion, ProtocolVersion, peerMin, peerMax)
+	}
+	return high.String(), nil
+}
+
+// wireVersion is the protocol version to use when sending to the peer
+func (p Peer) wireVersion() string {
+	if p.Version == "" {
+		return MinProtocolVersion
+	}
+	return p.Version
+}
+
+// HasFeature reports whether the peer advertised a feature
+func (p Peer) HasFeature(feature string) bool {
+	for _, f := range p.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+} 
\ No newline at end of file
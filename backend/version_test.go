@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct {
+		min, max string
+		want     string
+	}{
+		{"", "", "1.0"},
+		{"1.0", "1.0", "1.0"},
+		{"1.0", "1.1", "1.1"},
+		{"1.0", "1.7", ProtocolVersion},
+		{"1.1", "2.3", ProtocolVersion},
+	}
+	for _, c := range cases {
+		got, err := negotiateVersion(c.min, c.max)
+		if err != nil || got != c.want {
+			t.Errorf("negotiateVersion(%q, %q) = %q, %v; want %q", c.min, c.max, got, err, c.want)
+		}
+	}
+	
+	if _, err := negotiateVersion("2.0", "2.1"); !errors.Is(err, ErrNoCommonVersion) {
+		t.Errorf("Expected ErrNoCommonVersion for a newer-only peer, got %v", err)
+	}
+	if _, err := negotiateVersion("one", ""); err == nil {
+		t.Error("Expected an unparseable version to be rejected")
+	}
+}
+
+func TestIsValidAcceptsSupportedVersions(t *testing.T) {
+	for version, valid := range map[string]bool{"1.0": true, "1.1": true, "1.2": true, "1.3": false, "2.0": false, "": false} {
+		msg := NewProtocolMessage(MessageTypePing, "sender", generateMessageID())
+		msg.Version = version
+		if err := msg.IsValid(); (err == nil) != valid {
+			t.Errorf("Version %q: expected valid=%v, got %v", version, valid, err)
+		}
+	}
+} 
\ No newline at end of file
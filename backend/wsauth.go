@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"github.com/mr-tron/base58"
+	"ripcord/security"
+)
+
+const (
+	// WSAuthDomain labels what a client signs to prove it holds its key:
+	// the challenge nonce and our node key, so the answer is no use at
+	// another node
+	WSAuthDomain = "ripcord-ws-auth-v1"
+	
+	wsAuthTimeout    = 30 * time.Second // to answer the challenge
+	wsSessionTTL     = 24 * time.Hour   // since the session was last used
+	maxWSUsernameLen = 50
+)
+
+var (
+	ErrWSAuthFailed     = errors.New("authentication failed")
+	ErrWSSessionExpired = errors.New("session expired")
+	ErrWSKeyNotAllowed  = errors.New("key is not allowed on this node")
+)
+
+// wsSession lets a client that proved its key reconnect without signing
+// again. Sessions are kept in memory, so a restart asks for a new proof.
+type wsSession struct {
+	userID    string
+	username  string
+	publicKey string
+	expiresAt time.Time
+}
+
+// wsAuthData is what a client signs to answer a challenge
+func wsAuthData(nonce, serverKey string) []byte {
+	return security.NewSignedData(WSAuthDomain).String(nonce).String(serverKey).Encoded()
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// sendAuthChallenge gives the client a fresh nonce to sign
+func (s *Server) sendAuthChallenge(client *WSClient) {
+	client.nonce = randomHex(32)
+	s.sendToClient(client, map[string]interface{}{
+		"type":       "auth_challenge",
+		"nonce":      client.nonce,
+		"server_key": s.node.ID,
+	})
+}
+
+// handleWSAuth binds the client to a key, either by a signature over the
+// outstanding challenge or by a session token from an earlier connection.
+// A failed attempt is answered with a new challenge.
+func (s *Server) handleWSAuth(client *WSClient, msg map[string]interface{}) {
+	if client.authenticated.Load() {
+		return
+	}
+	
+	var session *wsSession
+	var token string
+	var err error
+	if token, _ = msg["session_token"].(string); token != "" {
+		session, err = s.resumeWSSession(token)
+	} else {
+		session, err = s.verifyWSChallenge(client, msg)
+		if err == nil {
+			token = s.newWSSession(session)
+		}
+	}
+	client.nonce = ""
+	
+	if err != nil {
+		s.sendToClient(client, map[string]interface{}{
+			"type":    "auth_response",
+			"success": false,
+			"error":   err.Error(),
+		})
+		s.sendAuthChallenge(client)
+		return
+	}
+	
+	client.userID = session.userID
+	client.username = session.username
+	client.publicKey = session.publicKey
+	client.authenticated.Store(true)
+	client.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	
+	s.sendToClient(client, map[string]interface{}{
+		"type":          "auth_response",
+		"success":       true,
+		"session_token": token,
+		"expires_at":    session.expiresAt,
+		"user": map[string]interface{}{
+			"id":         client.userID,
+			"username":   client.username,
+			"public_key": client.publicKey,
+		},
+	})
+	s.startWSPresence(client)
+}
+
+// verifyWSChallenge checks the client's signature over the nonce we sent
+func (s *Server) verifyWSChallenge(client *WSClient, msg map[string]interface{}) (*wsSession, error) {
+	if client.nonce == "" {
+		return nil, ErrWSAuthFailed
+	}
+	
+	publicKeyHex, _ := msg["public_key"].(string)
+	signatureHex, _ := msg["signature"].(string)
+	key, err := hex.DecodeString(publicKeyHex)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrWSAuthFailed
+	}
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil || !ed25519.Verify(key, wsAuthData(client.nonce, s.node.ID), signature) {
+		return nil, ErrWSAuthFailed
+	}
+	
+	// A client posts as the node, so proving a key is not enough on its own
+	publicKeyHex = hex.EncodeToString(key)
+	if !s.clientKeyAllowed(publicKeyHex) {
+		log.Printf("Refused WebSocket client key %s; add it to server.client_keys to allow it", publicKeyHex)
+		return nil, ErrWSKeyNotAllowed
+	}
+	
+	username, _ := msg["username"].(string)
+	username = strings.TrimSpace(username)
+	if username == "" {
+		username = "Anonymous"
+	}
+	if utf8.RuneCountInString(username) > maxWSUsernameLen {
+		username = string([]rune(username)[:maxWSUsernameLen])
+	}
+	
+	return &wsSession{
+		userID:    base58.Encode(key),
+		username:  username,
+		publicKey: publicKeyHex,
+	}, nil
+}
+
+// clientKeyAllowed reports whether a client may use the node with a key it
+// proved: the node's own key or one listed in server.client_keys
+func (s *Server) clientKeyAllowed(publicKeyHex string) bool {
+	if publicKeyHex == s.node.ID {
+		return true
+	}
+	
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	for _, key := range s.config.Server.ClientKeys {
+		if strings.EqualFold(key, publicKeyHex) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWSOrigin admits pages served by this node and those listed in
+// server.allowed_origins. Clients other than browsers send no Origin.
+func (s *Server) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	for _, allowed := range s.config.Server.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// newWSSession stores a session and returns its token, dropping any that
+// have expired
+func (s *Server) newWSSession(session *wsSession) string {
+	s.wsSessionMutex.Lock()
+	defer s.wsSessionMutex.Unlock()
+	
+	now := time.Now()
+	for token, existing := range s.wsSessions {
+		if now.After(existing.expiresAt) {
+			delete(s.wsSessions, token)
+		}
+	}
+	
+	token := randomHex(32)
+	session.expiresAt = now.Add(wsSessionTTL)
+	s.wsSessions[token] = session
+	return token
+}
+
+// resumeWSSession looks up a session token and extends its life
+func (s *Server) resumeWSSession(token string) (*wsSession, error) {
+	s.wsSessionMutex.Lock()
+	defer s.wsSessionMutex.Unlock()
+	
+	session, exists := s.wsSessions[token]
+	if !exists {
+		return nil, ErrWSAuthFailed
+	}
+	if time.Now().After(session.expiresAt) {
+		delete(s.wsSessions, token)
+		return nil, ErrWSSessionExpired
+	}
+	
+	session.expiresAt = time.Now().Add(wsSessionTTL)
+	resumed := *session
+	return &resumed, nil
+} 
\ No newline at end of file
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"github.com/gorilla/websocket"
+	"github.com/mr-tron/base58"
+	"ripcord/transport"
+)
+
+// wsTestClient reads the server's events one at a time, though the writer
+// may put several in a frame
+type wsTestClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	pending []string
+	session string // token from the last authentication
+}
+
+func dialTestServer(t *testing.T, url string) *wsTestClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &wsTestClient{t: t, conn: conn}
+}
+
+func (c *wsTestClient) send(msg map[string]interface{}) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("Failed to send: %v", err)
+	}
+}
+
+func (c *wsTestClient) next() map[string]interface{} {
+	c.t.Helper()
+	for len(c.pending) == 0 {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("Failed to read: %v", err)
+		}
+		c.pending = strings.Split(string(data), "\n")
+	}
+	
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(c.pending[0]), &event); err != nil {
+		c.t.Fatalf("Invalid event %q: %v", c.pending[0], err)
+	}
+	c.pending = c.pending[1:]
+	return event
+}
+
+// expect reads the next event, which must be of the given type. Presence
+// arrives whenever anyone connects, so it is skipped unless asked for.
+func (c *wsTestClient) expect(eventType string) map[string]interface{} {
+	c.t.Helper()
+	event := c.next()
+	for event["type"] == "presence_update" && eventType != "presence_update" {
+		event = c.next()
+	}
+	if event["type"] != eventType {
+		c.t.Fatalf("Expected %s, got %v", eventType, event)
+	}
+	return event
+}
+
+// allowClientKey lists a key in the server's client_keys
+func allowClientKey(server *Server, publicKey ed25519.PublicKey) {
+	server.configMutex.Lock()
+	defer server.configMutex.Unlock()
+	server.config.Server.ClientKeys = append(server.config.Server.ClientKeys, hex.EncodeToString(publicKey))
+}
+
+// authenticate answers the challenge with a new key, which the server is
+// told to allow, and returns the user
+func (c *wsTestClient) authenticate(server *Server, username string) map[string]interface{} {
+	c.t.Helper()
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	allowClientKey(server, publicKey)
+	challenge := c.expect("auth_challenge")
+	c.send(map[string]interface{}{
+		"type":       "auth",
+		"username":   username,
+		"public_key": hex.EncodeToString(publicKey),
+		"signature":  hex.EncodeToString(ed25519.Sign(privateKey, wsAuthData(challenge["nonce"].(string), server.node.ID))),
+	})
+	response := c.expect("auth_response")
+	if response["success"] != true {
+		c.t.Fatalf("Failed to authenticate: %v", response)
+	}
+	c.session, _ = response["session_token"].(string)
+	return response["user"].(map[string]interface{})
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	node := newTestNode(t, transport.NewLoopbackNetwork(), "server")
+	server := &Server{
+		cryptoManager: node.cryptoManager,
+		db:            node.db,
+		roomManager:   node.roomManager,
+		node:          node.Node,
+		config:        &Config{},
+		hub:           newWSHub(),
+		wsSessions:    make(map[string]*wsSession),
+		wsPresence:    make(map[string]map[*WSClient]string),
+		wsTyping:      newTypingThrottle(TypingInterval),
+	}
+	server.upgrader.CheckOrigin = server.checkWSOrigin
+	server.hub.onRemove = server.forgetWSClient
+	go server.hub.run()
+	t.Cleanup(server.hub.stop)
+	
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleWebSocket)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	
+	client := dialTestServer(t, httpServer.URL)
+	challenge := client.expect("auth_challenge")
+	if challenge["server_key"] != server.node.ID {
+		t.Errorf("Expected the challenge to name the node key, got %v", challenge["server_key"])
+	}
+	
+	// Nothing but auth is accepted first
+	client.send(map[string]interface{}{"type": "get_messages", "room_id": "room"})
+	if refused := client.expect("error"); refused["error"] != "authentication required" {
+		t.Errorf("Expected the request to be refused, got %v", refused)
+	}
+	
+	// A signature over another nonce is no proof
+	stale := ed25519.Sign(privateKey, wsAuthData("other nonce", server.node.ID))
+	client.send(map[string]interface{}{
+		"type":       "auth",
+		"public_key": hex.EncodeToString(publicKey),
+		"signature":  hex.EncodeToString(stale),
+	})
+	if failed := client.expect("auth_response"); failed["success"] != false {
+		t.Fatalf("Expected a bad signature to fail, got %v", failed)
+	}
+	challenge = client.expect("auth_challenge")
+	
+	// Nor is a key the node was not told to allow
+	answer := func(nonce, username string) {
+		client.send(map[string]interface{}{
+			"type":       "auth",
+			"username":   username,
+			"public_key": hex.EncodeToString(publicKey),
+			"signature":  hex.EncodeToString(ed25519.Sign(privateKey, wsAuthData(nonce, server.node.ID))),
+		})
+	}
+	answer(challenge["nonce"].(string), "alice")
+	if failed := client.expect("auth_response"); failed["error"] != ErrWSKeyNotAllowed.Error() {
+		t.Fatalf("Expected an unlisted key to be refused, got %v", failed)
+	}
+	challenge = client.expect("auth_challenge")
+	
+	// A long name is cut between characters
+	allowClientKey(server, publicKey)
+	answer(challenge["nonce"].(string), "alice"+strings.Repeat("é", maxWSUsernameLen))
+	response := client.expect("auth_response")
+	user, _ := response["user"].(map[string]interface{})
+	if response["success"] != true || user["id"] != base58.Encode(publicKey) || user["username"] != "alice"+strings.Repeat("é", maxWSUsernameLen-5) {
+		t.Fatalf("Expected to be authenticated as the key, got %v", response)
+	}
+	token, _ := response["session_token"].(string)
+	if token == "" {
+		t.Fatal("Expected a session token")
+	}
+	
+	// A reconnect resumes with the token instead of signing again
+	resumed := dialTestServer(t, httpServer.URL)
+	resumed.expect("auth_challenge")
+	resumed.send(map[string]interface{}{"type": "auth", "session_token": token})
+	response = resumed.expect("auth_response")
+	user, _ = response["user"].(map[string]interface{})
+	if response["success"] != true || user["id"] != base58.Encode(publicKey) {
+		t.Errorf("Expected the session to resume, got %v", response)
+	}
+	
+	unknown := dialTestServer(t, httpServer.URL)
+	unknown.expect("auth_challenge")
+	unknown.send(map[string]interface{}{"type": "auth", "session_token": "not-a-token"})
+	if failed := unknown.expect("auth_response"); failed["success"] != false {
+		t.Errorf("Expected an unknown token to fail, got %v", failed)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.config.Server.AllowedOrigins = []string{"https://chat.example/"}
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+	
+	for origin, allowed := range map[string]bool{
+		"":                      true,
+		httpServer.URL:          true,
+		"https://chat.example":  true,
+		"https://evil.example":  false,
+		"https://chat.example.": false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if (err == nil) != allowed {
+			t.Errorf("Origin %q: expected allowed %v, got %v", origin, allowed, err)
+		}
+	}
+} 
\ No newline at end of file
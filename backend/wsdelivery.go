@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"ripcord/database"
+	"ripcord/types"
+)
+
+const (
+	maxWSClientIDLen = 64
+	maxWSReplay      = 200 // messages per room in one replay frame
+	maxWSHistory     = 200 // messages in one message_history frame
+)
+
+var ErrWSClientID = errors.New("client ID is too long")
+
+// postClientMessage posts a message once per client ID. A retry of one
+// already stored returns it again, with stored false. Every client posts
+// as the node, so client IDs are kept per the client's user, and another
+// user's ID never returns their message.
+func (s *Server) postClientMessage(client *WSClient, roomID, content, clientID string) (*types.Message, bool, error) {
+	if clientID == "" {
+		message, err := s.postMessage(roomID, content, "")
+		return message, err == nil, err
+	}
+	if len(clientID) > maxWSClientIDLen {
+		return nil, false, ErrWSClientID
+	}
+	
+	s.wsSendMutex.Lock()
+	defer s.wsSendMutex.Unlock()
+	
+	clientID = client.userID + ":" + clientID
+	existing, err := s.db.GetMessageByClientID(roomID, s.cryptoManager.GetPublicKeyBase58(), clientID)
+	if err == nil {
+		return existing, false, nil
+	}
+	if err != database.ErrMessageNotFound {
+		return nil, false, err
+	}
+
+	message, err := s.postMessage(roomID, content, clientID)
+	return message, err == nil, err
+}
+
+// ackWSSend answers a send_message. With a client ID the answer is an ack
+// naming the stored message; without one, only failures are reported.
+func (s *Server) ackWSSend(client *WSClient, roomID, clientID string, message *types.Message, err error) {
+	if clientID == "" {
+		if err != nil {
+			s.sendToClient(client, map[string]interface{}{
+				"type":    "error",
+				"error":   err.Error(),
+				"room_id": roomID,
+			})
+		}
+		return
+	}
+	
+	ack := map[string]interface{}{
+		"type":      "ack",
+		"client_id": clientID,
+		"room_id":   roomID,
+		"success":   err == nil,
+	}
+	if err != nil {
+		ack["error"] = err.Error()
+	} else {
+		ack["message_id"] = message.ID
+		ack["seq"] = message.Seq
+	}
+	s.sendToClient(client, ack)
+}
+
+// stampRoomEvent gives a room event its room ID and a sequence number:
+// the message's own for a message, otherwise the room's latest, so a
+// client always knows where to resume from
+func (s *Server) stampRoomEvent(roomID string, event map[string]interface{}) {
+	if _, ok := event["room_id"]; !ok {
+		event["room_id"] = roomID
+	}
+	if seq, ok := event["seq"]; ok {
+		if seq, ok := seq.(int64); ok {
+			s.hub.noteRoomSeq(roomID, seq)
+		}
+		return
+	}
+	if message, ok := event["message"].(*types.Message); ok {
+		event["seq"] = message.Seq
+		s.hub.noteRoomSeq(roomID, message.Seq)
+		return
+	}
+	
+	seq, err := s.roomSeq(roomID)
+	if err != nil {
+		log.Printf("Failed to get sequence of room %s: %v", roomID, err)
+		return
+	}
+	event["seq"] = seq
+}
+
+// roomSeq returns the sequence number of the last message stored in a
+// room. Each message stored is noted in the hub as it is posted or its
+// event goes out, so the database is only asked once per room.
+func (s *Server) roomSeq(roomID string) (int64, error) {
+	if seq, ok := s.hub.roomSeq(roomID); ok {
+		return seq, nil
+	}
+	
+	seq, err := s.db.GetRoomSeq(roomID)
+	if err != nil {
+		return 0, err
+	}
+	return s.hub.noteRoomSeq(roomID, seq), nil
+}
+
+// handleWSResume subscribes to the rooms named, each with the last sequence
+// number the client saw there, and replays what it missed from the
+// database. The client is subscribed before the database is read, so
+// nothing falls between, though a message may arrive both ways. A replay
+// that is not complete is continued with another resume.
+func (s *Server) handleWSResume(client *WSClient, msg map[string]interface{}) {
+	seen, _ := msg["rooms"].(map[string]interface{})
+	roomIDs := make([]string, 0, len(seen))
+	for roomID := range seen {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	
+	held := s.subscribeWSClient(client, roomIDs)
+	for _, roomID := range held {
+		after, _ := seen[roomID].(float64)
+		messages, err := s.db.GetMessagesAfterSeq(roomID, int64(after), maxWSReplay+1)
+		if err != nil {
+			log.Printf("Failed to replay room %s: %v", roomID, err)
+			continue
+		}
+		
+		complete := len(messages) <= maxWSReplay
+		if !complete {
+			messages = messages[:maxWSReplay]
+		}
+		seq := int64(after)
+		if len(messages) > 0 {
+			seq = messages[len(messages)-1].Seq
+		}
+		if messages == nil {
+			messages = []*types.Message{}
+		}
+		
+		s.sendToClient(client, map[string]interface{}{
+			"type":     "replay",
+			"room_id":  roomID,
+			"seq":      seq,
+			"messages": messages,
+			"complete": complete,
+		})
+	}
+	
+	s.sendToClient(client, map[string]interface{}{
+		"type":     "resumed",
+		"room_ids": held,
+	})
+} 
\ No newline at end of file
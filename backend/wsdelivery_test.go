@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"ripcord/database"
+)
+
+func TestWebSocketDelivery(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	self := server.cryptoManager.GetPublicKeyBase58()
+	room, err := server.roomManager.CreateRoom("General", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	
+	alice := dialTestServer(t, httpServer.URL)
+	alice.authenticate(server, "alice")
+	alice.send(map[string]interface{}{"type": "subscribe", "room_id": room.ID})
+	subscribed := alice.expect("subscribed")
+	if seqs, _ := subscribed["seqs"].(map[string]interface{}); seqs[room.ID] != float64(0) {
+		t.Errorf("Expected an empty room to be at sequence 0, got %v", subscribed)
+	}
+	
+	send := map[string]interface{}{"type": "send_message", "room_id": room.ID, "client_id": "c1", "content": "hello"}
+	alice.send(send)
+	ack := alice.expect("ack")
+	if ack["success"] != true || ack["client_id"] != "c1" || ack["seq"] != float64(1) {
+		t.Fatalf("Expected the send to be acknowledged, got %v", ack)
+	}
+	if event := alice.expect("message"); event["seq"] != float64(1) || event["room_id"] != room.ID {
+		t.Errorf("Expected the message event to carry its sequence number, got %v", event)
+	}
+	
+	// A retry is acknowledged with the same message and not stored again
+	alice.send(send)
+	if retried := alice.expect("ack"); retried["message_id"] != ack["message_id"] {
+		t.Errorf("Expected the retry to name the first message, got %v", retried)
+	}
+	alice.send(map[string]interface{}{"type": "send_message", "room_id": room.ID, "client_id": "c2", "content": "again"})
+	alice.expect("ack")
+	if event := alice.expect("message"); event["seq"] != float64(2) {
+		t.Errorf("Expected the next message to be the second, got %v", event)
+	}
+	
+	// Other room events carry the room's latest sequence number
+	bob := dialTestServer(t, httpServer.URL)
+	bob.authenticate(server, "bob")
+	bob.send(map[string]interface{}{"type": "subscribe", "room_id": room.ID})
+	bob.expect("subscribed")
+	if joined := alice.expect("user_joined"); joined["seq"] != float64(2) {
+		t.Errorf("Expected user_joined at sequence 2, got %v", joined)
+	}
+	
+	// Messages posted while alice is away are replayed when she resumes
+	alice.conn.Close()
+	for _, content := range []string{"missed", "also missed"} {
+		if _, err := server.postMessage(room.ID, content, ""); err != nil {
+			t.Fatalf("Failed to post message: %v", err)
+		}
+	}
+	
+	alice = dialTestServer(t, httpServer.URL)
+	alice.authenticate(server, "alice")
+	alice.send(map[string]interface{}{"type": "resume", "rooms": map[string]interface{}{room.ID: 2}})
+	replay := alice.expect("replay")
+	messages, _ := replay["messages"].([]interface{})
+	if replay["complete"] != true || replay["seq"] != float64(4) || len(messages) != 2 {
+		t.Fatalf("Expected the two missed messages, got %v", replay)
+	}
+	if first := messages[0].(map[string]interface{}); first["content"] != "missed" || first["seq"] != float64(3) {
+		t.Errorf("Expected the replay in order, got %v", first)
+	}
+	if resumed := alice.expect("resumed"); len(resumed["room_ids"].([]interface{})) != 1 {
+		t.Errorf("Expected the room to be subscribed again, got %v", resumed)
+	}
+	
+	// Client IDs are kept per user, so bob's c1 is a message of its own
+	bob.send(send)
+	bobAck := bob.next()
+	for bobAck["type"] != "ack" {
+		bobAck = bob.next()
+	}
+	if bobAck["message_id"] == ack["message_id"] || bobAck["seq"] != float64(5) {
+		t.Errorf("Expected bob's message to be stored, got %v", bobAck)
+	}
+} 
+// countingDatabase counts the room sequence lookups that reach the database
+type countingDatabase struct {
+	database.Database
+	seqQueries int
+}
+
+func (db *countingDatabase) GetRoomSeq(roomID string) (int64, error) {
+	db.seqQueries++
+	return db.Database.GetRoomSeq(roomID)
+}
+
+func TestRoomEventSeqIsCached(t *testing.T) {
+	server, _ := newTestServer(t)
+	self := server.cryptoManager.GetPublicKeyBase58()
+	room, err := server.roomManager.CreateRoom("General", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	db := &countingDatabase{Database: server.db}
+	server.db = db
+	
+	stamp := func(event map[string]interface{}) interface{} {
+		server.stampRoomEvent(room.ID, event)
+		return event["seq"]
+	}
+	if seq := stamp(map[string]interface{}{"type": "user_joined"}); seq != int64(0) {
+		t.Errorf("Expected an empty room at sequence 0, got %v", seq)
+	}
+	
+	for _, content := range []string{"one", "two"} {
+		if _, err := server.postMessage(room.ID, content, ""); err != nil {
+			t.Fatalf("Failed to post message: %v", err)
+		}
+	}
+	if seq := stamp(map[string]interface{}{"type": "user_left"}); seq != int64(2) {
+		t.Errorf("Expected the room at sequence 2, got %v", seq)
+	}
+	
+	// Events from the node carry the sequence they reached
+	stamp(map[string]interface{}{"type": "room_synced", "seq": int64(5)})
+	if seq := stamp(map[string]interface{}{"type": "user_joined"}); seq != int64(5) {
+		t.Errorf("Expected the room at sequence 5 after a sync, got %v", seq)
+	}
+	
+	if db.seqQueries != 1 {
+		t.Errorf("Expected the database to be asked once, got %d", db.seqQueries)
+	}
+}
+
+func TestWebSocketSendIsValidated(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	self := server.cryptoManager.GetPublicKeyBase58()
+	room, err := server.roomManager.CreateRoom("General", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	
+	alice := dialTestServer(t, httpServer.URL)
+	alice.authenticate(server, "alice")
+	alice.send(map[string]interface{}{"type": "subscribe", "room_id": room.ID})
+	alice.expect("subscribed")
+	
+	// Content is sanitized and limited as it is over HTTP
+	for clientID, content := range map[string]string{"blank": " \t ", "long": strings.Repeat("a", MaxMessageLength+1)} {
+		alice.send(map[string]interface{}{"type": "send_message", "room_id": room.ID, "client_id": clientID, "content": content})
+		if ack := alice.expect("ack"); ack["success"] != false {
+			t.Errorf("Expected the %s message to be refused, got %v", clientID, ack)
+		}
+	}
+	alice.send(map[string]interface{}{"type": "send_message", "room_id": room.ID, "client_id": "ok", "content": "  hello\x00  there "})
+	alice.expect("ack")
+	if event := alice.expect("message"); event["message"].(map[string]interface{})["content"] != "hello there" {
+		t.Errorf("Expected the content to be sanitized, got %v", event["message"])
+	}
+	
+	// History requests are capped however many are asked for
+	for i := 0; i < maxWSHistory+5; i++ {
+		if _, err := server.postMessage(room.ID, fmt.Sprintf("message %d", i), ""); err != nil {
+			t.Fatalf("Failed to post message: %v", err)
+		}
+	}
+	alice.send(map[string]interface{}{"type": "get_messages", "room_id": room.ID, "limit": 1000000})
+	history := alice.expect("message_history")
+	if messages, _ := history["messages"].([]interface{}); len(messages) != maxWSHistory {
+		t.Errorf("Expected %d messages, got %d", maxWSHistory, len(messages))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+const (
+	maxWSFrameSize     = 8192 // room lists make subscribe frames the largest
+	maxWSSubscriptions = 500
+)
+
+var (
+	ErrWSNotSubscribed = errors.New("not subscribed to room")
+	ErrWSNotMember     = errors.New("not a member of the room")
+)
+
+// wsRoomIDs reads the rooms named by a subscribe or unsubscribe frame,
+// as a room_ids list or a single room_id
+func wsRoomIDs(msg map[string]interface{}) []string {
+	var roomIDs []string
+	if list, ok := msg["room_ids"].([]interface{}); ok {
+		for _, item := range list {
+			if roomID, ok := item.(string); ok && roomID != "" {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	if roomID, ok := msg["room_id"].(string); ok && roomID != "" {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// handleWSSubscribe adds rooms to those the client receives events for.
+// The reply lists the requested rooms that are now subscribed, leaving
+// out unknown rooms, those the client may not read and any past
+// maxWSSubscriptions, with the sequence number each has reached.
+func (s *Server) handleWSSubscribe(client *WSClient, msg map[string]interface{}) {
+	held := s.subscribeWSClient(client, wsRoomIDs(msg))
+	seqs := make(map[string]int64, len(held))
+	for _, roomID := range held {
+		seq, err := s.roomSeq(roomID)
+		if err != nil {
+			log.Printf("Failed to get sequence of room %s: %v", roomID, err)
+			continue
+		}
+		seqs[roomID] = seq
+	}
+	
+	s.sendToClient(client, map[string]interface{}{
+		"type":     "subscribed",
+		"room_ids": held,
+		"seqs":     seqs,
+	})
+}
+
+func (s *Server) handleWSUnsubscribe(client *WSClient, msg map[string]interface{}) {
+	s.sendToClient(client, map[string]interface{}{
+		"type":     "unsubscribed",
+		"room_ids": s.unsubscribeWSClient(client, wsRoomIDs(msg)),
+	})
+}
+
+// wsMayRead reports whether a client may follow a room: its user is a
+// member, or ours is, since the clients a node lets in post as the node
+func (s *Server) wsMayRead(client *WSClient, room *Room) bool {
+	return room.IsMember(client.userID) || room.IsMember(s.cryptoManager.GetPublicKeyBase58())
+}
+
+// subscribeWSClient asks the hub to index the client under each known
+// room it may read and tells the rooms it joined. Each room it may not
+// read is answered with an error. It returns the rooms the client holds
+// of those asked for.
+func (s *Server) subscribeWSClient(client *WSClient, roomIDs []string) []string {
+	known := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		room, err := s.roomManager.GetRoom(roomID)
+		if err != nil {
+			continue
+		}
+		if !s.wsMayRead(client, room) {
+			s.sendToClient(client, map[string]interface{}{
+				"type":    "error",
+				"error":   ErrWSNotMember.Error(),
+				"room_id": roomID,
+			})
+			continue
+		}
+		known = append(known, roomID)
+	}
+	
+	result := s.hub.request(wsSubscribe, client, known)
+	for _, roomID := range result.changed {
+		s.broadcastToRoom(roomID, map[string]interface{}{
+			"type":    "user_joined",
+			"room_id": roomID,
+			"user": map[string]interface{}{
+				"id":       client.userID,
+				"username": client.username,
+			},
+		}, client)
+	}
+	return result.held
+}
+
+// unsubscribeWSClient drops the client from each room and tells the rooms
+// it left. It returns the rooms it was subscribed to.
+func (s *Server) unsubscribeWSClient(client *WSClient, roomIDs []string) []string {
+	result := s.hub.request(wsUnsubscribe, client, roomIDs)
+	s.announceWSLeave(client, result.changed)
+	return result.changed
+}
+
+// announceWSLeave tells the rooms of a client the hub let go that it left
+func (s *Server) announceWSLeave(client *WSClient, rooms []string) {
+	for _, roomID := range rooms {
+		s.broadcastToRoom(roomID, map[string]interface{}{
+			"type":    "user_left",
+			"room_id": roomID,
+			"user_id": client.userID,
+		}, client)
+	}
+}
+
+func (s *Server) isSubscribed(client *WSClient, roomID string) bool {
+	return len(s.hub.request(wsCheck, client, []string{roomID}).held) > 0
+} 
\ No newline at end of file
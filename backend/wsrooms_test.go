@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	self := server.cryptoManager.GetPublicKeyBase58()
+	general, err := server.roomManager.CreateRoom("General", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	random, err := server.roomManager.CreateRoom("Random", "", false, self, "server", self)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	
+	alice := dialTestServer(t, httpServer.URL)
+	aliceUser := alice.authenticate(server, "alice")
+	alice.send(map[string]interface{}{"type": "subscribe", "room_ids": []string{general.ID, random.ID, "missing"}})
+	subscribed := alice.expect("subscribed")
+	if !reflect.DeepEqual(subscribed["room_ids"], []interface{}{general.ID, random.ID}) {
+		t.Fatalf("Expected both known rooms to be subscribed, got %v", subscribed)
+	}
+	
+	bob := dialTestServer(t, httpServer.URL)
+	bobUser := bob.authenticate(server, "bob")
+	bob.send(map[string]interface{}{"type": "subscribe", "room_id": general.ID})
+	bob.expect("subscribed")
+	if joined := alice.expect("user_joined"); joined["room_id"] != general.ID {
+		t.Errorf("Expected bob to join general, got %v", joined)
+	}
+	
+	// Alice hears both rooms on one connection, bob only the one he holds
+	alice.send(map[string]interface{}{"type": "send_message", "room_id": random.ID, "content": "in random"})
+	alice.send(map[string]interface{}{"type": "send_message", "room_id": general.ID, "content": "in general"})
+	for _, roomID := range []string{random.ID, general.ID} {
+		message := alice.expect("message")["message"].(map[string]interface{})
+		if message["room_id"] != roomID {
+			t.Errorf("Expected a message in %s, got %v", roomID, message)
+		}
+	}
+	if message := bob.expect("message")["message"].(map[string]interface{}); message["content"] != "in general" {
+		t.Errorf("Expected bob to receive only the general message, got %v", message)
+	}
+	
+	bob.send(map[string]interface{}{"type": "send_message", "room_id": random.ID, "content": "uninvited"})
+	if refused := bob.expect("error"); refused["error"] != "not subscribed to room" {
+		t.Errorf("Expected sending outside the subscriptions to be refused, got %v", refused)
+	}
+	
+	alice.send(map[string]interface{}{"type": "unsubscribe", "room_ids": []string{random.ID}})
+	if unsubscribed := alice.expect("unsubscribed"); !reflect.DeepEqual(unsubscribed["room_ids"], []interface{}{random.ID}) {
+		t.Errorf("Expected random to be unsubscribed, got %v", unsubscribed)
+	}
+	if _, indexed := server.hub.snapshot().rooms[random.ID]; indexed {
+		t.Error("Expected a room without subscribers to leave the index")
+	}
+	
+	// A closed connection leaves every room it held
+	bob.conn.Close()
+	left := alice.expect("user_left")
+	if left["room_id"] != general.ID || left["user_id"] != bobUser["id"] {
+		t.Errorf("Expected bob to leave general, got %v", left)
+	}
+	if subscribers := server.hub.snapshot().rooms[general.ID]; subscribers != 1 {
+		t.Errorf("Expected one subscriber left in general, got %d", subscribers)
+	}
+	
+	// A room neither alice nor the node is in is refused, history and all
+	secret, err := server.roomManager.CreateRoom("Secret", "", true, "carol", "carol", "carol")
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	server.db.SaveMessage(NewMessage(secret.ID, "carol", "carol", "private", ""))
+	for request, reply := range map[string]string{"subscribe": "subscribed", "resume": "resumed", "get_messages": ""} {
+		alice.send(map[string]interface{}{"type": request, "room_id": secret.ID, "rooms": map[string]interface{}{secret.ID: 0}})
+		if refused := alice.expect("error"); refused["error"] != ErrWSNotMember.Error() || refused["room_id"] != secret.ID {
+			t.Errorf("Expected %s to be refused, got %v", request, refused)
+		}
+		if reply == "" {
+			continue
+		}
+		if held := alice.expect(reply); len(held["room_ids"].([]interface{})) != 0 {
+			t.Errorf("Expected %s to hold nothing, got %v", request, held)
+		}
+	}
+	
+	if err := secret.AddMember(aliceUser["id"].(string), "alice", aliceUser["id"].(string)); err != nil {
+		t.Fatalf("Failed to add alice: %v", err)
+	}
+	alice.send(map[string]interface{}{"type": "subscribe", "room_id": secret.ID})
+	if subscribed := alice.expect("subscribed"); !reflect.DeepEqual(subscribed["room_ids"], []interface{}{secret.ID}) {
+		t.Errorf("Expected a member to subscribe, got %v", subscribed)
+	}
+} 
\ No newline at end of file
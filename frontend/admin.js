@@ -206,6 +206,14 @@ class RipcordNodeAdmin {
             stats.messages || 0;
         document.getElementById('active-peers-count').textContent = 
             stats.peers || 0;
+        
+        const protocol = stats.protocol || {};
+        const rejected = document.getElementById('rejected-messages-count');
+        rejected.textContent = protocol.rejected || 0;
+        rejected.title = `Replayed: ${protocol.replayed || 0}, ` +
+            `Clock skew: ${protocol.timestamp_skew || 0}, ` +
+            `Bad signature: ${protocol.invalid_signature || 0}, ` +
+            `Unknown peer: ${protocol.unknown_peer || 0}`;
     }
     
     updateNodeStatus(status, text) {
@@ -258,7 +266,6 @@ class RipcordNodeAdmin {
         card.innerHTML = `
             <div class="room-header">
                 <h3 class="room-title">${this.escapeHtml(room.name)}</h3>
-                <div class="room-invite-code">${room.invite_code || 'N/A'}</div>
             </div>
             <div class="room-stats">
                 <div class="room-stat">
@@ -278,7 +285,7 @@ class RipcordNodeAdmin {
                 <button class="btn btn-small btn-primary" onclick="adminApp.viewRoomDetails('${room.id}')">
                     View Details
                 </button>
-                <button class="btn btn-small btn-secondary" onclick="adminApp.copyInviteCode('${room.invite_code || ''}')">
+                <button class="btn btn-small btn-secondary" onclick="adminApp.copyInvite('${room.id}')">
                     Copy Invite
                 </button>
                 <button class="btn btn-small btn-warning" onclick="adminApp.kickAllFromRoom('${room.id}')">
@@ -339,24 +346,40 @@ class RipcordNodeAdmin {
         
         card.innerHTML = `
             <div class="peer-header">
-                <div class="peer-id">${this.truncateKey(peer.id || 'Unknown')}</div>
+                <div class="peer-id">${this.escapeHtml(peer.nickname || '')} ${this.truncateKey(peer.id || 'Unknown')}</div>
                 <div class="peer-status">
                     <span class="status-badge ${statusClass}">${peer.status || 'Unknown'}</span>
                 </div>
             </div>
             <div class="peer-info">
                 <div class="peer-info-item">
-                    <div class="peer-info-label">I2P Address</div>
-                    <div class="peer-info-value">${this.truncateAddress(peer.i2p_address || 'N/A')}</div>
+                    <div class="peer-info-label">Address</div>
+                    <div class="peer-info-value">${this.truncateAddress(peer.address || peer.i2p_address || 'N/A')}</div>
+                </div>
+                <div class="peer-info-item">
+                    <div class="peer-info-label">Last Seen</div>
+                    <div class="peer-info-value">${this.formatTimestamp(peer.last_seen)}</div>
+                </div>
+                <div class="peer-info-item">
+                    <div class="peer-info-label">Active Rooms</div>
+                    <div class="peer-info-value">${(peer.active_rooms || []).length}</div>
                 </div>
                 <div class="peer-info-item">
                     <div class="peer-info-label">Connected Since</div>
                     <div class="peer-info-value">${this.formatTimestamp(peer.connected_at)}</div>
                 </div>
                 <div class="peer-info-item">
-                    <div class="peer-info-label">Messages Sent</div>
+                    <div class="peer-info-label">Messages Received</div>
                     <div class="peer-info-value">${peer.message_count || 0}</div>
                 </div>
+                <div class="peer-info-item">
+                    <div class="peer-info-label">Queued Messages</div>
+                    <div class="peer-info-value">${peer.queued || 0}</div>
+                </div>
+                <div class="peer-info-item">
+                    <div class="peer-info-label">Protocol</div>
+                    <div class="peer-info-value">${this.escapeHtml(peer.version || '1.0')}${(peer.features || []).length ? ' (' + this.escapeHtml(peer.features.join(', ')) + ')' : ''}</div>
+                </div>
                 <div class="peer-info-item">
                     <div class="peer-info-label">Trust Level</div>
                     <div class="peer-info-value">${peer.trust_level || 'Unknown'}</div>
@@ -403,7 +426,10 @@ class RipcordNodeAdmin {
     
     async loadSettings() {
         try {
-            const response = await fetch('/api/admin/settings');
+            const response = await fetch('/api/admin/settings', { headers: this.adminHeaders() });
+            if (response.status === 401) {
+                sessionStorage.removeItem('ripcord_admin_token');
+            }
             if (response.ok) {
                 this.settings = await response.json();
                 this.populateSettingsForm();
@@ -450,7 +476,7 @@ class RipcordNodeAdmin {
         
         // Security settings
         document.getElementById('auto-block-malicious').checked = this.settings.security?.auto_block_malicious || false;
-        document.getElementById('require-signature-verification').checked = this.settings.security?.require_signature_verification || true;
+        document.getElementById('require-signature-verification').checked = this.settings.security?.require_signature_verification !== false;
         document.getElementById('rate-limit').value = this.settings.security?.rate_limit_per_minute || 60;
     }
     
@@ -512,6 +538,29 @@ class RipcordNodeAdmin {
         }
     }
     
+    // Invites are signed tokens, so a fresh one is issued for each copy
+    async copyInvite(roomId) {
+        try {
+            const response = await fetch('/api/rooms/invites/create', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ room_id: roomId })
+            });
+            
+            if (!response.ok) {
+                this.showError('Failed to create invite');
+                return;
+            }
+            
+            const invite = await response.json();
+            await navigator.clipboard.writeText(invite.token);
+            this.showSuccess('Invite copied, valid until ' + this.formatTimestamp(invite.expires_at));
+        } catch (error) {
+            console.error('Error creating invite:', error);
+            this.showError('Error creating invite');
+        }
+    }
+    
     async saveSettings() {
         const settings = {
             i2p: {
@@ -534,10 +583,13 @@ class RipcordNodeAdmin {
         try {
             const response = await fetch('/api/admin/settings', {
                 method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
+                headers: this.adminHeaders({ 'Content-Type': 'application/json' }),
                 body: JSON.stringify(settings)
             });
             
+            if (response.status === 401) {
+                sessionStorage.removeItem('ripcord_admin_token');
+            }
             if (response.ok) {
                 this.settings = settings;
                 this.showSuccess('Settings saved successfully');
@@ -551,6 +603,16 @@ class RipcordNodeAdmin {
     }
     
     // Utility methods
+    // Settings need the token the server keeps in data/admin.token
+    adminHeaders(headers = {}) {
+        let token = sessionStorage.getItem('ripcord_admin_token');
+        if (!token) {
+            token = prompt('Admin token (from data/admin.token):') || '';
+            sessionStorage.setItem('ripcord_admin_token', token);
+        }
+        return { ...headers, Authorization: `Bearer ${token}` };
+    }
+    
     startPeriodicRefresh() {
         this.refreshInterval = setInterval(() => {
             if (this.currentSection === 'overview') {
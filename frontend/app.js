@@ -8,6 +8,16 @@ class RipcordApp {
         this.rooms = new Map();
         this.users = new Map();
         this.websocket = null;
+        this.identity = new ClientIdentity();
+        this.authenticated = false;
+        this.authAttempts = 0;
+        this.keyRefused = false;        // the node does not allow our key
+        this.roomSeqs = new Map();      // last message sequence number seen per room
+        this.seenMessages = new Map();  // recent message IDs per room, to drop repeats
+        this.pendingSends = new Map();  // sends not yet acknowledged, by client ID
+        this.presence = new Map();      // last known status per user ID
+        this.typing = new Map();        // per room, who is typing and their expiry timers
+        this.typingSentAt = 0;
         this.components = {};
         
         this.init();
@@ -51,6 +61,16 @@ class RipcordApp {
             }
         });
         
+        document.getElementById('message-input').addEventListener('input', () => {
+            this.sendTyping();
+        });
+        
+        // A hidden tab counts as away; the server shows us online if
+        // another of our connections is active
+        document.addEventListener('visibilitychange', () => {
+            this.sendPresence();
+        });
+        
         document.getElementById('create-room-form').addEventListener('submit', (e) => {
             e.preventDefault();
             this.createRoom();
@@ -63,6 +83,14 @@ class RipcordApp {
         document.getElementById('room-settings-btn').addEventListener('click', () => {
             this.showSettingsPanel();
         });
+        
+        document.getElementById('close-safety-number').addEventListener('click', () => {
+            this.hideSafetyNumber();
+        });
+        
+        document.getElementById('verify-safety-number').addEventListener('click', () => {
+            this.verifySafetyNumber();
+        });
     }
     
     async connectToBackend() {
@@ -97,11 +125,9 @@ class RipcordApp {
             console.log('WebSocket connected');
             this.updateConnectionStatus('connected', 'Connected');
             
-            // Authenticate with WebSocket
-            this.sendWebSocketMessage({
-                type: 'auth',
-                username: this.currentUser.username || 'Anonymous'
-            });
+            // The server opens with an auth challenge
+            this.authenticated = false;
+            this.authAttempts = 0;
         };
         
         this.websocket.onmessage = (event) => {
@@ -115,6 +141,7 @@ class RipcordApp {
         
         this.websocket.onclose = () => {
             console.log('WebSocket disconnected');
+            this.authenticated = false;
             this.updateConnectionStatus('error', 'Disconnected');
             
             // Attempt to reconnect after 3 seconds
@@ -133,9 +160,29 @@ class RipcordApp {
     
     handleWebSocketMessage(data) {
         switch (data.type) {
+            case 'auth_challenge':
+                this.handleAuthChallenge(data);
+                break;
             case 'auth_response':
                 this.handleAuthResponse(data);
                 break;
+            case 'error':
+                console.error('WebSocket request refused:', data.error);
+                break;
+            case 'subscribed':
+                this.handleSubscribed(data);
+                break;
+            case 'unsubscribed':
+                break;
+            case 'ack':
+                this.handleAck(data);
+                break;
+            case 'replay':
+                this.handleReplay(data);
+                break;
+            case 'resumed':
+                this.resendPending(data.room_ids);
+                break;
             case 'message':
                 this.handleNewMessage(data);
                 break;
@@ -154,23 +201,66 @@ class RipcordApp {
             case 'user_left':
                 this.handleUserLeft(data);
                 break;
+            case 'room_synced':
+                this.handleRoomSynced(data);
+                break;
+            case 'key_changed':
+                this.handleKeyChanged(data);
+                break;
+            case 'presence_update':
+                this.handlePresenceUpdate(data);
+                break;
+            case 'typing':
+                this.handleTyping(data);
+                break;
             default:
                 console.warn('Unknown message type:', data.type);
         }
     }
     
-    authenticateUser() {
-        // TODO: Implement user authentication
-        const authMessage = {
-            type: 'auth',
-            username: this.getStoredUsername() || 'Anonymous',
-            publicKey: this.getStoredPublicKey()
-        };
+    // Resumes the previous session when the server still has it, and
+    // otherwise signs the challenge with our key. A failed attempt brings a
+    // new challenge, so this gives up after a few.
+    async handleAuthChallenge(data) {
+        if (this.keyRefused) {
+            this.updateConnectionStatus('error', 'Key Not Allowed');
+            return;
+        }
+        if (this.authAttempts >= 3) {
+            this.updateConnectionStatus('error', 'Authentication Failed');
+            return;
+        }
+        this.authAttempts++;
+        
+        const sessionToken = localStorage.getItem('ripcord_ws_session');
+        if (sessionToken) {
+            this.sendWebSocketMessage({
+                type: 'auth',
+                session_token: sessionToken
+            });
+            return;
+        }
         
-        this.sendWebSocketMessage(authMessage);
+        try {
+            const signature = await this.identity.signChallenge(data.nonce, data.server_key);
+            this.sendWebSocketMessage({
+                type: 'auth',
+                username: this.currentUser?.username || this.currentUser?.nickname || 'Anonymous',
+                public_key: this.identity.publicKeyHex,
+                signature: signature
+            });
+        } catch (error) {
+            console.error('Failed to sign the authentication challenge:', error);
+            this.updateConnectionStatus('error', 'Authentication Failed');
+        }
     }
     
     sendWebSocketMessage(message) {
+        if (message.type !== 'auth' && !this.authenticated) {
+            console.error('WebSocket not authenticated');
+            return;
+        }
+        
         if (this.websocket && this.websocket.readyState === WebSocket.OPEN) {
             this.websocket.send(JSON.stringify(message));
         } else {
@@ -182,6 +272,13 @@ class RipcordApp {
         const input = document.getElementById('message-input');
         const content = input.value.trim();
         
+        // "/dm <user ID> <message>" sends an encrypted direct message
+        const dm = content.match(/^\/dm\s+(\S+)\s+([\s\S]+)$/);
+        if (dm) {
+            await this.sendDirectMessage(dm[1], dm[2], input);
+            return;
+        }
+        
         if (!content || !this.currentRoom) {
             return;
         }
@@ -193,11 +290,17 @@ class RipcordApp {
         }
         
         // Try WebSocket first, fall back to HTTP API
-        if (this.websocket && this.websocket.readyState === WebSocket.OPEN) {
-            this.sendWebSocketMessage({
+        if (this.authenticated) {
+            // Kept until acknowledged and sent again after a reconnect; the
+            // client ID stops the server storing it twice
+            const message = {
                 type: 'send_message',
+                room_id: this.currentRoom.id,
+                client_id: crypto.randomUUID(),
                 content: sanitizedContent
-            });
+            };
+            this.pendingSends.set(message.client_id, message);
+            this.sendWebSocketMessage(message);
             
             // Clear input immediately for better UX
             input.value = '';
@@ -234,6 +337,32 @@ class RipcordApp {
         }
     }
     
+    async sendDirectMessage(recipient, content, input) {
+        try {
+            const response = await fetch('/api/dms/send', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify({
+                    recipient: recipient,
+                    content: content
+                })
+            });
+            
+            if (response.ok) {
+                input.value = '';
+                if (this.components.inputBar) {
+                    this.components.inputBar.clearInput();
+                }
+            } else {
+                console.error('Failed to send direct message:', await response.text());
+            }
+        } catch (error) {
+            console.error('Error sending direct message:', error);
+        }
+    }
+    
     async createRoom() {
         const nameInput = document.getElementById('room-name');
         const descInput = document.getElementById('room-description');
@@ -255,6 +384,7 @@ class RipcordApp {
                 const room = await response.json();
                 this.rooms.set(room.id, room);
                 this.components.roomList.addRoom(room);
+                this.subscribeRooms([room.id]);
                 this.hideCreateRoomModal();
                 
                 // Clear form
@@ -278,13 +408,14 @@ class RipcordApp {
             this.updateCurrentRoomDisplay();
             this.components.chatPane.clearMessages();
             this.components.roomList.setActiveRoom(roomId);
+            this.components.roomList.clearUnreadCount(roomId);
+            this.loadKeyWarnings(roomId);
+            this.renderTyping();
             
-            // Join room via WebSocket for real-time updates
-            if (this.websocket && this.websocket.readyState === WebSocket.OPEN) {
-                this.sendWebSocketMessage({
-                    type: 'join_room',
-                    room_id: roomId
-                });
+            if (this.authenticated) {
+                // Already subscribed along with every other room, unless
+                // it was only just created
+                this.subscribeRooms([roomId]);
                 
                 // Request message history
                 this.sendWebSocketMessage({
@@ -329,11 +460,35 @@ class RipcordApp {
     // Event handlers
     handleAuthResponse(data) {
         if (data.success) {
+            this.authenticated = true;
+            this.authAttempts = 0;
+            localStorage.setItem('ripcord_ws_session', data.session_token);
+            
             this.currentUser = data.user;
             this.storeUserData(data.user);
-            this.loadRooms();
+            
+            // The server counts a new connection online
+            if (document.hidden) {
+                this.sendPresence();
+            }
+            
+            // Subscriptions belong to the connection, so they are made again
+            this.loadRooms().then(() => this.resumeRooms());
+            
+            // Rejoin the open room after a reconnect
+            if (this.currentRoom) {
+                this.selectRoom(this.currentRoom.id);
+            }
         } else {
+            // A stale session token is dropped, so the next challenge is signed
             console.error('Authentication failed:', data.error);
+            localStorage.removeItem('ripcord_ws_session');
+            
+            // The node's owner has to list this browser's key first
+            if (data.error === 'key is not allowed on this node') {
+                this.keyRefused = true;
+                console.error(`Add ${this.identity.publicKeyHex} to server.client_keys in the server's config.json`);
+            }
         }
     }
     
@@ -343,28 +498,164 @@ class RipcordApp {
             this.rooms.set(room.id, room);
         });
         this.components.roomList.updateRooms(Array.from(this.rooms.values()));
+        this.subscribeRooms(Array.from(this.rooms.keys()));
+    }
+    
+    // Subscribes again after a reconnect. Rooms we have seen messages in
+    // are resumed, so the server replays what was missed meanwhile.
+    resumeRooms() {
+        const roomIds = Array.from(this.rooms.keys());
+        const resumable = roomIds.filter(roomId => this.roomSeqs.has(roomId));
+        
+        for (let i = 0; i < resumable.length; i += 100) {
+            const rooms = {};
+            resumable.slice(i, i + 100).forEach(roomId => {
+                rooms[roomId] = this.roomSeqs.get(roomId);
+            });
+            this.sendWebSocketMessage({ type: 'resume', rooms: rooms });
+        }
+        this.subscribeRooms(roomIds.filter(roomId => !this.roomSeqs.has(roomId)));
+    }
+    
+    // Subscribes the connection to rooms' live events, in batches that fit
+    // the server's frame size limit
+    subscribeRooms(roomIds) {
+        if (!this.authenticated) return;
+        
+        for (let i = 0; i < roomIds.length; i += 100) {
+            this.sendWebSocketMessage({
+                type: 'subscribe',
+                room_ids: roomIds.slice(i, i + 100)
+            });
+        }
     }
     
     handleUserList(data) {
         this.users.clear();
         data.users.forEach(user => {
+            user.status = this.presence.get(user.id) || user.status;
             this.users.set(user.id, user);
         });
         this.components.userList.updateUsers(Array.from(this.users.values()));
     }
     
     handleNewMessage(data) {
-        this.components.chatPane.addMessage(data.message);
+        const message = data.message;
+        if (!this.noteMessage(message)) return;
+        
+        // A message ends its author's typing
+        this.stopTyping(message.room_id, message.user_id);
+        
+        if (this.currentRoom && this.currentRoom.id === message.room_id) {
+            this.components.chatPane.addMessage(message);
+        } else {
+            this.countUnread(message.room_id);
+        }
+    }
+    
+    // Messages in the other subscribed rooms only count as unread
+    countUnread(roomId) {
+        const room = this.components.roomList.getRoomById(roomId);
+        if (room) {
+            this.components.roomList.setUnreadCount(roomId, (room.unread_count || 0) + 1);
+        }
+    }
+    
+    // Records a message's sequence number and ID. Returns false for one
+    // already seen, as a replay can repeat what arrived live.
+    noteMessage(message) {
+        let seen = this.seenMessages.get(message.room_id);
+        if (!seen) {
+            seen = new Set();
+            this.seenMessages.set(message.room_id, seen);
+        }
+        if (seen.has(message.id)) return false;
+        
+        seen.add(message.id);
+        if (seen.size > 500) {
+            seen.delete(seen.values().next().value);
+        }
+        if (message.seq > (this.roomSeqs.get(message.room_id) || 0)) {
+            this.roomSeqs.set(message.room_id, message.seq);
+        }
+        return true;
+    }
+    
+    handleSubscribed(data) {
+        // Where a room stands when we first hear of it, to resume from later
+        Object.entries(data.seqs || {}).forEach(([roomId, seq]) => {
+            if (!this.roomSeqs.has(roomId)) {
+                this.roomSeqs.set(roomId, seq);
+            }
+        });
+        this.resendPending(data.room_ids);
+    }
+    
+    handleAck(data) {
+        this.pendingSends.delete(data.client_id);
+        if (!data.success) {
+            console.error('Message not sent:', data.error);
+        }
+    }
+    
+    resendPending(roomIds) {
+        this.pendingSends.forEach(message => {
+            if (roomIds && roomIds.includes(message.room_id)) {
+                this.sendWebSocketMessage(message);
+            }
+        });
+    }
+    
+    handleReplay(data) {
+        const isOpen = this.currentRoom && this.currentRoom.id === data.room_id;
+        let replayed = 0;
+        data.messages.forEach(message => {
+            if (!this.noteMessage(message)) return;
+            replayed++;
+            if (!isOpen) {
+                this.countUnread(data.room_id);
+            }
+        });
+        if (data.seq > (this.roomSeqs.get(data.room_id) || 0)) {
+            this.roomSeqs.set(data.room_id, data.seq);
+        }
+        
+        // Missed messages belong before any that arrived live, so the open
+        // room is reloaded in order
+        if (replayed > 0 && isOpen) {
+            this.components.chatPane.clearMessages();
+            this.components.chatPane.loadMessageHistory(data.room_id);
+        }
+        
+        if (!data.complete) {
+            this.sendWebSocketMessage({ type: 'resume', rooms: { [data.room_id]: data.seq } });
+        }
     }
     
+    
     handleMessageHistory(data) {
         if (data.messages && Array.isArray(data.messages)) {
             data.messages.forEach(message => {
+                this.noteMessage(message);
                 this.components.chatPane.addMessage(message);
             });
         }
     }
     
+    handleRoomSynced(data) {
+        // Synced messages can land anywhere in the history, so reload it in order
+        if (this.currentRoom && this.currentRoom.id === data.room_id) {
+            this.components.chatPane.clearMessages();
+            this.components.chatPane.loadMessageHistory(data.room_id);
+        }
+    }
+    
+    handleKeyChanged(data) {
+        if (this.currentRoom && data.rooms.includes(this.currentRoom.id)) {
+            this.showKeyWarnings([data.warning]);
+        }
+    }
+    
     handleRoomJoined(data) {
         this.currentRoom = data.room;
         this.updateCurrentRoomDisplay();
@@ -380,15 +671,104 @@ class RipcordApp {
     }
     
     handleUserJoined(data) {
+        // Events arrive for every subscribed room
+        if (data.room_id && (!this.currentRoom || this.currentRoom.id !== data.room_id)) return;
+        
+        data.user.status = this.presence.get(data.user.id) || 'online';
         this.users.set(data.user.id, data.user);
         this.components.userList.addUser(data.user);
     }
     
     handleUserLeft(data) {
+        if (data.room_id && (!this.currentRoom || this.currentRoom.id !== data.room_id)) return;
+        
         this.users.delete(data.user_id);
         this.components.userList.removeUser(data.user_id);
     }
     
+    sendPresence() {
+        if (!this.authenticated) return;
+        
+        this.sendWebSocketMessage({
+            type: 'presence_update',
+            status: document.hidden ? 'away' : 'online'
+        });
+    }
+    
+    // Statuses arrive for every user the server knows of, here or on other
+    // nodes, whether or not they are in the open room
+    handlePresenceUpdate(data) {
+        this.presence.set(data.user_id, data.status);
+        
+        const user = this.users.get(data.user_id);
+        if (user) {
+            user.status = data.status;
+        }
+        this.components.userList.setUserStatus(data.user_id, data.status);
+    }
+    
+    // The server passes on one typing event every few seconds, so sending
+    // more often than that is wasted
+    sendTyping() {
+        if (!this.authenticated || !this.currentRoom) return;
+        
+        const now = Date.now();
+        if (now - this.typingSentAt < 3000) return;
+        this.typingSentAt = now;
+        
+        this.sendWebSocketMessage({
+            type: 'typing',
+            room_id: this.currentRoom.id
+        });
+    }
+    
+    // Each typing event lasts expires_in milliseconds unless renewed
+    handleTyping(data) {
+        if (this.currentUser && data.user_id === this.currentUser.id) return;
+        
+        let typists = this.typing.get(data.room_id);
+        if (!typists) {
+            typists = new Map();
+            this.typing.set(data.room_id, typists);
+        }
+        
+        const previous = typists.get(data.user_id);
+        if (previous) {
+            clearTimeout(previous.timer);
+        }
+        typists.set(data.user_id, {
+            username: data.username || 'Someone',
+            timer: setTimeout(() => this.stopTyping(data.room_id, data.user_id), data.expires_in || 6000)
+        });
+        this.renderTyping();
+    }
+    
+    stopTyping(roomId, userId) {
+        const typists = this.typing.get(roomId);
+        const typist = typists?.get(userId);
+        if (!typist) return;
+        
+        clearTimeout(typist.timer);
+        typists.delete(userId);
+        this.renderTyping();
+    }
+    
+    renderTyping() {
+        const indicator = document.getElementById('typing-indicator');
+        const typists = this.currentRoom ? this.typing.get(this.currentRoom.id) : null;
+        const names = typists ? Array.from(typists.values(), typist => typist.username) : [];
+        
+        if (names.length === 0) {
+            indicator.textContent = '';
+        } else if (names.length === 1) {
+            indicator.textContent = `${names[0]} is typing...`;
+        } else if (names.length === 2) {
+            indicator.textContent = `${names[0]} and ${names[1]} are typing...`;
+        } else {
+            indicator.textContent = 'Several people are typing...';
+        }
+    }
+    
     // UI helpers
     updateConnectionStatus(status, text) {
         const indicator = document.getElementById('status-indicator');
@@ -419,6 +799,108 @@ class RipcordApp {
         this.components.settingsPanel.show();
     }
     
+    // Key changes of verified contacts are shown above the room or DM
+    // until the new safety number is verified
+    async loadKeyWarnings(roomId) {
+        this.showKeyWarnings([]);
+        try {
+            const response = await fetch(`/api/trust/warnings?room_id=${encodeURIComponent(roomId)}`);
+            if (response.ok && this.currentRoom && this.currentRoom.id === roomId) {
+                this.showKeyWarnings(await response.json());
+            }
+        } catch (error) {
+            console.error('Error loading key warnings:', error);
+        }
+    }
+    
+    showKeyWarnings(warnings) {
+        const banner = document.getElementById('key-warning');
+        banner.innerHTML = '';
+        
+        warnings.forEach(warning => {
+            const line = document.createElement('div');
+            const name = warning.nickname || warning.user_id;
+            line.textContent = `⚠ The key of ${name}, which you verified, has changed. ` +
+                'Messages may come from someone else. Compare safety numbers again before trusting them.';
+            
+            const button = document.createElement('button');
+            button.className = 'btn btn-secondary';
+            button.textContent = 'Compare';
+            button.addEventListener('click', () => {
+                this.showSafetyNumber({ id: warning.user_id, username: name });
+            });
+            
+            line.appendChild(button);
+            banner.appendChild(line);
+        });
+        
+        banner.classList.toggle('hidden', warnings.length === 0);
+    }
+    
+    async showSafetyNumber(user) {
+        try {
+            const response = await fetch(`/api/trust/safety-number?user_id=${encodeURIComponent(user.id)}`);
+            if (!response.ok) {
+                this.showError('No safety number for this user');
+                return;
+            }
+            
+            const number = await response.json();
+            this.safetyNumberUser = user;
+            document.getElementById('safety-number-name').textContent = user.username;
+            document.getElementById('safety-number-digits').textContent = number.digits;
+            document.getElementById('safety-number-qr').value = number.qr_payload;
+            document.getElementById('safety-number-scanned').value = '';
+            
+            let status = number.verified ? 'Verified' : 'Not verified';
+            if (number.key_changed) {
+                status = 'Key changed since you verified it';
+            }
+            document.getElementById('safety-number-status').textContent = status;
+            document.getElementById('safety-number-modal').classList.remove('hidden');
+        } catch (error) {
+            console.error('Error loading safety number:', error);
+        }
+    }
+    
+    hideSafetyNumber() {
+        document.getElementById('safety-number-modal').classList.add('hidden');
+        this.safetyNumberUser = null;
+    }
+    
+    async verifySafetyNumber() {
+        if (!this.safetyNumberUser) return;
+        
+        // A scanned code is checked by the backend; otherwise the user
+        // confirms the digits shown match the contact's
+        const scanned = document.getElementById('safety-number-scanned').value.trim();
+        const request = { user_id: this.safetyNumberUser.id };
+        if (scanned) {
+            request.qr_payload = scanned;
+        } else {
+            request.digits = document.getElementById('safety-number-digits').textContent;
+        }
+        
+        try {
+            const response = await fetch('/api/trust/verify', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(request)
+            });
+            
+            if (response.ok) {
+                this.hideSafetyNumber();
+                if (this.currentRoom) {
+                    this.loadKeyWarnings(this.currentRoom.id);
+                }
+            } else {
+                this.showError('The safety number does not match');
+            }
+        } catch (error) {
+            console.error('Error verifying contact:', error);
+        }
+    }
+    
     // Storage helpers
     storeUserData(user) {
         localStorage.setItem('ripcord_username', user.username);
@@ -75,6 +75,12 @@ class ChatPane {
         time.textContent = this.formatTimestamp(message.timestamp);
         
         header.appendChild(username);
+        
+        const verification = this.createVerificationBadge(message.verification);
+        if (verification) {
+            header.appendChild(verification);
+        }
+        
         header.appendChild(time);
         
         const text = document.createElement('div');
@@ -87,6 +93,26 @@ class ChatPane {
         return contentDiv;
     }
     
+    // Flags messages whose signature did not verify against the author's key
+    createVerificationBadge(state) {
+        const labels = {
+            unsigned: ['Unsigned', 'This message carries no signature'],
+            invalid: ['Invalid signature', 'The signature does not match the author\'s key'],
+            unknown_key: ['Unknown key', 'The author\'s key is not known, so the signature could not be checked'],
+            unverified: ['Unverified', 'Stored before signatures were checked, and its signature could not be confirmed']
+        };
+        
+        if (!labels[state]) {
+            return null;
+        }
+        
+        const badge = document.createElement('span');
+        badge.className = `message-verification ${state}`;
+        badge.textContent = labels[state][0];
+        badge.title = labels[state][1];
+        return badge;
+    }
+    
     formatTimestamp(timestamp) {
         const date = new Date(timestamp);
         const now = new Date();
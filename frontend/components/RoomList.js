@@ -1,6 +1,5 @@
 // TODO: Implement room filtering and search
 // TODO: Implement room categories and favorites
-// TODO: Implement room notifications and unread counts
 // TODO: Implement room sorting options
 
 class RoomList {
@@ -22,6 +21,14 @@ class RoomList {
     }
     
     updateRooms(rooms) {
+        // Unread counts are kept locally, so they survive a reload of the list
+        const unread = new Map(this.rooms.map(room => [room.id, room.unread_count]));
+        rooms.forEach(room => {
+            if (unread.get(room.id)) {
+                room.unread_count = unread.get(room.id);
+            }
+        });
+        
         this.rooms = rooms;
         this.renderRooms();
     }
@@ -1,4 +1,3 @@
-// TODO: Implement user status indicators (online, away, busy)
 // TODO: Implement user profiles and avatars
 // TODO: Implement user search and filtering
 // TODO: Implement user actions (message, block, etc.)
@@ -196,7 +195,7 @@ class UserList {
     
     showUserActions(user) {
         // TODO: Implement user action menu
-        console.log('User clicked:', user.username);
+        window.ripcordApp?.showSafetyNumber(user);
     }
     
     showUserContextMenu(event, user) {
@@ -0,0 +1,83 @@
+// Ripcord client identity
+// An Ed25519 key pair made with WebCrypto and kept in IndexedDB. The
+// private key is not extractable, so it can sign the WebSocket challenge
+// but scripts cannot read it.
+
+class ClientIdentity {
+    constructor() {
+        this.dbName = 'ripcord';
+        this.storeName = 'keys';
+        this.keyPair = null;
+        this.publicKeyHex = null;
+    }
+
+    async load() {
+        if (this.keyPair) return;
+
+        const db = await this.openDatabase();
+        try {
+            let keyPair = await this.request(db.transaction(this.storeName).objectStore(this.storeName).get('identity'));
+            if (!keyPair) {
+                keyPair = await crypto.subtle.generateKey({ name: 'Ed25519' }, false, ['sign', 'verify']);
+                await this.request(db.transaction(this.storeName, 'readwrite').objectStore(this.storeName).put(keyPair, 'identity'));
+            }
+
+            const publicKey = await crypto.subtle.exportKey('raw', keyPair.publicKey);
+            this.publicKeyHex = ClientIdentity.toHex(new Uint8Array(publicKey));
+            this.keyPair = keyPair;
+        } finally {
+            db.close();
+        }
+    }
+
+    openDatabase() {
+        return new Promise((resolve, reject) => {
+            const request = indexedDB.open(this.dbName, 1);
+            request.onupgradeneeded = () => request.result.createObjectStore(this.storeName);
+            request.onsuccess = () => resolve(request.result);
+            request.onerror = () => reject(request.error);
+        });
+    }
+
+    request(request) {
+        return new Promise((resolve, reject) => {
+            request.onsuccess = () => resolve(request.result);
+            request.onerror = () => reject(request.error);
+        });
+    }
+
+    // Signs the server's challenge nonce together with the server's key, in
+    // the encoding of wsAuthData in backend/wsauth.go
+    async signChallenge(nonce, serverKey) {
+        await this.load();
+
+        const data = ClientIdentity.signedData('ripcord-ws-auth-v1', [nonce, serverKey]);
+        const signature = await crypto.subtle.sign({ name: 'Ed25519' }, this.keyPair.privateKey, data);
+        return ClientIdentity.toHex(new Uint8Array(signature));
+    }
+
+    // The domain label and a NUL byte, then each field with a 4-byte
+    // big-endian length, as security.SignedData encodes strings
+    static signedData(domain, fields) {
+        const encoder = new TextEncoder();
+        const parts = [encoder.encode(domain), new Uint8Array([0])];
+        fields.forEach(field => {
+            const bytes = encoder.encode(field);
+            const length = new Uint8Array(4);
+            new DataView(length.buffer).setUint32(0, bytes.length);
+            parts.push(length, bytes);
+        });
+
+        const data = new Uint8Array(parts.reduce((total, part) => total + part.length, 0));
+        let offset = 0;
+        parts.forEach(part => {
+            data.set(part, offset);
+            offset += part.length;
+        });
+        return data;
+    }
+
+    static toHex(bytes) {
+        return Array.from(bytes, byte => byte.toString(16).padStart(2, '0')).join('');
+    }
+}